@@ -0,0 +1,142 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/common/hexutil"
+	"github.com/NginProject/ngind/rpc"
+)
+
+// SignerNamespace is the JSON-RPC namespace of the methods served by external
+// signers:
+//
+//   signer_accounts()                          -> [address]
+//   signer_signTransaction(SignTxRequest)      -> signature
+//   signer_signData(SignDataRequest)           -> signature
+//   signer_signTypedData(SignTypedDataRequest) -> signature
+const SignerNamespace = "signer"
+
+// ExternalSigner is a SignerBackend forwarding the requests to an external
+// signer over JSON-RPC, which holds the keys and approves each request.
+type ExternalSigner struct {
+	endpoint string
+
+	mu     sync.Mutex // serializes the requests, responses are read in order
+	client rpc.Client
+	id     uint64
+}
+
+// NewExternalSigner connects to the external signer at endpoint, either an IPC
+// socket path or an HTTP URL.
+func NewExternalSigner(endpoint string) (*ExternalSigner, error) {
+	uri := endpoint
+	if !strings.HasPrefix(uri, "ipc:") && !strings.HasPrefix(uri, "rpc:") && !strings.Contains(uri, "://") {
+		uri = "ipc:" + uri
+	}
+	client, err := rpc.NewClient(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalSigner{endpoint: endpoint, client: client}, nil
+}
+
+// Endpoint returns the endpoint of the external signer.
+func (s *ExternalSigner) Endpoint() string {
+	return s.endpoint
+}
+
+// Close closes the connection to the external signer.
+func (s *ExternalSigner) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client.Close()
+}
+
+// signerResponse is a JSON-RPC response of the external signer.
+type signerResponse struct {
+	Id     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpc.JSONError  `json:"error"`
+}
+
+// call calls a method of the external signer, decoding its result into result.
+func (s *ExternalSigner) call(result interface{}, method string, args ...interface{}) error {
+	params, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.id++
+	id := strconv.FormatUint(s.id, 10)
+	req := rpc.JSONRequest{
+		Id:      json.RawMessage(id),
+		Version: "2.0",
+		Method:  SignerNamespace + "_" + method,
+		Payload: params,
+	}
+	if err := s.client.Send(req); err != nil {
+		return fmt.Errorf("external signer %s: %v", s.endpoint, err)
+	}
+	var resp signerResponse
+	if err := s.client.Recv(&resp); err != nil {
+		return fmt.Errorf("external signer %s: %v", s.endpoint, err)
+	}
+	if string(resp.Id) != id {
+		return fmt.Errorf("external signer %s: response id %s doesn't match request id %s", s.endpoint, resp.Id, id)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("external signer: %s", resp.Error.Message)
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Accounts returns the addresses of the accounts the external signer signs for.
+func (s *ExternalSigner) Accounts() ([]common.Address, error) {
+	var addrs []common.Address
+	err := s.call(&addrs, "accounts")
+	return addrs, err
+}
+
+// SignTx requests the external signer to sign a transaction.
+func (s *ExternalSigner) SignTx(req *SignTxRequest) ([]byte, error) {
+	var sig hexutil.Bytes
+	err := s.call(&sig, "signTransaction", req)
+	return sig, err
+}
+
+// SignData requests the external signer to sign a message.
+func (s *ExternalSigner) SignData(req *SignDataRequest) ([]byte, error) {
+	var sig hexutil.Bytes
+	err := s.call(&sig, "signData", req)
+	return sig, err
+}
+
+// SignTypedData requests the external signer to sign typed structured data.
+func (s *ExternalSigner) SignTypedData(req *SignTypedDataRequest) ([]byte, error) {
+	var sig hexutil.Bytes
+	err := s.call(&sig, "signTypedData", req)
+	return sig, err
+}
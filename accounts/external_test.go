@@ -0,0 +1,280 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/common/hexutil"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/rpc"
+)
+
+// FakeSignerAPI serves the signer namespace, signing every request for its
+// account with signKey, which may be another key than the account's. It's
+// exported as the RPC server only serves exported types.
+type FakeSignerAPI struct {
+	account common.Address
+	signKey *ecdsa.PrivateKey
+	reject  bool
+
+	mu       sync.Mutex
+	requests []SignTxRequest
+}
+
+func (api *FakeSignerAPI) Accounts() []common.Address {
+	return []common.Address{api.account}
+}
+
+func (api *FakeSignerAPI) SignTransaction(req SignTxRequest) (hexutil.Bytes, error) {
+	api.mu.Lock()
+	api.requests = append(api.requests, req)
+	api.mu.Unlock()
+
+	if api.reject {
+		return nil, errors.New("request rejected")
+	}
+	tx, signer, err := req.Transaction()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Sign(signer.Hash(tx).Bytes(), api.signKey)
+}
+
+func (api *FakeSignerAPI) SignData(req SignDataRequest) (hexutil.Bytes, error) {
+	if api.reject {
+		return nil, errors.New("request rejected")
+	}
+	return crypto.Sign(TextHash(req.Data), api.signKey)
+}
+
+// newTestExternalManager returns a manager signing through an external signer
+// served over IPC by api.
+func newTestExternalManager(t *testing.T, api *FakeSignerAPI) *Manager {
+	dir, err := ioutil.TempDir("", "external-signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	server := rpc.NewServer()
+	if err := server.RegisterName(SignerNamespace, api); err != nil {
+		t.Fatalf("failed to register signer API: %v", err)
+	}
+	endpoint := filepath.Join(dir, "signer.ipc")
+	listener, err := rpc.CreateIPCListener(endpoint)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", endpoint, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(rpc.NewJSONCodec(conn), rpc.OptionMethodInvocation)
+		}
+	}()
+
+	signer, err := NewExternalSigner(endpoint)
+	if err != nil {
+		t.Fatalf("failed to connect to signer: %v", err)
+	}
+	t.Cleanup(signer.Close)
+	return NewExternalManager(signer)
+}
+
+// Tests that transactions signed by an external signer keep their chain id,
+// the signer being asked to sign for it.
+func TestExternalSignTx(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+	api := &FakeSignerAPI{account: addr, signKey: key}
+	am := newTestExternalManager(t, api)
+
+	if !am.External() {
+		t.Fatalf("manager not external")
+	}
+	if accs := am.Accounts(); len(accs) != 1 || accs[0].Address != addr || !am.HasAddress(addr) {
+		t.Fatalf("accounts mismatch: have %v, want %x", accs, addr)
+	}
+	to := common.HexToAddress("0x1111")
+	tests := []struct {
+		signer  types.Signer
+		chainID *big.Int
+	}{
+		{types.BasicSigner{}, nil},
+		{types.NewChainIdSigner(big.NewInt(61)), big.NewInt(61)},
+		{types.NewChainIdSigner(big.NewInt(62)), big.NewInt(62)},
+	}
+	for i, tt := range tests {
+		tx := types.NewTransaction(uint64(i), to, big.NewInt(1), big.NewInt(21000), big.NewInt(1), []byte{0x01})
+		signed, err := am.SignTx(addr, tx, tt.signer)
+		if err != nil {
+			t.Fatalf("test %d: failed to sign: %v", i, err)
+		}
+		if from, err := signed.From(); err != nil || from != addr {
+			t.Errorf("test %d: sender mismatch: have %x (%v), want %x", i, from, err, addr)
+		}
+		if signed.Protected() != (tt.chainID != nil) {
+			t.Errorf("test %d: replay protection mismatch: have %v, want %v", i, signed.Protected(), tt.chainID != nil)
+		}
+		if tt.chainID != nil && signed.ChainId().Cmp(tt.chainID) != 0 {
+			t.Errorf("test %d: chain id mismatch: have %v, want %v", i, signed.ChainId(), tt.chainID)
+		}
+		if signed.Hash() == tx.Hash() || signed.Nonce() != uint64(i) || *signed.To() != to {
+			t.Errorf("test %d: signed transaction mismatch: %v", i, signed)
+		}
+
+		req := api.requests[len(api.requests)-1]
+		if req.From != addr || (req.ChainID == nil) != (tt.chainID == nil) || (tt.chainID != nil && req.ChainID.ToInt().Cmp(tt.chainID) != 0) {
+			t.Errorf("test %d: request mismatch: from %x, chain id %v", i, req.From, req.ChainID)
+		}
+	}
+	sig, err := am.SignData(addr, []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if err := verifySignature(addr, TextHash([]byte("hello")), sig); err != nil {
+		t.Errorf("data signature invalid: %v", err)
+	}
+}
+
+// Tests that signatures made by another key than the account's, or refused by
+// the signer, are not returned.
+func TestExternalSignerWrongKey(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+
+	am := newTestExternalManager(t, &FakeSignerAPI{account: addr, signKey: other})
+	tx := types.NewTransaction(0, common.HexToAddress("0x1111"), big.NewInt(1), big.NewInt(21000), big.NewInt(1), nil)
+	if _, err := am.SignTx(addr, tx, types.NewChainIdSigner(big.NewInt(61))); err == nil || !strings.Contains(err.Error(), "signature from") {
+		t.Errorf("transaction signed by another key accepted: %v", err)
+	}
+	if _, err := am.SignData(addr, []byte("hello")); err == nil || !strings.Contains(err.Error(), "signature from") {
+		t.Errorf("data signed by another key accepted: %v", err)
+	}
+
+	am = newTestExternalManager(t, &FakeSignerAPI{account: addr, signKey: key, reject: true})
+	if _, err := am.SignTx(addr, tx, types.BasicSigner{}); err == nil || !strings.Contains(err.Error(), "request rejected") {
+		t.Errorf("rejection mismatch: have %v, want request rejected", err)
+	}
+}
+
+// Tests that signatures are only accepted from the key of the account, in the
+// [R || S || V] format with V of 0 or 1.
+func TestVerifySignature(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+	hash := crypto.Keccak256([]byte("hello"))
+
+	sig, _ := crypto.Sign(hash, key)
+	wrong, _ := crypto.Sign(hash, other)
+	highV := common.CopyBytes(sig)
+	highV[64] += 27
+
+	tests := []struct {
+		sig []byte
+		ok  bool
+	}{
+		{sig, true},
+		{wrong, false},
+		{highV, false},
+		{sig[:64], false},
+		{append(common.CopyBytes(sig), 0), false},
+		{nil, false},
+	}
+	for i, tt := range tests {
+		if err := verifySignature(addr, hash, tt.sig); (err == nil) != tt.ok {
+			t.Errorf("test %d: verification mismatch: have error %v, want ok %v", i, err, tt.ok)
+		}
+	}
+	if err := verifySignature(addr, crypto.Keccak256([]byte("other")), sig); err == nil {
+		t.Errorf("signature of another hash accepted")
+	}
+}
+
+// Tests that the operations needing the keystore fail with an external signer.
+func TestExternalKeystoreOps(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+	am := newTestExternalManager(t, &FakeSignerAPI{account: addr, signKey: key})
+	acc := Account{Address: addr}
+
+	ops := map[string]func() error{
+		"Sign": func() error {
+			_, err := am.Sign(addr, crypto.Keccak256(nil))
+			return err
+		},
+		"SignWithPassphrase": func() error {
+			_, err := am.SignWithPassphrase(addr, "", crypto.Keccak256(nil))
+			return err
+		},
+		"Unlock":      func() error { return am.Unlock(acc, "") },
+		"TimedUnlock": func() error { return am.TimedUnlock(acc, "", 0) },
+		"NewAccount": func() error {
+			_, err := am.NewAccount("")
+			return err
+		},
+		"ImportECDSA": func() error {
+			_, err := am.ImportECDSA(key, "")
+			return err
+		},
+		"Import": func() error {
+			_, err := am.Import([]byte("{}"), "", "")
+			return err
+		},
+		"ImportPreSaleKey": func() error {
+			_, err := am.ImportPreSaleKey([]byte("{}"), "")
+			return err
+		},
+		"Export": func() error {
+			_, err := am.Export(acc, "", "")
+			return err
+		},
+		"Update":        func() error { return am.Update(acc, "", "") },
+		"DeleteAccount": func() error { return am.DeleteAccount(acc, "") },
+		"BuildIndexDB": func() error {
+			if errs := am.BuildIndexDB(); len(errs) > 0 {
+				return errs[0]
+			}
+			return nil
+		},
+		"ImportHDWallet": func() error {
+			_, err := am.ImportHDWallet(testMnemonic, "", "", nil)
+			return err
+		},
+	}
+	for name, op := range ops {
+		if err := op(); err != ErrExternalSigner {
+			t.Errorf("%s: have error %v, want %v", name, err, ErrExternalSigner)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/crypto/secp256k1"
+)
+
+// hardenedOffset is added to the index of hardened derivation path components.
+const hardenedOffset = 0x80000000
+
+// DefaultBaseDerivationPath is the BIP-44 path under which accounts are
+// derived by default, m/44'/60'/0'/0, followed by the account index. It uses
+// the coin type of the hardware and software wallets commonly used with the
+// network, so their mnemonics derive the same accounts.
+var DefaultBaseDerivationPath = DerivationPath{hardenedOffset + 44, hardenedOffset + 60, hardenedOffset + 0, 0}
+
+var errInvalidChildKey = errors.New("invalid child key, derive the next index instead")
+
+// DerivationPath is a BIP-32 derivation path, the indexes of the child keys
+// derived from the master key in turn. Hardened indexes are offset by 2^31.
+type DerivationPath []uint32
+
+// ParseDerivationPath parses a BIP-32 derivation path, eg. m/44'/60'/0'/0/0.
+// Hardened components are marked by an apostrophe or an h.
+func ParseDerivationPath(path string) (DerivationPath, error) {
+	components := strings.Split(strings.TrimSpace(path), "/")
+	if len(components) < 2 || strings.TrimSpace(components[0]) != "m" {
+		return nil, fmt.Errorf("invalid derivation path %q, must start with m/", path)
+	}
+	var result DerivationPath
+	for _, component := range components[1:] {
+		component = strings.TrimSpace(component)
+		offset := uint64(0)
+		if strings.HasSuffix(component, "'") || strings.HasSuffix(component, "h") {
+			offset = hardenedOffset
+			component = strings.TrimSpace(component[:len(component)-1])
+		}
+		index, err := strconv.ParseUint(component, 10, 32)
+		if err != nil || index >= hardenedOffset {
+			return nil, fmt.Errorf("invalid derivation path %q: component %q out of range [0, 2^31)", path, component)
+		}
+		result = append(result, uint32(index+offset))
+	}
+	return result, nil
+}
+
+// String returns the path in its canonical form, eg. m/44'/60'/0'/0/0.
+func (path DerivationPath) String() string {
+	result := "m"
+	for _, component := range path {
+		if component >= hardenedOffset {
+			result += fmt.Sprintf("/%d'", component-hardenedOffset)
+		} else {
+			result += fmt.Sprintf("/%d", component)
+		}
+	}
+	return result
+}
+
+// Child returns the path extended with index.
+func (path DerivationPath) Child(index uint32) DerivationPath {
+	child := make(DerivationPath, len(path)+1)
+	copy(child, path)
+	child[len(path)] = index
+	return child
+}
+
+// HasPrefix reports whether path is derived under base.
+func (path DerivationPath) HasPrefix(base DerivationPath) bool {
+	if len(path) < len(base) {
+		return false
+	}
+	for i := range base {
+		if path[i] != base[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (path DerivationPath) MarshalText() ([]byte, error) {
+	return []byte(path.String()), nil
+}
+
+func (path *DerivationPath) UnmarshalText(text []byte) error {
+	parsed, err := ParseDerivationPath(string(text))
+	if err != nil {
+		return err
+	}
+	*path = parsed
+	return nil
+}
+
+// deriveKey derives the private key at path from a BIP-32 seed.
+func deriveKey(seed []byte, path DerivationPath) (*ecdsa.PrivateKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	I := mac.Sum(nil)
+
+	n := secp256k1.S256().N
+	key, chainCode := new(big.Int).SetBytes(I[:32]), I[32:]
+	if key.Sign() == 0 || key.Cmp(n) >= 0 {
+		return nil, errors.New("invalid seed, derives an invalid master key")
+	}
+	for _, index := range path {
+		var data []byte
+		if index >= hardenedOffset {
+			data = append([]byte{0}, common.LeftPadBytes(key.Bytes(), 32)...)
+		} else {
+			data = compressPubkey(crypto.ToECDSA(common.LeftPadBytes(key.Bytes(), 32)))
+		}
+		data = append(data, make([]byte, 4)...)
+		binary.BigEndian.PutUint32(data[len(data)-4:], index)
+
+		mac := hmac.New(sha512.New, chainCode)
+		mac.Write(data)
+		I := mac.Sum(nil)
+
+		tweak := new(big.Int).SetBytes(I[:32])
+		if tweak.Cmp(n) >= 0 {
+			return nil, errInvalidChildKey
+		}
+		key.Add(key, tweak).Mod(key, n)
+		if key.Sign() == 0 {
+			return nil, errInvalidChildKey
+		}
+		chainCode = I[32:]
+	}
+	return crypto.ToECDSA(common.LeftPadBytes(key.Bytes(), 32)), nil
+}
+
+// compressPubkey encodes the public key of priv in the 33 bytes compressed form.
+func compressPubkey(priv *ecdsa.PrivateKey) []byte {
+	enc := make([]byte, 33)
+	enc[0] = 2 | byte(priv.PublicKey.Y.Bit(0))
+	copy(enc[1:], common.LeftPadBytes(priv.PublicKey.X.Bytes(), 32))
+	return enc
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/crypto"
+)
+
+// Tests that derivation paths are parsed from and formatted to their
+// canonical form.
+func TestParseDerivationPath(t *testing.T) {
+	tests := []struct {
+		input  string
+		output DerivationPath
+		canon  string
+	}{
+		{"m/44'/60'/0'/0", DefaultBaseDerivationPath, "m/44'/60'/0'/0"},
+		{" m / 44h / 60' / 0' / 0 / 7 ", DerivationPath{hardenedOffset + 44, hardenedOffset + 60, hardenedOffset, 0, 7}, "m/44'/60'/0'/0/7"},
+		{"m/2147483647'", DerivationPath{hardenedOffset + hardenedOffset - 1}, "m/2147483647'"},
+		{"m", nil, ""},
+		{"44'/60'", nil, ""},
+		{"m/2147483648", nil, ""},
+		{"m/-1", nil, ""},
+		{"m/0''", nil, ""},
+	}
+	for i, tt := range tests {
+		path, err := ParseDerivationPath(tt.input)
+		if (err == nil) != (tt.output != nil) {
+			t.Errorf("test %d: error mismatch: have %v, want ok %v", i, err, tt.output != nil)
+			continue
+		}
+		if !reflect.DeepEqual(path, tt.output) {
+			t.Errorf("test %d: path mismatch: have %v, want %v", i, path, tt.output)
+		}
+		if tt.output != nil && path.String() != tt.canon {
+			t.Errorf("test %d: canonical form mismatch: have %s, want %s", i, path, tt.canon)
+		}
+	}
+}
+
+// Tests that keys are derived as in the BIP-32 test vector 1.
+func TestDeriveKeyBIP32(t *testing.T) {
+	seed := common.FromHex("000102030405060708090a0b0c0d0e0f")
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{"m/0'", "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea"},
+		{"m/0'/1", "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368"},
+		{"m/0'/1/2'", "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca"},
+		{"m/0'/1/2'/2", "0f479245fb19a38a1954c5c7c0ebab2f9bdfd96a17563ef28a6a4b1a2a764ef4"},
+		{"m/0'/1/2'/2/1000000000", "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8"},
+	}
+	master, err := deriveKey(seed, nil)
+	if err != nil {
+		t.Fatalf("failed to derive master key: %v", err)
+	}
+	if have := common.Bytes2Hex(common.LeftPadBytes(crypto.FromECDSA(master), 32)); have != "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35" {
+		t.Errorf("master key mismatch: have %s", have)
+	}
+	for _, tt := range tests {
+		path, err := ParseDerivationPath(tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		key, err := deriveKey(seed, path)
+		if err != nil {
+			t.Fatalf("%s: failed to derive key: %v", tt.path, err)
+		}
+		if have := common.Bytes2Hex(common.LeftPadBytes(crypto.FromECDSA(key), 32)); have != tt.key {
+			t.Errorf("%s: key mismatch: have %s, want %s", tt.path, have, tt.key)
+		}
+	}
+}
+
+// Tests that the default BIP-44 path derives the accounts other wallets
+// derive from the same mnemonic.
+func TestDeriveKeyBIP44(t *testing.T) {
+	seed := MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	key, err := deriveKey(seed, DefaultBaseDerivationPath.Child(0))
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	want := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+	if addr := crypto.PubkeyToAddress(key.PublicKey); addr != want {
+		t.Errorf("address mismatch: have %x, want %x", addr, want)
+	}
+}
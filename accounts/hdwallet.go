@@ -0,0 +1,507 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+)
+
+// hdDiscoveryGap is the number of consecutive unused accounts after which
+// account discovery stops, as recommended by BIP-44.
+const hdDiscoveryGap = 20
+
+var (
+	ErrNoHDWallet     = errors.New("no HD wallet for given id")
+	ErrHDWalletExists = errors.New("HD wallet already imported")
+
+	errAccountExists = errors.New("account already exists")
+)
+
+// HDWallet is a hierarchical deterministic wallet, a BIP-39 seed stored
+// encrypted in the keystore from which accounts are derived along BIP-32
+// paths. The accounts derived so far are recorded along with the seed.
+type HDWallet struct {
+	ID       string         `json:"id"`
+	File     string         `json:"file"`
+	BasePath DerivationPath `json:"basePath"` // Path under which accounts are derived by index
+	Accounts []HDAccount    `json:"accounts"`
+}
+
+// HDAccount is an account derived from an HD wallet.
+type HDAccount struct {
+	Address common.Address `json:"address"`
+	Path    DerivationPath `json:"path"`
+}
+
+// hdWalletJSON is the keystore record of an HD wallet.
+type hdWalletJSON struct {
+	ID       string         `json:"id"`
+	BasePath DerivationPath `json:"basepath"`
+	Accounts []HDAccount    `json:"accounts"`
+	Crypto   cryptoJSON     `json:"crypto"`
+	Version  int            `json:"version"`
+
+	First *common.Address `json:"first,omitempty"` // Account at index 0 of the base path, identifying the seed
+}
+
+type hdWalletRecord struct {
+	HDWallet
+	crypto cryptoJSON
+	first  *common.Address
+}
+
+// hdStore holds the HD wallets of the keystore, stored as encrypted records
+// in its hd subdirectory. Records are loaded once, wallets copied into the
+// directory are picked up on restart.
+type hdStore struct {
+	dir     string
+	scryptN int
+	scryptP int
+	mu      sync.RWMutex
+	wallets []*hdWalletRecord
+}
+
+func newHDStore(keydir string, scryptN, scryptP int) *hdStore {
+	hd := &hdStore{
+		dir:     filepath.Join(keydir, "hd"),
+		scryptN: scryptN,
+		scryptP: scryptP,
+	}
+	files, err := ioutil.ReadDir(hd.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.V(logger.Debug).Infof("can't load HD wallets: %v", err)
+		}
+		return hd
+	}
+	for _, fi := range files {
+		path := filepath.Join(hd.dir, fi.Name())
+		if skipKeyFile(fi) {
+			glog.V(logger.Detail).Infof("ignoring file %s", path)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			glog.V(logger.Detail).Infoln(err)
+			continue
+		}
+		var w hdWalletJSON
+		if err := json.Unmarshal(data, &w); err != nil || w.ID == "" {
+			glog.V(logger.Debug).Infof("can't decode HD wallet %s: %v", path, err)
+			continue
+		}
+		hd.wallets = append(hd.wallets, &hdWalletRecord{
+			HDWallet: HDWallet{ID: w.ID, File: path, BasePath: w.BasePath, Accounts: w.Accounts},
+			crypto:   w.Crypto,
+			first:    w.First,
+		})
+	}
+	sort.Slice(hd.wallets, func(i, j int) bool { return hd.wallets[i].File < hd.wallets[j].File })
+	return hd
+}
+
+// write stores the record of a wallet.
+// Callers must hold hd.mu.
+func (hd *hdStore) write(w *hdWalletRecord) error {
+	data, err := json.Marshal(hdWalletJSON{
+		ID:       w.ID,
+		BasePath: w.BasePath,
+		Accounts: w.Accounts,
+		Crypto:   w.crypto,
+		Version:  1,
+		First:    w.first,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(hd.dir, 0700); err != nil {
+		return err
+	}
+	return writeKeyFile(w.File, data)
+}
+
+// wallet returns the wallet of the given id.
+// Callers must hold hd.mu.
+func (hd *hdStore) wallet(id string) (*hdWalletRecord, error) {
+	for _, w := range hd.wallets {
+		if w.ID == id {
+			return w, nil
+		}
+	}
+	return nil, ErrNoHDWallet
+}
+
+// find returns the wallet an account is derived from and its path. If the
+// account names a file, it must be the one of the wallet.
+// Callers must hold hd.mu.
+func (hd *hdStore) find(a Account) (*hdWalletRecord, DerivationPath, error) {
+	file := a.File
+	if file != "" && !filepath.IsAbs(file) {
+		file = filepath.Join(hd.dir, filepath.Base(file))
+	}
+	for _, w := range hd.wallets {
+		if file != "" && file != w.File {
+			continue
+		}
+		for _, acc := range w.Accounts {
+			if acc.Address == a.Address {
+				return w, acc.Path, nil
+			}
+		}
+	}
+	return nil, nil, ErrNoMatch
+}
+
+// accounts returns the accounts derived from all wallets.
+func (hd *hdStore) accounts() []Account {
+	hd.mu.RLock()
+	defer hd.mu.RUnlock()
+
+	var accs []Account
+	for _, w := range hd.wallets {
+		for _, acc := range w.Accounts {
+			accs = append(accs, Account{Address: acc.Address, File: w.File})
+		}
+	}
+	return accs
+}
+
+func (hd *hdStore) hasAddress(addr common.Address) bool {
+	hd.mu.RLock()
+	defer hd.mu.RUnlock()
+
+	_, _, err := hd.find(Account{Address: addr})
+	return err == nil
+}
+
+// decryptSeed decrypts the seed of a wallet. The seed should be zeroed once
+// done with.
+func (w *hdWalletRecord) decryptSeed(passphrase string) ([]byte, error) {
+	return decryptData(w.crypto, passphrase)
+}
+
+// getDecryptedKey derives the key of an account from the seed of its wallet.
+func (hd *hdStore) getDecryptedKey(a Account, passphrase string) (Account, *key, error) {
+	hd.mu.RLock()
+	defer hd.mu.RUnlock()
+
+	w, path, err := hd.find(a)
+	if err != nil {
+		return Account{}, nil, err
+	}
+	seed, err := w.decryptSeed(passphrase)
+	if err != nil {
+		return Account{}, nil, err
+	}
+	defer zeroBytes(seed)
+
+	priv, err := deriveKey(seed, path)
+	if err != nil {
+		return Account{}, nil, err
+	}
+	k, err := newKeyFromECDSA(priv)
+	if err != nil {
+		return Account{}, nil, err
+	}
+	if k.Address != a.Address {
+		zeroKey(k.PrivateKey)
+		return Account{}, nil, errAddrMismatch
+	}
+	return Account{Address: k.Address, File: w.File}, k, nil
+}
+
+// zeroBytes zeroes a byte slice in memory.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// HDWallets returns the HD wallets of the keystore.
+func (am *Manager) HDWallets() []HDWallet {
+	am.hd.mu.RLock()
+	defer am.hd.mu.RUnlock()
+
+	wallets := make([]HDWallet, len(am.hd.wallets))
+	for i, w := range am.hd.wallets {
+		wallets[i] = w.HDWallet
+		wallets[i].Accounts = append([]HDAccount(nil), w.Accounts...)
+	}
+	return wallets
+}
+
+// HDWallet returns the HD wallet of the given id.
+func (am *Manager) HDWallet(id string) (HDWallet, error) {
+	for _, w := range am.HDWallets() {
+		if w.ID == id {
+			return w, nil
+		}
+	}
+	return HDWallet{}, ErrNoHDWallet
+}
+
+// ImportHDWallet stores the seed of a BIP-39 mnemonic, derived with the optional
+// mnemonic passphrase, into the keystore as a new HD wallet, encrypting it with
+// passphrase. Accounts are derived under basePath, DefaultBaseDerivationPath if
+// nil. The mnemonic itself isn't stored, nor can it be recovered from the seed.
+// A wallet of a seed imported already, or whose first account under basePath
+// is held already, is rejected with ErrHDWalletExists.
+func (am *Manager) ImportHDWallet(mnemonic, mnemonicPassphrase, passphrase string, basePath DerivationPath) (HDWallet, error) {
+	if am.signer != nil {
+		return HDWallet{}, ErrExternalSigner
+	}
+	if err := ValidateMnemonic(mnemonic); err != nil {
+		return HDWallet{}, err
+	}
+	if basePath == nil {
+		basePath = DefaultBaseDerivationPath
+	}
+	seed := MnemonicToSeed(mnemonic, mnemonicPassphrase)
+	defer zeroBytes(seed)
+
+	var first *common.Address
+	if priv, err := deriveKey(seed, basePath.Child(0)); err == nil {
+		addr := crypto.PubkeyToAddress(priv.PublicKey)
+		zeroKey(priv)
+		first = &addr
+	} else if err != errInvalidChildKey {
+		return HDWallet{}, err
+	}
+	cryptoStruct, err := encryptData(seed, passphrase, am.hd.scryptN, am.hd.scryptP)
+	if err != nil {
+		return HDWallet{}, err
+	}
+	id, err := newKeyUUID()
+	if err != nil {
+		return HDWallet{}, err
+	}
+	timestamp := time.Now().UTC().Format("2006-01-02T15-04-05.999999999")
+	w := &hdWalletRecord{
+		HDWallet: HDWallet{
+			ID:       id,
+			File:     filepath.Join(am.hd.dir, fmt.Sprintf("UTC--%sZ--%s", timestamp, id)),
+			BasePath: basePath,
+		},
+		crypto: cryptoStruct,
+		first:  first,
+	}
+
+	am.hd.mu.Lock()
+	defer am.hd.mu.Unlock()
+	if first != nil {
+		if _, _, err := am.hd.find(Account{Address: *first}); err == nil || am.ac.hasAddress(*first) {
+			return HDWallet{}, ErrHDWalletExists
+		}
+		for _, held := range am.hd.wallets {
+			if held.first != nil && *held.first == *first {
+				return HDWallet{}, ErrHDWalletExists
+			}
+		}
+	}
+	if err := am.hd.write(w); err != nil {
+		return HDWallet{}, err
+	}
+	am.hd.wallets = append(am.hd.wallets, w)
+	return w.HDWallet, nil
+}
+
+// DeriveHDAccount derives the account at path from the seed of an HD wallet,
+// decrypted with passphrase, and adds it to the accounts of the wallet. If path
+// is nil, the account following the last one derived under the base path of
+// the wallet is.
+func (am *Manager) DeriveHDAccount(id string, path DerivationPath, passphrase string) (Account, error) {
+	am.hd.mu.Lock()
+	defer am.hd.mu.Unlock()
+
+	w, err := am.hd.wallet(id)
+	if err != nil {
+		return Account{}, err
+	}
+	if path == nil {
+		next := uint32(0)
+		for _, acc := range w.Accounts {
+			if len(acc.Path) == len(w.BasePath)+1 && acc.Path.HasPrefix(w.BasePath) && acc.Path[len(acc.Path)-1] >= next {
+				next = acc.Path[len(acc.Path)-1] + 1
+			}
+		}
+		if next >= hardenedOffset {
+			return Account{}, fmt.Errorf("no account index left under %v", w.BasePath)
+		}
+		path = w.BasePath.Child(next)
+	}
+	seed, err := w.decryptSeed(passphrase)
+	if err != nil {
+		return Account{}, err
+	}
+	defer zeroBytes(seed)
+
+	priv, err := deriveKey(seed, path)
+	if err != nil {
+		return Account{}, err
+	}
+	addr := crypto.PubkeyToAddress(priv.PublicKey)
+	zeroKey(priv)
+
+	for _, acc := range w.Accounts {
+		if acc.Address == addr {
+			return Account{Address: addr, File: w.File}, nil
+		}
+	}
+	if _, _, err := am.hd.find(Account{Address: addr}); err == nil || am.ac.hasAddress(addr) {
+		return Account{}, errAccountExists
+	}
+	if err := am.pinHDAccounts(w, HDAccount{Address: addr, Path: path}); err != nil {
+		return Account{}, err
+	}
+	return Account{Address: addr, File: w.File}, nil
+}
+
+// DiscoverHDAccounts derives the accounts under the base path of an HD wallet,
+// decrypted with passphrase, by increasing index, and adds the ones found used
+// to the accounts of the wallet. Discovery stops after a gap of unused accounts,
+// as in BIP-44. It returns the accounts newly added.
+func (am *Manager) DiscoverHDAccounts(id string, passphrase string, used func(common.Address) (bool, error)) ([]Account, error) {
+	am.hd.mu.Lock()
+	defer am.hd.mu.Unlock()
+
+	w, err := am.hd.wallet(id)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := w.decryptSeed(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(seed)
+
+	var found []HDAccount
+	for index, gap := uint32(0), 0; gap < hdDiscoveryGap && index < hardenedOffset; index++ {
+		path := w.BasePath.Child(index)
+		priv, err := deriveKey(seed, path)
+		if err == errInvalidChildKey {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		addr := crypto.PubkeyToAddress(priv.PublicKey)
+		zeroKey(priv)
+
+		isUsed, err := used(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !isUsed {
+			gap++
+			continue
+		}
+		gap = 0
+		// Skip the accounts held by the keystore already
+		if _, _, err := am.hd.find(Account{Address: addr}); err == nil || am.ac.hasAddress(addr) {
+			continue
+		}
+		found = append(found, HDAccount{Address: addr, Path: path})
+	}
+	if err := am.pinHDAccounts(w, found...); err != nil {
+		return nil, err
+	}
+	accs := make([]Account, len(found))
+	for i, acc := range found {
+		accs[i] = Account{Address: acc.Address, File: w.File}
+	}
+	return accs, nil
+}
+
+// pinHDAccounts adds accounts to a wallet.
+// Callers must hold am.hd.mu.
+func (am *Manager) pinHDAccounts(w *hdWalletRecord, accs ...HDAccount) error {
+	if len(accs) == 0 {
+		return nil
+	}
+	updated := *w
+	updated.Accounts = append(append([]HDAccount(nil), w.Accounts...), accs...)
+	if err := am.hd.write(&updated); err != nil {
+		return err
+	}
+	*w = updated
+	return nil
+}
+
+// UpdateHDWallet changes the passphrase of an HD wallet.
+func (am *Manager) UpdateHDWallet(id string, passphrase, newPassphrase string) error {
+	am.hd.mu.Lock()
+	defer am.hd.mu.Unlock()
+
+	w, err := am.hd.wallet(id)
+	if err != nil {
+		return err
+	}
+	seed, err := w.decryptSeed(passphrase)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(seed)
+
+	cryptoStruct, err := encryptData(seed, newPassphrase, am.hd.scryptN, am.hd.scryptP)
+	if err != nil {
+		return err
+	}
+	updated := *w
+	updated.crypto = cryptoStruct
+	if err := am.hd.write(&updated); err != nil {
+		return err
+	}
+	*w = updated
+	return nil
+}
+
+// removeHDAccount removes a derived account from its wallet. It can be derived
+// again at any time.
+func (am *Manager) removeHDAccount(a Account) error {
+	am.hd.mu.Lock()
+	defer am.hd.mu.Unlock()
+
+	w, _, err := am.hd.find(a)
+	if err != nil {
+		return err
+	}
+	updated := *w
+	updated.Accounts = nil
+	for _, acc := range w.Accounts {
+		if acc.Address != a.Address {
+			updated.Accounts = append(updated.Accounts, acc)
+		}
+	}
+	if err := am.hd.write(&updated); err != nil {
+		return err
+	}
+	*w = updated
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+// Tests that a seed is imported once only, across restarts and whatever
+// accounts were derived from it, and that no record is left of a rejected
+// import.
+func TestImportHDWalletTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hdwallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	am, err := NewManager(dir, LightScryptN, LightScryptP, false)
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	w, err := am.ImportHDWallet(testMnemonic, "", "pass", nil)
+	if err != nil {
+		t.Fatalf("failed to import wallet: %v", err)
+	}
+	// Only an account beyond the first one is derived
+	if _, err := am.DeriveHDAccount(w.ID, DefaultBaseDerivationPath.Child(3), "pass"); err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	if _, err := am.ImportHDWallet(testMnemonic, "", "other", nil); err != ErrHDWalletExists {
+		t.Errorf("error mismatch on reimport: have %v, want %v", err, ErrHDWalletExists)
+	}
+	// Another mnemonic passphrase or base path derives other accounts
+	if _, err := am.ImportHDWallet(testMnemonic, "TREZOR", "pass", nil); err != nil {
+		t.Errorf("failed to import wallet of another passphrase: %v", err)
+	}
+	if _, err := am.ImportHDWallet(testMnemonic, "", "pass", DerivationPath{hardenedOffset + 44, hardenedOffset + 61, hardenedOffset, 0}); err != nil {
+		t.Errorf("failed to import wallet of another base path: %v", err)
+	}
+	am, err = NewManager(dir, LightScryptN, LightScryptP, false)
+	if err != nil {
+		t.Fatalf("failed to reopen manager: %v", err)
+	}
+	if _, err := am.ImportHDWallet(testMnemonic, "", "pass", nil); err != ErrHDWalletExists {
+		t.Errorf("error mismatch on reimport after restart: have %v, want %v", err, ErrHDWalletExists)
+	}
+	if n := len(am.HDWallets()); n != 3 {
+		t.Errorf("wallet count mismatch: have %d, want 3", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "hd", "*")); len(files) != 3 {
+		t.Errorf("wallet file count mismatch: have %d, want 3", len(files))
+	}
+}
@@ -245,42 +245,51 @@ type cipherparamsJSON struct {
 
 // encryptKey encrypts key as version 3.
 func encryptKey(key *key, secret string, scryptN, scryptP int) ([]byte, error) {
+	cryptoStruct, err := encryptData(crypto.FromECDSA(key.PrivateKey), secret, scryptN, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(web3v3{
+		ID:      key.UUID,
+		Address: hex.EncodeToString(key.Address[:]),
+		Crypto:  cryptoStruct,
+		Version: 3,
+	})
+}
+
+// encryptData encrypts data with secret as the crypto section of a version 3
+// record.
+func encryptData(data []byte, secret string, scryptN, scryptP int) (cryptoJSON, error) {
 	salt := randentropy.GetEntropyCSPRNG(32)
 	derivedKey, err := scrypt.Key([]byte(secret), salt, scryptN, scryptR, scryptP, scryptDKLen)
 	if err != nil {
-		return nil, err
+		return cryptoJSON{}, err
 	}
 	encryptKey := derivedKey[:16]
-	keyBytes := crypto.FromECDSA(key.PrivateKey)
 
 	iv := randentropy.GetEntropyCSPRNG(aes.BlockSize) // 16
-	cipherText, err := aesCTRXOR(encryptKey, keyBytes, iv)
+	cipherText, err := aesCTRXOR(encryptKey, data, iv)
 	if err != nil {
-		return nil, err
+		return cryptoJSON{}, err
 	}
 	mac := crypto.Keccak256(derivedKey[16:32], cipherText)
 
-	return json.Marshal(web3v3{
-		ID:      key.UUID,
-		Address: hex.EncodeToString(key.Address[:]),
-		Crypto: cryptoJSON{
-			Cipher:     "aes-128-ctr",
-			CipherText: hex.EncodeToString(cipherText),
-			CipherParams: cipherparamsJSON{
-				IV: hex.EncodeToString(iv),
-			},
-			KDF: "scrypt",
-			KDFParams: map[string]interface{}{
-				"n":     scryptN,
-				"r":     scryptR,
-				"p":     scryptP,
-				"dklen": scryptDKLen,
-				"salt":  hex.EncodeToString(salt),
-			},
-			MAC: hex.EncodeToString(mac),
+	return cryptoJSON{
+		Cipher:     "aes-128-ctr",
+		CipherText: hex.EncodeToString(cipherText),
+		CipherParams: cipherparamsJSON{
+			IV: hex.EncodeToString(iv),
 		},
-		Version: 3,
-	})
+		KDF: "scrypt",
+		KDFParams: map[string]interface{}{
+			"n":     scryptN,
+			"r":     scryptR,
+			"p":     scryptP,
+			"dklen": scryptDKLen,
+			"salt":  hex.EncodeToString(salt),
+		},
+		MAC: hex.EncodeToString(mac),
+	}, nil
 }
 
 // Web3PrivateKey decrypts the record with secret and returns the private key.
@@ -345,26 +354,31 @@ func decryptKey(web3JSON []byte, secret string) (*key, error) {
 }
 
 func decryptKeyV3(keyProtected *web3v3, secret string) (keyBytes []byte, err error) {
-	if keyProtected.Crypto.Cipher != "aes-128-ctr" {
-		return nil, fmt.Errorf("Cipher not supported: %v", keyProtected.Crypto.Cipher)
+	return decryptData(keyProtected.Crypto, secret)
+}
+
+// decryptData decrypts the crypto section of a version 3 record with secret.
+func decryptData(cryptoStruct cryptoJSON, secret string) ([]byte, error) {
+	if cryptoStruct.Cipher != "aes-128-ctr" {
+		return nil, fmt.Errorf("Cipher not supported: %v", cryptoStruct.Cipher)
 	}
 
-	mac, err := hex.DecodeString(keyProtected.Crypto.MAC)
+	mac, err := hex.DecodeString(cryptoStruct.MAC)
 	if err != nil {
 		return nil, err
 	}
 
-	iv, err := hex.DecodeString(keyProtected.Crypto.CipherParams.IV)
+	iv, err := hex.DecodeString(cryptoStruct.CipherParams.IV)
 	if err != nil {
 		return nil, err
 	}
 
-	cipherText, err := hex.DecodeString(keyProtected.Crypto.CipherText)
+	cipherText, err := hex.DecodeString(cryptoStruct.CipherText)
 	if err != nil {
 		return nil, err
 	}
 
-	derivedKey, err := getKDFKey(keyProtected.Crypto, secret)
+	derivedKey, err := getKDFKey(cryptoStruct, secret)
 	if err != nil {
 		return nil, err
 	}
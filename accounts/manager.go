@@ -34,6 +34,8 @@ import (
 
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
 )
 
 var (
@@ -42,6 +44,7 @@ var (
 	ErrDecrypt = errors.New("could not decrypt key with given passphrase")
 
 	errAddrMismatch = errors.New("security violation: address of file didn't match request")
+	errHDAccount    = errors.New("account is derived from an HD wallet, update the wallet instead")
 )
 
 // Account represents a stored key.
@@ -73,10 +76,13 @@ func (acc *Account) UnmarshalJSON(raw []byte) error {
 	return json.Unmarshal(raw, &acc.Address)
 }
 
-// Manager manages a key storage directory on disk.
+// Manager manages a key storage directory on disk, or defers to an external
+// signer holding the keys.
 type Manager struct {
 	ac       caching
 	keyStore keyStore
+	hd       *hdStore
+	signer   SignerBackend // external signer, nil if the keys are held by the keystore
 	mu       sync.RWMutex
 	unlocked map[common.Address]*unlocked
 }
@@ -109,6 +115,7 @@ func NewManager(keydir string, scryptN, scryptP int, wantCacheDB bool) (*Manager
 
 	am := &Manager{
 		keyStore: *store,
+		hd:       newHDStore(store.baseDir, scryptN, scryptP),
 		unlocked: make(map[common.Address]*unlocked),
 	}
 	if wantCacheDB {
@@ -134,18 +141,52 @@ func NewManager(keydir string, scryptN, scryptP int, wantCacheDB bool) (*Manager
 	return am, nil
 }
 
+// NewExternalManager creates a manager without keystore, routing the signing
+// requests to an external signer.
+func NewExternalManager(signer SignerBackend) *Manager {
+	return &Manager{
+		hd:       &hdStore{},
+		signer:   signer,
+		unlocked: make(map[common.Address]*unlocked),
+	}
+}
+
 func (am *Manager) BuildIndexDB() []error {
+	if am.signer != nil {
+		return []error{ErrExternalSigner}
+	}
 	return am.ac.Syncfs2db(time.Now().Add(-60 * 24 * 7 * 30 * 120 * time.Minute)) // arbitrarily long "last updated"
 }
 
 // HasAddress reports whether a key with the given address is present.
 func (am *Manager) HasAddress(addr common.Address) bool {
-	return am.ac.hasAddress(addr)
+	if am.signer != nil {
+		for _, a := range am.Accounts() {
+			if a.Address == addr {
+				return true
+			}
+		}
+		return false
+	}
+	return am.ac.hasAddress(addr) || am.hd.hasAddress(addr)
 }
 
-// Accounts returns all key files present in the directory.
+// Accounts returns all key files present in the directory, followed by the
+// accounts derived from HD wallets, or the accounts of the external signer.
 func (am *Manager) Accounts() []Account {
-	return am.ac.accounts()
+	if am.signer != nil {
+		addrs, err := am.signer.Accounts()
+		if err != nil {
+			glog.V(logger.Warn).Warnf("Failed to list external signer accounts: %v", err)
+			return nil
+		}
+		accs := make([]Account, len(addrs))
+		for i, addr := range addrs {
+			accs[i] = Account{Address: addr}
+		}
+		return accs
+	}
+	return append(am.ac.accounts(), am.hd.accounts()...)
 }
 
 // DeleteAccount deletes the key matched by account if the passphrase is correct.
@@ -161,6 +202,10 @@ func (am *Manager) DeleteAccount(a Account, passphrase string) error {
 	if err != nil {
 		return err
 	}
+	// Derived accounts are only dropped from their wallet, keeping the seed
+	if filepath.Dir(a.File) == am.hd.dir {
+		return am.removeHDAccount(a)
+	}
 
 	if !filepath.IsAbs(a.File) {
 		p := filepath.Join(am.ac.getKeydir(), a.File)
@@ -178,7 +223,11 @@ func (am *Manager) DeleteAccount(a Account, passphrase string) error {
 }
 
 // Sign signs hash with an unlocked private key matching the given address.
+// External signers only sign typed requests, see SignTx and SignData.
 func (am *Manager) Sign(addr common.Address, hash []byte) (signature []byte, err error) {
+	if am.signer != nil {
+		return nil, ErrExternalSigner
+	}
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
@@ -256,13 +305,20 @@ func (am *Manager) TimedUnlock(a Account, passphrase string, timeout time.Durati
 }
 
 func (am *Manager) getDecryptedKey(a Account, auth string) (Account, *key, error) {
+	if am.signer != nil {
+		return Account{}, nil, ErrExternalSigner
+	}
 	am.ac.maybeReload()
 	am.ac.muLock()
-	a, err := am.ac.find(a)
+	found, err := am.ac.find(a)
 	am.ac.muUnlock()
+	if err == ErrNoMatch {
+		return am.hd.getDecryptedKey(a, auth)
+	}
 	if err != nil {
 		return Account{}, nil, err
 	}
+	a = found
 
 	key := &key{}
 	if a.EncryptedKey != "" {
@@ -304,6 +360,9 @@ func (am *Manager) expire(addr common.Address, u *unlocked, timeout time.Duratio
 // NewAccount generates a new key and stores it into the key directory,
 // encrypting it with the passphrase.
 func (am *Manager) NewAccount(passphrase string) (Account, error) {
+	if am.signer != nil {
+		return Account{}, ErrExternalSigner
+	}
 	_, account, err := storeNewKey(&am.keyStore, passphrase)
 	if err != nil {
 		return Account{}, err
@@ -334,6 +393,9 @@ func (am *Manager) Export(a Account, passphrase, newPassphrase string) (keyJSON
 
 // Import stores the given encrypted JSON key into the key directory.
 func (am *Manager) Import(keyJSON []byte, passphrase, newPassphrase string) (Account, error) {
+	if am.signer != nil {
+		return Account{}, ErrExternalSigner
+	}
 	key, err := decryptKey(keyJSON, passphrase)
 	if key != nil && key.PrivateKey != nil {
 		defer zeroKey(key.PrivateKey)
@@ -346,6 +408,9 @@ func (am *Manager) Import(keyJSON []byte, passphrase, newPassphrase string) (Acc
 
 // ImportECDSA stores the given key into the key directory, encrypting it with the passphrase.
 func (am *Manager) ImportECDSA(priv *ecdsa.PrivateKey, passphrase string) (Account, error) {
+	if am.signer != nil {
+		return Account{}, ErrExternalSigner
+	}
 	key, err := newKeyFromECDSA(priv)
 	if err != nil {
 		return Account{}, err
@@ -359,6 +424,9 @@ func (am *Manager) ImportECDSA(priv *ecdsa.PrivateKey, passphrase string) (Accou
 }
 
 func (am *Manager) importKey(key *key, passphrase string) (Account, error) {
+	if am.signer != nil {
+		return Account{}, ErrExternalSigner
+	}
 	file, err := am.keyStore.Insert(key, passphrase)
 	if err != nil {
 		return Account{}, err
@@ -375,12 +443,19 @@ func (am *Manager) Update(a Account, passphrase, newPassphrase string) error {
 	if err != nil {
 		return err
 	}
+	if filepath.Dir(a.File) == am.hd.dir {
+		zeroKey(key.PrivateKey)
+		return errHDAccount
+	}
 	return am.keyStore.Update(a.File, key, newPassphrase)
 }
 
 // ImportPreSaleKey decrypts the given Ethereum presale wallet and stores
 // a key file in the key directory. The key file is encrypted with the same passphrase.
 func (am *Manager) ImportPreSaleKey(keyJSON []byte, passphrase string) (Account, error) {
+	if am.signer != nil {
+		return Account{}, ErrExternalSigner
+	}
 	a, _, err := importPreSaleKey(&am.keyStore, keyJSON, passphrase)
 	if err != nil {
 		return a, err
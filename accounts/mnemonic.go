@@ -0,0 +1,129 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/NginProject/ngind/crypto/randentropy"
+)
+
+// DefaultMnemonicBits is the entropy size of generated mnemonics, giving 24 words.
+const DefaultMnemonicBits = 256
+
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+var mnemonicIndexes = func() map[string]int {
+	indexes := make(map[string]int, len(mnemonicWords))
+	for i, w := range mnemonicWords {
+		indexes[w] = i
+	}
+	return indexes
+}()
+
+// NewMnemonic generates a BIP-39 mnemonic sentence from bits of random entropy.
+// bits must be a multiple of 32 between 128 and 256.
+func NewMnemonic(bits int) (string, error) {
+	if bits%32 != 0 || bits < 128 || bits > 256 {
+		return "", fmt.Errorf("invalid mnemonic entropy size %d, must be a multiple of 32 within [128, 256]", bits)
+	}
+	return EntropyToMnemonic(randentropy.GetEntropyCSPRNG(bits / 8))
+}
+
+// EntropyToMnemonic encodes entropy as a BIP-39 mnemonic sentence. Each word
+// holds 11 bits of the entropy followed by its checksum, the leading
+// len(entropy)/4 bits of its SHA256 hash.
+func EntropyToMnemonic(entropy []byte) (string, error) {
+	bits := len(entropy) * 8
+	if bits%32 != 0 || bits < 128 || bits > 256 {
+		return "", fmt.Errorf("invalid mnemonic entropy size %d, must be a multiple of 32 within [128, 256]", bits)
+	}
+	checksumBits := uint(bits / 32)
+	hash := sha256.Sum256(entropy)
+
+	data := new(big.Int).SetBytes(entropy)
+	data.Lsh(data, checksumBits)
+	data.Or(data, big.NewInt(int64(hash[0]>>(8-checksumBits))))
+
+	words := make([]string, (bits+int(checksumBits))/11)
+	mask := big.NewInt(2047)
+	for i := len(words) - 1; i >= 0; i-- {
+		words[i] = mnemonicWords[new(big.Int).And(data, mask).Int64()]
+		data.Rsh(data, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// MnemonicToEntropy decodes a BIP-39 mnemonic sentence, verifying its words
+// and checksum.
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(normalizeMnemonic(mnemonic))
+	if len(words)%3 != 0 || len(words) < 12 || len(words) > 24 {
+		return nil, fmt.Errorf("%v: %d words, must be 12, 15, 18, 21 or 24", ErrInvalidMnemonic, len(words))
+	}
+	data := new(big.Int)
+	for _, w := range words {
+		i, ok := mnemonicIndexes[w]
+		if !ok {
+			return nil, fmt.Errorf("%v: unknown word %q", ErrInvalidMnemonic, w)
+		}
+		data.Lsh(data, 11)
+		data.Or(data, big.NewInt(int64(i)))
+	}
+	checksumBits := uint(len(words) * 11 / 33)
+	checksum := new(big.Int).And(data, big.NewInt(1<<checksumBits-1))
+	data.Rsh(data, checksumBits)
+
+	entropy := make([]byte, len(words)*11*32/33/8)
+	b := data.Bytes()
+	copy(entropy[len(entropy)-len(b):], b)
+
+	hash := sha256.Sum256(entropy)
+	if checksum.Int64() != int64(hash[0]>>(8-checksumBits)) {
+		return nil, fmt.Errorf("%v: checksum mismatch", ErrInvalidMnemonic)
+	}
+	return entropy, nil
+}
+
+// ValidateMnemonic returns an error if mnemonic isn't a valid BIP-39 mnemonic
+// sentence.
+func ValidateMnemonic(mnemonic string) error {
+	_, err := MnemonicToEntropy(mnemonic)
+	return err
+}
+
+// MnemonicToSeed derives the BIP-39 seed of a mnemonic sentence, protected by
+// an optional passphrase. Any passphrase derives a valid seed, a forgotten or
+// mistyped one yields different accounts.
+func MnemonicToSeed(mnemonic, passphrase string) []byte {
+	salt := "mnemonic" + norm.NFKD.String(passphrase)
+	return pbkdf2.Key([]byte(normalizeMnemonic(mnemonic)), []byte(salt), 2048, 64, sha512.New)
+}
+
+// normalizeMnemonic returns the NFKD normalized mnemonic, its words lower
+// cased and separated by single spaces.
+func normalizeMnemonic(mnemonic string) string {
+	return norm.NFKD.String(strings.Join(strings.Fields(strings.ToLower(mnemonic)), " "))
+}
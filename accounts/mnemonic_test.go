@@ -0,0 +1,117 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+)
+
+// Tests that mnemonics are encoded, decoded and turned into seeds as in the
+// BIP-39 reference vectors, protected by the passphrase TREZOR.
+func TestMnemonicVectors(t *testing.T) {
+	tests := []struct {
+		entropy  string
+		mnemonic string
+		seed     string
+	}{
+		{
+			"00000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+			"legal winner thank year wave sausage worth useful legal winner thank yellow",
+			"2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607",
+		},
+		{
+			"80808080808080808080808080808080",
+			"letter advice cage absurd amount doctor acoustic avoid letter advice cage above",
+			"d71de856f81a8acc65e6fc851a38d4d7ec216fd0796d0a6827a3ad6ed5511a30fa280f12eb2e47ed2ac03b5c462a0358d18d69fe4f985ec81778c1b370b652a8",
+		},
+		{
+			"ffffffffffffffffffffffffffffffff",
+			"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong",
+			"ac27495480225222079d7be181583751e86f571027b0497b5b5d11218e0a8a13332572917f0f8e5a589620c6f15b11c61dee327651a14c34e18231052e48c069",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon art",
+			"bda85446c68413707090a52022edd26a1c9462295029f2e60cd7c4f2bbd3097170af7a4d73245cafa9c3cca8d561a7c3de6f5d4a10be8ed2a5e608d68f92fcc8",
+		},
+	}
+	for i, tt := range tests {
+		entropy := common.FromHex(tt.entropy)
+		mnemonic, err := EntropyToMnemonic(entropy)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode entropy: %v", i, err)
+		}
+		if mnemonic != tt.mnemonic {
+			t.Errorf("test %d: mnemonic mismatch: have %q, want %q", i, mnemonic, tt.mnemonic)
+		}
+		decoded, err := MnemonicToEntropy(tt.mnemonic)
+		if err != nil {
+			t.Fatalf("test %d: failed to decode mnemonic: %v", i, err)
+		}
+		if !bytes.Equal(decoded, entropy) {
+			t.Errorf("test %d: entropy mismatch: have %x, want %x", i, decoded, entropy)
+		}
+		if seed := MnemonicToSeed(tt.mnemonic, "TREZOR"); common.Bytes2Hex(seed) != tt.seed {
+			t.Errorf("test %d: seed mismatch: have %x, want %s", i, seed, tt.seed)
+		}
+		// Case and spacing don't change the seed
+		sloppy := " " + strings.ToUpper(strings.Replace(tt.mnemonic, " ", "  ", -1)) + "\n"
+		if seed := MnemonicToSeed(sloppy, "TREZOR"); common.Bytes2Hex(seed) != tt.seed {
+			t.Errorf("test %d: seed of unnormalized mnemonic mismatch: have %x, want %s", i, seed, tt.seed)
+		}
+	}
+}
+
+// Tests that mnemonics of invalid length, words or checksum are rejected.
+func TestValidateMnemonic(t *testing.T) {
+	tests := []string{
+		"",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abuot",
+		"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo",
+	}
+	for i, mnemonic := range tests {
+		if err := ValidateMnemonic(mnemonic); err == nil {
+			t.Errorf("test %d: invalid mnemonic %q accepted", i, mnemonic)
+		}
+	}
+	for _, bits := range []int{128, 160, 192, 224, 256} {
+		mnemonic, err := NewMnemonic(bits)
+		if err != nil {
+			t.Fatalf("failed to generate %d bits mnemonic: %v", bits, err)
+		}
+		if words := len(strings.Fields(mnemonic)); words != bits*3/32 {
+			t.Errorf("%d bits mnemonic of %d words, want %d", bits, words, bits*3/32)
+		}
+		if err := ValidateMnemonic(mnemonic); err != nil {
+			t.Errorf("generated mnemonic %q invalid: %v", mnemonic, err)
+		}
+	}
+	if _, err := NewMnemonic(100); err == nil {
+		t.Errorf("mnemonic of invalid entropy size generated")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package accounts
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/NginProject/ngind/accounts/typeddata"
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/common/hexutil"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+)
+
+var ErrExternalSigner = errors.New("not supported with an external signer, keys are held by the signer")
+
+// SignerBackend signs transactions and data on behalf of accounts. The Manager
+// routes signing through its backend: the keys unlocked in the keystore, or an
+// external signer keeping the keys out of the process.
+//
+// Requests are typed, so the backend can check what it signs and compute the
+// hash itself. Signatures are in the [R || S || V] format, where V is 0 or 1.
+type SignerBackend interface {
+	// Accounts returns the addresses of the accounts the backend signs for.
+	Accounts() ([]common.Address, error)
+	// SignTx signs the hash of a transaction.
+	SignTx(req *SignTxRequest) ([]byte, error)
+	// SignData signs the hash of a message, see TextHash.
+	SignData(req *SignDataRequest) ([]byte, error)
+	// SignTypedData signs the EIP-712 hash of typed structured data.
+	SignTypedData(req *SignTypedDataRequest) ([]byte, error)
+}
+
+// SignTxRequest is a request to sign a transaction.
+type SignTxRequest struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"` // nil for contract creations
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Gas      *hexutil.Big    `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Data     hexutil.Bytes   `json:"data"`
+	ChainID  *hexutil.Big    `json:"chainId"` // EIP-155 chain id, nil if the transaction isn't replay protected
+}
+
+// NewSignTxRequest returns the request to sign tx from an account, hashed by signer.
+func NewSignTxRequest(from common.Address, tx *types.Transaction, signer types.Signer) *SignTxRequest {
+	req := &SignTxRequest{
+		From:     from,
+		To:       tx.To(),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Gas:      (*hexutil.Big)(tx.Gas()),
+		GasPrice: (*hexutil.Big)(tx.GasPrice()),
+		Value:    (*hexutil.Big)(tx.Value()),
+		Data:     tx.Data(),
+	}
+	if s, ok := signer.(types.ChainIdSigner); ok {
+		req.ChainID = (*hexutil.Big)(s.ChainId())
+	}
+	return req
+}
+
+// Transaction returns the transaction requested to be signed, along with its
+// signer.
+func (req *SignTxRequest) Transaction() (*types.Transaction, types.Signer, error) {
+	if req.Gas == nil || req.GasPrice == nil || req.Value == nil {
+		return nil, nil, errors.New("missing gas, gas price or value")
+	}
+	var tx *types.Transaction
+	if req.To == nil {
+		tx = types.NewContractCreation(uint64(req.Nonce), req.Value.ToInt(), req.Gas.ToInt(), req.GasPrice.ToInt(), req.Data)
+	} else {
+		tx = types.NewTransaction(uint64(req.Nonce), *req.To, req.Value.ToInt(), req.Gas.ToInt(), req.GasPrice.ToInt(), req.Data)
+	}
+	var signer types.Signer = types.BasicSigner{}
+	if req.ChainID != nil {
+		signer = types.NewChainIdSigner(req.ChainID.ToInt())
+	}
+	tx.SetSigner(signer)
+	return tx, signer, nil
+}
+
+// SignDataRequest is a request to sign a message.
+type SignDataRequest struct {
+	From common.Address `json:"from"`
+	Data hexutil.Bytes  `json:"data"`
+}
+
+// SignTypedDataRequest is a request to sign typed structured data.
+type SignTypedDataRequest struct {
+	From common.Address       `json:"from"`
+	Data *typeddata.TypedData `json:"data"`
+}
+
+// TextHash returns the hash signed for a message, calculated as
+//   keccak256("\x19Ethereum Signed Message:\n"${message length}${message}).
+//
+// This gives context to the signed message and prevents signing of transactions.
+func TextHash(data []byte) []byte {
+	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(data), data)
+	return crypto.Keccak256([]byte(msg))
+}
+
+// keystoreBackend signs with the keys unlocked in the keystore of a Manager.
+type keystoreBackend struct {
+	am *Manager
+}
+
+func (b keystoreBackend) Accounts() ([]common.Address, error) {
+	accs := b.am.Accounts()
+	addrs := make([]common.Address, len(accs))
+	for i, acc := range accs {
+		addrs[i] = acc.Address
+	}
+	return addrs, nil
+}
+
+func (b keystoreBackend) SignTx(req *SignTxRequest) ([]byte, error) {
+	tx, signer, err := req.Transaction()
+	if err != nil {
+		return nil, err
+	}
+	return b.am.Sign(req.From, signer.Hash(tx).Bytes())
+}
+
+func (b keystoreBackend) SignData(req *SignDataRequest) ([]byte, error) {
+	return b.am.Sign(req.From, TextHash(req.Data))
+}
+
+func (b keystoreBackend) SignTypedData(req *SignTypedDataRequest) ([]byte, error) {
+	hash, err := req.Data.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return b.am.Sign(req.From, hash)
+}
+
+// SignTx signs a transaction, hashed by signer, with the unlocked key of addr,
+// or has it signed by the external signer, and returns the signed transaction.
+func (am *Manager) SignTx(addr common.Address, tx *types.Transaction, signer types.Signer) (*types.Transaction, error) {
+	hash := signer.Hash(tx)
+	sig, err := am.backend().SignTx(NewSignTxRequest(addr, tx, signer))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(addr, hash.Bytes(), sig); err != nil {
+		return nil, err
+	}
+	return tx.WithSigner(signer).WithSignature(sig)
+}
+
+// SignData signs the hash of a message, see TextHash, with the unlocked key of
+// addr, or has it signed by the external signer. The V value of the signature
+// is 0 or 1.
+func (am *Manager) SignData(addr common.Address, data []byte) ([]byte, error) {
+	sig, err := am.backend().SignData(&SignDataRequest{From: addr, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(addr, TextHash(data), sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// SignTypedData signs the EIP-712 hash of typed structured data with the
+// unlocked key of addr, or has it signed by the external signer. The V value
+// of the signature is 0 or 1.
+func (am *Manager) SignTypedData(addr common.Address, data *typeddata.TypedData) ([]byte, error) {
+	hash, err := data.Hash()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := am.backend().SignTypedData(&SignTypedDataRequest{From: addr, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(addr, hash, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// backend returns the backend signing requests are routed through.
+func (am *Manager) backend() SignerBackend {
+	if am.signer != nil {
+		return am.signer
+	}
+	return keystoreBackend{am}
+}
+
+// External reports whether the keys are held by an external signer.
+func (am *Manager) External() bool {
+	return am.signer != nil
+}
+
+// verifySignature checks that a signature of hash, returned by a backend, was
+// made by the key of addr.
+func verifySignature(addr common.Address, hash, sig []byte) error {
+	if len(sig) != 65 || sig[64] > 1 {
+		return fmt.Errorf("invalid signature from signer: %x", sig)
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return err
+	}
+	if signer := crypto.PubkeyToAddress(*pub); signer != addr {
+		return fmt.Errorf("signature from %x instead of %x", signer, addr)
+	}
+	return nil
+}
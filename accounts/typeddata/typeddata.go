@@ -0,0 +1,426 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+// Package typeddata implements the hashing and encoding of typed structured
+// data, as specified by EIP-712, for signing off-chain messages such as orders
+// and permits which can be verified on chain.
+package typeddata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/common/hexutil"
+	"github.com/NginProject/ngind/crypto"
+)
+
+// DomainType is the name of the type of the domain separator, which must be
+// defined by the types of the typed data.
+const DomainType = "EIP712Domain"
+
+// Field is a member of a struct type.
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Types maps the names of the struct types to their members.
+type Types map[string][]Field
+
+// TypedData is typed structured data, as given to eth_signTypedData:
+//
+//   {
+//     "types":       {"EIP712Domain": [...], "Mail": [...], ...},
+//     "primaryType": "Mail",
+//     "domain":      {"name": "Ether Mail", "version": "1", "chainId": 1, ...},
+//     "message":     {...}
+//   }
+//
+// Values of struct types are JSON objects. Integers are JSON numbers or decimal
+// or 0x prefixed hex strings, addresses and bytes 0x prefixed hex strings.
+type TypedData struct {
+	Types       Types                  `json:"types"`
+	PrimaryType string                 `json:"primaryType"`
+	Domain      map[string]interface{} `json:"domain"`
+	Message     map[string]interface{} `json:"message"`
+}
+
+// UnmarshalJSON decodes the typed data, keeping the numbers exact.
+func (td *TypedData) UnmarshalJSON(input []byte) error {
+	type typedData TypedData
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	return dec.Decode((*typedData)(td))
+}
+
+// Hash returns the hash signed for the typed data, calculated as
+//   keccak256("\x19\x01" ‖ domainSeparator ‖ hashStruct(message)).
+func (td *TypedData) Hash() ([]byte, error) {
+	if err := td.Validate(); err != nil {
+		return nil, err
+	}
+	domainSeparator, err := td.HashStruct(DomainType, td.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("domain: %v", err)
+	}
+	data := append([]byte{0x19, 0x01}, domainSeparator...)
+	if td.PrimaryType != DomainType {
+		message, err := td.HashStruct(td.PrimaryType, td.Message)
+		if err != nil {
+			return nil, fmt.Errorf("message: %v", err)
+		}
+		data = append(data, message...)
+	}
+	return crypto.Keccak256(data), nil
+}
+
+// DomainSeparator returns the hash of the domain.
+func (td *TypedData) DomainSeparator() ([]byte, error) {
+	if err := td.Validate(); err != nil {
+		return nil, err
+	}
+	return td.HashStruct(DomainType, td.Domain)
+}
+
+// Validate checks that the types are well formed and define the domain and
+// primary types.
+func (td *TypedData) Validate() error {
+	if td == nil {
+		return errors.New("no typed data")
+	}
+	if _, ok := td.Types[DomainType]; !ok {
+		return fmt.Errorf("type %s undefined", DomainType)
+	}
+	if _, ok := td.Types[td.PrimaryType]; !ok {
+		return fmt.Errorf("primary type %q undefined", td.PrimaryType)
+	}
+	for name, fields := range td.Types {
+		if !validIdentifier(name) || isAtomic(name) {
+			return fmt.Errorf("invalid type name %q", name)
+		}
+		seen := make(map[string]bool)
+		for _, f := range fields {
+			if !validIdentifier(f.Name) || seen[f.Name] {
+				return fmt.Errorf("type %s: invalid or duplicate field name %q", name, f.Name)
+			}
+			seen[f.Name] = true
+			if !td.validType(f.Type) {
+				return fmt.Errorf("type %s: field %s has invalid type %q", name, f.Name, f.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func (td *TypedData) validType(typ string) bool {
+	if elem, _, ok := arrayType(typ); ok {
+		return td.validType(elem)
+	}
+	_, ok := td.Types[typ]
+	return ok || isAtomic(typ)
+}
+
+// EncodeType returns the encoding of a struct type: its name and members,
+// followed by the struct types it references, sorted by name, eg.
+//   Mail(Person from,Person to,string contents)Person(string name,address wallet)
+func (td *TypedData) EncodeType(primaryType string) string {
+	deps := make(map[string]bool)
+	td.dependencies(primaryType, deps)
+	delete(deps, primaryType)
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range append([]string{primaryType}, names...) {
+		buf.WriteString(name)
+		buf.WriteByte('(')
+		for i, f := range td.Types[name] {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(f.Type)
+			buf.WriteByte(' ')
+			buf.WriteString(f.Name)
+		}
+		buf.WriteByte(')')
+	}
+	return buf.String()
+}
+
+// dependencies adds typ and the struct types it references, recursively, to deps.
+func (td *TypedData) dependencies(typ string, deps map[string]bool) {
+	for {
+		elem, _, ok := arrayType(typ)
+		if !ok {
+			break
+		}
+		typ = elem
+	}
+	if _, ok := td.Types[typ]; !ok || deps[typ] {
+		return
+	}
+	deps[typ] = true
+	for _, f := range td.Types[typ] {
+		td.dependencies(f.Type, deps)
+	}
+}
+
+// TypeHash returns the hash of the encoding of a struct type.
+func (td *TypedData) TypeHash(primaryType string) []byte {
+	return crypto.Keccak256([]byte(td.EncodeType(primaryType)))
+}
+
+// HashStruct returns the hash of a value of a struct type, calculated as
+//   keccak256(typeHash ‖ encodeData(value)).
+func (td *TypedData) HashStruct(primaryType string, data map[string]interface{}) ([]byte, error) {
+	enc, err := td.EncodeData(primaryType, data)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(enc), nil
+}
+
+// EncodeData returns the type hash of a struct type followed by the encoding
+// of the members of a value, 32 bytes each.
+func (td *TypedData) EncodeData(primaryType string, data map[string]interface{}) ([]byte, error) {
+	fields, ok := td.Types[primaryType]
+	if !ok {
+		return nil, fmt.Errorf("type %q undefined", primaryType)
+	}
+	if len(data) > len(fields) {
+		for name := range data {
+			if !hasField(fields, name) {
+				return nil, fmt.Errorf("%s: unknown field %q", primaryType, name)
+			}
+		}
+	}
+	enc := td.TypeHash(primaryType)
+	for _, f := range fields {
+		value, ok := data[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing field %q", primaryType, f.Name)
+		}
+		word, err := td.encodeValue(f.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", primaryType, f.Name, err)
+		}
+		enc = append(enc, word...)
+	}
+	return enc, nil
+}
+
+// encodeValue returns the 32 bytes encoding of a value. Dynamic values, arrays
+// and structs are encoded by their hash.
+func (td *TypedData) encodeValue(typ string, value interface{}) ([]byte, error) {
+	if elem, length, ok := arrayType(typ); ok {
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v is not an array", value)
+		}
+		if length >= 0 && len(items) != length {
+			return nil, fmt.Errorf("array of %d items instead of %d", len(items), length)
+		}
+		var enc []byte
+		for i, item := range items {
+			word, err := td.encodeValue(elem, item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %v", i, err)
+			}
+			enc = append(enc, word...)
+		}
+		return crypto.Keccak256(enc), nil
+	}
+	if _, ok := td.Types[typ]; ok {
+		data, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v is not a %s struct", value, typ)
+		}
+		return td.HashStruct(typ, data)
+	}
+	if !isAtomic(typ) {
+		return nil, fmt.Errorf("invalid type %q", typ)
+	}
+
+	switch {
+	case typ == "bool":
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a bool", value)
+		}
+		if b {
+			return common.LeftPadBytes([]byte{1}, 32), nil
+		}
+		return make([]byte, 32), nil
+
+	case typ == "address":
+		s, ok := value.(string)
+		if !ok || !common.IsHexAddress(s) {
+			return nil, fmt.Errorf("%v is not an address", value)
+		}
+		return common.LeftPadBytes(common.HexToAddress(s).Bytes(), 32), nil
+
+	case typ == "string":
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a string", value)
+		}
+		return crypto.Keccak256([]byte(s)), nil
+
+	case typ == "bytes":
+		b, err := toBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.Keccak256(b), nil
+
+	case strings.HasPrefix(typ, "bytes"):
+		size, _ := strconv.Atoi(typ[len("bytes"):])
+		b, err := toBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > size {
+			return nil, fmt.Errorf("%d bytes don't fit %s", len(b), typ)
+		}
+		return common.RightPadBytes(b, 32), nil
+
+	case strings.HasPrefix(typ, "uint"), strings.HasPrefix(typ, "int"):
+		return encodeInteger(typ, value)
+	}
+	panic("unreachable")
+}
+
+// encodeInteger returns the 32 bytes two's complement encoding of an integer.
+func encodeInteger(typ string, value interface{}) ([]byte, error) {
+	var n *big.Int
+	switch v := value.(type) {
+	case json.Number:
+		n, _ = new(big.Int).SetString(string(v), 10)
+	case string:
+		n, _ = new(big.Int).SetString(v, 0)
+	case float64:
+		if f := new(big.Float).SetFloat64(v); f.IsInt() {
+			n, _ = f.Int(nil)
+		}
+	case *big.Int:
+		n = v
+	}
+	if n == nil {
+		return nil, fmt.Errorf("%v is not an integer", value)
+	}
+	signed := strings.HasPrefix(typ, "int")
+	bits, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(typ, "u"), "int"))
+
+	if signed {
+		limit := new(big.Int).Lsh(common.Big1, uint(bits-1))
+		if n.Cmp(limit) >= 0 || n.Cmp(new(big.Int).Neg(limit)) < 0 {
+			return nil, fmt.Errorf("%v out of range of %s", n, typ)
+		}
+	} else if n.Sign() < 0 || n.BitLen() > bits {
+		return nil, fmt.Errorf("%v out of range of %s", n, typ)
+	}
+	if n.Sign() < 0 {
+		n = new(big.Int).Add(n, new(big.Int).Lsh(common.Big1, 256))
+	}
+	return common.LeftPadBytes(n.Bytes(), 32), nil
+}
+
+func toBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		b, err := hexutil.Decode(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not 0x prefixed hex bytes", v)
+		}
+		return b, nil
+	case []byte:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%v is not bytes", value)
+}
+
+// arrayType splits an array type into the type of its items and its length,
+// -1 for dynamic arrays.
+func arrayType(typ string) (elem string, length int, ok bool) {
+	if !strings.HasSuffix(typ, "]") {
+		return "", 0, false
+	}
+	i := strings.LastIndexByte(typ, '[')
+	if i <= 0 {
+		return "", 0, false
+	}
+	if size := typ[i+1 : len(typ)-1]; size != "" {
+		n, err := strconv.ParseUint(size, 10, 31)
+		if err != nil {
+			return "", 0, false
+		}
+		return typ[:i], int(n), true
+	}
+	return typ[:i], -1, true
+}
+
+// isAtomic reports whether typ is an elementary type.
+func isAtomic(typ string) bool {
+	switch typ {
+	case "bool", "address", "string", "bytes":
+		return true
+	}
+	for _, prefix := range []string{"bytes", "uint", "int"} {
+		if !strings.HasPrefix(typ, prefix) {
+			continue
+		}
+		size, err := strconv.Atoi(typ[len(prefix):])
+		if err != nil || strings.HasPrefix(typ[len(prefix):], "0") {
+			return false
+		}
+		if prefix == "bytes" {
+			return size >= 1 && size <= 32
+		}
+		return size >= 8 && size <= 256 && size%8 == 0
+	}
+	return false
+}
+
+func validIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && c != '$' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !(i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func hasField(fields []Field, name string) bool {
+	for _, f := range fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package typeddata
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+)
+
+// mailJSON is the example typed data of EIP-712.
+const mailJSON = `{
+	"types": {
+		"EIP712Domain": [
+			{"name": "name", "type": "string"},
+			{"name": "version", "type": "string"},
+			{"name": "chainId", "type": "uint256"},
+			{"name": "verifyingContract", "type": "address"}
+		],
+		"Person": [
+			{"name": "name", "type": "string"},
+			{"name": "wallet", "type": "address"}
+		],
+		"Mail": [
+			{"name": "from", "type": "Person"},
+			{"name": "to", "type": "Person"},
+			{"name": "contents", "type": "string"}
+		]
+	},
+	"primaryType": "Mail",
+	"domain": {
+		"name": "Ether Mail",
+		"version": "1",
+		"chainId": 1,
+		"verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	},
+	"message": {
+		"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+		"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+		"contents": "Hello, Bob!"
+	}
+}`
+
+// testMail decodes the example typed data of EIP-712.
+func testMail(t *testing.T) *TypedData {
+	td := new(TypedData)
+	if err := json.Unmarshal([]byte(mailJSON), td); err != nil {
+		t.Fatalf("failed to decode typed data: %v", err)
+	}
+	return td
+}
+
+// Tests that the example typed data of EIP-712 is encoded and hashed as in
+// the specification.
+func TestMailVector(t *testing.T) {
+	td := testMail(t)
+
+	if enc := td.EncodeType("Mail"); enc != "Mail(Person from,Person to,string contents)Person(string name,address wallet)" {
+		t.Errorf("type encoding mismatch: have %s", enc)
+	}
+	if hash := common.Bytes2Hex(td.TypeHash("Mail")); hash != "a0cedeb2dc280ba39b857546d74f5549c3a1d7bdc2dd96bf881f76108e23dac2" {
+		t.Errorf("type hash mismatch: have %s", hash)
+	}
+	separator, err := td.DomainSeparator()
+	if err != nil {
+		t.Fatalf("failed to hash domain: %v", err)
+	}
+	if hash := common.Bytes2Hex(separator); hash != "f2cee375fa42b42143804025fc449deafd50cc031ca257e0b194a650a912090f" {
+		t.Errorf("domain separator mismatch: have %s", hash)
+	}
+	message, err := td.HashStruct(td.PrimaryType, td.Message)
+	if err != nil {
+		t.Fatalf("failed to hash message: %v", err)
+	}
+	if hash := common.Bytes2Hex(message); hash != "c52c0ee5d84264471806290a3f2c4cecfc5490626bf912d01f240d7a274b371e" {
+		t.Errorf("message hash mismatch: have %s", hash)
+	}
+	digest, err := td.Hash()
+	if err != nil {
+		t.Fatalf("failed to hash typed data: %v", err)
+	}
+	if hash := common.Bytes2Hex(digest); hash != "be609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2" {
+		t.Errorf("digest mismatch: have %s", hash)
+	}
+}
+
+// Tests that malformed types and values not matching their types are
+// rejected.
+func TestInvalidTypedData(t *testing.T) {
+	tests := []struct {
+		old, new string
+		err      string
+	}{
+		{`"primaryType": "Mail"`, `"primaryType": "Letter"`, "primary type"},
+		{`"EIP712Domain": [`, `"Domain": [`, "EIP712Domain undefined"},
+		{`{"name": "wallet", "type": "address"}`, `{"name": "wallet", "type": "Wallet"}`, "invalid type"},
+		{`{"name": "wallet", "type": "address"}`, `{"name": "name", "type": "address"}`, "duplicate field"},
+		{`"contents": "Hello, Bob!"`, `"content": "Hello, Bob!"`, "field"},
+		{`"chainId": 1,`, `"chainId": "one",`, "chainId"},
+		{`"0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"`, `"0xbBbB"`, "wallet"},
+	}
+	for i, tt := range tests {
+		if !strings.Contains(mailJSON, tt.old) {
+			t.Fatalf("test %d: %s not found", i, tt.old)
+		}
+		td := new(TypedData)
+		if err := json.Unmarshal([]byte(strings.Replace(mailJSON, tt.old, tt.new, 1)), td); err != nil {
+			t.Fatalf("test %d: failed to decode typed data: %v", i, err)
+		}
+		if _, err := td.Hash(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %q", i, err, tt.err)
+		}
+	}
+}
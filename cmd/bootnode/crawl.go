@@ -0,0 +1,339 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/p2p"
+	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/p2p/distip"
+)
+
+// Message codes and capabilities of the ngin protocol used by the crawler.
+// They mirror the unexported wire definitions in package ngin.
+const (
+	nginStatusMsg          = 0x00
+	nginGetBlockHeadersMsg = 0x03
+	nginBlockHeadersMsg    = 0x04
+)
+
+var crawlCaps = []p2p.Cap{{Name: "ngin", Version: 63}, {Name: "ngin", Version: 62}}
+
+// errNoStatus is recorded for nodes which complete the RLPx handshake but
+// don't speak the ngin protocol.
+var errNoStatus = errors.New("no ngin status received")
+
+// crawlStatus is the ngin status message, see ngin.statusData.
+type crawlStatus struct {
+	ProtocolVersion uint32
+	NetworkId       uint32
+	TD              *big.Int
+	CurrentBlock    common.Hash
+	GenesisBlock    common.Hash
+}
+
+// crawlHeadersQuery is the ngin GetBlockHeaders message querying by hash,
+// see ngin.getBlockHeadersData.
+type crawlHeadersQuery struct {
+	Origin  common.Hash
+	Amount  uint64
+	Skip    uint64
+	Reverse bool
+}
+
+// crawledNode is the information recorded for a single node.
+type crawledNode struct {
+	URL       string    `json:"url"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen,omitempty"`  // last successful status handshake
+	LastCheck time.Time `json:"lastCheck,omitempty"` // last handshake attempt
+	Error     string    `json:"error,omitempty"`     // error of the last attempt, if any
+
+	Name       string      `json:"name,omitempty"`
+	Protocols  []string    `json:"protocols,omitempty"`
+	Version    uint32      `json:"version,omitempty"`
+	NetworkId  uint32      `json:"networkId,omitempty"`
+	TD         *big.Int    `json:"td,omitempty"`
+	Head       common.Hash `json:"head,omitempty"`
+	HeadNumber uint64      `json:"headNumber,omitempty"`
+	Genesis    common.Hash `json:"genesis,omitempty"`
+}
+
+// nodeSet is the JSON node set written by the crawler, keyed by hex node ID.
+type nodeSet map[string]*crawledNode
+
+func loadNodeSet(file string) (nodeSet, error) {
+	ns := make(nodeSet)
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ns, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &ns); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return ns, nil
+}
+
+func writeNodeSet(file string, ns nodeSet) error {
+	b, err := json.MarshalIndent(ns, "", "  ")
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err = os.Stdout.Write(append(b, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// staticNodes returns the URLs of the nodes which were reachable within the
+// given age and, if network is non-zero, belong to that network. The format
+// matches static-nodes.json.
+func (ns nodeSet) staticNodes(network uint32, maxAge time.Duration) []string {
+	var urls []string
+	for _, n := range ns {
+		if n.LastSeen.IsZero() || time.Since(n.LastSeen) > maxAge {
+			continue
+		}
+		if network != 0 && n.NetworkId != network {
+			continue
+		}
+		urls = append(urls, n.URL)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// crawler walks the discovery table and handshakes with every node found.
+type crawler struct {
+	key     *ecdsa.PrivateKey
+	tab     *discover.Table
+	timeout time.Duration
+
+	mu    sync.Mutex
+	nodes nodeSet
+	seen  map[discover.NodeID]bool // nodes checked during this run
+}
+
+func (c *crawler) run(duration time.Duration, workers int) {
+	var (
+		deadline = time.Now().Add(duration)
+		queue    = make(chan *discover.Node, workers)
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range queue {
+				c.check(n)
+			}
+		}()
+	}
+	buf := make([]*discover.Node, 64)
+	for time.Now().Before(deadline) {
+		var target discover.NodeID
+		rand.Read(target[:])
+		found := c.tab.Lookup(target)
+		found = append(found, buf[:c.tab.ReadRandomNodes(buf)]...)
+
+		for _, n := range found {
+			c.mu.Lock()
+			fresh := !c.seen[n.ID]
+			c.seen[n.ID] = true
+			c.mu.Unlock()
+			if fresh && time.Now().Before(deadline) {
+				queue <- n
+			}
+		}
+		glog.V(logger.Info).Infof("crawl: %d nodes checked, %s left", len(c.seen), deadline.Sub(time.Now()).Truncate(time.Second))
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// check handshakes with a single node and records the result.
+func (c *crawler) check(n *discover.Node) {
+	now := time.Now()
+
+	c.mu.Lock()
+	rec := c.nodes[n.ID.String()]
+	if rec == nil {
+		rec = &crawledNode{FirstSeen: now}
+		c.nodes[n.ID.String()] = rec
+	}
+	rec.URL = n.String()
+	c.mu.Unlock()
+
+	info, err := c.handshake(n)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec.LastCheck = now
+	rec.Error = ""
+	if info != nil {
+		rec.Name, rec.Protocols = info.Name, info.Protocols
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		glog.V(logger.Debug).Infof("crawl: %v: %v", n, err)
+		return
+	}
+	rec.LastSeen = now
+	rec.Version, rec.NetworkId, rec.TD = info.Version, info.NetworkId, info.TD
+	rec.Head, rec.HeadNumber, rec.Genesis = info.Head, info.HeadNumber, info.Genesis
+	glog.V(logger.Detail).Infof("crawl: %v: %s ngin/%d network=%d head=#%d", n, rec.Name, rec.Version, rec.NetworkId, rec.HeadNumber)
+}
+
+// handshake runs the RLPx and ngin status handshakes with the given node.
+// The returned info is non-nil if the RLPx handshake succeeded, even if the
+// status exchange failed afterwards.
+func (c *crawler) handshake(n *discover.Node) (*crawledNode, error) {
+	conn, err := p2p.Dial(c.key, n, "ngind-crawler", crawlCaps, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(p2p.DiscQuitting)
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	info := &crawledNode{Name: conn.Name}
+	for _, cap := range conn.Caps {
+		info.Protocols = append(info.Protocols, cap.String())
+	}
+	msg, err := conn.ReadProtocolMsg()
+	if err != nil {
+		return info, err
+	}
+	if msg.Code != nginStatusMsg {
+		msg.Discard()
+		return info, errNoStatus
+	}
+	var status crawlStatus
+	if err := msg.Decode(&status); err != nil {
+		return info, fmt.Errorf("invalid status: %v", err)
+	}
+	info.Version, info.NetworkId, info.TD = status.ProtocolVersion, status.NetworkId, status.TD
+	info.Head, info.Genesis = status.CurrentBlock, status.GenesisBlock
+
+	// Echo the remote status back so the node doesn't drop us for a genesis
+	// or network mismatch, then ask for the head header to learn its number.
+	if err := conn.WriteProtocolMsg(nginStatusMsg, &status); err != nil {
+		return info, err
+	}
+	if err := conn.WriteProtocolMsg(nginGetBlockHeadersMsg, &crawlHeadersQuery{Origin: status.CurrentBlock, Amount: 1}); err != nil {
+		return info, err
+	}
+	for {
+		msg, err := conn.ReadProtocolMsg()
+		if err != nil {
+			// Status is known, the head number is optional.
+			return info, nil
+		}
+		if msg.Code != nginBlockHeadersMsg {
+			msg.Discard()
+			continue
+		}
+		var headers []*types.Header
+		if err := msg.Decode(&headers); err == nil && len(headers) > 0 && headers[0].Hash() == status.CurrentBlock {
+			info.HeadNumber = headers[0].Number.Uint64()
+		}
+		return info, nil
+	}
+}
+
+// crawl implements the crawl subcommand.
+func crawl(args []string, nodeKey *ecdsa.PrivateKey, netrestrict *distip.Netlist) {
+	var (
+		fs         = flag.NewFlagSet("crawl", flag.ExitOnError)
+		bootnodes  = fs.String("bootnodes", "", "comma separated enode URLs to start from (default: mainnet bootnodes)")
+		addr       = fs.String("addr", ":0", "UDP listen address for discovery")
+		output     = fs.String("out", "nodes.json", "node set file, updated in place ('-' for stdout)")
+		static     = fs.String("static", "", "also write reachable nodes as a static-nodes.json list to this file")
+		network    = fs.Uint("networkid", 0, "only include nodes of this network in the -static list (0 = any)")
+		duration   = fs.Duration("duration", 5*time.Minute, "how long to crawl")
+		timeout    = fs.Duration("timeout", 10*time.Second, "dial and handshake timeout per node")
+		workers    = fs.Int("workers", 16, "number of concurrent handshakes")
+		staticDays = fs.Int("static-age", 1, "max days since last successful handshake for -static nodes")
+	)
+	fs.Parse(args)
+
+	if nodeKey == nil {
+		var err error
+		if nodeKey, err = crypto.GenerateKey(); err != nil {
+			log.Fatalf("could not generate key: %v", err)
+		}
+	}
+	var boot []*discover.Node
+	if *bootnodes != "" {
+		boot = core.ParseBootstrapNodeStrings(strings.Split(*bootnodes, ","))
+	} else {
+		boot = core.DefaultConfigMainnet.ParsedBootstrap
+	}
+	if len(boot) == 0 {
+		log.Fatal("crawl: no bootnodes")
+	}
+
+	nodes := make(nodeSet)
+	if *output != "-" {
+		var err error
+		if nodes, err = loadNodeSet(*output); err != nil {
+			log.Fatalf("crawl: %v", err)
+		}
+	}
+	tab, err := discover.ListenUDP(nodeKey, *addr, nil, "", netrestrict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tab.SetFallbackNodes(boot); err != nil {
+		log.Fatal(err)
+	}
+	c := &crawler{key: nodeKey, tab: tab, timeout: *timeout, nodes: nodes, seen: make(map[discover.NodeID]bool)}
+	c.run(*duration, *workers)
+	tab.Close()
+
+	if err := writeNodeSet(*output, nodes); err != nil {
+		log.Fatalf("crawl: %v", err)
+	}
+	if *static != "" {
+		b, _ := json.MarshalIndent(nodes.staticNodes(uint32(*network), time.Duration(*staticDays)*24*time.Hour), "", "  ")
+		if err := ioutil.WriteFile(*static, b, 0644); err != nil {
+			log.Fatalf("crawl: %v", err)
+		}
+	}
+}
@@ -16,6 +16,10 @@
 // along with Ngin. If not, see <http://www.gnu.org/licenses/>.
 
 // bootnode runs a bootstrap node for the Ethereum Discovery Protocol.
+//
+// Run as 'bootnode crawl [flags]' it instead walks the discovery table,
+// handshakes with every node found and writes the results to a JSON node set.
+// Use 'bootnode crawl -h' to list the crawler flags.
 package main
 
 import (
@@ -28,6 +32,7 @@ import (
 	"github.com/NginProject/ngind/crypto"
 	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/p2p/distip"
 	"github.com/NginProject/ngind/p2p/nat"
 )
 
@@ -41,6 +46,7 @@ var (
 	nodeKeyFile = flag.String("nodekey", "", "private key filename")
 	nodeKeyHex  = flag.String("nodekeyhex", "", "private key as hex (for testing)")
 	natdesc     = flag.String("nat", "none", "port mapping mechanism (any|none|upnp|pmp|extip:<IP>)")
+	netrestrict = flag.String("netrestrict", "", "restrict network communication to the given IP networks (CIDR masks)")
 	versionFlag = flag.Bool("version", false, "Prints the revision identifier and exit immediatily.")
 )
 
@@ -62,31 +68,11 @@ func onlyDoGenKey() {
 	os.Exit(0)
 }
 
-func main() {
-	flag.Var(glog.GetVerbosity(), "verbosity", "log verbosity (0-9)")
-	flag.Var(glog.GetVModule(), "vmodule", "log verbosity pattern")
-	glog.SetToStderr(true)
-	flag.Parse()
-
-	if *versionFlag {
-		fmt.Println("bootnode version", Version)
-		os.Exit(0)
-	}
-
-	if *genKey != "" {
-		// exits 0 if successful
-		onlyDoGenKey()
-	}
-
-	natm, err := nat.Parse(*natdesc)
-	if err != nil {
-		log.Fatalf("nat: %s", err)
-	}
-
+// loadNodeKey reads the key given by -nodekey or -nodekeyhex.
+// It returns nil if neither is set.
+func loadNodeKey() *ecdsa.PrivateKey {
 	var nodeKey *ecdsa.PrivateKey
 	switch {
-	case *nodeKeyFile == "" && *nodeKeyHex == "":
-		log.Fatal("Use -nodekey or -nodekeyhex to specify a private key")
 	case *nodeKeyFile != "" && *nodeKeyHex != "":
 		log.Fatal("Options -nodekey and -nodekeyhex are mutually exclusive")
 	case *nodeKeyFile != "":
@@ -108,8 +94,49 @@ func main() {
 			log.Fatalf("nodekeyhex: %s", err)
 		}
 	}
+	return nodeKey
+}
+
+func main() {
+	flag.Var(glog.GetVerbosity(), "verbosity", "log verbosity (0-9)")
+	flag.Var(glog.GetVModule(), "vmodule", "log verbosity pattern")
+	glog.SetToStderr(true)
+	flag.Parse()
+
+	if *versionFlag {
+		fmt.Println("bootnode version", Version)
+		os.Exit(0)
+	}
+
+	if *genKey != "" {
+		// exits 0 if successful
+		onlyDoGenKey()
+	}
+
+	var restrictList *distip.Netlist
+	if *netrestrict != "" {
+		var err error
+		if restrictList, err = distip.ParseNetlist(*netrestrict); err != nil {
+			log.Fatalf("-netrestrict: %v", err)
+		}
+	}
+
+	if flag.Arg(0) == "crawl" {
+		crawl(flag.Args()[1:], loadNodeKey(), restrictList)
+		os.Exit(0)
+	}
+
+	natm, err := nat.Parse(*natdesc)
+	if err != nil {
+		log.Fatalf("nat: %s", err)
+	}
+
+	nodeKey := loadNodeKey()
+	if nodeKey == nil {
+		log.Fatal("Use -nodekey or -nodekeyhex to specify a private key")
+	}
 
-	if _, err := discover.ListenUDP(nodeKey, *listenAddr, natm, ""); err != nil {
+	if _, err := discover.ListenUDP(nodeKey, *listenAddr, natm, "", restrictList); err != nil {
 		log.Fatal(err)
 	}
 	select {}
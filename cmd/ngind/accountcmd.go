@@ -62,7 +62,7 @@ ngind wallet import /path/to/my.wallet
 		Description: `
 
 	Manage accounts lets you create new accounts, list all existing accounts,
-	import a private key into a new account.
+	import a private key into a new account, and manage mnemonic based HD wallets.
 
 	'$ ngind account <command> --help' shows help for any subcommand.
 
@@ -192,6 +192,7 @@ ngind account index
 	It non-recursively indexes all valid key files from keystore/*
 		`,
 			},
+			hdWalletCommand,
 		},
 	}
 )
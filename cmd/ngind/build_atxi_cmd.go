@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"math"
 
 	"github.com/NginProject/ngind/core"
 	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/logger"
 	"github.com/NginProject/ngind/logger/glog"
 	"gopkg.in/urfave/cli.v1"
 )
@@ -20,6 +22,8 @@ var buildAddrTxIndexCommand = cli.Command{
 	run the command on multiple occasions and pick up indexing progress where the last session
 	left off.
 	To enable address-transaction indexing during block sync and import, use the '--atxi' flag.
+	With the '--atxi.tokens' flag, ERC-20 and ERC-721 token transfers are indexed as well,
+	sharing the placeholder of the transactions.
 			`,
 	Flags: []cli.Flag{
 		cli.IntFlag{
@@ -38,6 +42,56 @@ var buildAddrTxIndexCommand = cli.Command{
 	},
 }
 
+var migrateAddrTxIndexCommand = cli.Command{
+	Action: migrateAddrTxIndexCmd,
+	Name:   "atxi-migrate",
+	Usage:  "Convert the index for transactions by address to the current layout",
+	Description: `
+	Converts an index for transactions by address built by an older version to the
+	current layout, which lists the transactions of an address in chain order and
+	supports cursor based pagination. The node refuses to use an outdated index.
+	The transaction positions are looked up in the chain, entries of transactions
+	missing from the canonical chain are dropped.
+	The command can be interrupted and run again, it resumes the migration where
+	the last session left off.
+			`,
+}
+
+var addrTxIndexCommand = cli.Command{
+	Name:  "atxi",
+	Usage: "Manage the index for transactions by address",
+	Subcommands: []cli.Command{
+		{
+			Action: verifyAddrTxIndexCmd,
+			Name:   "verify",
+			Usage:  "Check the index for transactions by address against the canonical chain",
+			Description: `
+	Checks that the canonical blocks are indexed, with the transactions of each,
+	and that no entries are left of blocks which are not or no longer canonical,
+	as after a crash during a reorg. All the entries of the range are scanned,
+	including the ones written by older versions, which didn't record the hash
+	of their block.
+	With --repair, divergent blocks are reindexed and stale entries removed.
+	The node itself only checks the most recent blocks at startup.
+			`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "start",
+					Usage: "Block number at which to begin verifying index",
+				},
+				cli.IntFlag{
+					Name:  "stop",
+					Usage: "Block number at which to stop verifying index, 0 meaning the head block",
+				},
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Fix the divergences found",
+				},
+			},
+		},
+	},
+}
+
 func buildAddrTxIndexCmd(ctx *cli.Context) error {
 	// Divide global cache availability equally between chaindata (pre-existing blockdata) and
 	// address-transaction database. This ratio is arbitrary and could potentially be optimized or delegated to be user configurable.
@@ -65,6 +119,68 @@ func buildAddrTxIndexCmd(ctx *cli.Context) error {
 	}
 	defer chainDB.Close()
 
-	bc.SetAtxi(&core.AtxiT{Db: indexDB, AutoMode: false, Progress: &core.AtxiProgressT{}})
+	bc.SetAtxi(&core.AtxiT{
+		Db:             indexDB,
+		AutoMode:       false,
+		Progress:       &core.AtxiProgressT{},
+		TokenTransfers: ctx.GlobalBool(aliasableName(AddrTxIndexTokensFlag.Name, ctx)),
+		InternalTxs:    ctx.GlobalBool(aliasableName(AddrTxIndexInternalFlag.Name, ctx)),
+	})
 	return core.BuildAddrTxIndex(bc, chainDB, indexDB, startIndex, stopIndex, step)
 }
+
+func migrateAddrTxIndexCmd(ctx *cli.Context) error {
+	ngindb.SetCacheRatio("chaindata", 0.5)
+	ngindb.SetHandleRatio("chaindata", 1)
+	ngindb.SetCacheRatio("indexes", 0.5)
+	ngindb.SetHandleRatio("indexes", 1)
+
+	indexDB := MakeIndexDatabase(ctx)
+	if indexDB == nil {
+		glog.Fatalln("can't open index database")
+	}
+	defer indexDB.Close()
+
+	chainDB := MakeChainDatabase(ctx)
+	if chainDB == nil {
+		glog.Fatalln("can't open chain database")
+	}
+	defer chainDB.Close()
+
+	return core.MigrateAddrTxIndex(chainDB, indexDB)
+}
+
+func verifyAddrTxIndexCmd(ctx *cli.Context) error {
+	ngindb.SetCacheRatio("chaindata", 0.5)
+	ngindb.SetHandleRatio("chaindata", 1)
+	ngindb.SetCacheRatio("indexes", 0.5)
+	ngindb.SetHandleRatio("indexes", 1)
+
+	indexDB := MakeIndexDatabase(ctx)
+	if indexDB == nil {
+		glog.Fatalln("can't open index database")
+	}
+	defer indexDB.Close()
+
+	bc, chainDB := MakeChain(ctx)
+	if bc == nil || chainDB == nil {
+		glog.Fatalln("can't open chain database")
+	}
+	defer chainDB.Close()
+
+	if err := core.CheckAddrTxIndexVersion(indexDB); err != nil {
+		return err
+	}
+	repair := ctx.Bool("repair")
+	res, err := core.VerifyAddrTxIndex(bc, indexDB, uint64(ctx.Int("start")), uint64(ctx.Int("stop")), true, repair)
+	if err != nil {
+		return err
+	}
+	glog.D(logger.Error).Infof("Verified %d blocks: %d missing, %d orphaned, %d stale entries", res.Blocks, res.Missing, res.Orphaned, res.Stale)
+	if repair {
+		glog.D(logger.Error).Infof("Repaired %d blocks and entries", res.Repaired)
+	} else if res.Diverged() {
+		return errors.New("index diverges from the chain, run with --repair to fix it")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var buildBalanceHistoryCommand = cli.Command{
+	Action: buildBalanceHistoryCmd,
+	Name:   "balance-history-build",
+	Usage:  "Generate index of account balances by block",
+	Description: `
+	Builds an index of the balances of the accounts, recording the balance of every
+	account changed by a block as of after that block. Block 0 records the genesis
+	allocations.
+	The blocks are re-executed on top of the historical states, which must be held on
+	disk or be regenerable from the nearest older ones (see --state.regenlimit).
+	The command is idempotent; it will not hurt to run multiple times on the same range.
+	If run without --start flag, the command makes use of a persistent placeholder, so you can
+	run the command on multiple occasions and pick up indexing progress where the last session
+	left off.
+	To enable balance indexing during block sync and import, use the '--balance-history' flag.
+			`,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "start",
+			Usage: "Block number at which to begin building index",
+		},
+		cli.IntFlag{
+			Name:  "stop",
+			Usage: "Block number at which to stop building index",
+		},
+		cli.IntFlag{
+			Name:  "step",
+			Usage: "Number of blocks between progress reports and placeholder updates",
+			Value: 10000,
+		},
+	},
+}
+
+func buildBalanceHistoryCmd(ctx *cli.Context) error {
+	ngindb.SetCacheRatio("chaindata", 0.5)
+	ngindb.SetHandleRatio("chaindata", 1)
+	ngindb.SetCacheRatio("indexes", 0.5)
+	ngindb.SetHandleRatio("indexes", 1)
+
+	var startIndex uint64 = math.MaxUint64
+	if ctx.IsSet("start") {
+		startIndex = uint64(ctx.Int("start"))
+	}
+	stopIndex := uint64(ctx.Int("stop"))
+	step := uint64(ctx.Int("step"))
+
+	indexDB := MakeIndexDatabase(ctx)
+	if indexDB == nil {
+		glog.Fatalln("can't open index database")
+	}
+	defer indexDB.Close()
+
+	bc, chainDB := MakeChain(ctx)
+	if bc == nil || chainDB == nil {
+		glog.Fatalln("can't open chain database")
+	}
+	defer chainDB.Close()
+
+	return core.BuildBalanceHistory(bc, indexDB, startIndex, stopIndex, step)
+}
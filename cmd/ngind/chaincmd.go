@@ -29,7 +29,6 @@ import (
 
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/core"
-	"github.com/NginProject/ngind/core/state"
 	"github.com/NginProject/ngind/core/types"
 	"github.com/NginProject/ngind/logger/glog"
 	"gopkg.in/urfave/cli.v1"
@@ -40,6 +39,14 @@ var (
 		Action: importChain,
 		Name:   "import",
 		Usage:  `Import a blockchain file`,
+		Description: `
+	Imports the blocks of an RLP file written by the export command. Blocks are
+	decoded, their senders recovered and their proof of work verified ahead of
+	execution, using all available cores.
+
+	The position of the last imported block is saved to <DATADIR>/<CHAINDIR>/import.checkpoint,
+	importing the same file again after an interruption resumes from it.
+		`,
 	}
 	exportCommand = cli.Command{
 		Action: exportChain,
@@ -123,9 +130,15 @@ func importChain(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
 		log.Fatal("This command requires an argument.")
 	}
-	chain, chainDb := MakeChain(ctx)
+	if ctx.GlobalString(MLogFlag.Name) != "off" {
+		mustRegisterMLogsFromContext(ctx)
+	}
+	seals := newImportPoW(MakePoW(ctx))
+	chain, chainDb := MakeChainWithPoW(ctx, seals)
 	start := time.Now()
-	err := ImportChain(chain, ctx.Args().First())
+	checkpoint := filepath.Join(MustMakeChainDataDir(ctx), importCheckpointFile)
+	err := ImportChain(chain, seals, ctx.Args().First(), checkpoint)
+	chain.Stop()
 	chainDb.Close()
 	if err != nil {
 		log.Fatal("Import error: ", err)
@@ -182,11 +195,15 @@ func upgradeDB(ctx *cli.Context) error {
 	}
 	chainDb.Close()
 	os.RemoveAll(filepath.Join(ctx.GlobalString(DataDirFlag.Name), "chaindata"))
+	if dir := MakeAncientDir(ctx); dir != "" {
+		os.RemoveAll(dir)
+	}
 
 	// Import the chain file.
-	chain, chainDb = MakeChain(ctx)
+	seals := newImportPoW(MakePoW(ctx))
+	chain, chainDb = MakeChainWithPoW(ctx, seals)
 	core.WriteBlockChainVersion(chainDb, core.BlockChainVersion)
-	err := ImportChain(chain, exportFile)
+	err := ImportChain(chain, seals, exportFile, "")
 	chainDb.Close()
 	if err != nil {
 		log.Fatalf("Import error %v (a backup is made in %s, use the import command to import it)", err, exportFile)
@@ -261,7 +278,7 @@ func dump(ctx *cli.Context) error {
 			out.WriteString("{}\n")
 			log.Fatal("block not found")
 		} else {
-			state, err := state.New(block.Root(), state.NewDatabase(chainDb))
+			state, err := chain.StateAtBlock(block)
 			if err != nil {
 				return fmt.Errorf("could not create new state: %v", err)
 			}
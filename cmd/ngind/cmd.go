@@ -44,7 +44,6 @@ import (
 	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/node"
 	"github.com/NginProject/ngind/pow"
-	"github.com/NginProject/ngind/rlp"
 
 	"gopkg.in/urfave/cli.v1"
 )
@@ -169,91 +168,6 @@ func StartNode(stack *node.Node) {
 	}()
 }
 
-// Chain imports a blockchain.
-func ImportChain(chain *core.BlockChain, fn string) error {
-	// Watch for Ctrl-C while the import is running.
-	// If a signal is received, the import will stop at the next batch.
-	interrupt := make(chan os.Signal, 1)
-	stop := make(chan struct{})
-	signal.Notify(interrupt, os.Interrupt)
-	defer signal.Stop(interrupt)
-	defer close(interrupt)
-	go func() {
-		if _, ok := <-interrupt; ok {
-			glog.D(logger.Warn).Warnln("caught interrupt during import, will stop at next batch")
-		}
-		close(stop)
-	}()
-	checkInterrupt := func() bool {
-		select {
-		case <-stop:
-			return true
-		default:
-			return false
-		}
-	}
-
-	glog.D(logger.Error).Infoln("Importing blockchain ", fn)
-	fh, err := os.Open(fn)
-	if err != nil {
-		return err
-	}
-	defer fh.Close()
-	stream := rlp.NewStream(fh, 0)
-
-	// Run actual the import.
-	blocks := make(types.Blocks, importBatchSize)
-	n := 0
-	for batch := 0; ; batch++ {
-		// Load a batch of RLP blocks.
-		if checkInterrupt() {
-			return fmt.Errorf("interrupted")
-		}
-		i := 0
-		for ; i < importBatchSize; i++ {
-			var b types.Block
-			if err := stream.Decode(&b); err == io.EOF {
-				break
-			} else if err != nil {
-				return fmt.Errorf("at block %d: %v", n, err)
-			}
-			// don't import first block
-			if b.NumberU64() == 0 {
-				i--
-				continue
-			}
-			blocks[i] = &b
-			n++
-		}
-		if i == 0 {
-			break
-		}
-		// Import the batch.
-		if checkInterrupt() {
-			return fmt.Errorf("interrupted")
-		}
-		if hasAllBlocks(chain, blocks[:i]) {
-			glog.D(logger.Warn).Warnf("skipping batch %d, all blocks present [%x / %x]",
-				batch, blocks[0].Hash().Bytes()[:4], blocks[i-1].Hash().Bytes()[:4])
-			continue
-		}
-
-		if res := chain.InsertChain(blocks[:i]); res.Error != nil {
-			return fmt.Errorf("invalid block %d: %v", n, res.Error)
-		}
-	}
-	return nil
-}
-
-func hasAllBlocks(chain *core.BlockChain, bs []*types.Block) bool {
-	for _, b := range bs {
-		if !chain.HasBlock(b.Hash()) {
-			return false
-		}
-	}
-	return true
-}
-
 func ExportChain(blockchain *core.BlockChain, fn string) error {
 	glog.D(logger.Warn).Infoln("Exporting blockchain to", fn, "(this may take a while)...")
 	fh, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
@@ -707,11 +621,15 @@ func dumpChainConfig(ctx *cli.Context) error {
 
 // startNode boots up the system node and all registered protocols, after which
 // it unlocks any requested accounts, and starts the RPC/IPC interfaces and the
-// miner.
+// miner. A light client has no full ngin service, nil is returned for it.
 func startNode(ctx *cli.Context, stack *node.Node) *ngin.Ngin {
 	// Start up the node itself
 	StartNode(stack)
 
+	if ctx.GlobalBool(aliasableName(LightModeFlag.Name, ctx)) {
+		return nil
+	}
+
 	// Unlock any account specifically requested
 	var ng *ngin.Ngin
 	if err := stack.Service(&ng); err != nil {
@@ -928,6 +846,12 @@ func resetChaindata(ctx *cli.Context) error {
 			return err
 		}
 		glog.D(logger.Error).Infof("Successfully removed chaindata directory: '%s'\n", dir)
+		if ancient := MakeAncientDir(ctx); ancient != "" {
+			if err := os.RemoveAll(ancient); err != nil {
+				return err
+			}
+			glog.D(logger.Error).Infof("Successfully removed ancient directory: '%s'\n", ancient)
+		}
 	} else {
 		glog.D(logger.Error).Infoln("Leaving chaindata untouched. As you were.")
 	}
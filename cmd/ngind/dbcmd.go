@@ -0,0 +1,237 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// dbLogInterval is the time between progress reports of the db commands.
+const dbLogInterval = 8 * time.Second
+
+var dbIndexesFlag = cli.BoolFlag{
+	Name:  "indexes",
+	Usage: "Operate on the index database instead of the chain database",
+}
+
+var dbCommand = cli.Command{
+	Name:  "db",
+	Usage: "Low level database operations",
+	Description: `
+	Inspect and maintain the chain database, or with --indexes the index database.
+	The node must not be running.
+	`,
+	Subcommands: []cli.Command{
+		{
+			Action: inspectDatabase,
+			Name:   "inspect",
+			Usage:  "Report the number and size of the entries of each kind",
+			Description: `
+	Walks the whole database and groups the entries by the kind of data they hold,
+	as told by their key prefix. Trie nodes, contract code and transactions are all
+	keyed by a bare hash and are reported together. The ancient store holding the
+	old blocks is reported separately.
+			`,
+			Flags: []cli.Flag{dbIndexesFlag},
+		},
+		{
+			Action: compactDatabase,
+			Name:   "compact",
+			Usage:  "Compact the whole database",
+			Description: `
+	Compacts the database range by range, reclaiming the space of deleted and
+	overwritten entries. Badger compacts the whole database at once, bolt
+	databases can't be compacted and only reuse the space for later writes.
+			`,
+			Flags: []cli.Flag{dbIndexesFlag},
+		},
+		{
+			Action:    getDatabaseKey,
+			Name:      "get",
+			Usage:     "Print the value stored under a raw key",
+			ArgsUsage: "<0x-prefixed hex key>",
+			Flags:     []cli.Flag{dbIndexesFlag},
+		},
+		{
+			Action:    deleteDatabaseKey,
+			Name:      "delete",
+			Usage:     "Delete the value stored under a raw key",
+			ArgsUsage: "<0x-prefixed hex key>",
+			Description: `
+	Deletes a single raw key. This is meant for repairing corrupted databases and
+	can easily make things worse, back up the data directory first.
+			`,
+			Flags: []cli.Flag{dbIndexesFlag},
+		},
+	},
+}
+
+// openDatabase opens the database the db commands operate on.
+func openDatabase(ctx *cli.Context) ngindb.Database {
+	if ctx.Bool(dbIndexesFlag.Name) {
+		return MakeIndexDatabase(ctx)
+	}
+	return MakeChainDatabase(ctx)
+}
+
+// databaseKeyArg parses the hex encoded key given as the command argument.
+func databaseKeyArg(ctx *cli.Context) []byte {
+	if len(ctx.Args()) != 1 {
+		glog.Fatal("A single 0x-prefixed hex key must be given as argument")
+	}
+	arg := ctx.Args().First()
+	if !common.IsHex(arg) {
+		glog.Fatalf("Invalid hex key %q", arg)
+	}
+	return common.FromHex(arg)
+}
+
+func inspectDatabase(ctx *cli.Context) error {
+	db := openDatabase(ctx)
+	defer db.Close()
+
+	var (
+		start  = time.Now()
+		logged = time.Now()
+		counts = make(map[string]int)
+		sizes  = make(map[string]common.StorageSize)
+		total  int
+	)
+	it := db.NewIterator()
+	for it.Next() {
+		key := it.Key()
+		category := core.DatabaseKeyCategory(key)
+		counts[category]++
+		sizes[category] += common.StorageSize(len(key) + len(it.Value()))
+		total++
+
+		if time.Since(logged) > dbLogInterval {
+			glog.V(logger.Info).Infof("Inspecting database: %d entries, elapsed %v", total, time.Since(start))
+			logged = time.Now()
+		}
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		glog.Fatalf("Database iteration failed: %v", err)
+	}
+	glog.V(logger.Info).Infof("Inspected %d entries in %v", total, time.Since(start))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CATEGORY\tITEMS\tSIZE")
+
+	var size common.StorageSize
+	for _, category := range core.KeyCategories {
+		if counts[category] == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%v\n", category, counts[category], sizes[category])
+		size += sizes[category]
+	}
+	fmt.Fprintf(w, "Total\t%d\t%v\n", total, size)
+
+	if store, ok := db.(ngindb.AncientStore); ok {
+		fmt.Fprintf(w, "Ancient store\t%d blocks\t%v\n", store.Ancients(), dirSize(MustMakeAncientDir(ctx)))
+	}
+	return w.Flush()
+}
+
+// dirSize returns the total size of the files in dir.
+func dirSize(dir string) common.StorageSize {
+	var size common.StorageSize
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += common.StorageSize(info.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+func compactDatabase(ctx *cli.Context) error {
+	db := openDatabase(ctx)
+	defer db.Close()
+
+	if stats, err := db.Stat("leveldb.stats"); err == nil {
+		fmt.Println(stats)
+	}
+	// Compact one leading key byte at a time to be able to report progress,
+	// a single full range compaction can take hours without a word.
+	start := time.Now()
+	for b := 0; b < 256; b++ {
+		var from, to []byte
+		if b > 0 {
+			from = []byte{byte(b)}
+		}
+		if b < 255 {
+			to = []byte{byte(b + 1)}
+		}
+		if err := db.Compact(from, to); err != nil {
+			glog.Fatalf("Database compaction failed: %v", err)
+		}
+		if (b+1)%16 == 0 {
+			glog.V(logger.Info).Infof("Compacting database: %d%% done, elapsed %v", (b+1)*100/256, time.Since(start))
+		}
+	}
+	glog.V(logger.Info).Infof("Database compacted in %v", time.Since(start))
+
+	if stats, err := db.Stat("leveldb.stats"); err == nil {
+		fmt.Println(stats)
+	}
+	return nil
+}
+
+func getDatabaseKey(ctx *cli.Context) error {
+	key := databaseKeyArg(ctx)
+
+	db := openDatabase(ctx)
+	defer db.Close()
+
+	value, err := db.Get(key)
+	if err != nil {
+		glog.Fatalf("Could not get key %x: %v", key, err)
+	}
+	fmt.Printf("Key: 0x%x (%s)\n", key, core.DatabaseKeyCategory(key))
+	fmt.Printf("Value: 0x%x\n", value)
+	return nil
+}
+
+func deleteDatabaseKey(ctx *cli.Context) error {
+	key := databaseKeyArg(ctx)
+
+	db := openDatabase(ctx)
+	defer db.Close()
+
+	if ok, err := db.Has(key); err != nil || !ok {
+		glog.Fatalf("Key %x not found", key)
+	}
+	if err := db.Delete(key); err != nil {
+		glog.Fatalf("Could not delete key %x: %v", key, err)
+	}
+	fmt.Printf("Deleted key 0x%x (%s)\n", key, core.DatabaseKeyCategory(key))
+	return nil
+}
@@ -41,11 +41,13 @@ import (
 	"github.com/NginProject/ngind/ngin"
 	"github.com/NginProject/ngind/ngindb"
 	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/les"
 	"github.com/NginProject/ngind/logger"
 	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/miner"
 	"github.com/NginProject/ngind/node"
 	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/p2p/distip"
 	"github.com/NginProject/ngind/p2p/nat"
 	"github.com/NginProject/ngind/pow"
 	"github.com/NginProject/ngind/whisper"
@@ -329,6 +331,20 @@ func MakeNAT(ctx *cli.Context) nat.Interface {
 	return natif
 }
 
+// MakeNetRestrict parses the --netrestrict CIDR whitelist, returning nil if
+// the flag is not set.
+func MakeNetRestrict(ctx *cli.Context) *distip.Netlist {
+	netrestrict := ctx.GlobalString(aliasableName(NetrestrictFlag.Name, ctx))
+	if netrestrict == "" {
+		return nil
+	}
+	list, err := distip.ParseNetlist(netrestrict)
+	if err != nil {
+		log.Fatalf("Option %s: %v", aliasableName(NetrestrictFlag.Name, ctx), err)
+	}
+	return list
+}
+
 // MakeRPCModules splits input separated by a comma and trims excessive white
 // space from the substrings.
 func MakeRPCModules(input string) []string {
@@ -357,6 +373,27 @@ func MakeWSRpcHost(ctx *cli.Context) string {
 	return ctx.GlobalString(aliasableName(WSListenAddrFlag.Name, ctx))
 }
 
+// MakeCacheConfig returns the state pruning configuration selected by the
+// --gcmode flag.
+func MakeCacheConfig(ctx *cli.Context) *core.CacheConfig {
+	var config core.CacheConfig
+	switch mode := ctx.GlobalString(aliasableName(GCModeFlag.Name, ctx)); mode {
+	case "full":
+		config = *core.DefaultCacheConfig
+	case "archive":
+		config = *core.ArchiveCacheConfig
+	default:
+		glog.Fatalf("invalid --%s value %q, expected \"full\" or \"archive\"", GCModeFlag.Name, mode)
+	}
+	config.AncientThreshold = uint64(ctx.GlobalInt(aliasableName(AncientThresholdFlag.Name, ctx)))
+	if !config.Disabled {
+		config.RegenLimit = uint64(ctx.GlobalInt(aliasableName(StateRegenLimitFlag.Name, ctx)))
+		config.RegenTimeout = ctx.GlobalDuration(aliasableName(StateRegenTimeoutFlag.Name, ctx))
+	}
+	config.Snapshot = ctx.GlobalBool(aliasableName(StateSnapshotFlag.Name, ctx))
+	return &config
+}
+
 // MakeDatabaseHandles raises out the number of allowed file handles per process
 // for ngind and returns half of the allowance to assign to the database.
 func MakeDatabaseHandles() int {
@@ -375,6 +412,15 @@ func MakeDatabaseHandles() int {
 
 // MakeAccountManager creates an account manager from set command line flags.
 func MakeAccountManager(ctx *cli.Context) *accounts.Manager {
+	if endpoint := ctx.GlobalString(aliasableName(SignerFlag.Name, ctx)); endpoint != "" {
+		signer, err := accounts.NewExternalSigner(endpoint)
+		if err != nil {
+			glog.Fatalf("connect to external signer at %q: %s", endpoint, err)
+		}
+		glog.V(logger.Info).Infof("Using external signer at %s", endpoint)
+		return accounts.NewExternalManager(signer)
+	}
+
 	// Create the keystore crypto primitive, light if requested
 	scryptN := accounts.StandardScryptN
 	scryptP := accounts.StandardScryptP
@@ -494,16 +540,36 @@ func MakeSystemNode(version string, ctx *cli.Context) *node.Node {
 	// Assemble and return the protocol stack
 	stack, err := node.New(stackConf)
 	if err != nil {
-		glog.Fatalf("%v: failed to create the protocol stack: ", ErrStackFail, err)
+		glog.Fatalf("%v: failed to create the protocol stack: %v", ErrStackFail, err)
 	}
-	if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
-		return ngin.New(ctx, ethConf)
-	}); err != nil {
-		glog.Fatalf("%v: failed to register the Ngin service: ", ErrStackFail, err)
+	if ctx.GlobalBool(aliasableName(LightModeFlag.Name, ctx)) {
+		if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
+			return les.New(ctx, ethConf)
+		}); err != nil {
+			glog.Fatalf("%v: failed to register the light Ngin service: %v", ErrStackFail, err)
+		}
+	} else {
+		if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
+			return ngin.New(ctx, ethConf)
+		}); err != nil {
+			glog.Fatalf("%v: failed to register the Ngin service: %v", ErrStackFail, err)
+		}
+		if servePercent := ctx.GlobalInt(aliasableName(LightServFlag.Name, ctx)); servePercent > 0 {
+			maxClients := ctx.GlobalInt(aliasableName(LightPeersFlag.Name, ctx))
+			if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
+				var full *ngin.Ngin
+				if err := ctx.Service(&full); err != nil {
+					return nil, err
+				}
+				return les.NewServer(full, servePercent, maxClients)
+			}); err != nil {
+				glog.Fatalf("%v: failed to register the light server: %v", ErrStackFail, err)
+			}
+		}
 	}
 	if shhEnable {
 		if err := stack.Register(func(*node.ServiceContext) (node.Service, error) { return whisper.New(), nil }); err != nil {
-			glog.Fatalf("%v: failed to register the Whisper service: ", ErrStackFail, err)
+			glog.Fatalf("%v: failed to register the Whisper service: %v", ErrStackFail, err)
 		}
 	}
 
@@ -534,12 +600,14 @@ func mustMakeStackConf(ctx *cli.Context, name string, config *core.SufficientCha
 	// Configure the node's service container
 	stackConf = &node.Config{
 		DataDir:         MustMakeChainDataDir(ctx),
+		DatabaseEngine:  ctx.GlobalString(aliasableName(DBEngineFlag.Name, ctx)),
 		PrivateKey:      MakeNodeKey(ctx),
 		Name:            name,
 		NoDiscovery:     ctx.GlobalBool(aliasableName(NoDiscoverFlag.Name, ctx)),
 		BootstrapNodes:  config.ParsedBootstrap,
 		ListenAddr:      MakeListenAddress(ctx),
 		NAT:             MakeNAT(ctx),
+		NetRestrict:     MakeNetRestrict(ctx),
 		MaxPeers:        ctx.GlobalInt(aliasableName(MaxPeersFlag.Name, ctx)),
 		MaxPendingPeers: ctx.GlobalInt(aliasableName(MaxPendingPeersFlag.Name, ctx)),
 		IPCPath:         MakeIPCPath(ctx),
@@ -582,6 +650,9 @@ func mustMakeEthConf(ctx *cli.Context, sconf *core.SufficientChainConfig) *ngin.
 	passwords := MakePasswordList(ctx)
 
 	accounts := strings.Split(ctx.GlobalString(aliasableName(UnlockedAccountFlag.Name, ctx)), ",")
+	if accman.External() && strings.TrimSpace(strings.Join(accounts, "")) != "" {
+		glog.Fatalf("--%s cannot be used with --%s, accounts are unlocked by the external signer", UnlockedAccountFlag.Name, SignerFlag.Name)
+	}
 	for i, account := range accounts {
 		if trimmed := strings.TrimSpace(account); trimmed != "" {
 			unlockAccount(ctx, accman, trimmed, i, passwords)
@@ -592,10 +663,20 @@ func mustMakeEthConf(ctx *cli.Context, sconf *core.SufficientChainConfig) *ngin.
 		ChainConfig:             sconf.ChainConfig,
 		Genesis:                 sconf.Genesis,
 		UseAddrTxIndex:    ctx.GlobalBool(aliasableName(AddrTxIndexFlag.Name, ctx)),
+		UseTokenIndex:     ctx.GlobalBool(aliasableName(AddrTxIndexTokensFlag.Name, ctx)),
+		UseInternalTxs:    ctx.GlobalBool(aliasableName(AddrTxIndexInternalFlag.Name, ctx)),
+		UseBalanceIndex:   ctx.GlobalBool(aliasableName(BalanceHistoryFlag.Name, ctx)),
 		FastSync:          ctx.GlobalBool(aliasableName(FastSyncFlag.Name, ctx)),
+		NoPruning:         MakeCacheConfig(ctx).Disabled,
+		RegenLimit:        MakeCacheConfig(ctx).RegenLimit,
+		RegenTimeout:      MakeCacheConfig(ctx).RegenTimeout,
+		Snapshot:          ctx.GlobalBool(aliasableName(StateSnapshotFlag.Name, ctx)),
 		BlockChainVersion: ctx.GlobalInt(aliasableName(BlockchainVersionFlag.Name, ctx)),
 		DatabaseCache:     ctx.GlobalInt(aliasableName(CacheFlag.Name, ctx)),
 		DatabaseHandles:   MakeDatabaseHandles(),
+		DatabaseAncient:   MakeAncientDir(ctx),
+		AncientThreshold:  MakeCacheConfig(ctx).AncientThreshold,
+		AncientNoCompress: ctx.GlobalBool(aliasableName(AncientNoCompressFlag.Name, ctx)),
 		NetworkId:         sconf.Network,
 		MaxPeers:          ctx.GlobalInt(aliasableName(MaxPeersFlag.Name, ctx)),
 		AccountManager:    accman,
@@ -802,13 +883,41 @@ func MakeChainDatabase(ctx *cli.Context) ngindb.Database {
 		chaindir = MustMakeChainDataDir(ctx)
 		cache    = ctx.GlobalInt(aliasableName(CacheFlag.Name, ctx))
 		handles  = MakeDatabaseHandles()
+		engine   = ctx.GlobalString(aliasableName(DBEngineFlag.Name, ctx))
 	)
 
-	chainDb, err := ngindb.NewLDBDatabase(filepath.Join(chaindir, "chaindata"), cache, handles)
+	chainDb, err := ngindb.Open(engine, filepath.Join(chaindir, "chaindata"), cache, handles)
 	if err != nil {
 		glog.Fatal("Could not open database: ", err)
 	}
-	return chainDb
+	compress := !ctx.GlobalBool(aliasableName(AncientNoCompressFlag.Name, ctx))
+	frdb, err := ngindb.NewDatabaseWithFreezer(chainDb, MustMakeAncientDir(ctx), compress)
+	if err != nil {
+		glog.Fatal("Could not open ancient store: ", err)
+	}
+	return frdb
+}
+
+// MakeAncientDir returns the ancient store directory set with --datadir.ancient,
+// or an empty string to use the default one within chaindata.
+func MakeAncientDir(ctx *cli.Context) string {
+	path := ctx.GlobalString(aliasableName(AncientDirFlag.Name, ctx))
+	if path == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		glog.Fatalf("cannot make absolute path for ancient dir: %v: %v", path, err)
+	}
+	return abs
+}
+
+// MustMakeAncientDir returns the directory of the ancient store.
+func MustMakeAncientDir(ctx *cli.Context) string {
+	if dir := MakeAncientDir(ctx); dir != "" {
+		return dir
+	}
+	return filepath.Join(MustMakeChainDataDir(ctx), "chaindata", "ancient")
 }
 
 func MakeIndexDatabase(ctx *cli.Context) ngindb.Database {
@@ -816,30 +925,39 @@ func MakeIndexDatabase(ctx *cli.Context) ngindb.Database {
 		chaindir = MustMakeChainDataDir(ctx)
 		cache    = ctx.GlobalInt(aliasableName(CacheFlag.Name, ctx))
 		handles  = MakeDatabaseHandles()
+		engine   = ctx.GlobalString(aliasableName(DBEngineFlag.Name, ctx))
 	)
 
-	indexesDb, err := ngindb.NewLDBDatabase(filepath.Join(chaindir, "indexes"), cache, handles)
+	indexesDb, err := ngindb.Open(engine, filepath.Join(chaindir, "indexes"), cache, handles)
 	if err != nil {
 		glog.Fatal("Could not open database: ", err)
 	}
 	return indexesDb
 }
 
+// MakePoW creates the proof of work engine from set command line flags.
+func MakePoW(ctx *cli.Context) pow.PoW {
+	if ctx.GlobalBool(aliasableName(FakePoWFlag.Name, ctx)) {
+		glog.V(logger.Info).Infoln("Consensus: fake")
+		glog.D(logger.Warn).Warnln("Consensus: fake")
+		return core.FakePow{}
+	}
+	return M00N.New()
+}
+
 // MakeChain creates a chain manager from set command line flags.
 func MakeChain(ctx *cli.Context) (chain *core.BlockChain, chainDb ngindb.Database) {
+	return MakeChainWithPoW(ctx, MakePoW(ctx))
+}
+
+// MakeChainWithPoW creates a chain manager verifying seals with the given
+// proof of work engine.
+func MakeChainWithPoW(ctx *cli.Context, pow pow.PoW) (chain *core.BlockChain, chainDb ngindb.Database) {
 	var err error
 	sconf := mustMakeSufficientChainConfig(ctx)
 	chainDb = MakeChainDatabase(ctx)
 
-	pow := pow.PoW(core.FakePow{})
-	if !ctx.GlobalBool(aliasableName(FakePoWFlag.Name, ctx)) {
-		pow = M00N.New()
-	} else {
-		glog.V(logger.Info).Infoln("Consensus: fake")
-		glog.D(logger.Warn).Warnln("Consensus: fake")
-	}
-
-	chain, err = core.NewBlockChain(chainDb, sconf.ChainConfig, pow, new(event.TypeMux))
+	chain, err = core.NewBlockChainWithCache(chainDb, sconf.ChainConfig, pow, new(event.TypeMux), MakeCacheConfig(ctx))
 	if err != nil {
 		glog.Fatal("Could not start chainmanager: ", err)
 	}
@@ -12,6 +12,7 @@ import (
 	"github.com/NginProject/ngind/core"
 	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/ngin"
+	"github.com/NginProject/ngind/ngindb"
 	"github.com/NginProject/ngind/rpc"
 	"gopkg.in/urfave/cli.v1"
 )
@@ -44,6 +45,24 @@ var (
 		Usage: "Data directory for the databases and keystore",
 		Value: DirectoryString{common.DefaultDataDir()},
 	}
+	DBEngineFlag = cli.StringFlag{
+		Name:  "db.engine",
+		Usage: "Database engine for newly created databases (" + strings.Join(ngindb.Engines(), ", ") + "), existing ones keep theirs",
+		Value: ngindb.DefaultEngine,
+	}
+	AncientDirFlag = DirectoryFlag{
+		Name:  "datadir.ancient",
+		Usage: "Directory for the ancient chain segments (default = inside chaindata)",
+	}
+	AncientThresholdFlag = cli.IntFlag{
+		Name:  "ancient.threshold",
+		Usage: "Number of recent blocks kept in the chain database, older ones are moved to the ancient store (0 = disabled)",
+		Value: core.FreezerThreshold,
+	}
+	AncientNoCompressFlag = cli.BoolFlag{
+		Name:  "ancient.nocompress",
+		Usage: "Disables snappy compression of newly created ancient store tables",
+	}
 	KeyStoreDirFlag = DirectoryFlag{
 		Name:  "keystore",
 		Usage: "Directory path for the keystore",
@@ -85,6 +104,25 @@ var (
 		Usage: "Megabytes of memory allocated to internal caching (min 16MB / database forced)",
 		Value: 1024,
 	}
+	GCModeFlag = cli.StringFlag{
+		Name:  "gcmode",
+		Usage: `Blockchain garbage collection mode ("full", "archive"), "full" prunes the states of old blocks`,
+		Value: "archive",
+	}
+	StateRegenLimitFlag = cli.IntFlag{
+		Name:  "state.regenlimit",
+		Usage: "Maximum number of blocks re-executed to serve a request for a pruned state (0 = disabled)",
+		Value: core.DefaultRegenLimit,
+	}
+	StateRegenTimeoutFlag = cli.DurationFlag{
+		Name:  "state.regentimeout",
+		Usage: "Maximum time spent regenerating a pruned state for a single request (0 = no limit)",
+		Value: core.DefaultRegenTimeout,
+	}
+	StateSnapshotFlag = cli.BoolFlag{
+		Name:  "state.snapshot",
+		Usage: "Maintain a flat snapshot of the state to speed up state reads",
+	}
 	BlockchainVersionFlag = cli.IntFlag{
 		Name:  "blockchain-version,blockchainversion",
 		Usage: "Blockchain version (integer)",
@@ -94,6 +132,20 @@ var (
 		Name:  "fast",
 		Usage: "Enable fast syncing through state downloads",
 	}
+	LightModeFlag = cli.BoolFlag{
+		Name:  "light",
+		Usage: "Run as a light client, retrieving state on demand from light servers",
+	}
+	LightServFlag = cli.IntFlag{
+		Name:  "lightserv",
+		Usage: "Maximum percentage of time allowed for serving light client requests (0 = off)",
+		Value: 0,
+	}
+	LightPeersFlag = cli.IntFlag{
+		Name:  "lightpeers",
+		Usage: "Maximum number of light clients to serve",
+		Value: 20,
+	}
 	LightKDFFlag = cli.BoolFlag{
 		Name:  "light-kdf,lightkdf",
 		Usage: "Reduce key-derivation RAM & CPU usage at some expense of KDF strength",
@@ -106,6 +158,18 @@ var (
 		Name:  "atxi.autobuild,atxi.auto-build",
 		Usage: "Begins automatic concurrent indexes building process that runs alongside a normally running ng.",
 	}
+	AddrTxIndexTokensFlag = cli.BoolFlag{
+		Name:  "atxi.tokens",
+		Usage: "Index ERC-20 and ERC-721 token transfers by address along with the transactions, requires --atxi. Also applies to command 'atxi-build'",
+	}
+	AddrTxIndexInternalFlag = cli.BoolFlag{
+		Name:  "atxi.internal",
+		Usage: "Index internal transactions by address along with the transactions, requires --atxi and the states of the indexed blocks (--gcmode=archive). Also applies to command 'atxi-build'",
+	}
+	BalanceHistoryFlag = cli.BoolFlag{
+		Name:  "balance-history",
+		Usage: "Toggle index of account balances by block. Pre-existing chaindata, genesis allocations included, can be indexed with command 'balance-history-build'",
+	}
 	// Masternode settings
 	MasternodeFlag = cli.BoolFlag{
 		Name:  "masternode",
@@ -152,6 +216,11 @@ var (
 		Usage: "Password file to use for non-inteactive password input",
 		Value: "",
 	}
+	SignerFlag = cli.StringFlag{
+		Name:  "signer",
+		Usage: "External signer endpoint (IPC path or HTTP URL); accounts and signing are delegated to it and no local keystore is used",
+		Value: "",
+	}
 	// logging and debug settings
 	NeckbeardFlag = cli.BoolFlag{
 		Name:  "neckbeard",
@@ -359,6 +428,10 @@ var (
 		Name:  "no-discover,nodiscover",
 		Usage: "Disables the peer discovery mechanism (manual peer addition)",
 	}
+	NetrestrictFlag = cli.StringFlag{
+		Name:  "netrestrict",
+		Usage: "Restricts network communication to the given IP networks (CIDR masks)",
+	}
 	WhisperEnabledFlag = cli.BoolFlag{
 		Name:  "shh",
 		Usage: "Enable Whisper",
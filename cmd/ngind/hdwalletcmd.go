@@ -0,0 +1,296 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/console"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	hdPathFlag = cli.StringFlag{
+		Name:  "path",
+		Usage: "BIP-32 derivation path, eg. m/44'/60'/0'/0",
+	}
+	hdMnemonicPasswordFlag = cli.StringFlag{
+		Name:  "mnemonicpassword",
+		Usage: "Password file holding the optional BIP-39 mnemonic passphrase",
+	}
+	hdWalletCommand = cli.Command{
+		Name:  "hd",
+		Usage: "Manage mnemonic based HD wallets",
+		Description: `
+
+	HD wallets hold a seed, derived from a BIP-39 mnemonic sentence and an optional
+	mnemonic passphrase, from which any number of accounts are derived along BIP-32
+	paths. By default accounts are derived under the BIP-44 path m/44'/60'/0'/0,
+	followed by the account index, like the common hardware and software wallets do.
+
+	The seed is stored encrypted with your password under <DATADIR>/<CHAINDIR>/keystore/hd,
+	along with the accounts derived so far, which are listed, unlocked and used like
+	any other account. The mnemonic itself is not stored: write it down, along with
+	its passphrase if any, to restore the wallet and all of its accounts.
+
+	'$ ngind account hd <command> --help' shows help for any subcommand.
+		`,
+		Subcommands: []cli.Command{
+			{
+				Action: hdWalletCreate,
+				Name:   "new",
+				Usage:  "Create an HD wallet from a new mnemonic",
+				Flags:  []cli.Flag{hdPathFlag, hdMnemonicPasswordFlag},
+				Description: `
+
+ngind account hd new [--path <basepath>]
+
+	Generates a 24 words mnemonic, creates a wallet from it and derives its first account.
+	Prints the mnemonic, the wallet id and the address of the account.
+	You are prompted for an optional mnemonic passphrase, and for the password the wallet is
+	encrypted with.
+
+	For non-interactive use the passwords can be specified with the --password and
+	--mnemonicpassword flags:
+
+		ngind --password <passwordfile> account hd new --mnemonicpassword <passwordfile>
+				`,
+			},
+			{
+				Action: hdWalletImport,
+				Name:   "import",
+				Usage:  "Create an HD wallet from an existing mnemonic",
+				Flags:  []cli.Flag{hdPathFlag, hdMnemonicPasswordFlag},
+				Description: `
+
+ngind account hd import [--path <basepath>] [<mnemonicfile>]
+
+	Creates a wallet from a BIP-39 mnemonic, read from <mnemonicfile> or prompted for,
+	and derives its first account. Prints the wallet id and the address of the account.
+	Use 'ngind account hd discover' to add the other accounts used on chain.
+				`,
+			},
+			{
+				Action: hdWalletList,
+				Name:   "list",
+				Usage:  "Print HD wallets and their accounts",
+			},
+			{
+				Action: hdWalletDerive,
+				Name:   "derive",
+				Usage:  "Derive an account from an HD wallet",
+				Flags:  []cli.Flag{hdPathFlag},
+				Description: `
+
+ngind account hd derive [--path <path>] <id>
+
+	Derives the account at the given path, eg. m/44'/60'/1'/0/0, or the account following the
+	last one derived under the base path of the wallet, and prints its address.
+				`,
+			},
+			{
+				Action: hdWalletDiscover,
+				Name:   "discover",
+				Usage:  "Discover the accounts of an HD wallet used on chain",
+				Description: `
+
+ngind account hd discover <id>
+
+	Derives the accounts under the base path of the wallet by increasing index, adding the
+	ones having sent transactions or holding a balance as of the head block of the local
+	chain, until 20 unused ones in a row. Prints the addresses of the accounts added.
+	The node must not be running.
+				`,
+			},
+			{
+				Action: hdWalletUpdate,
+				Name:   "update",
+				Usage:  "Change the password of an HD wallet",
+				Description: `
+
+ngind account hd update <id>
+
+	Changes the password the seed of the wallet is encrypted with, shared by its accounts.
+				`,
+			},
+		},
+	}
+)
+
+// hdPath returns the derivation path given by the path flag, nil if unset.
+func hdPath(ctx *cli.Context) accounts.DerivationPath {
+	if !ctx.IsSet(hdPathFlag.Name) {
+		return nil
+	}
+	path, err := accounts.ParseDerivationPath(ctx.String(hdPathFlag.Name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path
+}
+
+// hdMnemonicPassword returns the mnemonic passphrase, from the file given by the
+// mnemonicpassword flag or prompted for.
+func hdMnemonicPassword(ctx *cli.Context, confirmation bool) string {
+	if file := ctx.String(hdMnemonicPasswordFlag.Name); file != "" {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal("Failed to read mnemonic password file: ", err)
+		}
+		return strings.TrimRight(strings.SplitN(string(text), "\n", 2)[0], "\r")
+	}
+	if len(MakePasswordList(ctx)) > 0 {
+		return ""
+	}
+	return getPassPhrase("Please give the mnemonic passphrase, if any. It is needed along with the mnemonic to restore the wallet.", confirmation, 0, nil)
+}
+
+func hdWalletArg(ctx *cli.Context) string {
+	if len(ctx.Args()) == 0 {
+		log.Fatal("No HD wallet id specified")
+	}
+	return ctx.Args().First()
+}
+
+func hdWalletCreate(ctx *cli.Context) error {
+	base := hdPath(ctx)
+	accman := MakeAccountManager(ctx)
+
+	mnemonic, err := accounts.NewMnemonic(accounts.DefaultMnemonicBits)
+	if err != nil {
+		log.Fatal("Failed to generate mnemonic: ", err)
+	}
+	mnemonicPassword := hdMnemonicPassword(ctx, true)
+	password := getPassPhrase("Your new wallet is locked with a password. Please give a password. Do not forget this password.", true, 0, MakePasswordList(ctx))
+
+	w, err := accman.ImportHDWallet(mnemonic, mnemonicPassword, password, base)
+	if err != nil {
+		log.Fatal("Failed to create HD wallet: ", err)
+	}
+	acc, err := accman.DeriveHDAccount(w.ID, nil, password)
+	if err != nil {
+		log.Fatal("Failed to derive account: ", err)
+	}
+	fmt.Printf("Mnemonic: %s\n", mnemonic)
+	fmt.Println("Write the mnemonic down and keep it safe, it is not stored and cannot be shown again.")
+	fmt.Printf("Wallet: %s\n", w.ID)
+	fmt.Printf("Address: 0x%x\n", acc.Address)
+	return nil
+}
+
+func hdWalletImport(ctx *cli.Context) error {
+	base := hdPath(ctx)
+
+	var mnemonic string
+	if file := ctx.Args().First(); file != "" {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal("Could not read mnemonic file: ", err)
+		}
+		mnemonic = string(text)
+	} else {
+		input, err := console.Stdin.PromptPassword("Mnemonic: ")
+		if err != nil {
+			log.Fatal("Failed to read mnemonic: ", err)
+		}
+		mnemonic = input
+	}
+	if err := accounts.ValidateMnemonic(mnemonic); err != nil {
+		log.Fatal(err)
+	}
+	accman := MakeAccountManager(ctx)
+	mnemonicPassword := hdMnemonicPassword(ctx, false)
+	password := getPassPhrase("Your new wallet is locked with a password. Please give a password. Do not forget this password.", true, 0, MakePasswordList(ctx))
+
+	w, err := accman.ImportHDWallet(mnemonic, mnemonicPassword, password, base)
+	if err != nil {
+		log.Fatal("Failed to import HD wallet: ", err)
+	}
+	acc, err := accman.DeriveHDAccount(w.ID, nil, password)
+	if err != nil {
+		log.Fatal("Failed to derive account: ", err)
+	}
+	fmt.Printf("Wallet: %s\n", w.ID)
+	fmt.Printf("Address: 0x%x\n", acc.Address)
+	return nil
+}
+
+func hdWalletList(ctx *cli.Context) error {
+	accman := MakeAccountManager(ctx)
+	for i, w := range accman.HDWallets() {
+		fmt.Printf("Wallet #%d: %s %s %s\n", i, w.ID, w.BasePath, w.File)
+		for _, acc := range w.Accounts {
+			fmt.Printf("  {%x} %s\n", acc.Address, acc.Path)
+		}
+	}
+	return nil
+}
+
+func hdWalletDerive(ctx *cli.Context) error {
+	id := hdWalletArg(ctx)
+	path := hdPath(ctx)
+	accman := MakeAccountManager(ctx)
+	password := getPassPhrase(fmt.Sprintf("Unlocking HD wallet %s", id), false, 0, MakePasswordList(ctx))
+
+	acc, err := accman.DeriveHDAccount(id, path, password)
+	if err != nil {
+		log.Fatal("Failed to derive account: ", err)
+	}
+	fmt.Printf("Address: 0x%x\n", acc.Address)
+	return nil
+}
+
+func hdWalletDiscover(ctx *cli.Context) error {
+	id := hdWalletArg(ctx)
+	accman := MakeAccountManager(ctx)
+	password := getPassPhrase(fmt.Sprintf("Unlocking HD wallet %s", id), false, 0, MakePasswordList(ctx))
+
+	bc, chainDb := MakeChain(ctx)
+	defer chainDb.Close()
+	state, err := bc.State()
+	if err != nil {
+		log.Fatal("Failed to open head state: ", err)
+	}
+	found, err := accman.DiscoverHDAccounts(id, password, func(addr common.Address) (bool, error) {
+		return state.GetNonce(addr) > 0 || state.GetBalance(addr).Sign() > 0, nil
+	})
+	if err != nil {
+		log.Fatal("Failed to discover accounts: ", err)
+	}
+	for _, acc := range found {
+		fmt.Printf("Address: 0x%x\n", acc.Address)
+	}
+	fmt.Printf("Discovered %d accounts as of block #%d\n", len(found), bc.CurrentBlock().NumberU64())
+	return nil
+}
+
+func hdWalletUpdate(ctx *cli.Context) error {
+	id := hdWalletArg(ctx)
+	accman := MakeAccountManager(ctx)
+	password := getPassPhrase(fmt.Sprintf("Unlocking HD wallet %s", id), false, 0, nil)
+	newPassword := getPassPhrase("Please give a new password. Do not forget this password.", true, 0, nil)
+
+	if err := accman.UpdateHDWallet(id, password, newPassword); err != nil {
+		log.Fatal("Could not update the HD wallet: ", err)
+	}
+	return nil
+}
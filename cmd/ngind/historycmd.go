@@ -0,0 +1,374 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/era"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	// historyChecksumsFile lists the accumulator roots of the exported epochs.
+	historyChecksumsFile = "checksums.txt"
+
+	// historyHeaderCheckFreq is the share of headers whose proof of work is
+	// verified when importing against trusted accumulators.
+	historyHeaderCheckFreq = 100
+)
+
+var (
+	exportHistoryCommand = cli.Command{
+		Action:    exportHistory,
+		Name:      "export-history",
+		Usage:     "Export blockchain history into era archive files",
+		ArgsUsage: "<dir> [<first> <last>]",
+		Description: `
+	Writes the headers, bodies, receipts and total difficulties of the canonical
+	chain into <dir>, one era file per epoch of 8192 blocks. Optional second and
+	third arguments control the first and last block to write, the first one is
+	rounded down to the start of its epoch.
+
+	Each file ends with the accumulator root of its epoch, a merkle root over the
+	hashes and total difficulties of its blocks. The roots are also listed in
+	<dir>/checksums.txt, which can be handed to import-history --trusted.
+		`,
+	}
+	importHistoryCommand = cli.Command{
+		Action:    importHistory,
+		Name:      "import-history",
+		Usage:     "Import blockchain history from era archive files",
+		ArgsUsage: "<dir>",
+		Description: `
+	Imports the era files found in <dir> in epoch order. Every block is checked
+	against its header and every file against its accumulator root.
+
+	By default the blocks are executed as with the import command. With --trusted
+	pointing at a list of accumulator roots obtained from a trusted source (the
+	checksums.txt of an export), the epochs matching it are stored without
+	execution, the way fast sync stores blocks: the state of the imported chain
+	is then downloaded from the network.
+		`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "trusted",
+				Usage: "File of trusted \"<epoch> <accumulator root>\" lines, skips block execution",
+			},
+		},
+	}
+)
+
+func exportHistory(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 && len(ctx.Args()) != 3 {
+		log.Fatal("This command requires a directory argument, optionally followed by the first and last block.")
+	}
+	chain, chainDb := MakeChain(ctx)
+	defer chainDb.Close()
+	start := time.Now()
+
+	first, last := uint64(0), chain.CurrentBlock().NumberU64()
+	if len(ctx.Args()) == 3 {
+		var err error
+		if first, err = strconv.ParseUint(ctx.Args().Get(1), 10, 64); err != nil {
+			log.Fatal("export-history paramater: ", err)
+		}
+		if last, err = strconv.ParseUint(ctx.Args().Get(2), 10, 64); err != nil {
+			log.Fatal("export-history paramater: ", err)
+		}
+	}
+	network := mustMakeSufficientChainConfig(ctx).Identity
+	if err := ExportHistory(chain, chainDb, ctx.Args().First(), network, first, last); err != nil {
+		log.Fatal("Export error: ", err)
+	}
+	fmt.Printf("Export done in %v\n", time.Since(start))
+	return nil
+}
+
+func importHistory(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		log.Fatal("This command requires an argument.")
+	}
+	var trusted map[uint64]common.Hash
+	if path := ctx.String("trusted"); path != "" {
+		var err error
+		if trusted, err = era.ReadChecksums(path); err != nil {
+			log.Fatal("Could not read trusted accumulators: ", err)
+		}
+	}
+	chain, chainDb := MakeChain(ctx)
+	start := time.Now()
+
+	network := mustMakeSufficientChainConfig(ctx).Identity
+	err := ImportHistory(chain, ctx.Args().First(), network, trusted)
+	chain.Stop()
+	chainDb.Close()
+	if err != nil {
+		log.Fatal("Import error: ", err)
+	}
+	fmt.Printf("Import done in %v\n", time.Since(start))
+	return nil
+}
+
+// ExportHistory writes the canonical blocks from the epoch of first up to last
+// into era files in dir, along with the list of their accumulator roots.
+func ExportHistory(chain *core.BlockChain, chainDb ngindb.Database, dir, network string, first, last uint64) error {
+	if first > last {
+		return fmt.Errorf("first (%d) is greater than last (%d)", first, last)
+	}
+	if head := chain.CurrentBlock().NumberU64(); last > head {
+		return fmt.Errorf("last (%d) is past the chain head (%d)", last, head)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	glog.D(logger.Warn).Infoln("Exporting blockchain history to", dir, "(this may take a while)...")
+
+	checksums := new(bytes.Buffer)
+	for epoch := first / era.EpochSize; epoch <= last/era.EpochSize; epoch++ {
+		from, to := epoch*era.EpochSize, (epoch+1)*era.EpochSize-1
+		if to > last {
+			to = last
+		}
+		root, err := exportEpoch(chain, chainDb, dir, network, epoch, from, to)
+		if err != nil {
+			return fmt.Errorf("epoch %d: %v", epoch, err)
+		}
+		fmt.Fprintf(checksums, "%d %s\n", epoch, root.Hex())
+		glog.D(logger.Warn).Infof("Exported epoch %d, blocks #%d-#%d, accumulator %s", epoch, from, to, root.Hex())
+	}
+	return writeFileAtomic(filepath.Join(dir, historyChecksumsFile), checksums.Bytes())
+}
+
+// exportEpoch writes the blocks from..to of an epoch into a new era file.
+func exportEpoch(chain *core.BlockChain, chainDb ngindb.Database, dir, network string, epoch, from, to uint64) (common.Hash, error) {
+	tmp := filepath.Join(dir, fmt.Sprintf("%s-%05d.era.tmp", network, epoch))
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer os.Remove(tmp)
+	defer fh.Close()
+
+	buf := bufio.NewWriter(fh)
+	builder := era.NewBuilder(buf)
+	for nr := from; nr <= to; nr++ {
+		block := chain.GetBlockByNumber(nr)
+		if block == nil {
+			return common.Hash{}, fmt.Errorf("block #%d not found", nr)
+		}
+		receipts := core.GetBlockReceipts(chainDb, block.Hash())
+		if len(receipts) != len(block.Transactions()) {
+			return common.Hash{}, fmt.Errorf("receipts of block #%d not found", nr)
+		}
+		td := chain.GetTd(block.Hash())
+		if td == nil {
+			return common.Hash{}, fmt.Errorf("total difficulty of block #%d not found", nr)
+		}
+		if err := builder.Add(block, receipts, td); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	root, err := builder.Finalize()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := buf.Flush(); err != nil {
+		return common.Hash{}, err
+	}
+	if err := fh.Sync(); err != nil {
+		return common.Hash{}, err
+	}
+	if err := fh.Close(); err != nil {
+		return common.Hash{}, err
+	}
+	return root, os.Rename(tmp, filepath.Join(dir, era.Filename(network, epoch, root)))
+}
+
+// ImportHistory imports the era files of the network found in dir. Epochs
+// whose accumulator matches the trusted one are stored without execution.
+func ImportHistory(chain *core.BlockChain, dir, network string, trusted map[uint64]common.Hash) error {
+	// Watch for Ctrl-C while the import is running.
+	// If a signal is received, the import will stop at the next epoch.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	paths, err := era.ReadDir(dir, network)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no %s era files in %s", network, dir)
+	}
+	glog.D(logger.Error).Infoln("Importing blockchain history from", dir)
+
+	for _, path := range paths {
+		select {
+		case <-interrupt:
+			return fmt.Errorf("interrupted")
+		default:
+		}
+		if err := importEpoch(chain, path, trusted); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// importEpoch verifies the blocks of an era file against their headers and the
+// file accumulator, then inserts them into the chain.
+func importEpoch(chain *core.BlockChain, path string, trusted map[uint64]common.Hash) error {
+	e, err := era.Open(path)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+
+	root, err := e.Accumulator()
+	if err != nil {
+		return err
+	}
+	skipExec := false
+	if trusted != nil {
+		want, ok := trusted[e.Epoch()]
+		if !ok {
+			return fmt.Errorf("no trusted accumulator for epoch %d", e.Epoch())
+		}
+		if root != want {
+			return fmt.Errorf("accumulator mismatch: have %s, want %s", root.Hex(), want.Hex())
+		}
+		skipExec = true
+	}
+
+	var (
+		blocks   = make(types.Blocks, 0, e.Count())
+		receipts = make([]types.Receipts, 0, e.Count())
+		hashes   = make([]common.Hash, 0, e.Count())
+		tds      = make([]*big.Int, 0, e.Count())
+	)
+	for nr := e.Start(); nr < e.Start()+e.Count(); nr++ {
+		block, rcpts, td, err := e.GetBlockByNumber(nr)
+		if err != nil {
+			return err
+		}
+		if err := verifyHistoryBlock(block, rcpts); err != nil {
+			return fmt.Errorf("block #%d: %v", nr, err)
+		}
+		if n := len(blocks); n > 0 && block.ParentHash() != blocks[n-1].Hash() {
+			return fmt.Errorf("block #%d: parent hash mismatch", nr)
+		}
+		hashes = append(hashes, block.Hash())
+		tds = append(tds, td)
+		blocks = append(blocks, block)
+		receipts = append(receipts, rcpts)
+	}
+	if have, err := era.ComputeAccumulator(hashes, tds); err != nil {
+		return err
+	} else if have != root {
+		return fmt.Errorf("accumulator mismatch: computed %s, recorded %s", have.Hex(), root.Hex())
+	}
+	// Genesis is never imported, only checked against the local one.
+	if blocks[0].NumberU64() == 0 {
+		if blocks[0].Hash() != chain.Genesis().Hash() {
+			return fmt.Errorf("genesis mismatch: have %x, want %x", blocks[0].Hash(), chain.Genesis().Hash())
+		}
+		blocks, receipts, tds = blocks[1:], receipts[1:], tds[1:]
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	start := time.Now()
+
+	if skipExec {
+		headers := make([]*types.Header, len(blocks))
+		for i, block := range blocks {
+			headers[i] = block.Header()
+		}
+		if res := chain.InsertHeaderChain(headers, historyHeaderCheckFreq); res.Error != nil {
+			return fmt.Errorf("invalid header #%d: %v", headers[res.Index].Number, res.Error)
+		}
+		for i, block := range blocks {
+			if td := chain.GetTd(block.Hash()); td == nil || td.Cmp(tds[i]) != 0 {
+				return fmt.Errorf("block #%d: total difficulty mismatch: have %v, want %v", block.NumberU64(), td, tds[i])
+			}
+		}
+		if res := chain.InsertReceiptChain(blocks, receipts); res.Error != nil {
+			return fmt.Errorf("invalid block #%d: %v", blocks[res.Index].NumberU64(), res.Error)
+		}
+	} else {
+		for i := 0; i < len(blocks); i += importBatchSize {
+			batch := blocks[i:]
+			if len(batch) > importBatchSize {
+				batch = batch[:importBatchSize]
+			}
+			if hasAllBlocks(chain, batch) {
+				continue
+			}
+			if res := chain.InsertChain(batch); res.Error != nil {
+				return fmt.Errorf("invalid block #%d: %v", batch[res.Index].NumberU64(), res.Error)
+			}
+		}
+	}
+	glog.D(logger.Warn).Infof("Imported epoch %d, blocks #%d-#%d in %v (execution skipped: %v)",
+		e.Epoch(), blocks[0].NumberU64(), blocks[len(blocks)-1].NumberU64(), time.Since(start), skipExec)
+	return nil
+}
+
+// verifyHistoryBlock checks that the body and receipts of an archived block
+// match its header.
+func verifyHistoryBlock(block *types.Block, receipts types.Receipts) error {
+	header := block.Header()
+	if hash := types.DeriveSha(block.Transactions()); hash != header.TxHash {
+		return fmt.Errorf("transaction root mismatch: have %x, want %x", hash, header.TxHash)
+	}
+	if hash := types.CalcUncleHash(block.Uncles()); hash != header.UncleHash {
+		return fmt.Errorf("uncle root mismatch: have %x, want %x", hash, header.UncleHash)
+	}
+	if len(receipts) != len(block.Transactions()) {
+		return fmt.Errorf("%d receipts for %d transactions", len(receipts), len(block.Transactions()))
+	}
+	if hash := types.DeriveSha(receipts); hash != header.ReceiptHash {
+		return fmt.Errorf("receipt root mismatch: have %x, want %x", hash, header.ReceiptHash)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
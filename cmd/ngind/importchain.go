@@ -0,0 +1,450 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/pow"
+	"github.com/NginProject/ngind/rlp"
+)
+
+const (
+	// importCheckpointFile records how far the import of a chain file got, in
+	// the chain data directory.
+	importCheckpointFile = "import.checkpoint"
+
+	importLogInterval = 8 * time.Second // Time between import progress reports
+	importQueueSize   = 2               // Batches buffered between the import stages
+)
+
+// importBatch is a batch of blocks travelling through the import pipeline.
+type importBatch struct {
+	blocks types.Blocks
+	offset int64 // File offset right after the last block
+	err    error
+}
+
+// importCheckpoint is the position of the last inserted block of an import,
+// used to resume an interrupted import of the same file.
+type importCheckpoint struct {
+	File   string      `json:"file"`
+	Size   int64       `json:"size"`
+	Offset int64       `json:"offset"`
+	Number uint64      `json:"number"`
+	Hash   common.Hash `json:"hash"`
+}
+
+// importPoW wraps the proof of work of the chain to remember the seals checked
+// ahead of insertion by the import pipeline, so that the chain doesn't verify
+// them again.
+type importPoW struct {
+	pow.PoW
+	verified sync.Map // Hashes of the blocks with a verified seal
+}
+
+func newImportPoW(engine pow.PoW) *importPoW {
+	return &importPoW{PoW: engine}
+}
+
+// Verify implements pow.PoW, consuming the seals verified in advance.
+func (p *importPoW) Verify(block pow.Block) bool {
+	hash := block.Header().Hash()
+	if _, ok := p.verified.Load(hash); ok {
+		p.verified.Delete(hash)
+		return true
+	}
+	return p.PoW.Verify(block)
+}
+
+// preverify checks the seal of a block and remembers it if valid.
+func (p *importPoW) preverify(block *types.Block) bool {
+	if !p.PoW.Verify(block) {
+		return false
+	}
+	p.verified.Store(block.Hash(), struct{}{})
+	return true
+}
+
+// forget drops the verified seals of blocks that won't be inserted.
+func (p *importPoW) forget(blocks types.Blocks) {
+	for _, block := range blocks {
+		p.verified.Delete(block.Hash())
+	}
+}
+
+// countingReader counts the bytes consumed by the RLP stream, tracking the
+// file offset of the decoded blocks.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// ImportChain imports the blocks of an RLP export file. Decoding, sender
+// recovery and seal verification run concurrently with the insertion of the
+// previous batches; seals are verified ahead only if seals is set, it must be
+// the proof of work engine of the chain.
+//
+// If checkpoint is set, the position of the last inserted block is saved to
+// it after every batch, and a later import of the same file resumes from it.
+func ImportChain(chain *core.BlockChain, seals *importPoW, fn string, checkpoint string) error {
+	// Watch for Ctrl-C while the import is running.
+	// If a signal is received, the import will stop at the next batch.
+	interrupt := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	signal.Notify(interrupt, os.Interrupt)
+	defer func() {
+		// Stop signal delivery before closing, a signal sent on the closed
+		// channel would panic.
+		signal.Stop(interrupt)
+		close(interrupt)
+	}()
+	go func() {
+		if _, ok := <-interrupt; ok {
+			glog.D(logger.Warn).Warnln("caught interrupt during import, will stop at next batch")
+		}
+		close(stop)
+	}()
+
+	glog.D(logger.Error).Infoln("Importing blockchain ", fn)
+	fh, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if cp := readImportCheckpoint(checkpoint); cp != nil {
+		switch {
+		case cp.File != path || cp.Size != fi.Size():
+			glog.D(logger.Warn).Warnf("Ignoring import checkpoint of another file: %s", cp.File)
+		case !chain.HasBlock(cp.Hash):
+			glog.D(logger.Warn).Warnf("Ignoring import checkpoint at block #%d [%x…], block not in the chain", cp.Number, cp.Hash[:4])
+		default:
+			if _, err := fh.Seek(cp.Offset, io.SeekStart); err != nil {
+				return err
+			}
+			offset = cp.Offset
+			glog.D(logger.Warn).Infof("Resuming import after block #%d [%x…], at offset %d", cp.Number, cp.Hash[:4], cp.Offset)
+		}
+	}
+
+	// Start the decoding and verification stages, they stop when done is closed.
+	done := make(chan struct{})
+	defer close(done)
+
+	decoded := decodeImportBatches(fh, offset, done)
+	verified := verifyImportBatches(chain, seals, decoded, done)
+
+	// Insert the verified batches.
+	progress := newImportProgress(offset, fi.Size())
+	for batch := range verified {
+		select {
+		case <-stop:
+			return fmt.Errorf("interrupted")
+		default:
+		}
+		if batch.err != nil {
+			return batch.err
+		}
+		blocks := batch.blocks
+		if !hasAllBlocks(chain, blocks) {
+			if res := chain.InsertChain(blocks); res.Error != nil {
+				return fmt.Errorf("invalid block %d: %v", blocks[res.Index].NumberU64(), res.Error)
+			}
+		} else {
+			glog.D(logger.Warn).Warnf("skipping batch, all blocks present [#%d / #%d]",
+				blocks[0].NumberU64(), blocks[len(blocks)-1].NumberU64())
+			if seals != nil {
+				seals.forget(blocks)
+			}
+		}
+		if checkpoint != "" {
+			last := blocks[len(blocks)-1]
+			cp := &importCheckpoint{File: path, Size: fi.Size(), Offset: batch.offset, Number: last.NumberU64(), Hash: last.Hash()}
+			if err := writeImportCheckpoint(checkpoint, cp); err != nil {
+				return fmt.Errorf("failed to write import checkpoint: %v", err)
+			}
+		}
+		progress.update(blocks, batch.offset)
+	}
+	progress.report(true)
+
+	if checkpoint != "" {
+		os.Remove(checkpoint)
+	}
+	return nil
+}
+
+// decodeImportBatches decodes the blocks of an RLP stream starting at offset
+// into batches. The genesis block is skipped, and a decoding failure reports
+// the offset of the broken block.
+func decodeImportBatches(r io.Reader, offset int64, done <-chan struct{}) <-chan *importBatch {
+	out := make(chan *importBatch, importQueueSize)
+	go func() {
+		defer close(out)
+
+		counter := &countingReader{r: bufio.NewReaderSize(r, 1024*1024), n: offset}
+		stream := rlp.NewStream(counter, 0)
+		for {
+			batch := &importBatch{blocks: make(types.Blocks, 0, importBatchSize), offset: counter.n}
+			for len(batch.blocks) < importBatchSize {
+				b := new(types.Block)
+				if err := stream.Decode(b); err == io.EOF {
+					break
+				} else if err != nil {
+					batch.err = fmt.Errorf("at offset %d: %v", batch.offset, err)
+					break
+				}
+				batch.offset = counter.n
+
+				// don't import first block
+				if b.NumberU64() == 0 {
+					continue
+				}
+				batch.blocks = append(batch.blocks, b)
+			}
+			if len(batch.blocks) == 0 && batch.err == nil {
+				return
+			}
+			select {
+			case out <- batch:
+			case <-done:
+				return
+			}
+			if batch.err != nil || len(batch.blocks) < importBatchSize {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// verifyImportBatches recovers the transaction senders of the decoded blocks
+// and verifies their seals if seals is set, spreading the blocks of a batch
+// over all the available cores.
+func verifyImportBatches(chain *core.BlockChain, seals *importPoW, in <-chan *importBatch, done <-chan struct{}) <-chan *importBatch {
+	out := make(chan *importBatch, importQueueSize)
+	go func() {
+		defer close(out)
+
+		for batch := range in {
+			if batch.err == nil {
+				batch.err = verifyImportBatch(chain, seals, batch.blocks)
+			}
+			select {
+			case out <- batch:
+			case <-done:
+				return
+			}
+			if batch.err != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func verifyImportBatch(chain *core.BlockChain, seals *importPoW, blocks types.Blocks) error {
+	var (
+		tasks = make(chan int, len(blocks))
+		errs  = make([]error, len(blocks))
+		wg    sync.WaitGroup
+	)
+	for i := range blocks {
+		tasks <- i
+	}
+	close(tasks)
+
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				block := blocks[i]
+				if seals != nil && !seals.preverify(block) {
+					errs[i] = &core.BlockNonceErr{Hash: block.Hash(), Number: block.Number(), Nonce: block.Nonce()}
+					continue
+				}
+				signer := chain.Config().GetSigner(block.Number())
+				for _, tx := range block.Transactions() {
+					if _, err := types.Sender(signer, tx); err != nil {
+						errs[i] = fmt.Errorf("invalid transaction %x: %v", tx.Hash(), err)
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("invalid block %d: %v", blocks[i].NumberU64(), err)
+		}
+	}
+	return nil
+}
+
+func hasAllBlocks(chain *core.BlockChain, bs []*types.Block) bool {
+	for _, b := range bs {
+		if !chain.HasBlock(b.Hash()) {
+			return false
+		}
+	}
+	return true
+}
+
+// importProgress tracks and periodically reports the import rate.
+type importProgress struct {
+	start      time.Time
+	lastReport time.Time
+
+	startOffset int64 // File offset the import started from
+	offset      int64 // File offset of the last inserted block
+	size        int64 // File size
+
+	blocks uint64
+	txs    uint64
+	gas    uint64
+	last   *types.Block
+}
+
+func newImportProgress(offset, size int64) *importProgress {
+	now := time.Now()
+	return &importProgress{start: now, lastReport: now, startOffset: offset, offset: offset, size: size}
+}
+
+// update accounts for a batch of inserted blocks.
+func (p *importProgress) update(blocks types.Blocks, offset int64) {
+	for _, block := range blocks {
+		p.txs += uint64(len(block.Transactions()))
+		p.gas += block.GasUsed().Uint64()
+	}
+	p.blocks += uint64(len(blocks))
+	p.offset = offset
+	p.last = blocks[len(blocks)-1]
+
+	if time.Since(p.lastReport) >= importLogInterval {
+		p.report(false)
+	}
+}
+
+// report logs the import rates and the estimated time left, computed from the
+// share of the file already imported.
+func (p *importProgress) report(final bool) {
+	p.lastReport = time.Now()
+	if p.last == nil {
+		return
+	}
+	var (
+		elapsed = time.Since(p.start)
+		bps     = float64(p.blocks) / elapsed.Seconds()
+		mgasps  = float64(p.gas) / 1e6 / elapsed.Seconds()
+		eta     time.Duration
+	)
+	if read := p.offset - p.startOffset; read > 0 && !final {
+		eta = time.Duration(float64(elapsed) * float64(p.size-p.offset) / float64(read))
+	}
+	if logger.MlogEnabled() {
+		mlogClientImportProgress.AssignDetails(
+			p.blocks,
+			p.txs,
+			p.last.NumberU64(),
+			p.last.Hash().Hex(),
+			p.offset,
+			p.size,
+			bps,
+			mgasps,
+			elapsed,
+			eta,
+		).Send(mlogClient)
+	}
+	if final {
+		glog.D(logger.Warn).Infof("Imported %d blocks, %d txs in %v (%.2f blocks/s, %.2f Mgas/s) #%d [%x…]",
+			p.blocks, p.txs, elapsed.Round(time.Second), bps, mgasps, p.last.NumberU64(), p.last.Hash().Bytes()[:4])
+		return
+	}
+	glog.D(logger.Warn).Infof("Importing: %d blocks, %d txs (%.2f blocks/s, %.2f Mgas/s) #%d [%x…] %.1f%% ETA %v",
+		p.blocks, p.txs, bps, mgasps, p.last.NumberU64(), p.last.Hash().Bytes()[:4],
+		100*float64(p.offset)/float64(p.size), eta.Round(time.Second))
+}
+
+// readImportCheckpoint loads the import checkpoint at path, nil if there is
+// none or it can't be read.
+func readImportCheckpoint(path string) *importCheckpoint {
+	if path == "" {
+		return nil
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.D(logger.Warn).Warnf("Failed to read import checkpoint: %v", err)
+		}
+		return nil
+	}
+	cp := new(importCheckpoint)
+	if err := json.Unmarshal(blob, cp); err != nil {
+		glog.D(logger.Warn).Warnf("Failed to decode import checkpoint: %v", err)
+		return nil
+	}
+	return cp
+}
+
+func writeImportCheckpoint(path string, cp *importCheckpoint) error {
+	blob, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, blob)
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
+)
+
+// newImportTestFile returns the RLP export of a chain of n blocks, genesis
+// included, with the file offset right after every block.
+func newImportTestFile(t *testing.T, n int) ([]byte, []int64, []*types.Block) {
+	db, _ := ngindb.NewMemDatabase()
+	genesis := core.WriteGenesisBlockForTesting(db)
+	blocks, _ := core.GenerateChain(core.DefaultConfigMainnet.ChainConfig, genesis, db, n, nil)
+	blocks = append([]*types.Block{genesis}, blocks...)
+
+	var (
+		buf  bytes.Buffer
+		ends = make([]int64, len(blocks))
+	)
+	for i, block := range blocks {
+		if err := rlp.Encode(&buf, block); err != nil {
+			t.Fatalf("failed to encode block %d: %v", i, err)
+		}
+		ends[i] = int64(buf.Len())
+	}
+	return buf.Bytes(), ends, blocks
+}
+
+// newImportTestChain returns a chain holding the blocks up to head.
+func newImportTestChain(t *testing.T, blocks []*types.Block, head int) *core.BlockChain {
+	db, _ := ngindb.NewMemDatabase()
+	core.WriteGenesisBlockForTesting(db)
+
+	chain, err := core.NewBlockChain(db, core.DefaultConfigMainnet.ChainConfig, core.FakePow{}, new(event.TypeMux))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if head > 0 {
+		if res := chain.InsertChain(blocks[1 : head+1]); res.Error != nil {
+			t.Fatalf("failed to insert chain: %v", res.Error)
+		}
+	}
+	return chain
+}
+
+// Tests that the decoded batches carry the blocks of the stream, the genesis
+// excepted, and the exact file offset right after their last block, also when
+// resuming mid-file, and that a decoding failure reports the offset of the
+// broken block.
+func TestDecodeImportBatches(t *testing.T) {
+	n := importBatchSize + 10
+	data, ends, _ := newImportTestFile(t, n)
+	size := int64(len(data))
+
+	type batch struct {
+		first, last uint64
+		offset      int64
+	}
+	tests := []struct {
+		offset  int64 // File offset to decode from
+		broken  int   // Block replaced by garbage along with the rest, if set
+		batches []batch
+		err     string
+	}{
+		{
+			offset: 0,
+			batches: []batch{
+				{1, uint64(importBatchSize), ends[importBatchSize]},
+				{uint64(importBatchSize) + 1, uint64(n), size},
+			},
+		},
+		{
+			offset: ends[5],
+			batches: []batch{
+				{6, uint64(importBatchSize) + 5, ends[importBatchSize+5]},
+				{uint64(importBatchSize) + 6, uint64(n), size},
+			},
+		},
+		{
+			offset:  ends[n-1],
+			batches: []batch{{uint64(n), uint64(n), size}},
+		},
+		{
+			offset: size,
+		},
+		{
+			offset:  ends[3],
+			broken:  5,
+			batches: []batch{{4, 4, ends[4]}},
+			err:     fmt.Sprintf("at offset %d:", ends[4]),
+		},
+	}
+	for i, tt := range tests {
+		stream := data[tt.offset:]
+		if tt.broken > 0 {
+			stream = append(append([]byte{}, data[tt.offset:ends[tt.broken-1]]...), 0x80)
+		}
+		done := make(chan struct{})
+
+		var (
+			batches []batch
+			err     error
+		)
+		for b := range decodeImportBatches(bytes.NewReader(stream), tt.offset, done) {
+			if len(b.blocks) > 0 {
+				batches = append(batches, batch{b.blocks[0].NumberU64(), b.blocks[len(b.blocks)-1].NumberU64(), b.offset})
+				for j, block := range b.blocks {
+					if want := b.blocks[0].NumberU64() + uint64(j); block.NumberU64() != want {
+						t.Errorf("test %d: block number mismatch: have %d, want %d", i, block.NumberU64(), want)
+					}
+				}
+			}
+			if b.err != nil {
+				err = b.err
+			}
+		}
+		close(done)
+
+		if fmt.Sprint(batches) != fmt.Sprint(tt.batches) {
+			t.Errorf("test %d: batches mismatch: have %v, want %v", i, batches, tt.batches)
+		}
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+			t.Errorf("test %d: error mismatch: have %v, want %q", i, err, tt.err+"…")
+		}
+	}
+}
+
+// Tests that an import resumes from the checkpoint of the same file if the
+// chain has its block, and that a checkpoint of another file or at a block
+// not in the chain is ignored.
+func TestImportChainCheckpoint(t *testing.T) {
+	const n, head = 8, 3
+
+	dir, err := ioutil.TempDir("", "ngind-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, ends, blocks := newImportTestFile(t, n)
+	size := int64(len(data))
+
+	// The blocks before the checkpoint are garbled, only a resumed import
+	// gets through the file.
+	garbled := append([]byte{}, data...)
+	for i := int64(0); i < ends[head]; i++ {
+		garbled[i] = 0xff
+	}
+	fn, other := filepath.Join(dir, "chain.rlp"), filepath.Join(dir, "other.rlp")
+	if err := ioutil.WriteFile(other, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := filepath.Join(dir, importCheckpointFile)
+
+	// Checkpoints at the end of the file, importing nothing if not ignored.
+	unknown := types.NewBlockWithHeader(&types.Header{Number: blocks[head].Number(), Extra: []byte("unknown")})
+	tests := []struct {
+		file       []byte
+		checkpoint *importCheckpoint
+	}{
+		{data, nil},
+		{data, &importCheckpoint{File: other, Size: size, Offset: size, Number: n, Hash: blocks[n].Hash()}},
+		{data, &importCheckpoint{File: fn, Size: size + 1, Offset: size, Number: n, Hash: blocks[n].Hash()}},
+		{data, &importCheckpoint{File: fn, Size: size, Offset: size, Number: head, Hash: unknown.Hash()}},
+		{data, &importCheckpoint{File: fn, Size: size, Offset: size, Number: n, Hash: blocks[n].Hash()}},
+		{garbled, &importCheckpoint{File: fn, Size: size, Offset: ends[head], Number: head, Hash: blocks[head].Hash()}},
+	}
+	for i, tt := range tests {
+		if err := ioutil.WriteFile(fn, tt.file, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(checkpoint)
+		if tt.checkpoint != nil {
+			if err := writeImportCheckpoint(checkpoint, tt.checkpoint); err != nil {
+				t.Fatalf("test %d: failed to write checkpoint: %v", i, err)
+			}
+		}
+		chain := newImportTestChain(t, blocks, head)
+		if err := ImportChain(chain, nil, fn, checkpoint); err != nil {
+			t.Fatalf("test %d: import failed: %v", i, err)
+		}
+		if have := chain.CurrentBlock().Hash(); have != blocks[n].Hash() {
+			t.Errorf("test %d: head mismatch: have #%d [%x], want #%d [%x]", i,
+				chain.CurrentBlock().NumberU64(), have[:4], n, blocks[n].Hash().Bytes()[:4])
+		}
+		if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+			t.Errorf("test %d: checkpoint left after import: %v", i, err)
+		}
+	}
+}
@@ -84,6 +84,8 @@ func makeCLIApp() (app *cli.App) {
 	app.Commands = []cli.Command{
 		importCommand,
 		exportCommand,
+		exportHistoryCommand,
+		importHistoryCommand,
 		dumpChainConfigCommand,
 		upgradedbCommand,
 		dumpCommand,
@@ -101,6 +103,11 @@ func makeCLIApp() (app *cli.App) {
 		versionCommand,
 		makeMlogDocCommand,
 		buildAddrTxIndexCommand,
+		migrateAddrTxIndexCommand,
+		addrTxIndexCommand,
+		buildBalanceHistoryCommand,
+		snapshotCommand,
+		dbCommand,
 	}
 
 	app.Flags = []cli.Flag{
@@ -110,17 +117,32 @@ func makeCLIApp() (app *cli.App) {
 		NodeNameFlag,
 		UnlockedAccountFlag,
 		PasswordFileFlag,
+		SignerFlag,
 		AccountsIndexFlag,
 		BootnodesFlag,
 		DataDirFlag,
+		DBEngineFlag,
+		AncientDirFlag,
+		AncientThresholdFlag,
+		AncientNoCompressFlag,
 		DocRootFlag,
 		KeyStoreDirFlag,
 		ChainIdentityFlag,
 		BlockchainVersionFlag,
 		FastSyncFlag,
+		LightModeFlag,
+		LightServFlag,
+		LightPeersFlag,
 		AddrTxIndexFlag,
 		AddrTxIndexAutoBuildFlag,
+		AddrTxIndexTokensFlag,
+		AddrTxIndexInternalFlag,
+		BalanceHistoryFlag,
 		CacheFlag,
+		GCModeFlag,
+		StateRegenLimitFlag,
+		StateRegenTimeoutFlag,
+		StateSnapshotFlag,
 		LightKDFFlag,
 		JSpathFlag,
 		ListenPortFlag,
@@ -135,6 +157,7 @@ func makeCLIApp() (app *cli.App) {
 		NATFlag,
 		NatspecEnabledFlag,
 		NoDiscoverFlag,
+		NetrestrictFlag,
 		NodeKeyFileFlag,
 		NodeKeyHexFlag,
 		RPCEnabledFlag,
@@ -299,7 +322,7 @@ func ng(ctx *cli.Context) error {
 	n := MakeSystemNode(Version, ctx)
 	ethe := startNode(ctx, n)
 
-	if ctx.GlobalString(LogStatusFlag.Name) != "off" {
+	if ethe != nil && ctx.GlobalString(LogStatusFlag.Name) != "off" {
 		dispatchStatusLogs(ctx, ethe)
 	}
 	logLoggingConfiguration(ctx)
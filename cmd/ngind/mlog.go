@@ -9,6 +9,7 @@ var mlogClient = logger.MLogRegisterAvailable("client", mlogLinesClient)
 var mlogLinesClient = []*logger.MLogT{
 	mlogClientStartup,
 	mlogClientShutdown,
+	mlogClientImportProgress,
 }
 
 var clientDetails = []logger.MLogDetailT{
@@ -46,3 +47,22 @@ var mlogClientShutdown = &logger.MLogT{
 			{Owner: "STOP", Key: "ERROR", Value: "STRING_OR_NULL"},
 			{Owner: "CLIENT", Key: "DURATION", Value: "INT"}}...),
 }
+
+var mlogClientImportProgress = &logger.MLogT{
+	Description: "Called periodically while importing a blockchain file, and once the import is done.",
+	Receiver:    "CLIENT",
+	Verb:        "IMPORT",
+	Subject:     "PROGRESS",
+	Details: []logger.MLogDetailT{
+		{Owner: "IMPORT", Key: "BLOCKS", Value: "INT"},
+		{Owner: "IMPORT", Key: "TRANSACTIONS", Value: "INT"},
+		{Owner: "IMPORT", Key: "LAST_NUMBER", Value: "INT"},
+		{Owner: "IMPORT", Key: "LAST_HASH", Value: "STRING"},
+		{Owner: "IMPORT", Key: "OFFSET", Value: "INT"},
+		{Owner: "IMPORT", Key: "SIZE", Value: "INT"},
+		{Owner: "IMPORT", Key: "BLOCKS_PER_SECOND", Value: "NUMBER"},
+		{Owner: "IMPORT", Key: "MGAS_PER_SECOND", Value: "NUMBER"},
+		{Owner: "IMPORT", Key: "ELAPSED", Value: "DURATION"},
+		{Owner: "IMPORT", Key: "ETA", Value: "DURATION"},
+	},
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/state/pruner"
+	"github.com/NginProject/ngind/logger/glog"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var snapshotCommand = cli.Command{
+	Name:  "snapshot",
+	Usage: "Manage the state database",
+	Subcommands: []cli.Command{
+		{
+			Action: pruneState,
+			Name:   "prune-state",
+			Usage:  "Delete state trie nodes unreachable from the recent states",
+			Description: `
+	Deletes the state trie nodes and contract code which are not reachable from
+	the state of the chain head, the states of the most recent blocks (see --retain)
+	or the genesis state, then compacts the chain database.
+
+	The node must not be running. The retained states are marked in a bloom filter
+	persisted to <DATADIR>/<CHAINDIR>/statebloom.bf, so the command is safe to
+	interrupt: running it again resumes the prune where it was left off.
+
+	Once pruned, historical states older than the retained ones are no longer
+	available to queries and tracing.
+			`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "bloomfilter.size",
+					Usage: "Megabytes of memory allocated to the bloom filter of the retained nodes",
+					Value: 2048,
+				},
+				cli.IntFlag{
+					Name:  "retain",
+					Usage: "Number of recent states to keep besides the chain head",
+					Value: core.TriesInMemory,
+				},
+			},
+		},
+	},
+}
+
+func pruneState(ctx *cli.Context) error {
+	chainDb := MakeChainDatabase(ctx)
+	defer chainDb.Close()
+
+	p := pruner.NewPruner(chainDb, MustMakeChainDataDir(ctx), uint64(ctx.Int("bloomfilter.size")), uint64(ctx.Int("retain")))
+	if err := p.Prune(); err != nil {
+		glog.Fatalf("State pruning failed: %v", err)
+	}
+	return nil
+}
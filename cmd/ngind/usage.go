@@ -73,12 +73,23 @@ var AppHelpFlagAndCommandGroups = []flagGroup{
 		},
 		Flags: []cli.Flag{
 			DataDirFlag,
+			DBEngineFlag,
+			AncientDirFlag,
+			AncientThresholdFlag,
+			AncientNoCompressFlag,
 			ChainIdentityFlag,
 			NetworkIdFlag,
 			DevModeFlag,
 			NodeNameFlag,
 			FastSyncFlag,
+			LightModeFlag,
+			LightServFlag,
+			LightPeersFlag,
 			CacheFlag,
+			GCModeFlag,
+			StateRegenLimitFlag,
+			StateRegenTimeoutFlag,
+			StateSnapshotFlag,
 			LightKDFFlag,
 			SputnikVMFlag,
 			BlockchainVersionFlag,
@@ -90,14 +101,21 @@ var AppHelpFlagAndCommandGroups = []flagGroup{
 			accountCommand,
 			walletCommand,
 			buildAddrTxIndexCommand,
+			migrateAddrTxIndexCommand,
+			addrTxIndexCommand,
+			buildBalanceHistoryCommand,
 		},
 		Flags: []cli.Flag{
 			KeyStoreDirFlag,
 			UnlockedAccountFlag,
 			PasswordFileFlag,
+			SignerFlag,
 			AccountsIndexFlag,
 			AddrTxIndexFlag,
 			AddrTxIndexAutoBuildFlag,
+			AddrTxIndexTokensFlag,
+			AddrTxIndexInternalFlag,
+			BalanceHistoryFlag,
 		},
 	},
 	{
@@ -136,6 +154,7 @@ var AppHelpFlagAndCommandGroups = []flagGroup{
 			MaxPendingPeersFlag,
 			NATFlag,
 			NoDiscoverFlag,
+			NetrestrictFlag,
 			NodeKeyFileFlag,
 			NodeKeyHexFlag,
 		},
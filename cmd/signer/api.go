@@ -0,0 +1,214 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/common/hexutil"
+	"github.com/NginProject/ngind/console"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+)
+
+// Methods of the signer namespace, as named in the audit log.
+const (
+	methodSignTx    = "signTransaction"
+	methodSignData  = "signData"
+	methodSignTyped = "signTypedData"
+)
+
+var errRejected = errors.New("request rejected")
+
+// SignerAPI serves the signer namespace, see accounts.SignerNamespace. Each
+// request is checked against the rules and, when they don't approve it, asked
+// for on the console. Requests are handled one at a time.
+type SignerAPI struct {
+	am          *accounts.Manager
+	rules       *Rules
+	ledger      *ledger
+	audit       *auditLog
+	interactive bool
+
+	mu sync.Mutex
+}
+
+// Accounts returns the addresses of the accounts of the keystore.
+func (api *SignerAPI) Accounts() []common.Address {
+	accs := api.am.Accounts()
+	addrs := make([]common.Address, len(accs))
+	for i, acc := range accs {
+		addrs[i] = acc.Address
+	}
+	return addrs
+}
+
+// SignTransaction signs the hash of a transaction once approved, returning the
+// signature.
+func (api *SignerAPI) SignTransaction(req accounts.SignTxRequest) (hexutil.Bytes, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	tx, signer, err := req.Transaction()
+	if err != nil {
+		return nil, err
+	}
+	id, err := api.received(methodSignTx, &req)
+	if err != nil {
+		return nil, err
+	}
+	reasons := api.rules.checkTx(&req, api.ledger)
+	summary := fmt.Sprintf("Transaction from 0x%x\n  to:        %s\n  value:     %v wei\n  gas:       %v\n  gas price: %v wei\n  nonce:     %d\n  data:      0x%x\n  chain id:  %v",
+		req.From, recipient(req.To), req.Value.ToInt(), req.Gas.ToInt(), req.GasPrice.ToInt(), req.Nonce, []byte(req.Data), req.ChainID)
+	by, err := api.decide(id, methodSignTx, &req, summary, reasons)
+	if err != nil {
+		return nil, err
+	}
+	// Counted once approved, even if signing then fails
+	api.ledger.addTx(time.Now(), &req)
+	return api.sign(id, methodSignTx, req.From, by, signer.Hash(tx).Bytes())
+}
+
+// SignData signs the hash of a message once approved, see accounts.TextHash,
+// returning the signature.
+func (api *SignerAPI) SignData(req accounts.SignDataRequest) (hexutil.Bytes, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	id, err := api.received(methodSignData, &req)
+	if err != nil {
+		return nil, err
+	}
+	summary := fmt.Sprintf("Message from 0x%x\n  data: 0x%x\n  text: %q", req.From, []byte(req.Data), string(req.Data))
+	by, err := api.decide(id, methodSignData, &req, summary, api.rules.checkData(&req))
+	if err != nil {
+		return nil, err
+	}
+	return api.sign(id, methodSignData, req.From, by, accounts.TextHash(req.Data))
+}
+
+// SignTypedData signs the EIP-712 hash of typed structured data once approved,
+// returning the signature.
+func (api *SignerAPI) SignTypedData(req accounts.SignTypedDataRequest) (hexutil.Bytes, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	hash, err := req.Data.Hash()
+	if err != nil {
+		return nil, err
+	}
+	id, err := api.received(methodSignTyped, &req)
+	if err != nil {
+		return nil, err
+	}
+	domain, _ := json.Marshal(req.Data.Domain)
+	message, _ := json.MarshalIndent(req.Data.Message, "    ", "  ")
+	summary := fmt.Sprintf("Typed data from 0x%x\n  domain:  %s\n  type:    %s\n  message: %s\n  hash:    0x%x",
+		req.From, domain, req.Data.PrimaryType, message, hash)
+	by, err := api.decide(id, methodSignTyped, &req, summary, api.rules.checkTypedData(&req))
+	if err != nil {
+		return nil, err
+	}
+	return api.sign(id, methodSignTyped, req.From, by, hash)
+}
+
+// received logs a new request, returning its id.
+func (api *SignerAPI) received(method string, req interface{}) (uint64, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	id := api.audit.nextID()
+	return id, api.audit.write(&auditEntry{ID: id, Event: eventRequest, Method: method, Request: data})
+}
+
+// decide approves a request by the rules when there are no reasons against it,
+// or else asks on the console. It logs the decision, returning who took it.
+func (api *SignerAPI) decide(id uint64, method string, req interface{}, summary string, reasons []string) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	entry := &auditEntry{ID: id, Event: eventApproved, Method: method, Request: data, By: "rules", Reasons: reasons}
+	if len(reasons) > 0 {
+		entry.By = "console"
+		if !api.confirm(id, summary, reasons) {
+			entry.Event = eventRejected
+		}
+	}
+	glog.V(logger.Info).Infof("Request #%d (%s) %s by %s", id, method, entry.Event, entry.By)
+	if err := api.audit.write(entry); err != nil {
+		return "", err
+	}
+	if entry.Event == eventRejected {
+		return "", fmt.Errorf("%v: %s", errRejected, strings.Join(reasons, ", "))
+	}
+	return entry.By, nil
+}
+
+// confirm asks on the console whether to approve a request, unless running
+// non-interactively.
+func (api *SignerAPI) confirm(id uint64, summary string, reasons []string) bool {
+	if !api.interactive {
+		return false
+	}
+	fmt.Printf("\nRequest #%d needs approval:\n%s\nNot approved by the rules:\n", id, summary)
+	for _, reason := range reasons {
+		fmt.Printf("  - %s\n", reason)
+	}
+	ok, err := console.Stdin.PromptConfirm("Approve")
+	if err != nil {
+		glog.V(logger.Error).Errorf("Failed to read approval: %v", err)
+		return false
+	}
+	return ok
+}
+
+// sign signs hash with the key of addr, logging the outcome. Keys are to be
+// unlocked for requests approved by the rules, the passphrase of locked keys is
+// asked for on the console for the approved ones.
+func (api *SignerAPI) sign(id uint64, method string, addr common.Address, by string, hash []byte) (hexutil.Bytes, error) {
+	sig, err := api.am.Sign(addr, hash)
+	if err == accounts.ErrLocked && by == "console" {
+		var passphrase string
+		if passphrase, err = console.Stdin.PromptPassword(fmt.Sprintf("Passphrase of 0x%x: ", addr)); err == nil {
+			sig, err = api.am.SignWithPassphrase(addr, passphrase, hash)
+		}
+	}
+	entry := &auditEntry{ID: id, Event: eventSigned, Method: method}
+	if err != nil {
+		entry.Event, entry.Error = eventFailed, err.Error()
+	}
+	if werr := api.audit.write(entry); werr != nil {
+		return nil, werr
+	}
+	return sig, err
+}
+
+func recipient(to *common.Address) string {
+	if to == nil {
+		return "contract creation"
+	}
+	return fmt.Sprintf("0x%x", *to)
+}
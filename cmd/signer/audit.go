@@ -0,0 +1,173 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+)
+
+// Audit log events. Every request is logged when received, then its decision
+// and, for approved ones, whether signing succeeded.
+const (
+	eventRequest  = "request"
+	eventApproved = "approved"
+	eventRejected = "rejected"
+	eventSigned   = "signed"
+	eventFailed   = "failed"
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time    time.Time       `json:"time"`
+	ID      uint64          `json:"id"`
+	Event   string          `json:"event"`
+	Method  string          `json:"method"`
+	Request json.RawMessage `json:"request,omitempty"`
+	By      string          `json:"by,omitempty"` // "rules" or "console", for decisions
+	Reasons []string        `json:"reasons,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// auditLog is the append-only audit log, a file of JSON entries, one per line.
+// Entries are synced to disk before the request proceeds, requests can't be
+// served when the log can't be written.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	id   uint64
+}
+
+// openAuditLog opens the audit log at path, replaying the transactions approved
+// today into the ledger.
+func openAuditLog(path string, l *ledger) (*auditLog, error) {
+	log := new(auditLog)
+	if err := log.replay(path, l); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.file = f
+	return log, nil
+}
+
+// replay reads the existing entries, restoring the last request id and the
+// value approved today per account. A final entry torn by a crash while it
+// was written is dropped from the file, its request having never proceeded.
+func (log *auditLog) replay(path string, l *ledger) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		reader = bufio.NewReader(f)
+		offset int64
+	)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		var entry auditEntry
+		if jsonErr := json.Unmarshal(data, &entry); jsonErr != nil {
+			if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+				return fmt.Errorf("%s:%d: %v", path, line, jsonErr)
+			}
+			glog.V(logger.Warn).Warnf("Dropping torn entry at %s:%d: %v", path, line, jsonErr)
+			return os.Truncate(path, offset)
+		}
+		offset += int64(len(data))
+
+		if entry.ID > log.id {
+			log.id = entry.ID
+		}
+		if entry.Event == eventApproved && entry.Method == methodSignTx {
+			var req accounts.SignTxRequest
+			if err := json.Unmarshal(entry.Request, &req); err != nil || req.Value == nil {
+				return fmt.Errorf("%s:%d: invalid transaction request", path, line)
+			}
+			l.addTx(entry.Time, &req)
+		}
+		if err == io.EOF {
+			// Terminate the entry, the next one would be appended to it
+			return appendNewline(path)
+		}
+	}
+}
+
+func appendNewline(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte{'\n'}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// nextID returns the id of a new request.
+func (log *auditLog) nextID() uint64 {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	log.id++
+	return log.id
+}
+
+// write appends an entry to the log.
+func (log *auditLog) write(entry *auditEntry) error {
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if _, err := log.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("audit log: %v", err)
+	}
+	if err := log.file.Sync(); err != nil {
+		return fmt.Errorf("audit log: %v", err)
+	}
+	return nil
+}
+
+func (log *auditLog) close() error {
+	return log.file.Close()
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+)
+
+// approvedEntry returns the log line of a transaction of value wei approved
+// as request id.
+func approvedEntry(t *testing.T, id uint64, value int64) string {
+	req, err := json.Marshal(txRequest(testRecipient, value, nil, 61))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&auditEntry{Time: time.Now(), ID: id, Event: eventApproved, Method: methodSignTx, Request: req})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data) + "\n"
+}
+
+// Tests that replaying the audit log restores the request id and the value
+// approved today, dropping a final entry torn by a crash and failing on
+// corrupted entries before the last.
+func TestAuditLogReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	entries := approvedEntry(t, 1, 10) + approvedEntry(t, 2, 20)
+	torn := approvedEntry(t, 3, 30)
+	torn = torn[:len(torn)/2]
+
+	tests := []struct {
+		content string
+		ok      bool
+		id      uint64
+		spent   int64
+		after   string
+	}{
+		{entries, true, 2, 30, entries},
+		{entries + torn, true, 2, 30, entries},
+		{entries + torn + "\n", true, 2, 30, entries},
+		{strings.TrimSuffix(entries, "\n"), true, 2, 30, entries},
+		{torn + "\n" + entries, false, 0, 0, ""},
+	}
+	for i, tt := range tests {
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		l := newLedger()
+		log, err := openAuditLog(path, l)
+		if (err == nil) != tt.ok {
+			t.Fatalf("test %d: error mismatch: have %v, want ok %v", i, err, tt.ok)
+		}
+		if err != nil {
+			continue
+		}
+		log.close()
+		if log.id != tt.id {
+			t.Errorf("test %d: id mismatch: have %d, want %d", i, log.id, tt.id)
+		}
+		if spent := l.get(testSender, common.Address{}); spent.Cmp(big.NewInt(tt.spent)) != 0 {
+			t.Errorf("test %d: spent mismatch: have %v, want %d", i, spent, tt.spent)
+		}
+		if data, _ := ioutil.ReadFile(path); string(data) != tt.after {
+			t.Errorf("test %d: log content mismatch: have %q, want %q", i, data, tt.after)
+		}
+	}
+}
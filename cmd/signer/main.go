@@ -0,0 +1,260 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+// signer is a signing daemon holding the keys of a keystore, to be used as the
+// external signer of ngind (ngind --signer <endpoint>).
+//
+// Signing requests are approved automatically when they comply with the rules,
+// see Rules, or else asked for on the console. Every request and decision is
+// appended to the audit log.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/console"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/rpc"
+)
+
+// Version is the application revision identifier. It can be set with the linker
+// as in: go build -ldflags "-X main.Version="`git describe --tags`
+var Version = "unknown"
+
+var (
+	KeyStoreDirFlag = cli.StringFlag{
+		Name:  "keystore",
+		Usage: "Directory of the keystore, in the format of ngind",
+	}
+	LightKDFFlag = cli.BoolFlag{
+		Name:  "lightkdf",
+		Usage: "Reduce key-derivation RAM & CPU usage at some expense of KDF strength",
+	}
+	UnlockedAccountFlag = cli.StringFlag{
+		Name:  "unlock",
+		Usage: "Comma separated list of accounts to unlock, for the requests approved by the rules",
+	}
+	PasswordFileFlag = cli.StringFlag{
+		Name:  "password",
+		Usage: "Password file to use for non-interactive password input",
+	}
+	RulesFlag = cli.StringFlag{
+		Name:  "rules",
+		Usage: "JSON file of the rules approving requests automatically",
+	}
+	AuditLogFlag = cli.StringFlag{
+		Name:  "audit",
+		Usage: "Audit log file, appended to (default: signer-audit.log beside the keystore)",
+	}
+	IPCPathFlag = cli.StringFlag{
+		Name:  "ipcpath",
+		Usage: "Filename for the IPC socket/pipe (default: signer.ipc beside the keystore)",
+	}
+	IPCDisabledFlag = cli.BoolFlag{
+		Name:  "ipcdisable",
+		Usage: "Disable the IPC endpoint",
+	}
+	HTTPFlag = cli.StringFlag{
+		Name:  "http",
+		Usage: "Listen address of the HTTP endpoint, eg. 127.0.0.1:8550, disabled if empty. It isn't authenticated: never expose it",
+	}
+	NoConsoleFlag = cli.BoolFlag{
+		Name:  "noconsole",
+		Usage: "Reject the requests not approved by the rules instead of asking on the console",
+	}
+	VerbosityFlag = cli.IntFlag{
+		Name:  "verbosity",
+		Usage: "Logging verbosity: 0=silent, 1=error, 2=warn, 3=info, 4=core, 5=debug, 6=detail",
+		Value: 3,
+	}
+)
+
+var app *cli.App
+
+func init() {
+	app = cli.NewApp()
+	app.Name = filepath.Base(os.Args[0])
+	app.Version = Version
+	app.Usage = "the rule based signing daemon"
+	app.Action = run
+	app.Flags = []cli.Flag{
+		KeyStoreDirFlag,
+		LightKDFFlag,
+		UnlockedAccountFlag,
+		PasswordFileFlag,
+		RulesFlag,
+		AuditLogFlag,
+		IPCPathFlag,
+		IPCDisabledFlag,
+		HTTPFlag,
+		NoConsoleFlag,
+		VerbosityFlag,
+	}
+}
+
+func run(ctx *cli.Context) error {
+	glog.SetToStderr(true)
+	glog.SetV(ctx.GlobalInt(VerbosityFlag.Name))
+
+	keydir := ctx.GlobalString(KeyStoreDirFlag.Name)
+	if keydir == "" {
+		log.Fatalf("No keystore given, use --%s", KeyStoreDirFlag.Name)
+	}
+	keydir, err := filepath.Abs(keydir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scryptN, scryptP := accounts.StandardScryptN, accounts.StandardScryptP
+	if ctx.GlobalBool(LightKDFFlag.Name) {
+		scryptN, scryptP = accounts.LightScryptN, accounts.LightScryptP
+	}
+	am, err := accounts.NewManager(keydir, scryptN, scryptP, false)
+	if err != nil {
+		log.Fatalf("Failed to open keystore %s: %v", keydir, err)
+	}
+	unlockAccounts(ctx, am)
+
+	rules, err := loadRules(ctx.GlobalString(RulesFlag.Name))
+	if err != nil {
+		log.Fatalf("Failed to load rules: %v", err)
+	}
+	auditPath := ctx.GlobalString(AuditLogFlag.Name)
+	if auditPath == "" {
+		auditPath = filepath.Join(filepath.Dir(keydir), "signer-audit.log")
+	}
+	l := newLedger()
+	audit, err := openAuditLog(auditPath, l)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer audit.close()
+
+	server := rpc.NewServer()
+	api := &SignerAPI{am: am, rules: rules, ledger: l, audit: audit, interactive: !ctx.GlobalBool(NoConsoleFlag.Name)}
+	if err := server.RegisterName(accounts.SignerNamespace, api); err != nil {
+		log.Fatal(err)
+	}
+	defer server.Stop()
+
+	var listeners []net.Listener
+	if !ctx.GlobalBool(IPCDisabledFlag.Name) {
+		endpoint := ctx.GlobalString(IPCPathFlag.Name)
+		if endpoint == "" {
+			endpoint = filepath.Join(filepath.Dir(keydir), "signer.ipc")
+		}
+		listener, err := rpc.CreateIPCListener(endpoint)
+		if err != nil {
+			log.Fatalf("Failed to open IPC endpoint: %v", err)
+		}
+		listeners = append(listeners, listener)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go server.ServeCodec(rpc.NewJSONCodec(conn), rpc.OptionMethodInvocation)
+			}
+		}()
+		glog.V(logger.Info).Infof("IPC endpoint opened: %s", endpoint)
+	}
+	if endpoint := ctx.GlobalString(HTTPFlag.Name); endpoint != "" {
+		listener, err := net.Listen("tcp", endpoint)
+		if err != nil {
+			log.Fatalf("Failed to open HTTP endpoint: %v", err)
+		}
+		listeners = append(listeners, listener)
+		go rpc.NewHTTPServer("", server).Serve(listener)
+		glog.V(logger.Info).Infof("HTTP endpoint opened: http://%s", endpoint)
+	}
+	if len(listeners) == 0 {
+		log.Fatal("No endpoint enabled")
+	}
+	glog.V(logger.Info).Infof("Signing for %d accounts, audit log %s", len(am.Accounts()), auditPath)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	<-sigc
+	glog.V(logger.Info).Infoln("Shutting down")
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	return nil
+}
+
+// unlockAccounts unlocks the accounts given by the unlock flag, with the
+// passwords of the password file or prompted for.
+func unlockAccounts(ctx *cli.Context, am *accounts.Manager) {
+	var passwords []string
+	if file := ctx.GlobalString(PasswordFileFlag.Name); file != "" {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("Failed to read password file: %v", err)
+		}
+		passwords = strings.Split(string(text), "\n")
+		for i := range passwords {
+			passwords[i] = strings.TrimRight(passwords[i], "\r")
+		}
+	}
+	var i int
+	for _, addr := range strings.Split(ctx.GlobalString(UnlockedAccountFlag.Name), ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if !common.IsHexAddress(addr) {
+			log.Fatalf("Invalid account address %q", addr)
+		}
+		account := accounts.Account{Address: common.HexToAddress(addr)}
+
+		var password string
+		switch {
+		case i < len(passwords):
+			password = passwords[i]
+		case len(passwords) > 0:
+			password = passwords[len(passwords)-1]
+		default:
+			var err error
+			if password, err = console.Stdin.PromptPassword(fmt.Sprintf("Passphrase of %s: ", addr)); err != nil {
+				log.Fatalf("Failed to read passphrase: %v", err)
+			}
+		}
+		if err := am.Unlock(account, password); err != nil {
+			log.Fatalf("Failed to unlock account %s: %v", addr, err)
+		}
+		glog.V(logger.Info).Infof("Unlocked account %x", account.Address)
+		i++
+	}
+}
+
+func main() {
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/common/hexutil"
+)
+
+// Rules is the policy requests are automatically approved by, loaded from a
+// JSON file:
+//
+//   {
+//     "chainId":          "61",           // chain id transactions must be replay protected for
+//     "recipients":       ["0x…"],        // allowlisted recipients
+//     "methods":          ["0xa9059cbb"], // allowed method selectors of calls carrying data
+//     "dailyLimit":       "1000000000000000000000", // total value per account and UTC day, in wei
+//     "tokenDailyLimits": {"0x…": "1000"}, // total token amount per account and UTC day, by token contract
+//     "maxGasPrice":      "50000000000",  // in wei
+//     "signData":         false,          // approve signing of messages
+//     "signTypedData":    false           // approve signing of EIP-712 typed data
+//   }
+//
+// A transaction is approved when it's replay protected for the chain id, goes
+// to an allowlisted recipient, its data, if any, calls an allowed method, and
+// it keeps within the limits. Contract creations are never approved by the
+// rules. Unset limits don't apply.
+//
+// The ERC-20 transfer, approve and transferFrom calls are decoded, and the
+// receiver of the tokens, or the spender approved, must be allowlisted too.
+// With a daily limit or token daily limits set, their amounts are counted
+// against the daily limit of the token called. Calls of tokens without a daily
+// limit of their own are then not approved, their amounts being in units the
+// limit in wei says nothing about.
+type Rules struct {
+	ChainID     *amount                    `json:"chainId"`
+	Recipients  []common.Address           `json:"recipients"`
+	Methods     []hexutil.Bytes            `json:"methods"`
+	DailyLimit  *amount                    `json:"dailyLimit"`
+	TokenLimits map[string]*amount         `json:"tokenDailyLimits"`
+	MaxGasPrice *amount                    `json:"maxGasPrice"`
+	SignData    bool                       `json:"signData"`
+	SignTyped   bool                       `json:"signTypedData"`
+
+	tokenLimits map[common.Address]*amount // TokenLimits by parsed address
+}
+
+// Method selectors of the ERC-20 calls moving tokens, or allowing to.
+var (
+	erc20Transfer     = []byte{0xa9, 0x05, 0x9c, 0xbb} // transfer(address,uint256)
+	erc20Approve      = []byte{0x09, 0x5e, 0xa7, 0xb3} // approve(address,uint256)
+	erc20TransferFrom = []byte{0x23, 0xb8, 0x72, 0xdd} // transferFrom(address,address,uint256)
+)
+
+// decodeTokenCall decodes the recipient and amount of an ERC-20 transfer,
+// approve or transferFrom call, the recipient being the spender of approve.
+// ok reports whether data calls one of them, amount is nil if the call is
+// malformed.
+func decodeTokenCall(data []byte) (recipient common.Address, amount *big.Int, ok bool) {
+	if len(data) < 4 {
+		return common.Address{}, nil, false
+	}
+	var args, arg int
+	switch string(data[:4]) {
+	case string(erc20Transfer), string(erc20Approve):
+		args, arg = 2, 0
+	case string(erc20TransferFrom):
+		args, arg = 3, 1
+	default:
+		return common.Address{}, nil, false
+	}
+	if len(data) != 4+32*args {
+		return common.Address{}, nil, true
+	}
+	for i := 0; i < args-1; i++ {
+		if word := data[4+32*i : 4+32*(i+1)]; new(big.Int).SetBytes(word[:12]).Sign() != 0 {
+			return common.Address{}, nil, true
+		}
+	}
+	recipient = common.BytesToAddress(data[4+32*arg : 4+32*(arg+1)])
+	return recipient, new(big.Int).SetBytes(data[4+32*(args-1):]), true
+}
+
+// amount is a wei amount, given as a decimal or 0x prefixed hex string.
+type amount big.Int
+
+func (a *amount) UnmarshalText(text []byte) error {
+	if _, ok := (*big.Int)(a).SetString(string(text), 0); !ok || (*big.Int)(a).Sign() < 0 {
+		return fmt.Errorf("invalid amount %q", text)
+	}
+	return nil
+}
+
+func (a *amount) MarshalText() ([]byte, error) {
+	return []byte((*big.Int)(a).String()), nil
+}
+
+// loadRules reads the rules from a JSON file. Without file, no request is
+// approved by the rules.
+func loadRules(file string) (*Rules, error) {
+	rules := new(Rules)
+	if file == "" {
+		return rules, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if rules.ChainID == nil || (*big.Int)(rules.ChainID).Sign() == 0 {
+		return nil, fmt.Errorf("%s: chainId required", file)
+	}
+	for _, m := range rules.Methods {
+		if len(m) != 4 {
+			return nil, fmt.Errorf("%s: invalid method selector %s, must be 4 bytes", file, m)
+		}
+	}
+	rules.tokenLimits = make(map[common.Address]*amount, len(rules.TokenLimits))
+	for token, limit := range rules.TokenLimits {
+		if !common.IsHexAddress(token) || limit == nil {
+			return nil, fmt.Errorf("%s: invalid daily limit of token %s", file, token)
+		}
+		rules.tokenLimits[common.HexToAddress(token)] = limit
+	}
+	return rules, nil
+}
+
+// checkTx returns the reasons why a transaction isn't approved by the rules,
+// none if it is. l holds the value and token amounts already approved today.
+func (r *Rules) checkTx(req *accounts.SignTxRequest, l *ledger) []string {
+	var reasons []string
+	switch {
+	case req.ChainID == nil:
+		reasons = append(reasons, "transaction not replay protected")
+	case r.ChainID == nil || req.ChainID.ToInt().Cmp((*big.Int)(r.ChainID)) != 0:
+		reasons = append(reasons, fmt.Sprintf("chain id %v not allowed", req.ChainID.ToInt()))
+	}
+	if req.To == nil {
+		reasons = append(reasons, "contract creation")
+	} else if !r.allowedRecipient(*req.To) {
+		reasons = append(reasons, fmt.Sprintf("recipient 0x%x not allowlisted", *req.To))
+	}
+	if len(req.Data) > 0 && !r.allowedMethod(req.Data) {
+		if len(req.Data) < 4 {
+			reasons = append(reasons, fmt.Sprintf("data 0x%x holds no method selector", []byte(req.Data)))
+		} else {
+			reasons = append(reasons, fmt.Sprintf("method 0x%x not allowed", []byte(req.Data[:4])))
+		}
+	}
+	if r.MaxGasPrice != nil && req.GasPrice.ToInt().Cmp((*big.Int)(r.MaxGasPrice)) > 0 {
+		reasons = append(reasons, fmt.Sprintf("gas price %v above maximum %v", req.GasPrice.ToInt(), (*big.Int)(r.MaxGasPrice)))
+	}
+	if r.DailyLimit != nil {
+		total := new(big.Int).Add(l.get(req.From, common.Address{}), req.Value.ToInt())
+		if total.Cmp((*big.Int)(r.DailyLimit)) > 0 {
+			reasons = append(reasons, fmt.Sprintf("daily value %v above limit %v", total, (*big.Int)(r.DailyLimit)))
+		}
+	}
+	if recipient, amount, ok := decodeTokenCall(req.Data); ok && req.To != nil {
+		if amount == nil {
+			return append(reasons, fmt.Sprintf("malformed call of token 0x%x", *req.To))
+		}
+		if !r.allowedRecipient(recipient) {
+			reasons = append(reasons, fmt.Sprintf("token recipient 0x%x not allowlisted", recipient))
+		}
+		if r.DailyLimit != nil || len(r.tokenLimits) > 0 {
+			limit := r.tokenLimits[*req.To]
+			if limit == nil {
+				reasons = append(reasons, fmt.Sprintf("no daily limit for token 0x%x", *req.To))
+			} else {
+				total := new(big.Int).Add(l.get(req.From, *req.To), amount)
+				if total.Cmp((*big.Int)(limit)) > 0 {
+					reasons = append(reasons, fmt.Sprintf("daily amount %v of token 0x%x above limit %v", total, *req.To, (*big.Int)(limit)))
+				}
+			}
+		}
+	}
+	return reasons
+}
+
+// checkData returns the reasons why signing a message isn't approved by the
+// rules, none if it is.
+func (r *Rules) checkData(req *accounts.SignDataRequest) []string {
+	if !r.SignData {
+		return []string{"message signing not allowed"}
+	}
+	return nil
+}
+
+// checkTypedData returns the reasons why signing typed data isn't approved by
+// the rules, none if it is.
+func (r *Rules) checkTypedData(req *accounts.SignTypedDataRequest) []string {
+	if !r.SignTyped {
+		return []string{"typed data signing not allowed"}
+	}
+	return nil
+}
+
+func (r *Rules) allowedRecipient(addr common.Address) bool {
+	for _, a := range r.Recipients {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rules) allowedMethod(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, m := range r.Methods {
+		if string(m) == string(data[:4]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ledger tracks the value of the transactions approved per account during the
+// current UTC day, and the amounts of the tokens they move, against the daily
+// limits.
+type ledger struct {
+	mu    sync.Mutex
+	day   string
+	spent map[ledgerKey]*big.Int
+}
+
+// ledgerKey identifies the spendings of an account in a token, the zero
+// address standing for the value in wei.
+type ledgerKey struct {
+	account common.Address
+	token   common.Address
+}
+
+func newLedger() *ledger {
+	return &ledger{day: ledgerDay(time.Now()), spent: make(map[ledgerKey]*big.Int)}
+}
+
+func ledgerDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// get returns the value, or amount of token, approved today for addr.
+func (l *ledger) get(addr common.Address, token common.Address) *big.Int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rollover(time.Now())
+	if spent := l.spent[ledgerKey{addr, token}]; spent != nil {
+		return new(big.Int).Set(spent)
+	}
+	return new(big.Int)
+}
+
+// addTx records the value of a transaction approved at t, and the amount of
+// token it moves if any. Transactions of past days are ignored.
+func (l *ledger) addTx(t time.Time, req *accounts.SignTxRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rollover(time.Now())
+	if ledgerDay(t) != l.day {
+		return
+	}
+	l.add(ledgerKey{req.From, common.Address{}}, req.Value.ToInt())
+	if _, amount, ok := decodeTokenCall(req.Data); ok && amount != nil && req.To != nil {
+		l.add(ledgerKey{req.From, *req.To}, amount)
+	}
+}
+
+func (l *ledger) add(key ledgerKey, value *big.Int) {
+	if l.spent[key] == nil {
+		l.spent[key] = new(big.Int)
+	}
+	l.spent[key].Add(l.spent[key], value)
+}
+
+// rollover resets the ledger when the day changed.
+func (l *ledger) rollover(now time.Time) {
+	if day := ledgerDay(now); day != l.day {
+		l.day = day
+		l.spent = make(map[ledgerKey]*big.Int)
+	}
+}
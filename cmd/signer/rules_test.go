@@ -0,0 +1,184 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/common/hexutil"
+)
+
+var (
+	testSender    = common.HexToAddress("0x1111")
+	testRecipient = common.HexToAddress("0x2222")
+	testToken     = common.HexToAddress("0xaaaa")
+	otherToken    = common.HexToAddress("0xbbbb")
+	stranger      = common.HexToAddress("0x3333")
+)
+
+// testRules loads the rules of the JSON document.
+func testRules(t *testing.T, doc string) (*Rules, error) {
+	dir, err := ioutil.TempDir("", "signer-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(file, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadRules(file)
+}
+
+// tokenCall returns the data of an ERC-20 call, with the address and amount
+// arguments.
+func tokenCall(selector []byte, amount int64, addrs ...common.Address) hexutil.Bytes {
+	data := append([]byte{}, selector...)
+	for _, addr := range addrs {
+		data = append(data, common.LeftPadBytes(addr.Bytes(), 32)...)
+	}
+	return append(data, common.LeftPadBytes(big.NewInt(amount).Bytes(), 32)...)
+}
+
+// txRequest returns a request to send value wei to to, with data.
+func txRequest(to common.Address, value int64, data hexutil.Bytes, chainID int64) *accounts.SignTxRequest {
+	req := &accounts.SignTxRequest{
+		From:     testSender,
+		To:       &to,
+		Gas:      (*hexutil.Big)(big.NewInt(100000)),
+		GasPrice: (*hexutil.Big)(big.NewInt(1)),
+		Value:    (*hexutil.Big)(big.NewInt(value)),
+		Data:     data,
+	}
+	if chainID != 0 {
+		req.ChainID = (*hexutil.Big)(big.NewInt(chainID))
+	}
+	return req
+}
+
+// Tests that rules files must set the chain id, and that token limits are
+// keyed by valid addresses.
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		doc string
+		ok  bool
+	}{
+		{`{}`, false},
+		{`{"chainId": "0"}`, false},
+		{`{"chainId": "61"}`, true},
+		{`{"chainId": "0x3d", "tokenDailyLimits": {"0x000000000000000000000000000000000000aaaa": "10"}}`, true},
+		{`{"chainId": "61", "tokenDailyLimits": {"0xaaaa": "10"}}`, false},
+		{`{"chainId": "61", "tokenDailyLimits": {"0x000000000000000000000000000000000000aaaa": null}}`, false},
+	}
+	for i, tt := range tests {
+		if _, err := testRules(t, tt.doc); (err == nil) != tt.ok {
+			t.Errorf("test %d: error mismatch: have %v, want ok %v", i, err, tt.ok)
+		}
+	}
+	if rules, err := loadRules(""); err != nil || len(rules.checkTx(txRequest(testRecipient, 0, nil, 61), newLedger())) == 0 {
+		t.Errorf("transaction approved without rules file")
+	}
+}
+
+// Tests that transactions are approved for the chain id of the rules only,
+// that token recipients must be allowlisted and that token amounts are
+// counted against the daily limits of the tokens.
+func TestRulesCheckTx(t *testing.T) {
+	rules, err := testRules(t, `{
+		"chainId":          "61",
+		"recipients":       ["0x0000000000000000000000000000000000002222", "0x000000000000000000000000000000000000aaaa", "0x000000000000000000000000000000000000bbbb"],
+		"methods":          ["0xa9059cbb", "0x095ea7b3", "0x23b872dd"],
+		"dailyLimit":       "100",
+		"tokenDailyLimits": {"0x000000000000000000000000000000000000aaaa": "1000"}
+	}`)
+	if err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+	l := newLedger()
+
+	tests := []struct {
+		req     *accounts.SignTxRequest
+		reasons []string
+	}{
+		{txRequest(testRecipient, 60, nil, 61), nil},
+		{txRequest(testRecipient, 10, nil, 0), []string{"transaction not replay protected"}},
+		{txRequest(testRecipient, 10, nil, 1), []string{"chain id 1 not allowed"}},
+		{txRequest(testRecipient, 60, nil, 61), []string{"daily value 120 above limit 100"}},
+		{txRequest(testToken, 0, tokenCall(erc20Transfer, 600, testRecipient), 61), nil},
+		{txRequest(testToken, 0, tokenCall(erc20Approve, 300, testRecipient), 61), nil},
+		{txRequest(testToken, 0, tokenCall(erc20TransferFrom, 200, stranger, testRecipient), 61), []string{"daily amount 1100 of token 0x000000000000000000000000000000000000aaaa above limit 1000"}},
+		{txRequest(testToken, 0, tokenCall(erc20TransferFrom, 100, stranger, testRecipient), 61), nil},
+		{txRequest(testToken, 0, tokenCall(erc20Transfer, 0, stranger), 61), []string{"token recipient 0x0000000000000000000000000000000000003333 not allowlisted"}},
+		{txRequest(testToken, 0, tokenCall(erc20Approve, 0, stranger), 61), []string{"token recipient 0x0000000000000000000000000000000000003333 not allowlisted"}},
+		{txRequest(testToken, 0, tokenCall(erc20TransferFrom, 0, testRecipient, stranger), 61), []string{"token recipient 0x0000000000000000000000000000000000003333 not allowlisted"}},
+		{txRequest(otherToken, 0, tokenCall(erc20Transfer, 1, testRecipient), 61), []string{"no daily limit for token 0x000000000000000000000000000000000000bbbb"}},
+		{txRequest(testToken, 0, tokenCall(erc20Transfer, 1, testRecipient)[:40], 61), []string{"malformed call of token 0x000000000000000000000000000000000000aaaa"}},
+		{txRequest(testToken, 0, append(hexutil.Bytes{0xa9, 0x05, 0x9c, 0xbb, 0x01}, tokenCall(erc20Transfer, 1, testRecipient)[5:]...), 61), []string{"malformed call of token 0x000000000000000000000000000000000000aaaa"}},
+	}
+	for i, tt := range tests {
+		reasons := rules.checkTx(tt.req, l)
+		if !reflect.DeepEqual(reasons, tt.reasons) {
+			t.Errorf("test %d: reasons mismatch: have %q, want %q", i, reasons, tt.reasons)
+		}
+		if len(reasons) == 0 {
+			l.addTx(time.Now(), tt.req)
+		}
+	}
+	if spent := l.get(testSender, testToken); spent.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("token amount mismatch: have %v, want 1000", spent)
+	}
+}
+
+// Tests that token limits apply without a limit of the value in wei, and that
+// without any limit only the token recipients are checked.
+func TestRulesTokenLimitsOnly(t *testing.T) {
+	tests := []struct {
+		rules   string
+		req     *accounts.SignTxRequest
+		reasons []string
+	}{
+		{`"tokenDailyLimits": {"0x000000000000000000000000000000000000aaaa": "1000"}`, txRequest(testRecipient, 1e18, nil, 61), nil},
+		{`"tokenDailyLimits": {"0x000000000000000000000000000000000000aaaa": "1000"}`, txRequest(testToken, 0, tokenCall(erc20Transfer, 1000, testRecipient), 61), nil},
+		{`"tokenDailyLimits": {"0x000000000000000000000000000000000000aaaa": "1000"}`, txRequest(testToken, 0, tokenCall(erc20Transfer, 1001, testRecipient), 61), []string{"daily amount 1001 of token 0x000000000000000000000000000000000000aaaa above limit 1000"}},
+		{`"tokenDailyLimits": {"0x000000000000000000000000000000000000aaaa": "1000"}`, txRequest(otherToken, 0, tokenCall(erc20Transfer, 1, testRecipient), 61), []string{"no daily limit for token 0x000000000000000000000000000000000000bbbb"}},
+		{`"signData": false`, txRequest(otherToken, 0, tokenCall(erc20Transfer, 1e18, testRecipient), 61), nil},
+		{`"signData": false`, txRequest(otherToken, 0, tokenCall(erc20Transfer, 1, stranger), 61), []string{"token recipient 0x0000000000000000000000000000000000003333 not allowlisted"}},
+	}
+	for i, tt := range tests {
+		rules, err := testRules(t, `{
+			"chainId":    "61",
+			"recipients": ["0x0000000000000000000000000000000000002222", "0x000000000000000000000000000000000000aaaa", "0x000000000000000000000000000000000000bbbb"],
+			"methods":    ["0xa9059cbb"],
+			`+tt.rules+`
+		}`)
+		if err != nil {
+			t.Fatalf("test %d: failed to load rules: %v", i, err)
+		}
+		if reasons := rules.checkTx(tt.req, newLedger()); !reflect.DeepEqual(reasons, tt.reasons) {
+			t.Errorf("test %d: reasons mismatch: have %q, want %q", i, reasons, tt.reasons)
+		}
+	}
+}
@@ -93,7 +93,7 @@ func (api *PrivateRegistarAPI) SaveInfo(info *compiler.ContractInfo, filename st
 // Register registers a new content hash in the registry.
 func (api *PrivateRegistarAPI) Register(sender common.Address, addr common.Address, contentHashHex string) (bool, error) {
 	block := api.be.bc.CurrentBlock()
-	state, err := state.New(block.Root(), state.NewDatabase(api.be.chainDb))
+	state, err := api.be.bc.StateAt(block.Root())
 	if err != nil {
 		return false, err
 	}
@@ -173,7 +173,7 @@ func (be *registryAPIBackend) Call(fromStr, toStr, valueStr, gasStr, gasPriceStr
 	}
 
 	block := be.bc.CurrentBlock()
-	statedb, err := state.New(block.Root(), state.NewDatabase(be.chainDb))
+	statedb, err := be.bc.StateAt(block.Root())
 	if err != nil {
 		return "", "", err
 	}
@@ -217,7 +217,7 @@ func (be *registryAPIBackend) Call(fromStr, toStr, valueStr, gasStr, gasPriceStr
 // StorageAt returns the data stores in the state for the given address and location.
 func (be *registryAPIBackend) StorageAt(addr string, storageAddr string) string {
 	block := be.bc.CurrentBlock()
-	state, err := state.New(block.Root(), state.NewDatabase(be.chainDb))
+	state, err := be.bc.StateAt(block.Root())
 	if err != nil {
 		return ""
 	}
@@ -277,12 +277,7 @@ func (be *registryAPIBackend) Transact(fromStr, toStr, nonceStr, valueStr, gasSt
 		tx = types.NewTransaction(nonce, to, value, gas, gasPrice, data)
 	}
 
-	sigHash := (types.BasicSigner{}).Hash(tx)
-	signature, err := be.am.Sign(from, sigHash.Bytes())
-	if err != nil {
-		return "", err
-	}
-	signedTx, err := tx.WithSigner(types.BasicSigner{}).WithSignature(signature)
+	signedTx, err := be.am.SignTx(from, tx, types.BasicSigner{})
 	if err != nil {
 		return "", err
 	}
@@ -2,37 +2,61 @@ package core
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"os"
 	"os/signal"
-	"sort"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/state"
 	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
 	"github.com/NginProject/ngind/ngindb"
 	"github.com/NginProject/ngind/logger"
 	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/rlp"
 )
 
+// AddrTxIndexVersion is the version of the address-transaction index layout.
+// Version 1 keyed the entries by little-endian block numbers, version 2 by
+// big-endian block numbers and transaction indexes so they iterate in chain
+// order.
+const AddrTxIndexVersion = 2
+
 var (
 	errAtxiNotEnabled = errors.New("atxi not intialized")
 	errAtxiInvalidUse = errors.New("invalid parameters passed to ATXI")
 
-	txAddressIndexPrefix = []byte("atx-")
-	txAddressBookmarkKey = []byte("ATXIBookmark")
+	errInternalTxsUnavailable = errors.New("internal transactions unavailable, the parent state is missing")
+
+	txAddressIndexPrefix     = []byte("atx2-")
+	txAddressBlockPrefix     = []byte("atxb-") // atxb-<blockNumber> -> hash and addresses of the indexed block
+	txAddressIndexV1Prefix   = []byte("atx-")
+	txAddressBookmarkKey     = []byte("ATXIBookmark")
+	txAddressIndexVersionKey = []byte("ATXIVersion")
+	txAddressIncompleteKey   = []byte("ATXIIncomplete") // lowest block whose internal transactions are missing
 )
 
+// addrTxKeyLength is the length of an index key, see formatAddrTxBytesIndex.
+const addrTxKeyLength = 5 + common.AddressLength + 8 + 4 + 1 + 1 + common.HashLength
+
+// addrTxCursorLength is the length of the key suffix following the address,
+// which makes up a pagination cursor.
+const addrTxCursorLength = addrTxKeyLength - 5 - common.AddressLength
+
 type AtxiT struct {
-	Db       ngindb.Database
-	AutoMode bool
-	Progress *AtxiProgressT
-	Step     uint64
+	Db             ngindb.Database
+	AutoMode       bool
+	Progress       *AtxiProgressT
+	Step           uint64
+	TokenTransfers bool // Whether token transfers are indexed too, see WriteBlockTokenTransfers
+	InternalTxs    bool // Whether internal transactions are indexed too, see BlockInternalTxs
 }
 
 type AtxiProgressT struct {
@@ -63,42 +87,118 @@ func (a *AtxiT) SetATXIBookmark(i uint64) error {
 	return dbSetATXIBookmark(a.Db, i)
 }
 
-// formatAddrTxIterator formats the index key prefix iterator, eg. atx-<address>
+func dbGetATXIIncomplete(db ngindb.Database) (uint64, bool) {
+	v, err := db.Get(txAddressIncompleteKey)
+	if err != nil || len(v) != 8 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(v), true
+}
+
+// dbMarkATXIIncomplete records that the internal transactions of block n are
+// missing from the index, keeping the lowest such block.
+func dbMarkATXIIncomplete(db ngindb.Database, n uint64) error {
+	if i, ok := dbGetATXIIncomplete(db); ok && i <= n {
+		return nil
+	}
+	bn := make([]byte, 8)
+	binary.LittleEndian.PutUint64(bn, n)
+	return db.Put(txAddressIncompleteKey, bn)
+}
+
+// GetATXIIncomplete returns the lowest block whose internal transactions are
+// missing from the index, if any. Rebuilding the index from it on, with their
+// states available, completes it.
+func (a *AtxiT) GetATXIIncomplete() (uint64, bool) {
+	return dbGetATXIIncomplete(a.Db)
+}
+
+// GetAddrTxIndexVersion returns the layout version of the address-transaction
+// index, 0 if the index is empty and unversioned.
+func GetAddrTxIndexVersion(db ngindb.Database) uint {
+	if enc, _ := db.Get(txAddressIndexVersionKey); len(enc) > 0 {
+		var vsn uint
+		rlp.DecodeBytes(enc, &vsn)
+		return vsn
+	}
+	// Version 1 wasn't recorded, recognize it by its entries
+	it := db.NewIteratorWithPrefix(txAddressIndexV1Prefix)
+	defer it.Release()
+	if it.Next() {
+		return 1
+	}
+	return 0
+}
+
+func writeAddrTxIndexVersion(db ngindb.Putter, vsn uint) error {
+	enc, _ := rlp.EncodeToBytes(vsn)
+	return db.Put(txAddressIndexVersionKey, enc)
+}
+
+// CheckAddrTxIndexVersion ensures the address-transaction index uses the
+// current layout, stamping an empty index with it.
+func CheckAddrTxIndexVersion(db ngindb.Database) error {
+	switch vsn := GetAddrTxIndexVersion(db); vsn {
+	case AddrTxIndexVersion:
+		return nil
+	case 0:
+		return writeAddrTxIndexVersion(db, AddrTxIndexVersion)
+	default:
+		return fmt.Errorf("address-transaction index layout version mismatch (%d / %d). Run ngind atxi-migrate", vsn, AddrTxIndexVersion)
+	}
+}
+
+// formatAddrTxIterator formats the index key prefix iterator, eg. atx2-<address>
 func formatAddrTxIterator(address common.Address) (iteratorPrefix []byte) {
 	iteratorPrefix = append(iteratorPrefix, txAddressIndexPrefix...)
 	iteratorPrefix = append(iteratorPrefix, address.Bytes()...)
 	return
 }
 
-// formatAddrTxBytesIndex formats the index key, eg. atx-<addr><blockNumber><t|f><s|c|><txhash>
-// The values for these arguments should be of determinate length and format, see test TestFormatAndResolveAddrTxBytesKey
-// for example.
-func formatAddrTxBytesIndex(address, blockNumber, direction, kindof, txhash []byte) (key []byte) {
-	key = make([]byte, 0, 66) // 66 is the total capacity of the key = prefix(4)+addr(20)+blockNumber(8)+dir(1)+kindof(1)+txhash(32)
+// formatAddrTxBytesIndex formats the index key, eg. atx2-<addr><blockNumber><txIndex><t|f><s|c|i><txhash>
+// The block number and transaction index are big-endian, so that the entries of
+// an address iterate in chain order.
+func formatAddrTxBytesIndex(address []byte, blockNumber uint64, txIndex uint32, direction, kindof, txhash []byte) (key []byte) {
+	key = make([]byte, 0, addrTxKeyLength)
 	key = append(key, txAddressIndexPrefix...)
 	key = append(key, address...)
-	key = append(key, blockNumber...)
+	key = append(key, make([]byte, 12)...)
+	binary.BigEndian.PutUint64(key[len(key)-12:], blockNumber)
+	binary.BigEndian.PutUint32(key[len(key)-4:], txIndex)
 	key = append(key, direction...)
 	key = append(key, kindof...)
 	key = append(key, txhash...)
 	return
 }
 
-// resolveAddrTxBytes resolves the index key to individual []byte values
-func resolveAddrTxBytes(key []byte) (address, blockNumber, direction, kindof, txhash []byte) {
-	// prefix = key[:4]
-	address = key[4:24]      // common.AddressLength = 20
-	blockNumber = key[24:32] // uint64 via little endian
-	direction = key[32:33]   // == key[32] (1 byte)
+// resolveAddrTxBytes resolves the index key to individual values
+func resolveAddrTxBytes(key []byte) (address []byte, blockNumber uint64, txIndex uint32, direction, kindof, txhash []byte) {
+	// prefix = key[:5]
+	address = key[5:25] // common.AddressLength = 20
+	blockNumber = binary.BigEndian.Uint64(key[25:33])
+	txIndex = binary.BigEndian.Uint32(key[33:37])
+	direction = key[37:38]
+	kindof = key[38:39]
+	txhash = key[39:]
+	return
+}
+
+// resolveAddrTxV1Bytes resolves a key of the version 1 layout,
+// atx-<addr><blockNumber><t|f><s|c><txhash> with a little-endian block number.
+func resolveAddrTxV1Bytes(key []byte) (address []byte, blockNumber uint64, direction, kindof, txhash []byte) {
+	address = key[4:24]
+	blockNumber = binary.LittleEndian.Uint64(key[24:32])
+	direction = key[32:33]
 	kindof = key[33:34]
 	txhash = key[34:]
 	return
 }
 
-// WriteBlockAddTxIndexes writes atx-indexes for a given block.
-func WriteBlockAddTxIndexes(indexDb ngindb.Database, block *types.Block) error {
+// WriteBlockAddTxIndexes writes atx-indexes for a given block, along with
+// the internal transactions made while processing it, if known.
+func WriteBlockAddTxIndexes(indexDb ngindb.Database, block *types.Block, internals [][]*state.InternalTx) error {
 	batch := indexDb.NewBatch()
-	if _, err := putBlockAddrTxsToBatch(batch, block); err != nil {
+	if _, err := putBlockAddrTxsToBatch(indexDb, batch, block, internals); err != nil {
 		return err
 	}
 	return batch.Write()
@@ -106,64 +206,168 @@ func WriteBlockAddTxIndexes(indexDb ngindb.Database, block *types.Block) error {
 
 // putBlockAddrTxsToBatch formats and puts keys for a given block to a db Batch.
 // Batch can be written afterward if no errors, ie. batch.Write()
-func putBlockAddrTxsToBatch(putBatch ngindb.Batch, block *types.Block) (txsCount int, err error) {
-	for _, tx := range block.Transactions() {
-		txsCount++
+// The entries hold the hash of the block, which is recorded along with the
+// addresses indexed. Entries left in db by a former block of the same number
+// are removed.
+func putBlockAddrTxsToBatch(db ngindb.Database, putBatch ngindb.Batch, block *types.Block, internals [][]*state.InternalTx) (txsCount int, err error) {
+	if rec, err := getAddrTxBlockRecord(db, block.NumberU64()); err != nil {
+		return 0, err
+	} else if rec != nil && rec.Hash != block.Hash() {
+		if err := rmAddrTxBlockToBatch(db, putBatch, block.NumberU64(), rec); err != nil {
+			return 0, err
+		}
+	}
+	keys, err := blockAddrTxKeys(block, internals)
+	if err != nil {
+		return 0, err
+	}
+	rec := &addrTxBlockRecord{Hash: block.Hash()}
+	seen := make(map[common.Address]bool)
+	for _, key := range keys {
+		if err := putBatch.Put(key, rec.Hash.Bytes()); err != nil {
+			return 0, err
+		}
+		if addr := common.BytesToAddress(key[5:25]); !seen[addr] {
+			seen[addr] = true
+			rec.Addrs = append(rec.Addrs, addr)
+		}
+	}
+	if len(keys) > 0 {
+		enc, err := rlp.EncodeToBytes(rec)
+		if err != nil {
+			return 0, err
+		}
+		if err := putBatch.Put(formatAddrTxBlockKey(block.NumberU64()), enc); err != nil {
+			return 0, err
+		}
+	}
+	return len(block.Transactions()), nil
+}
+
+// RmBlockAddrTxs removes the atx-indexes of a given block, along with those of
+// the internal transactions made while processing it, if known. If the block
+// was indexed with its hash, all its entries are found by its record.
+func RmBlockAddrTxs(db ngindb.Database, block *types.Block, internals [][]*state.InternalTx) error {
+	keys, err := blockAddrTxKeys(block, internals)
+	if err != nil {
+		return err
+	}
+	batch := db.NewBatch()
+	if rec, err := getAddrTxBlockRecord(db, block.NumberU64()); err != nil {
+		return err
+	} else if rec != nil && rec.Hash == block.Hash() {
+		if err := rmAddrTxBlockToBatch(db, batch, block.NumberU64(), rec); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
 
+// blockAddrTxKeys formats the index keys of a given block. Transactions are
+// indexed by their sender and recipient, contract creations by the address of
+// the created contract. The internal transactions, by transaction index, add
+// keys of kind 'i' for the addresses they involve which the transaction
+// itself doesn't.
+func blockAddrTxKeys(block *types.Block, internals [][]*state.InternalTx) (keys [][]byte, err error) {
+	for i, tx := range block.Transactions() {
 		from, err := tx.From()
 		if err != nil {
-			return txsCount, err
+			return nil, err
 		}
-		to := tx.To()
 		// s: standard
 		// c: contract
 		txKindOf := []byte("s")
-		if to == nil || to.IsEmpty() {
-			to = &common.Address{}
+		var to common.Address
+		if tx.To() == nil || tx.To().IsEmpty() {
+			to = crypto.CreateAddress(from, tx.Nonce())
 			txKindOf = []byte("c")
+		} else {
+			to = *tx.To()
 		}
-
-		// Note that len 8 because uint64 guaranteed <= 8 bytes.
-		bn := make([]byte, 8)
-		binary.LittleEndian.PutUint64(bn, block.NumberU64())
-
-		if err := putBatch.Put(formatAddrTxBytesIndex(from.Bytes(), bn, []byte("f"), txKindOf, tx.Hash().Bytes()), nil); err != nil {
-			return txsCount, err
+		keys = append(keys,
+			formatAddrTxBytesIndex(from.Bytes(), block.NumberU64(), uint32(i), []byte("f"), txKindOf, tx.Hash().Bytes()),
+			formatAddrTxBytesIndex(to.Bytes(), block.NumberU64(), uint32(i), []byte("t"), txKindOf, tx.Hash().Bytes()),
+		)
+		if i >= len(internals) {
+			continue
 		}
-		if err := putBatch.Put(formatAddrTxBytesIndex(to.Bytes(), bn, []byte("t"), txKindOf, tx.Hash().Bytes()), nil); err != nil {
-			return txsCount, err
+		// i: internal
+		type ref struct {
+			address   common.Address
+			direction byte
+		}
+		seen := map[ref]bool{{from, 'f'}: true, {to, 't'}: true}
+		for _, itx := range internals[i] {
+			for _, r := range []ref{{itx.From, 'f'}, {itx.To, 't'}} {
+				if seen[r] {
+					continue
+				}
+				seen[r] = true
+				keys = append(keys, formatAddrTxBytesIndex(r.address.Bytes(), block.NumberU64(), uint32(i), []byte{r.direction}, []byte("i"), tx.Hash().Bytes()))
+			}
 		}
 	}
-	return txsCount, nil
+	return keys, nil
 }
 
-type atxi struct {
-	blockN uint64
-	tx     string
-}
-type sortableAtxis []atxi
-
-// Len implements sort.Sort interface.
-func (s sortableAtxis) Len() int {
-	return len(s)
+// collectInternalTxs returns the internal transactions recorded in statedb
+// while processing the block, by transaction index. Only the built-in EVM
+// records them, none are known for blocks processed with SputnikVM.
+func collectInternalTxs(block *types.Block, statedb *state.StateDB) [][]*state.InternalTx {
+	internals := make([][]*state.InternalTx, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		internals[i] = statedb.GetInternalTxs(tx.Hash())
+	}
+	return internals
 }
 
-// Less implements sort.Sort interface.
-// By default newer transactions by blockNumber are first.
-func (s sortableAtxis) Less(i, j int) bool {
-	return s[i].blockN > s[j].blockN
+// BlockInternalTxs returns the internal transactions made while processing
+// the block, by transaction index. Unless recently processed, the block is
+// re-executed on top of its parent state. That state isn't regenerated for
+// indexing: errInternalTxsUnavailable is returned when it isn't held.
+func (bc *BlockChain) BlockInternalTxs(block *types.Block) ([][]*state.InternalTx, error) {
+	if len(block.Transactions()) == 0 {
+		return nil, nil
+	}
+	if cached, ok := bc.internalTxs.Get(block.Hash()); ok {
+		return cached.([][]*state.InternalTx), nil
+	}
+	parent := bc.GetBlock(block.ParentHash())
+	if parent == nil {
+		return nil, fmt.Errorf("block #%d [%x…] not found", block.NumberU64()-1, block.ParentHash().Bytes()[:4])
+	}
+	statedb, err := bc.StateAt(parent.Root())
+	if err != nil {
+		return nil, fmt.Errorf("%v: block #%d", errInternalTxsUnavailable, block.NumberU64())
+	}
+	if _, _, _, err := bc.processor.Process(block, statedb); err != nil {
+		return nil, err
+	}
+	internals := collectInternalTxs(block, statedb)
+	bc.internalTxs.Add(block.Hash(), internals)
+	return internals, nil
 }
 
-// Swap implements sort.Sort interface.
-func (s sortableAtxis) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-func (s sortableAtxis) TxStrings() []string {
-	var out = make([]string, 0, len(s))
-	for _, str := range s {
-		out = append(out, str.tx)
+// indexedInternalTxs returns the internal transactions of the block to index
+// along with its transactions, none unless enabled. Those unavailable are
+// recorded by marking the index incomplete, see GetATXIIncomplete.
+func (bc *BlockChain) indexedInternalTxs(indexDb ngindb.Database, block *types.Block) ([][]*state.InternalTx, error) {
+	if bc.atxi == nil || !bc.atxi.InternalTxs {
+		return nil, nil
+	}
+	internals, err := bc.BlockInternalTxs(block)
+	if err == nil {
+		return internals, nil
+	}
+	if _, ok := dbGetATXIIncomplete(indexDb); !ok {
+		glog.V(logger.Warn).Warnf("Address-transaction index incomplete from block #%d on: %v", block.NumberU64(), err)
 	}
-	return out
+	return nil, dbMarkATXIIncomplete(indexDb, block.NumberU64())
 }
 
 func BuildAddrTxIndex(bc *BlockChain, chainDB, indexDB ngindb.Database, startIndex, stopIndex, step uint64) error {
@@ -174,6 +378,10 @@ func BuildAddrTxIndex(bc *BlockChain, chainDB, indexDB ngindb.Database, startInd
 	if bc.atxi.Progress == nil {
 		bc.atxi.Progress = &AtxiProgressT{}
 	}
+	if err := CheckAddrTxIndexVersion(indexDB); err != nil {
+		bc.atxi.Progress.LastError = err
+		return err
+	}
 	// Use persistent placeholder in case start not spec'd
 	if startIndex == math.MaxUint64 {
 		startIndex = dbGetATXIBookmark(indexDB)
@@ -264,6 +472,13 @@ func BuildAddrTxIndex(bc *BlockChain, chainDB, indexDB ngindb.Database, startInd
 			return err
 		}
 	}
+	// Internal transactions missing from the rebuilt blocks on are now indexed
+	if n, ok := dbGetATXIIncomplete(indexDB); ok && bc.atxi.InternalTxs && n >= startIndex && stopIndex >= bc.CurrentBlock().NumberU64() {
+		if err := indexDB.Delete(txAddressIncompleteKey); err != nil {
+			bc.atxi.Progress.LastError = err
+			return err
+		}
+	}
 
 	// Print summary
 	totalBlocksF := float64(stopIndex - startIndex)
@@ -288,174 +503,268 @@ func (bc *BlockChain) GetATXIBuildProgress() (*AtxiProgressT, error) {
 	return bc.atxi.Progress, nil
 }
 
-// GetAddrTxs gets the indexed transactions for a given account address.
-// 'reverse' means "oldest first"
-func GetAddrTxs(db ngindb.Database, address common.Address, blockStartN uint64, blockEndN uint64, direction string, kindof string, paginationStart int, paginationEnd int, reverse bool) (txs []string, err error) {
+// parseAddrTxFilter validates the direction and kind of filters of an address
+// transactions query, returning the direction byte, 'b' meaning both, and the
+// kinds of transactions wanted, empty meaning all. The kind of filter is
+// either a word, of which the first letter counts (eg. standard), or a
+// combination of kind letters (eg. sc for standard or contract).
+func parseAddrTxFilter(direction string, kindof string) (wantDirection byte, wantKindOf string, err error) {
 	errWithReason := func(e error, s string) error {
 		return fmt.Errorf("%v: %s", e, s)
 	}
-
-	// validate params
 	if len(direction) > 0 && !strings.Contains("btf", direction[:1]) {
-		err = errWithReason(errAtxiInvalidUse, "Address transactions list signature requires direction param to be empty string or [b|t|f] prefix (eg. both, to, or from)")
-		return
+		return 0, "", errWithReason(errAtxiInvalidUse, "Address transactions list signature requires direction param to be empty string or [b|t|f] prefix (eg. both, to, or from)")
 	}
-	if len(kindof) > 0 && !strings.Contains("bsc", kindof[:1]) {
-		err = errWithReason(errAtxiInvalidUse, "Address transactions list signature requires 'kind of' param to be empty string or [s|c] prefix (eg. both, standard, or contract)")
-		return
-	}
-	if paginationStart > 0 && paginationEnd > 0 && paginationStart > paginationEnd {
-		err = errWithReason(errAtxiInvalidUse, "Pagination start must be less than or equal to pagination end params")
-		return
-	}
-	if paginationStart < 0 {
-		paginationStart = 0
+	if len(kindof) > 0 && !strings.Contains("bsci", kindof[:1]) {
+		return 0, "", errWithReason(errAtxiInvalidUse, "Address transactions list signature requires 'kind of' param to be empty string, [b|s|c|i] prefix (eg. both, standard, contract, or internal) or a combination of [s|c|i]")
 	}
-
-	// Have to cast to LevelDB to use iterator. Yuck.
-	ldb, ok := db.(*ngindb.LDBDatabase)
-	if !ok {
-		err = errWithReason(errors.New("internal interface error; please file a bug report"), "could not cast ngin db to level db")
-		return nil, nil
-	}
-
-	// This will be the returnable.
-	var hashes []string
-
-	// Map direction -> byte
-	var wantDirectionB byte = 'b'
+	wantDirection = 'b'
 	if len(direction) > 0 {
-		wantDirectionB = direction[0]
+		wantDirection = direction[0]
 	}
-	var wantKindOf byte = 'b'
-	if len(kindof) > 0 {
-		wantKindOf = kindof[0]
+	switch {
+	case len(kindof) == 0 || kindof[0] == 'b':
+	case strings.Trim(kindof, "sci") == "":
+		wantKindOf = kindof
+	default:
+		wantKindOf = kindof[:1]
 	}
+	return wantDirection, wantKindOf, nil
+}
 
-	// Create address prefix for iteration.
-	prefix := ngindb.NewBytesPrefix(formatAddrTxIterator(address))
-	it := ldb.NewIteratorRange(prefix)
-
-	var atxis sortableAtxis
+// scanAddrTxs calls fn with the index keys of the address between the given
+// blocks, 0 meaning unbounded, matching the direction and kind of filters. The
+// keys are visited newest first, or oldest first if reverse, seeking right
+// past the cursor if given. The scan stops when fn returns false.
+func scanAddrTxs(db ngindb.Database, address common.Address, blockStartN uint64, blockEndN uint64, wantDirection byte, wantKindOf string, cursor []byte, reverse bool, fn func(key []byte) bool) error {
+	prefix := formatAddrTxIterator(address)
+
+	start := make([]byte, len(prefix)+8)
+	copy(start, prefix)
+	binary.BigEndian.PutUint64(start[len(prefix):], blockStartN)
+
+	if blockEndN == 0 || blockEndN == math.MaxUint64 {
+		blockEndN = math.MaxUint64 - 1
+	}
+	limit := make([]byte, len(prefix)+8)
+	copy(limit, prefix)
+	binary.BigEndian.PutUint64(limit[len(prefix):], blockEndN+1)
+
+	var it ngindb.Iterator
+	if reverse {
+		if cursor != nil {
+			if from := append(append(common.CopyBytes(prefix), cursor...), 0); bytes.Compare(from, start) > 0 {
+				start = from
+			}
+		}
+		it = db.NewIteratorRange(start, limit)
+	} else {
+		if cursor != nil {
+			if to := append(common.CopyBytes(prefix), cursor...); bytes.Compare(to, limit) < 0 {
+				limit = to
+			}
+		}
+		it = db.NewReverseIteratorRange(start, limit)
+	}
+	defer it.Release()
 
 	for it.Next() {
 		key := it.Key()
-
-		_, blockNum, torf, k, txh := resolveAddrTxBytes(key)
-
-		bn := binary.LittleEndian.Uint64(blockNum)
-
-		// If atxi is smaller than blockstart, skip
-		if blockStartN > 0 && bn < blockStartN {
-			continue
-		}
-		// If atxi is greater than blockend, skip
-		if blockEndN > 0 && bn > blockEndN {
+		if len(key) != addrTxKeyLength {
 			continue
 		}
+		_, _, _, torf, k, _ := resolveAddrTxBytes(key)
+
 		// Ensure matching direction if spec'd
-		if wantDirectionB != 'b' && wantDirectionB != torf[0] {
+		if wantDirection != 'b' && wantDirection != torf[0] {
 			continue
 		}
-		// Ensure filter for/agnostic transaction kind of (contract, standard, both)
-		if wantKindOf != 'b' && wantKindOf != k[0] {
+		// Ensure filter for/agnostic transaction kind of (contract, standard, internal)
+		if wantKindOf != "" && strings.IndexByte(wantKindOf, k[0]) < 0 {
 			continue
 		}
-		if len(hashes) > 0 {
-
+		if !fn(key) {
+			break
 		}
-		tx := common.ToHex(txh)
-		atxis = append(atxis, atxi{blockN: bn, tx: tx})
 	}
-	it.Release()
-	err = it.Error()
+	return it.Error()
+}
+
+// GetAddrTxs gets the indexed transactions for a given account address.
+// Transactions are listed newest first, 'reverse' means "oldest first".
+// The pagination bounds are offsets within the list, paginationEnd <= 0
+// returning it to the end.
+func GetAddrTxs(db ngindb.Database, address common.Address, blockStartN uint64, blockEndN uint64, direction string, kindof string, paginationStart int, paginationEnd int, reverse bool) (txs []string, err error) {
+	wantDirection, wantKindOf, err := parseAddrTxFilter(direction, kindof)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	handleSorting := func(s sortableAtxis) sortableAtxis {
-		if len(s) <= 1 {
-			return s
+	if paginationStart > 0 && paginationEnd > 0 && paginationStart > paginationEnd {
+		return nil, fmt.Errorf("%v: %s", errAtxiInvalidUse, "Pagination start must be less than or equal to pagination end params")
+	}
+	if paginationStart < 0 {
+		paginationStart = 0
+	}
+	// The entries are stored in chain order, skip and stop right away
+	// instead of collecting and sorting them all.
+	var index int
+	err = scanAddrTxs(db, address, blockStartN, blockEndN, wantDirection, wantKindOf, nil, reverse, func(key []byte) bool {
+		if paginationEnd > 0 && index >= paginationEnd {
+			return false
 		}
-		sort.Sort(s) // newest txs (by blockNumber) latest
-		if reverse {
-			for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
-				s[i], s[j] = s[j], s[i]
-			}
+		if index >= paginationStart {
+			_, _, _, _, _, txh := resolveAddrTxBytes(key)
+			txs = append(txs, common.ToHex(txh))
 		}
-		if paginationStart > len(s) {
-			paginationStart = len(s)
+		index++
+		return true
+	})
+	return txs, err
+}
+
+// GetAddrTxsPage gets a page of at most limit indexed transactions for a given
+// account address, limit <= 0 meaning no limit. Transactions are listed newest
+// first, 'reverse' means "oldest first". The page starts after the opaque
+// cursor, empty for the first page, and the cursor of the next page is
+// returned, empty if there are no more transactions.
+func GetAddrTxsPage(db ngindb.Database, address common.Address, blockStartN uint64, blockEndN uint64, direction string, kindof string, limit int, cursor string, reverse bool) (txs []string, next string, err error) {
+	wantDirection, wantKindOf, err := parseAddrTxFilter(direction, kindof)
+	if err != nil {
+		return nil, "", err
+	}
+	var from []byte
+	if cursor != "" {
+		if from, err = base64.RawURLEncoding.DecodeString(cursor); err != nil || len(from) != addrTxCursorLength {
+			return nil, "", fmt.Errorf("%v: %s", errAtxiInvalidUse, "invalid pagination cursor")
 		}
-		if paginationEnd < 0 || paginationEnd > len(s) {
-			paginationEnd = len(s)
+	}
+	var last []byte
+	err = scanAddrTxs(db, address, blockStartN, blockEndN, wantDirection, wantKindOf, from, reverse, func(key []byte) bool {
+		// One entry beyond the page tells there's a next one
+		if limit > 0 && len(txs) == limit {
+			next = base64.RawURLEncoding.EncodeToString(last)
+			return false
 		}
-		return s[paginationStart:paginationEnd]
+		_, _, _, _, _, txh := resolveAddrTxBytes(key)
+		txs = append(txs, common.ToHex(txh))
+		last = common.CopyBytes(key[len(key)-addrTxCursorLength:])
+		return true
+	})
+	if err != nil {
+		return nil, "", err
 	}
-	txs = handleSorting(atxis).TxStrings()
-	return
+	return txs, next, nil
 }
 
-// RmAddrTx removes all atxi indexes for a given tx in case of a transaction removal, eg.
-// in the case of chain reorg.
-// It isn't an elegant function, but not a top priority for optimization because of
-// expected infrequency of it's being called.
-func RmAddrTx(db ngindb.Database, tx *types.Transaction) error {
-	if tx == nil {
-		return nil
-	}
-
-	ldb, ok := db.(*ngindb.LDBDatabase)
-	if !ok {
+// MigrateAddrTxIndex converts the entries of a version 1 address-transaction
+// index to the current layout, taking the transaction indexes from the lookup
+// metadata of the transactions in the chain database. Entries of transactions
+// missing from the canonical chain are dropped. The entries hold the hash of
+// their block, which is recorded along with the addresses indexed, as when
+// indexing blocks. Each batch of entries is converted atomically, an
+// interrupted migration resumes where it stopped.
+func MigrateAddrTxIndex(chainDb, indexDb ngindb.Database) error {
+	if vsn := GetAddrTxIndexVersion(indexDb); vsn != 1 {
+		if vsn == 0 {
+			return writeAddrTxIndexVersion(indexDb, AddrTxIndexVersion)
+		}
+		glog.D(logger.Warn).Infof("Address-transaction index already at layout version %d", vsn)
 		return nil
 	}
+	// sigc is a single-val channel for listening to program interrupt
+	var sigc = make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
 
-	txH := tx.Hash()
-	from, err := tx.From()
-	if err != nil {
-		return err
+	var (
+		start    = time.Now()
+		logged   = time.Now()
+		migrated int
+		dropped  int
+		batch    = indexDb.NewBatch()
+		records  = make(map[uint64]*addrTxBlockRecord)
+	)
+	// writeBatch writes the batch along with the records of the blocks of its
+	// entries, merged with those of the entries migrated by former batches.
+	writeBatch := func() error {
+		for n, rec := range records {
+			stored, err := getAddrTxBlockRecord(indexDb, n)
+			if err != nil {
+				return err
+			}
+			if stored != nil && stored.Hash == rec.Hash {
+				for _, addr := range stored.Addrs {
+					rec.addAddr(addr)
+				}
+			}
+			enc, err := rlp.EncodeToBytes(rec)
+			if err != nil {
+				return err
+			}
+			if err := batch.Put(formatAddrTxBlockKey(n), enc); err != nil {
+				return err
+			}
+		}
+		records = make(map[uint64]*addrTxBlockRecord)
+		return batch.Write()
 	}
+	it := indexDb.NewIteratorWithPrefix(txAddressIndexV1Prefix)
+	defer it.Release()
 
-	removals := [][]byte{}
-
-	// TODO: not DRY, could be refactored
-	pre := ngindb.NewBytesPrefix(formatAddrTxIterator(from))
-	it := ldb.NewIteratorRange(pre)
 	for it.Next() {
-		key := it.Key()
-		_, _, _, _, txh := resolveAddrTxBytes(key)
-		if bytes.Compare(txH.Bytes(), txh) == 0 {
-			removals = append(removals, key)
-			break // because there can be only one
-		}
-	}
-	it.Release()
-	if e := it.Error(); e != nil {
-		return e
-	}
-
-	to := tx.To()
-	if to != nil {
-		toRef := *to
-		pre := ngindb.NewBytesPrefix(formatAddrTxIterator(toRef))
-		it := ldb.NewIteratorRange(pre)
-		for it.Next() {
-			key := it.Key()
-			_, _, _, _, txh := resolveAddrTxBytes(key)
-			if bytes.Compare(txH.Bytes(), txh) == 0 {
-				removals = append(removals, key)
-				break // because there can be only one
+		key := common.CopyBytes(it.Key())
+		if len(key) != len(txAddressIndexV1Prefix)+common.AddressLength+8+1+1+common.HashLength {
+			continue
+		}
+		address, number, direction, kindof, txhash := resolveAddrTxV1Bytes(key)
+
+		blockHash, blockNumber, txIndex := GetTxLookupEntry(chainDb, common.BytesToHash(txhash))
+		if blockHash == (common.Hash{}) || blockNumber != number || GetCanonicalHash(chainDb, number) != blockHash {
+			dropped++
+		} else {
+			if err := batch.Put(formatAddrTxBytesIndex(address, number, uint32(txIndex), direction, kindof, txhash), blockHash.Bytes()); err != nil {
+				return err
 			}
+			rec := records[number]
+			if rec == nil || rec.Hash != blockHash {
+				rec = &addrTxBlockRecord{Hash: blockHash}
+				records[number] = rec
+			}
+			rec.addAddr(common.BytesToAddress(address))
+			migrated++
 		}
-		it.Release()
-		if e := it.Error(); e != nil {
-			return e
+		if err := batch.Delete(key); err != nil {
+			return err
 		}
-	}
-
-	for _, r := range removals {
-		if err := db.Delete(r); err != nil {
+		if batch.ValueSize() < ngindb.IdealBatchSize {
+			continue
+		}
+		if err := writeBatch(); err != nil {
 			return err
 		}
+		batch = indexDb.NewBatch()
+
+		if time.Since(logged) > 8*time.Second {
+			glog.D(logger.Warn).Infof("Migrating address-transaction index: %d entries migrated, %d dropped, elapsed %v", migrated, dropped, time.Since(start).Round(time.Second))
+			logged = time.Now()
+		}
+		// Listen for interrupts, nonblocking
+		select {
+		case s := <-sigc:
+			glog.D(logger.Warn).Warnln("atxi migration", "got interrupt:", s, "quitting")
+			return nil
+		default:
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if err := writeAddrTxIndexVersion(batch, AddrTxIndexVersion); err != nil {
+		return err
+	}
+	if err := writeBatch(); err != nil {
+		return err
 	}
+	glog.D(logger.Warn).Infof("Migrated address-transaction index in %v: %d entries migrated, %d dropped", time.Since(start).Round(time.Second), migrated, dropped)
 	return nil
 }
@@ -0,0 +1,444 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+var (
+	testAtxiKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	testAtxiAddr   = crypto.PubkeyToAddress(testAtxiKey.PublicKey)
+)
+
+// newAddrTxsBlock returns a block of signed transactions from the test account
+// to each of the recipients.
+func newAddrTxsBlock(t *testing.T, number int64, recipients ...common.Address) *types.Block {
+	var txs []*types.Transaction
+	for i, to := range recipients {
+		tx, err := types.NewTransaction(uint64(i), to, big.NewInt(1), big.NewInt(21000), new(big.Int), nil).SignECDSA(testAtxiKey)
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		txs = append(txs, tx)
+	}
+	return types.NewBlock(&types.Header{Number: big.NewInt(number)}, txs, nil, nil)
+}
+
+// newAddrTxsTestBlocks returns the blocks #1, #2 and #256, holding the
+// transactions, as positions <block>/<index>:
+//
+//	1/0 ->Y, 1/1 ->Z, 1/2 ->Y
+//	256/0 ->Z, 256/1 ->Y
+//
+// Block #256 is numbered to sort before #1 in a little-endian layout.
+func newAddrTxsTestBlocks(t *testing.T) []*types.Block {
+	return []*types.Block{
+		newAddrTxsBlock(t, 1, testAddrY, testAddrZ, testAddrY),
+		newAddrTxsBlock(t, 2),
+		newAddrTxsBlock(t, 256, testAddrZ, testAddrY),
+	}
+}
+
+// addrTxPositions maps the hashes of the transactions of the blocks to their
+// positions, as <block>/<index>.
+func addrTxPositions(blocks []*types.Block) map[string]string {
+	positions := make(map[string]string)
+	for _, block := range blocks {
+		for i, tx := range block.Transactions() {
+			positions[tx.Hash().Hex()] = fmt.Sprintf("%d/%d", block.NumberU64(), i)
+		}
+	}
+	return positions
+}
+
+// resolvePositions lists the positions of transaction hashes.
+func resolvePositions(t *testing.T, positions map[string]string, txs []string) []string {
+	resolved := []string{}
+	for _, tx := range txs {
+		pos, ok := positions[tx]
+		if !ok {
+			t.Fatalf("unknown transaction %s", tx)
+		}
+		resolved = append(resolved, pos)
+	}
+	return resolved
+}
+
+// newAddrTxsTestDB returns an index holding the test blocks.
+func newAddrTxsTestDB(t *testing.T) (*ngindb.MemDatabase, []*types.Block) {
+	db, _ := ngindb.NewMemDatabase()
+	blocks := newAddrTxsTestBlocks(t)
+	for _, block := range blocks {
+		if err := WriteBlockAddTxIndexes(db, block, nil); err != nil {
+			t.Fatalf("failed to index block #%d: %v", block.NumberU64(), err)
+		}
+	}
+	return db, blocks
+}
+
+// Tests that index keys resolve to the values they were formatted from, and
+// sort in chain order.
+func TestAddrTxKeyLayout(t *testing.T) {
+	txhash := common.HexToHash("0xdeadbeef").Bytes()
+
+	key := formatAddrTxBytesIndex(testAddrX.Bytes(), 0x0102030405, 0x0a0b0c0d, []byte("t"), []byte("c"), txhash)
+	if len(key) != addrTxKeyLength {
+		t.Fatalf("key length mismatch: have %d, want %d", len(key), addrTxKeyLength)
+	}
+	if !bytes.HasPrefix(key, formatAddrTxIterator(testAddrX)) {
+		t.Fatalf("key %x outside of address prefix", key)
+	}
+	address, number, txIndex, direction, kindof, hash := resolveAddrTxBytes(key)
+	if !bytes.Equal(address, testAddrX.Bytes()) || number != 0x0102030405 || txIndex != 0x0a0b0c0d ||
+		string(direction) != "t" || string(kindof) != "c" || !bytes.Equal(hash, txhash) {
+		t.Fatalf("key resolved to %x #%d/%d %s %s %x", address, number, txIndex, direction, kindof, hash)
+	}
+	// Keys of later transactions sort after, whatever their direction, kind
+	// and hash
+	ordered := [][]byte{
+		formatAddrTxBytesIndex(testAddrX.Bytes(), 1, 0, []byte("t"), []byte("s"), common.HexToHash("0xff").Bytes()),
+		formatAddrTxBytesIndex(testAddrX.Bytes(), 1, 1, []byte("f"), []byte("c"), common.HexToHash("0x01").Bytes()),
+		formatAddrTxBytesIndex(testAddrX.Bytes(), 1, 256, []byte("f"), []byte("i"), common.HexToHash("0x01").Bytes()),
+		formatAddrTxBytesIndex(testAddrX.Bytes(), 2, 0, []byte("f"), []byte("s"), common.HexToHash("0x01").Bytes()),
+		formatAddrTxBytesIndex(testAddrX.Bytes(), 256, 0, []byte("f"), []byte("s"), common.HexToHash("0x01").Bytes()),
+	}
+	for i := 1; i < len(ordered); i++ {
+		if bytes.Compare(ordered[i-1], ordered[i]) >= 0 {
+			t.Errorf("key %d doesn't sort after key %d", i, i-1)
+		}
+	}
+}
+
+// Tests that the transactions of an address are listed in chain order, by
+// offsets and by cursor, in both orders and with filters.
+func TestAddrTxsPagination(t *testing.T) {
+	db, blocks := newAddrTxsTestDB(t)
+	positions := addrTxPositions(blocks)
+
+	tests := []struct {
+		address    common.Address
+		start, end uint64
+		direction  string
+		limit      int
+		reverse    bool
+		want       [][]string
+	}{
+		// Newest first
+		{testAtxiAddr, 0, 0, "", 2, false, [][]string{{"256/1", "256/0"}, {"1/2", "1/1"}, {"1/0"}}},
+		// Oldest first, a page boundary at the last transaction
+		{testAtxiAddr, 0, 0, "f", 5, true, [][]string{{"1/0", "1/1", "1/2", "256/0", "256/1"}}},
+		{testAtxiAddr, 0, 0, "", 3, true, [][]string{{"1/0", "1/1", "1/2"}, {"256/0", "256/1"}}},
+		// Direction filter
+		{testAtxiAddr, 0, 0, "to", 0, false, [][]string{{}}},
+		{testAddrY, 0, 0, "t", 1, false, [][]string{{"256/1"}, {"1/2"}, {"1/0"}}},
+		// Block range
+		{testAtxiAddr, 2, 0, "", 1, true, [][]string{{"256/0"}, {"256/1"}}},
+		{testAddrZ, 0, 255, "", 0, false, [][]string{{"1/1"}}},
+		{testAddrY, 2, 255, "", 1, false, [][]string{{}}},
+	}
+	for i, tt := range tests {
+		var (
+			pages  [][]string
+			cursor string
+		)
+		for {
+			txs, next, err := GetAddrTxsPage(db, tt.address, tt.start, tt.end, tt.direction, "", tt.limit, cursor, tt.reverse)
+			if err != nil {
+				t.Fatalf("test %d: failed to get transactions: %v", i, err)
+			}
+			pages = append(pages, resolvePositions(t, positions, txs))
+			if next == "" {
+				break
+			}
+			if len(pages) > 10 {
+				t.Fatalf("test %d: pagination doesn't end", i)
+			}
+			cursor = next
+		}
+		if !reflect.DeepEqual(pages, tt.want) {
+			t.Errorf("test %d: pages mismatch: have %v, want %v", i, pages, tt.want)
+		}
+		// The offsets list the same transactions
+		var all []string
+		for _, page := range tt.want {
+			all = append(all, page...)
+		}
+		txs, err := GetAddrTxs(db, tt.address, tt.start, tt.end, tt.direction, "", 0, 0, tt.reverse)
+		if err != nil {
+			t.Fatalf("test %d: failed to get transactions: %v", i, err)
+		}
+		if have := resolvePositions(t, positions, txs); len(all) > 0 && !reflect.DeepEqual(have, all) {
+			t.Errorf("test %d: listing mismatch: have %v, want %v", i, have, all)
+		}
+	}
+	txs, err := GetAddrTxs(db, testAtxiAddr, 0, 0, "", "", 1, 3, false)
+	if err != nil {
+		t.Fatalf("failed to get transactions: %v", err)
+	}
+	if have, want := resolvePositions(t, positions, txs), []string{"256/0", "1/2"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("offsets mismatch: have %v, want %v", have, want)
+	}
+	if _, _, err := GetAddrTxsPage(db, testAtxiAddr, 0, 0, "", "", 1, "invalid", false); err == nil {
+		t.Errorf("invalid cursor accepted")
+	}
+}
+
+// formatAddrTxV1Key formats a key of the version 1 layout,
+// atx-<addr><blockNumber><t|f><s|c><txhash> with a little-endian block number.
+func formatAddrTxV1Key(address common.Address, blockNumber uint64, direction, kindof string, txhash common.Hash) []byte {
+	key := append(common.CopyBytes(txAddressIndexV1Prefix), address.Bytes()...)
+	key = append(key, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(key[len(key)-8:], blockNumber)
+	key = append(key, direction...)
+	key = append(key, kindof...)
+	return append(key, txhash.Bytes()...)
+}
+
+// Tests that a version 1 index is converted to the current layout, with the
+// transaction indexes taken from the lookup metadata in the chain database
+// and the block hashes recorded, and that entries of transactions off the
+// canonical chain are dropped.
+func TestMigrateAddrTxIndex(t *testing.T) {
+	chainDb, _ := ngindb.NewMemDatabase()
+	indexDb, _ := ngindb.NewMemDatabase()
+
+	blocks := newAddrTxsTestBlocks(t)
+	positions := addrTxPositions(blocks)
+	for _, block := range blocks {
+		if err := WriteCanonicalHash(chainDb, block.Hash(), block.NumberU64()); err != nil {
+			t.Fatalf("failed to write canonical hash: %v", err)
+		}
+	}
+	// Block #1 has its transactions stored with their metadata, block #256
+	// only has lookup entries
+	if err := WriteTransactions(chainDb, blocks[0]); err != nil {
+		t.Fatalf("failed to write transactions: %v", err)
+	}
+	if err := WriteTxLookupEntries(chainDb, blocks[2]); err != nil {
+		t.Fatalf("failed to write lookup entries: %v", err)
+	}
+	for _, block := range blocks {
+		for _, tx := range block.Transactions() {
+			indexDb.Put(formatAddrTxV1Key(testAtxiAddr, block.NumberU64(), "f", "s", tx.Hash()), nil)
+			indexDb.Put(formatAddrTxV1Key(*tx.To(), block.NumberU64(), "t", "s", tx.Hash()), nil)
+		}
+	}
+	// A transaction unknown to the chain, and one of a side block
+	side := newAddrTxsBlock(t, 2, testAddrX)
+	if err := WriteTransactions(chainDb, side); err != nil {
+		t.Fatalf("failed to write transactions: %v", err)
+	}
+	indexDb.Put(formatAddrTxV1Key(testAtxiAddr, 1, "f", "s", common.HexToHash("0x01")), nil)
+	indexDb.Put(formatAddrTxV1Key(testAtxiAddr, 2, "f", "s", side.Transactions()[0].Hash()), nil)
+
+	if vsn := GetAddrTxIndexVersion(indexDb); vsn != 1 {
+		t.Fatalf("version 1 index not recognized: version %d", vsn)
+	}
+	if err := MigrateAddrTxIndex(chainDb, indexDb); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if vsn := GetAddrTxIndexVersion(indexDb); vsn != AddrTxIndexVersion {
+		t.Fatalf("version mismatch after migration: have %d, want %d", vsn, AddrTxIndexVersion)
+	}
+	if err := CheckAddrTxIndexVersion(indexDb); err != nil {
+		t.Fatalf("migrated index rejected: %v", err)
+	}
+	for _, key := range indexDb.Keys() {
+		if bytes.HasPrefix(key, txAddressIndexV1Prefix) && !bytes.HasPrefix(key, txAddressIndexPrefix) {
+			t.Errorf("version 1 key left: %x", key)
+		}
+	}
+	tests := []struct {
+		address   common.Address
+		direction string
+		want      []string
+	}{
+		{testAtxiAddr, "", []string{"256/1", "256/0", "1/2", "1/1", "1/0"}},
+		{testAddrY, "t", []string{"256/1", "1/2", "1/0"}},
+		{testAddrZ, "", []string{"256/0", "1/1"}},
+	}
+	for i, tt := range tests {
+		txs, err := GetAddrTxs(indexDb, tt.address, 0, 0, tt.direction, "", 0, 0, false)
+		if err != nil {
+			t.Fatalf("test %d: failed to get transactions: %v", i, err)
+		}
+		if have := resolvePositions(t, positions, txs); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: transactions mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+	// The entries and records are those of indexed blocks
+	for _, block := range []*types.Block{blocks[0], blocks[2]} {
+		want, _ := ngindb.NewMemDatabase()
+		if err := WriteBlockAddTxIndexes(want, block, nil); err != nil {
+			t.Fatalf("failed to index block #%d: %v", block.NumberU64(), err)
+		}
+		for _, key := range want.Keys() {
+			have, _ := indexDb.Get(key)
+			wantValue, _ := want.Get(key)
+			if !bytes.HasPrefix(key, txAddressBlockPrefix) {
+				if !bytes.Equal(have, wantValue) {
+					t.Errorf("block #%d: entry %x mismatch: have %x, want %x", block.NumberU64(), key, have, wantValue)
+				}
+				continue
+			}
+			rec, err := getAddrTxBlockRecord(indexDb, block.NumberU64())
+			if err != nil || rec == nil || rec.Hash != block.Hash() || len(rec.Addrs) != 3 {
+				t.Errorf("block #%d: record mismatch: have %+v (%v)", block.NumberU64(), rec, err)
+			}
+		}
+		if err := RmBlockAddrTxs(indexDb, block, nil); err != nil {
+			t.Fatalf("failed to remove block #%d: %v", block.NumberU64(), err)
+		}
+	}
+	for _, key := range indexDb.Keys() {
+		if bytes.HasPrefix(key, txAddressIndexPrefix) || bytes.HasPrefix(key, txAddressBlockPrefix) {
+			t.Errorf("key left after removing the migrated blocks: %x", key)
+		}
+	}
+	// A migrated index is left alone
+	if err := MigrateAddrTxIndex(chainDb, indexDb); err != nil {
+		t.Fatalf("failed to rerun migration: %v", err)
+	}
+}
+
+// newAtxiTestChain returns a chain of n blocks, each holding a transaction
+// from the test account to testAddrY, and its database.
+func newAtxiTestChain(t *testing.T, n int) (*BlockChain, ngindb.Database) {
+	db, _ := ngindb.NewMemDatabase()
+	genesis := WriteGenesisBlockForTesting(db, GenesisAccount{Address: testAtxiAddr, Balance: big.NewInt(1000000)})
+	config := DefaultConfigMainnet.ChainConfig
+	blocks, _ := GenerateChain(config, genesis, db, n, func(i int, b *BlockGen) {
+		tx, err := types.NewTransaction(b.TxNonce(testAtxiAddr), testAddrY, big.NewInt(1), big.NewInt(21000), new(big.Int), nil).SignECDSA(testAtxiKey)
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	bc, err := NewBlockChain(db, config, FakePow{}, new(event.TypeMux))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if res := bc.InsertChain(blocks); res.Error != nil {
+		t.Fatalf("failed to insert chain: %v", res.Error)
+	}
+	return bc, db
+}
+
+// Tests that the index is verified against the canonical chain, blocks
+// missing, recorded with another hash or above the head and stale entries
+// being reported, and that a repair leaves a clean index.
+func TestVerifyAddrTxIndex(t *testing.T) {
+	bc, _ := newAtxiTestChain(t, 6)
+	defer bc.Stop()
+	indexDb, _ := ngindb.NewMemDatabase()
+
+	head := bc.CurrentBlock().NumberU64()
+	var canonical []string
+	for n := head; n > 0; n-- {
+		block := bc.GetBlockByNumber(n)
+		if err := WriteBlockAddTxIndexes(indexDb, block, nil); err != nil {
+			t.Fatalf("failed to index block #%d: %v", n, err)
+		}
+		canonical = append(canonical, block.Transactions()[0].Hash().Hex())
+	}
+	// Block #2 is missing, #3 recorded for a side block, one block above the
+	// head is indexed, and a value-less entry of an older version is stale
+	if err := RmBlockAddrTxs(indexDb, bc.GetBlockByNumber(2), nil); err != nil {
+		t.Fatalf("failed to remove block #2: %v", err)
+	}
+	for _, block := range []*types.Block{newAddrTxsBlock(t, 3, testAddrX), newAddrTxsBlock(t, int64(head+1), testAddrZ)} {
+		if err := WriteBlockAddTxIndexes(indexDb, block, nil); err != nil {
+			t.Fatalf("failed to index block #%d: %v", block.NumberU64(), err)
+		}
+	}
+	indexDb.Put(formatAddrTxBytesIndex(testAtxiAddr.Bytes(), 4, 0, []byte("f"), []byte("s"), common.HexToHash("0x01").Bytes()), nil)
+
+	tests := []struct {
+		deep, repair bool
+		want         AtxiVerifyResult
+	}{
+		{false, false, AtxiVerifyResult{Blocks: head + 1, Missing: 1, Orphaned: 2}},
+		{true, false, AtxiVerifyResult{Blocks: head + 1, Missing: 1, Orphaned: 2, Stale: 5}},
+		{true, true, AtxiVerifyResult{Blocks: head + 1, Missing: 1, Orphaned: 2, Stale: 1, Repaired: 4}},
+		{true, false, AtxiVerifyResult{Blocks: head + 1}},
+	}
+	for i, tt := range tests {
+		res, err := VerifyAddrTxIndex(bc, indexDb, 0, 0, tt.deep, tt.repair)
+		if err != nil {
+			t.Fatalf("test %d: failed to verify: %v", i, err)
+		}
+		if *res != tt.want {
+			t.Errorf("test %d: result mismatch: have %+v, want %+v", i, *res, tt.want)
+		}
+	}
+	txs, err := GetAddrTxs(indexDb, testAtxiAddr, 0, 0, "", "", 0, 0, false)
+	if err != nil {
+		t.Fatalf("failed to get transactions: %v", err)
+	}
+	if !reflect.DeepEqual(txs, canonical) {
+		t.Errorf("transactions mismatch after repair: have %v, want %v", txs, canonical)
+	}
+	for _, addr := range []common.Address{testAddrX, testAddrZ} {
+		if txs, _ := GetAddrTxs(indexDb, addr, 0, 0, "", "", 0, 0, false); len(txs) != 0 {
+			t.Errorf("transactions of %x left after repair: %v", addr, txs)
+		}
+	}
+}
+
+// Tests that the startup check repairs the index of the recent blocks and
+// resets a bookmark above the head.
+func TestCheckAddrTxIndex(t *testing.T) {
+	bc, _ := newAtxiTestChain(t, 3)
+	defer bc.Stop()
+	indexDb, _ := ngindb.NewMemDatabase()
+
+	head := bc.CurrentBlock().NumberU64()
+	if err := WriteBlockAddTxIndexes(indexDb, bc.GetBlockByNumber(1), nil); err != nil {
+		t.Fatalf("failed to index block #1: %v", err)
+	}
+	if err := WriteBlockAddTxIndexes(indexDb, newAddrTxsBlock(t, int64(head+1), testAddrZ), nil); err != nil {
+		t.Fatalf("failed to index block above head: %v", err)
+	}
+	if err := dbSetATXIBookmark(indexDb, head+1); err != nil {
+		t.Fatalf("failed to set bookmark: %v", err)
+	}
+	if err := CheckAddrTxIndex(bc, indexDb); err != nil {
+		t.Fatalf("failed to check index: %v", err)
+	}
+	res, err := VerifyAddrTxIndex(bc, indexDb, 0, 0, true, false)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if res.Diverged() {
+		t.Errorf("index diverging after check: %+v", *res)
+	}
+	if n := dbGetATXIBookmark(indexDb); n != head {
+		t.Errorf("bookmark mismatch: have %d, want %d", n, head)
+	}
+}
@@ -0,0 +1,323 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
+)
+
+var (
+	tokenTransferIndexPrefix = []byte("ttx-") // ttx-<addr><blockNumber><logIndex><t|f>, transfers of all tokens
+	tokenTransferTokenPrefix = []byte("ttk-") // ttk-<addr><token><blockNumber><logIndex><t|f>, transfers of one token
+
+	// transferEventTopic is the topic of the ERC-20 and ERC-721 event
+	// Transfer(address,address,uint256).
+	transferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+)
+
+// tokenTransferKeyLength and tokenTransferTokenKeyLength are the lengths of
+// the token transfer index keys, see formatTokenTransferIndex.
+const (
+	tokenTransferKeyLength      = 4 + common.AddressLength + 8 + 4 + 1
+	tokenTransferTokenKeyLength = tokenTransferKeyLength + common.AddressLength
+)
+
+// tokenTransferCursorLength is the length of a pagination cursor, the block
+// number and log index of the last transfer of a page.
+const tokenTransferCursorLength = 8 + 4
+
+// TokenTransfer is an ERC-20 or ERC-721 token transfer, as logged by the token
+// contract.
+type TokenTransfer struct {
+	Token       common.Address
+	From        common.Address
+	To          common.Address
+	Value       *big.Int // Amount transferred, or token id of ERC-721 transfers
+	BlockNumber uint64
+	LogIndex    uint32 // Index of the log within the block
+	TxHash      common.Hash
+}
+
+// tokenTransferEntry is the value of a token transfer index key.
+type tokenTransferEntry struct {
+	Token  common.Address
+	From   common.Address
+	To     common.Address
+	Value  *big.Int
+	TxHash common.Hash
+}
+
+// formatTokenTransferIndex formats the index key of a transfer among those of
+// all tokens, eg. ttx-<addr><blockNumber><logIndex><t|f>, or with token among
+// those of the token, eg. ttk-<addr><token><blockNumber><logIndex><t|f>
+// The block number and log index are big-endian, so that the transfers
+// iterate in chain order.
+func formatTokenTransferIndex(address common.Address, token *common.Address, blockNumber uint64, logIndex uint32, direction byte) []byte {
+	var key []byte
+	if token == nil {
+		key = make([]byte, 0, tokenTransferKeyLength)
+		key = append(key, tokenTransferIndexPrefix...)
+		key = append(key, address.Bytes()...)
+	} else {
+		key = make([]byte, 0, tokenTransferTokenKeyLength)
+		key = append(key, tokenTransferTokenPrefix...)
+		key = append(key, address.Bytes()...)
+		key = append(key, token.Bytes()...)
+	}
+	key = append(key, make([]byte, 12)...)
+	binary.BigEndian.PutUint64(key[len(key)-12:], blockNumber)
+	binary.BigEndian.PutUint32(key[len(key)-4:], logIndex)
+	return append(key, direction)
+}
+
+// resolveTokenTransferIndex resolves the position of the transfer in the chain
+// and its direction from an index key of either layout.
+func resolveTokenTransferIndex(key []byte) (blockNumber uint64, logIndex uint32, direction byte) {
+	pos := key[len(key)-1-tokenTransferCursorLength:]
+	blockNumber = binary.BigEndian.Uint64(pos[:8])
+	logIndex = binary.BigEndian.Uint32(pos[8:12])
+	direction = key[len(key)-1]
+	return
+}
+
+// putTokenTransferIndexes puts the keys indexing a transfer in both layouts
+// for the address, in the given direction.
+func putTokenTransferIndexes(putBatch ngindb.Batch, address common.Address, t *TokenTransfer, direction byte, enc []byte) error {
+	if err := putBatch.Put(formatTokenTransferIndex(address, nil, t.BlockNumber, t.LogIndex, direction), enc); err != nil {
+		return err
+	}
+	return putBatch.Put(formatTokenTransferIndex(address, &t.Token, t.BlockNumber, t.LogIndex, direction), enc)
+}
+
+// rmTokenTransferIndexes removes the keys indexing a transfer in both layouts
+// for the address, in the given direction.
+func rmTokenTransferIndexes(batch ngindb.Batch, address common.Address, t *TokenTransfer, direction byte) error {
+	if err := batch.Delete(formatTokenTransferIndex(address, nil, t.BlockNumber, t.LogIndex, direction)); err != nil {
+		return err
+	}
+	return batch.Delete(formatTokenTransferIndex(address, &t.Token, t.BlockNumber, t.LogIndex, direction))
+}
+
+// blockTokenTransfers returns the token transfers logged by the transactions
+// of a given block.
+func blockTokenTransfers(block *types.Block, receipts types.Receipts) []*TokenTransfer {
+	var (
+		transfers []*TokenTransfer
+		logIndex  uint32
+	)
+	for i, receipt := range receipts {
+		if i >= len(block.Transactions()) {
+			break
+		}
+		for _, log := range receipt.Logs {
+			index := logIndex
+			logIndex++
+
+			if len(log.Topics) == 0 || log.Topics[0] != transferEventTopic {
+				continue
+			}
+			var value *big.Int
+			switch {
+			case len(log.Topics) == 3 && len(log.Data) == 32: // ERC-20, amount in data
+				value = new(big.Int).SetBytes(log.Data)
+			case len(log.Topics) == 4 && len(log.Data) == 0: // ERC-721, indexed token id
+				value = log.Topics[3].Big()
+			default:
+				continue
+			}
+			transfers = append(transfers, &TokenTransfer{
+				Token:       log.Address,
+				From:        common.BytesToAddress(log.Topics[1].Bytes()),
+				To:          common.BytesToAddress(log.Topics[2].Bytes()),
+				Value:       value,
+				BlockNumber: block.NumberU64(),
+				LogIndex:    index,
+				TxHash:      block.Transactions()[i].Hash(),
+			})
+		}
+	}
+	return transfers
+}
+
+// WriteBlockTokenTransfers writes the token transfer indexes of a given block.
+func WriteBlockTokenTransfers(indexDb ngindb.Database, block *types.Block, receipts types.Receipts) error {
+	batch := indexDb.NewBatch()
+	if _, err := putBlockTokenTransfersToBatch(batch, block, receipts); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// putBlockTokenTransfersToBatch formats and puts the token transfer keys of a
+// given block to a db Batch, indexing every transfer by its sender and
+// recipient.
+func putBlockTokenTransfersToBatch(putBatch ngindb.Batch, block *types.Block, receipts types.Receipts) (transfersCount int, err error) {
+	for _, t := range blockTokenTransfers(block, receipts) {
+		enc, err := rlp.EncodeToBytes(&tokenTransferEntry{Token: t.Token, From: t.From, To: t.To, Value: t.Value, TxHash: t.TxHash})
+		if err != nil {
+			return transfersCount, err
+		}
+		if err := putTokenTransferIndexes(putBatch, t.From, t, 'f', enc); err != nil {
+			return transfersCount, err
+		}
+		if err := putTokenTransferIndexes(putBatch, t.To, t, 't', enc); err != nil {
+			return transfersCount, err
+		}
+		transfersCount++
+	}
+	return transfersCount, nil
+}
+
+// RmBlockTokenTransfers removes the token transfer indexes of a given block.
+func RmBlockTokenTransfers(db ngindb.Database, block *types.Block, receipts types.Receipts) error {
+	batch := db.NewBatch()
+	for _, t := range blockTokenTransfers(block, receipts) {
+		if err := rmTokenTransferIndexes(batch, t.From, t, 'f'); err != nil {
+			return err
+		}
+		if err := rmTokenTransferIndexes(batch, t.To, t, 't'); err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
+
+// GetTokenTransfers gets a page of at most limit indexed token transfers for a
+// given account address, limit <= 0 meaning no limit, optionally of a single
+// token. The transfers are taken between the given blocks, 0 meaning
+// unbounded, in the given direction relative to the address, [b|t|f].
+// Transfers are listed newest first, 'reverse' means "oldest first". The page
+// starts after the opaque cursor, empty for the first page, and the cursor of
+// the next page is returned, empty if there are no more transfers.
+func GetTokenTransfers(db ngindb.Database, address common.Address, token *common.Address, blockStartN uint64, blockEndN uint64, direction string, limit int, cursor string, reverse bool) (transfers []*TokenTransfer, next string, err error) {
+	wantDirection, _, err := parseAddrTxFilter(direction, "")
+	if err != nil {
+		return nil, "", err
+	}
+	var from []byte
+	if cursor != "" {
+		if from, err = base64.RawURLEncoding.DecodeString(cursor); err != nil || len(from) != tokenTransferCursorLength {
+			return nil, "", fmt.Errorf("%v: %s", errAtxiInvalidUse, "invalid pagination cursor")
+		}
+	}
+	if blockEndN == 0 || blockEndN == math.MaxUint64 {
+		blockEndN = math.MaxUint64 - 1
+	}
+	// The transfers are stored in chain order, seek from the cursor and stop
+	// one transfer beyond the page instead of collecting them all.
+	prefix := formatTokenTransferIndex(address, token, 0, 0, 0)
+	prefix = prefix[:len(prefix)-1-tokenTransferCursorLength]
+	keyLength := len(prefix) + tokenTransferCursorLength + 1
+
+	start := make([]byte, len(prefix)+8)
+	copy(start, prefix)
+	binary.BigEndian.PutUint64(start[len(prefix):], blockStartN)
+
+	end := make([]byte, len(prefix)+8)
+	copy(end, prefix)
+	binary.BigEndian.PutUint64(end[len(prefix):], blockEndN+1)
+
+	var it ngindb.Iterator
+	if reverse {
+		if from != nil {
+			// Past both directions of the transfer at the cursor
+			if after := append(append(common.CopyBytes(prefix), from...), 0xff); bytes.Compare(after, start) > 0 {
+				start = after
+			}
+		}
+		it = db.NewIteratorRange(start, end)
+	} else {
+		if from != nil {
+			if before := append(common.CopyBytes(prefix), from...); bytes.Compare(before, end) < 0 {
+				end = before
+			}
+		}
+		it = db.NewReverseIteratorRange(start, end)
+	}
+	defer it.Release()
+
+	var last []byte
+	for it.Next() {
+		key := it.Key()
+		if len(key) != keyLength {
+			continue
+		}
+		if _, _, torf := resolveTokenTransferIndex(key); wantDirection != 'b' && wantDirection != torf {
+			continue
+		}
+		pos := key[len(prefix) : len(prefix)+tokenTransferCursorLength]
+		// Transfers of the address to itself are indexed in both directions
+		if last != nil && bytes.Equal(pos, last) {
+			continue
+		}
+		// One transfer beyond the page tells there's a next one
+		if limit > 0 && len(transfers) == limit {
+			next = base64.RawURLEncoding.EncodeToString(last)
+			break
+		}
+		var entry tokenTransferEntry
+		if err := rlp.DecodeBytes(it.Value(), &entry); err != nil {
+			return nil, "", err
+		}
+		number, index, _ := resolveTokenTransferIndex(key)
+		transfers = append(transfers, &TokenTransfer{
+			Token:       entry.Token,
+			From:        entry.From,
+			To:          entry.To,
+			Value:       entry.Value,
+			BlockNumber: number,
+			LogIndex:    index,
+			TxHash:      entry.TxHash,
+		})
+		last = common.CopyBytes(pos)
+	}
+	if err := it.Error(); err != nil {
+		return nil, "", err
+	}
+	return transfers, next, nil
+}
+
+// rmTokenTransfersAbove removes the token transfer indexes of the blocks above
+// head, in both layouts.
+func rmTokenTransfersAbove(db ngindb.Database, head uint64) error {
+	for _, prefix := range [][]byte{tokenTransferIndexPrefix, tokenTransferTokenPrefix} {
+		it := db.NewIteratorWithPrefix(prefix)
+		batch := db.NewBatch()
+		for it.Next() {
+			key := it.Key()
+			if len(key) != tokenTransferKeyLength && len(key) != tokenTransferTokenKeyLength {
+				continue
+			}
+			if n, _, _ := resolveTokenTransferIndex(key); n > head {
+				if err := batch.Delete(common.CopyBytes(key)); err != nil {
+					it.Release()
+					return err
+				}
+				if batch.ValueSize() >= ngindb.IdealBatchSize {
+					if err := batch.Write(); err != nil {
+						it.Release()
+						return err
+					}
+					batch = db.NewBatch()
+				}
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+		if err := batch.Write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
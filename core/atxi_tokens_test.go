@@ -0,0 +1,231 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/core/vm"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+var (
+	testTokenA = common.HexToAddress("0xaaaa")
+	testTokenB = common.HexToAddress("0xbbbb")
+	testAddrX  = common.HexToAddress("0x1111")
+	testAddrY  = common.HexToAddress("0x2222")
+	testAddrZ  = common.HexToAddress("0x3333")
+)
+
+// erc20Transfer returns the log of an ERC-20 transfer.
+func erc20Transfer(token, from, to common.Address, amount int64) *vm.Log {
+	return &vm.Log{
+		Address: token,
+		Topics:  []common.Hash{transferEventTopic, from.Hash(), to.Hash()},
+		Data:    common.LeftPadBytes(big.NewInt(amount).Bytes(), 32),
+	}
+}
+
+// erc721Transfer returns the log of an ERC-721 transfer.
+func erc721Transfer(token, from, to common.Address, id int64) *vm.Log {
+	return &vm.Log{
+		Address: token,
+		Topics:  []common.Hash{transferEventTopic, from.Hash(), to.Hash(), common.BigToHash(big.NewInt(id))},
+	}
+}
+
+// newTransfersBlock returns a block of one transaction per log list, along
+// with the receipts holding the logs.
+func newTransfersBlock(number int64, logs ...vm.Logs) (*types.Block, types.Receipts) {
+	var (
+		txs      []*types.Transaction
+		receipts types.Receipts
+	)
+	for i, l := range logs {
+		txs = append(txs, types.NewTransaction(uint64(i), testTokenA, new(big.Int), big.NewInt(100000), new(big.Int), nil))
+		receipt := types.NewReceipt(nil, new(big.Int))
+		receipt.Logs = l
+		receipts = append(receipts, receipt)
+	}
+	return types.NewBlock(&types.Header{Number: big.NewInt(number)}, txs, nil, receipts), receipts
+}
+
+// newTokenTransfersTestDB returns an index holding the transfers of three
+// blocks, as positions <block>/<log>:
+//
+//	1/0 A X->Y 10, 1/1 B Z->X 20
+//	2/0 A X->X 5,  2/1 B Y->X #7 (ERC-721), 2/2 unrelated event
+//	3/0 A Y->X 1
+func newTokenTransfersTestDB(t *testing.T) (*ngindb.MemDatabase, []*types.Block, []types.Receipts) {
+	db, _ := ngindb.NewMemDatabase()
+
+	unrelated := &vm.Log{Address: testTokenA, Topics: []common.Hash{common.HexToHash("0x01")}}
+	b1, r1 := newTransfersBlock(1, vm.Logs{erc20Transfer(testTokenA, testAddrX, testAddrY, 10), erc20Transfer(testTokenB, testAddrZ, testAddrX, 20)})
+	b2, r2 := newTransfersBlock(2, vm.Logs{erc20Transfer(testTokenA, testAddrX, testAddrX, 5)}, vm.Logs{erc721Transfer(testTokenB, testAddrY, testAddrX, 7), unrelated})
+	b3, r3 := newTransfersBlock(3, vm.Logs{erc20Transfer(testTokenA, testAddrY, testAddrX, 1)})
+
+	blocks, receipts := []*types.Block{b1, b2, b3}, []types.Receipts{r1, r2, r3}
+	for i := range blocks {
+		if err := WriteBlockTokenTransfers(db, blocks[i], receipts[i]); err != nil {
+			t.Fatalf("failed to index block #%d: %v", blocks[i].NumberU64(), err)
+		}
+	}
+	return db, blocks, receipts
+}
+
+// transferPositions lists the transfers as <block>/<log>.
+func transferPositions(transfers []*TokenTransfer) []string {
+	positions := []string{}
+	for _, t := range transfers {
+		positions = append(positions, fmt.Sprintf("%d/%d", t.BlockNumber, t.LogIndex))
+	}
+	return positions
+}
+
+// allTokenTransfers pages through the transfers, returning them by page.
+func allTokenTransfers(t *testing.T, db ngindb.Database, token *common.Address, start, end uint64, direction string, limit int, reverse bool) [][]string {
+	var (
+		pages  [][]string
+		cursor string
+	)
+	for {
+		transfers, next, err := GetTokenTransfers(db, testAddrX, token, start, end, direction, limit, cursor, reverse)
+		if err != nil {
+			t.Fatalf("failed to get transfers: %v", err)
+		}
+		pages = append(pages, transferPositions(transfers))
+		if next == "" {
+			return pages
+		}
+		if len(pages) > 10 {
+			t.Fatalf("pagination doesn't end")
+		}
+		cursor = next
+	}
+}
+
+// Tests that token transfers are decoded from the logs and indexed for both
+// their sender and recipient.
+func TestTokenTransfersDecoding(t *testing.T) {
+	db, _, _ := newTokenTransfersTestDB(t)
+
+	transfers, next, err := GetTokenTransfers(db, testAddrX, nil, 2, 2, "", 0, "", true)
+	if err != nil {
+		t.Fatalf("failed to get transfers: %v", err)
+	}
+	if next != "" {
+		t.Errorf("cursor returned without limit: %q", next)
+	}
+	want := []*TokenTransfer{
+		{Token: testTokenA, From: testAddrX, To: testAddrX, Value: big.NewInt(5), BlockNumber: 2, LogIndex: 0},
+		{Token: testTokenB, From: testAddrY, To: testAddrX, Value: big.NewInt(7), BlockNumber: 2, LogIndex: 1},
+	}
+	if len(transfers) != len(want) {
+		t.Fatalf("transfers mismatch: have %v, want %v", transferPositions(transfers), transferPositions(want))
+	}
+	for i, tr := range transfers {
+		want[i].TxHash = tr.TxHash
+		if !reflect.DeepEqual(tr, want[i]) {
+			t.Errorf("transfer %d mismatch: have %+v, want %+v", i, tr, want[i])
+		}
+	}
+	if transfers[0].TxHash == transfers[1].TxHash {
+		t.Errorf("transfers of distinct transactions share hash %x", transfers[0].TxHash)
+	}
+	// The recipient of a transfer finds it too
+	transfers, _, err = GetTokenTransfers(db, testAddrY, nil, 0, 0, "t", 0, "", true)
+	if err != nil {
+		t.Fatalf("failed to get transfers: %v", err)
+	}
+	if have, want := transferPositions(transfers), []string{"1/0"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("transfers to recipient mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that transfers are paginated by cursor in both orders, with and
+// without token and direction filters.
+func TestTokenTransfersPagination(t *testing.T) {
+	db, _, _ := newTokenTransfersTestDB(t)
+	tokenA := testTokenA
+
+	tests := []struct {
+		token      *common.Address
+		start, end uint64
+		direction  string
+		limit      int
+		reverse    bool
+		want       [][]string
+	}{
+		// Newest first, the transfer to itself listed once
+		{nil, 0, 0, "", 2, false, [][]string{{"3/0", "2/1"}, {"2/0", "1/1"}, {"1/0"}}},
+		// Oldest first
+		{nil, 0, 0, "b", 2, true, [][]string{{"1/0", "1/1"}, {"2/0", "2/1"}, {"3/0"}}},
+		// A page boundary at the last transfer
+		{nil, 0, 0, "", 5, false, [][]string{{"3/0", "2/1", "2/0", "1/1", "1/0"}}},
+		{nil, 0, 0, "", 4, true, [][]string{{"1/0", "1/1", "2/0", "2/1"}, {"3/0"}}},
+		// Single token
+		{&tokenA, 0, 0, "", 1, false, [][]string{{"3/0"}, {"2/0"}, {"1/0"}}},
+		{&tokenA, 0, 0, "to", 1, true, [][]string{{"2/0"}, {"3/0"}}},
+		{&tokenA, 0, 0, "from", 0, false, [][]string{{"2/0", "1/0"}}},
+		// Block range
+		{nil, 2, 3, "t", 1, false, [][]string{{"3/0"}, {"2/1"}, {"2/0"}}},
+		{nil, 0, 1, "", 0, true, [][]string{{"1/0", "1/1"}}},
+		{&tokenA, 2, 2, "", 1, true, [][]string{{"2/0"}}},
+		{nil, 4, 0, "", 1, true, [][]string{{}}},
+	}
+	for i, tt := range tests {
+		if have := allTokenTransfers(t, db, tt.token, tt.start, tt.end, tt.direction, tt.limit, tt.reverse); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: pages mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+	if _, _, err := GetTokenTransfers(db, testAddrX, nil, 0, 0, "", 1, "invalid", false); err == nil {
+		t.Errorf("invalid cursor accepted")
+	}
+}
+
+// Tests that the transfers of removed blocks are unindexed.
+func TestTokenTransfersRemoval(t *testing.T) {
+	db, blocks, receipts := newTokenTransfersTestDB(t)
+
+	if err := RmBlockTokenTransfers(db, blocks[0], receipts[0]); err != nil {
+		t.Fatalf("failed to remove block #1: %v", err)
+	}
+	if have, want := allTokenTransfers(t, db, nil, 0, 0, "", 0, true), [][]string{{"2/0", "2/1", "3/0"}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("transfers mismatch after removal: have %v, want %v", have, want)
+	}
+	if err := rmTokenTransfersAbove(db, 2); err != nil {
+		t.Fatalf("failed to remove blocks above #2: %v", err)
+	}
+	if have, want := allTokenTransfers(t, db, nil, 0, 0, "", 0, true), [][]string{{"2/0", "2/1"}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("transfers mismatch after rewind: have %v, want %v", have, want)
+	}
+	tokenA := testTokenA
+	if have, want := allTokenTransfers(t, db, &tokenA, 0, 0, "", 0, true), [][]string{{"2/0"}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("token transfers mismatch after rewind: have %v, want %v", have, want)
+	}
+	if err := RmBlockTokenTransfers(db, blocks[1], receipts[1]); err != nil {
+		t.Fatalf("failed to remove block #2: %v", err)
+	}
+	if keys := db.Keys(); len(keys) != 0 {
+		t.Errorf("%d keys left in index", len(keys))
+	}
+}
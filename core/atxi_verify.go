@@ -0,0 +1,348 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
+)
+
+// atxiCheckDepth is the number of most recent blocks whose atx-indexes are
+// checked against the canonical chain at startup, covering the blocks whose
+// indexing may have been interrupted by a crash.
+const atxiCheckDepth = 256
+
+// addrTxBlockRecord records the block an indexed block number belongs to, and
+// the addresses it was indexed for.
+type addrTxBlockRecord struct {
+	Hash  common.Hash
+	Addrs []common.Address
+}
+
+// AtxiVerifyResult sums up the divergences of the atx-index from the
+// canonical chain.
+type AtxiVerifyResult struct {
+	Blocks   uint64 // Number of blocks checked
+	Missing  uint64 // Canonical blocks not, or partially, indexed
+	Orphaned uint64 // Indexed blocks not or no longer in the canonical chain
+	Stale    uint64 // Entries not belonging to the canonical chain
+	Repaired uint64 // Blocks reindexed and stale entries removed
+}
+
+// Diverged returns whether the index was found diverging from the chain.
+func (r *AtxiVerifyResult) Diverged() bool {
+	return r.Missing+r.Orphaned+r.Stale > 0
+}
+
+// addAddr adds addr to the addresses of the record, unless already there.
+func (rec *addrTxBlockRecord) addAddr(addr common.Address) {
+	for _, a := range rec.Addrs {
+		if a == addr {
+			return
+		}
+	}
+	rec.Addrs = append(rec.Addrs, addr)
+}
+
+// formatAddrTxBlockKey formats the key of the record of an indexed block,
+// eg. atxb-<blockNumber>
+func formatAddrTxBlockKey(blockNumber uint64) []byte {
+	key := make([]byte, len(txAddressBlockPrefix)+8)
+	copy(key, txAddressBlockPrefix)
+	binary.BigEndian.PutUint64(key[len(txAddressBlockPrefix):], blockNumber)
+	return key
+}
+
+// getAddrTxBlockRecord returns the record of the block indexed at a given
+// number, nil if none is.
+func getAddrTxBlockRecord(db ngindb.Database, blockNumber uint64) (*addrTxBlockRecord, error) {
+	enc, _ := db.Get(formatAddrTxBlockKey(blockNumber))
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	rec := new(addrTxBlockRecord)
+	if err := rlp.DecodeBytes(enc, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// rmAddrTxBlockToBatch puts the deletion of the entries of a recorded block,
+// and of its record, to a db Batch. Only the entries holding the hash of the
+// recorded block are removed.
+func rmAddrTxBlockToBatch(db ngindb.Database, batch ngindb.Batch, blockNumber uint64, rec *addrTxBlockRecord) error {
+	number := make([]byte, 8)
+	binary.BigEndian.PutUint64(number, blockNumber)
+	for _, addr := range rec.Addrs {
+		it := db.NewIteratorWithPrefix(append(formatAddrTxIterator(addr), number...))
+		for it.Next() {
+			if bytes.Equal(it.Value(), rec.Hash.Bytes()) {
+				if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+					it.Release()
+					return err
+				}
+			}
+		}
+		err := it.Error()
+		it.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Delete(formatAddrTxBlockKey(blockNumber))
+}
+
+// rmAddrTxBlocksAbove removes the entries and records of the blocks indexed
+// above head, returning their number.
+func rmAddrTxBlocksAbove(db ngindb.Database, head uint64) (int, error) {
+	var numbers []uint64
+	it := db.NewIteratorWithPrefix(txAddressBlockPrefix)
+	for it.Next() {
+		if n := binary.BigEndian.Uint64(it.Key()[len(txAddressBlockPrefix):]); n > head {
+			numbers = append(numbers, n)
+		}
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range numbers {
+		rec, err := getAddrTxBlockRecord(db, n)
+		if err != nil {
+			return 0, err
+		}
+		batch := db.NewBatch()
+		if err := rmAddrTxBlockToBatch(db, batch, n, rec); err != nil {
+			return 0, err
+		}
+		if err := batch.Write(); err != nil {
+			return 0, err
+		}
+	}
+	return len(numbers), nil
+}
+
+// VerifyAddrTxIndex checks the atx-index of the canonical blocks between start
+// and stop, the head block if stop is 0, against their hashes. Blocks missing
+// from the index, or whose transaction entries are incomplete, and blocks
+// indexed but no longer canonical are reported, along with blocks indexed
+// above the head. A deep check additionally scans all the entries of the
+// range, reporting those not belonging to the canonical chain, including the
+// ones written by older versions which didn't record the block hash. With
+// repair, the divergent blocks are reindexed and the stale entries removed.
+func VerifyAddrTxIndex(bc *BlockChain, indexDb ngindb.Database, start, stop uint64, deep, repair bool) (*AtxiVerifyResult, error) {
+	head := bc.CurrentBlock().NumberU64()
+	if stop == 0 || stop > head {
+		stop = head
+	}
+	res := new(AtxiVerifyResult)
+
+	// sigc is a single-val channel for listening to program interrupt
+	var sigc = make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	if repair {
+		n, err := rmAddrTxBlocksAbove(indexDb, head)
+		if err != nil {
+			return res, err
+		}
+		res.Orphaned += uint64(n)
+		res.Repaired += uint64(n)
+	} else {
+		it := indexDb.NewIteratorWithPrefix(txAddressBlockPrefix)
+		for it.Next() {
+			if binary.BigEndian.Uint64(it.Key()[len(txAddressBlockPrefix):]) > head {
+				res.Orphaned++
+			}
+		}
+		it.Release()
+	}
+
+	for n := start; n <= stop; n++ {
+		block := bc.GetBlockByNumber(n)
+		if block == nil {
+			return res, fmt.Errorf("block %d is nil", n)
+		}
+		res.Blocks++
+
+		rec, err := getAddrTxBlockRecord(indexDb, n)
+		if err != nil {
+			return res, err
+		}
+		var diverged bool
+		switch {
+		case rec != nil && rec.Hash != block.Hash():
+			res.Orphaned++
+			diverged = true
+		case len(block.Transactions()) == 0:
+		case rec == nil:
+			res.Missing++
+			diverged = true
+		default:
+			keys, err := blockAddrTxKeys(block, nil)
+			if err != nil {
+				return res, err
+			}
+			for _, key := range keys {
+				if v, _ := indexDb.Get(key); !bytes.Equal(v, block.Hash().Bytes()) {
+					res.Missing++
+					diverged = true
+					break
+				}
+			}
+		}
+		if diverged {
+			glog.V(logger.Debug).Infof("atxi: block #%d [%x…] diverges from the index", n, block.Hash().Bytes()[:4])
+		}
+		if diverged && repair {
+			if err := repairAddrTxBlock(bc, indexDb, block, rec); err != nil {
+				return res, err
+			}
+			res.Repaired++
+		}
+		if n > start && (n-start)%100000 == 0 {
+			glog.D(logger.Info).Infof("atxi verify: block %d / %d, %d missing, %d orphaned", n, stop, res.Missing, res.Orphaned)
+		}
+		// Listen for interrupts, nonblocking
+		select {
+		case s := <-sigc:
+			glog.D(logger.Info).Warnln("atxi verify", "got interrupt:", s, "quitting")
+			return res, nil
+		default:
+		}
+	}
+	if !deep {
+		return res, nil
+	}
+	return res, verifyAddrTxEntries(bc, indexDb, start, stop, head, repair, res)
+}
+
+// repairAddrTxBlock reindexes a canonical block, dropping the entries of the
+// block formerly recorded at its number.
+func repairAddrTxBlock(bc *BlockChain, indexDb ngindb.Database, block *types.Block, rec *addrTxBlockRecord) error {
+	if len(block.Transactions()) == 0 {
+		batch := indexDb.NewBatch()
+		if err := rmAddrTxBlockToBatch(indexDb, batch, block.NumberU64(), rec); err != nil {
+			return err
+		}
+		return batch.Write()
+	}
+	internals, err := bc.indexedInternalTxs(indexDb, block)
+	if err != nil {
+		return err
+	}
+	return WriteBlockAddTxIndexes(indexDb, block, internals)
+}
+
+// verifyAddrTxEntries scans the entries of the blocks between start and stop,
+// and any above head, reporting and with repair removing those not belonging
+// to the canonical chain.
+func verifyAddrTxEntries(bc *BlockChain, indexDb ngindb.Database, start, stop, head uint64, repair bool, res *AtxiVerifyResult) error {
+	var (
+		canonical = make(map[uint64]*types.Block)
+		removals  [][]byte
+	)
+	canonicalBlock := func(n uint64) *types.Block {
+		block, ok := canonical[n]
+		if !ok {
+			// Entries of an address iterate in chain order, only keep a few blocks
+			if len(canonical) > 1024 {
+				canonical = make(map[uint64]*types.Block)
+			}
+			block = bc.GetBlockByNumber(n)
+			canonical[n] = block
+		}
+		return block
+	}
+	deleteRemovals := func() error {
+		if !repair {
+			removals = nil
+			return nil
+		}
+		batch := indexDb.NewBatch()
+		for _, key := range removals {
+			if err := batch.Delete(key); err != nil {
+				return err
+			}
+		}
+		res.Repaired += uint64(len(removals))
+		removals = nil
+		return batch.Write()
+	}
+
+	it := indexDb.NewIteratorWithPrefix(txAddressIndexPrefix)
+	for it.Next() {
+		key := it.Key()
+		if len(key) != addrTxKeyLength {
+			continue
+		}
+		_, n, txIndex, _, _, txhash := resolveAddrTxBytes(key)
+		if n <= head && (n < start || n > stop) {
+			continue
+		}
+		var stale bool
+		if block := canonicalBlock(n); n > head || block == nil {
+			stale = true
+		} else if v := it.Value(); len(v) == common.HashLength {
+			stale = !bytes.Equal(v, block.Hash().Bytes())
+		} else {
+			// Entries written by older versions hold no block hash
+			txs := block.Transactions()
+			stale = int(txIndex) >= len(txs) || !bytes.Equal(txs[txIndex].Hash().Bytes(), txhash)
+		}
+		if !stale {
+			continue
+		}
+		res.Stale++
+		removals = append(removals, common.CopyBytes(key))
+		// Prevent removals from getting too massive
+		if len(removals) > 100000 {
+			if err := deleteRemovals(); err != nil {
+				it.Release()
+				return err
+			}
+		}
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil {
+		return err
+	}
+	return deleteRemovals()
+}
+
+// CheckAddrTxIndex checks the atx-index of the most recent blocks against the
+// canonical chain, repairing it from an interrupted update.
+func CheckAddrTxIndex(bc *BlockChain, indexDb ngindb.Database) error {
+	head := bc.CurrentBlock().NumberU64()
+	start := uint64(0)
+	if head >= atxiCheckDepth {
+		start = head - atxiCheckDepth + 1
+	}
+	res, err := VerifyAddrTxIndex(bc, indexDb, start, head, false, true)
+	if err != nil {
+		return err
+	}
+	if res.Diverged() {
+		glog.V(logger.Warn).Warnf("Repaired address-transaction index: %d blocks missing, %d orphaned", res.Missing, res.Orphaned)
+		glog.D(logger.Warn).Warnf("Repaired address-transaction index: %d blocks missing, %d orphaned", res.Missing, res.Orphaned)
+	}
+	if n, ok := dbGetATXIIncomplete(indexDb); ok {
+		glog.V(logger.Warn).Warnf("Address-transaction index lacks internal transactions from block #%d on, run atxi-build from there on an archive node to complete it", n)
+	}
+	if dbGetATXIBookmark(indexDb) > head {
+		return dbSetATXIBookmark(indexDb, head)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
+)
+
+var (
+	balanceIndexPrefix      = []byte("bal-")  // bal-<addr><blockNumber> -> balance
+	balanceBlockIndexPrefix = []byte("balb-") // balb-<blockNumber> -> addresses whose balance changed
+	balanceBookmarkKey      = []byte("BalanceHistoryBookmark")
+)
+
+// balanceKeyLength is the length of a balance index key, see
+// formatBalanceIndex.
+const balanceKeyLength = 4 + common.AddressLength + 8
+
+// BalanceIndexT holds the database of the balance history index, which records
+// the balance of an account at every canonical block changing it.
+type BalanceIndexT struct {
+	Db ngindb.Database
+}
+
+// BalanceRecord is the balance of an account as of after a block.
+type BalanceRecord struct {
+	BlockNumber uint64
+	Balance     *big.Int
+}
+
+// formatBalanceIndex formats the index key, eg. bal-<addr><blockNumber>
+// The block number is big-endian, so that the balances of an account iterate
+// in chain order.
+func formatBalanceIndex(address common.Address, blockNumber uint64) []byte {
+	key := make([]byte, balanceKeyLength)
+	copy(key, balanceIndexPrefix)
+	copy(key[4:], address.Bytes())
+	binary.BigEndian.PutUint64(key[4+common.AddressLength:], blockNumber)
+	return key
+}
+
+// formatBalanceBlockIndex formats the key of the addresses whose balance
+// changed in a block, eg. balb-<blockNumber>
+func formatBalanceBlockIndex(blockNumber uint64) []byte {
+	key := make([]byte, len(balanceBlockIndexPrefix)+8)
+	copy(key, balanceBlockIndexPrefix)
+	binary.BigEndian.PutUint64(key[len(balanceBlockIndexPrefix):], blockNumber)
+	return key
+}
+
+func dbGetBalanceHistoryBookmark(db ngindb.Database) uint64 {
+	v, err := db.Get(balanceBookmarkKey)
+	if err != nil || len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func dbSetBalanceHistoryBookmark(db ngindb.Database, i uint64) error {
+	bn := make([]byte, 8)
+	binary.BigEndian.PutUint64(bn, i)
+	return db.Put(balanceBookmarkKey, bn)
+}
+
+// getBlockBalanceAddrs returns the addresses recorded for a block number.
+func getBlockBalanceAddrs(db ngindb.Database, blockNumber uint64) ([]common.Address, error) {
+	enc, _ := db.Get(formatBalanceBlockIndex(blockNumber))
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	var addrs []common.Address
+	if err := rlp.DecodeBytes(enc, &addrs); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// rmBlockBalancesToBatch puts the deletion of the balances recorded for a
+// block number to a db Batch.
+func rmBlockBalancesToBatch(db ngindb.Database, batch ngindb.Batch, blockNumber uint64) error {
+	addrs, err := getBlockBalanceAddrs(db, blockNumber)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := batch.Delete(formatBalanceIndex(addr, blockNumber)); err != nil {
+			return err
+		}
+	}
+	return batch.Delete(formatBalanceBlockIndex(blockNumber))
+}
+
+// WriteBlockBalances records the balances of the accounts changed by the block
+// of the given number, replacing those recorded for a former block of the same
+// number.
+func WriteBlockBalances(db ngindb.Database, blockNumber uint64, balances map[common.Address]*big.Int) error {
+	batch := db.NewBatch()
+	if err := rmBlockBalancesToBatch(db, batch, blockNumber); err != nil {
+		return err
+	}
+	addrs := make([]common.Address, 0, len(balances))
+	for addr := range balances {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i].Bytes(), addrs[j].Bytes()) < 0
+	})
+	for _, addr := range addrs {
+		if err := batch.Put(formatBalanceIndex(addr, blockNumber), balances[addr].Bytes()); err != nil {
+			return err
+		}
+	}
+	if len(addrs) > 0 {
+		enc, err := rlp.EncodeToBytes(addrs)
+		if err != nil {
+			return err
+		}
+		if err := batch.Put(formatBalanceBlockIndex(blockNumber), enc); err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
+
+// RmBlockBalances removes the balances recorded for the block of the given
+// number.
+func RmBlockBalances(db ngindb.Database, blockNumber uint64) error {
+	batch := db.NewBatch()
+	if err := rmBlockBalancesToBatch(db, batch, blockNumber); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// rmBalancesAbove removes the balances recorded for the blocks above head.
+func rmBalancesAbove(db ngindb.Database, head uint64) error {
+	it := db.NewIteratorWithPrefix(balanceBlockIndexPrefix)
+	var numbers []uint64
+	for it.Next() {
+		if n := binary.BigEndian.Uint64(it.Key()[len(balanceBlockIndexPrefix):]); n > head {
+			numbers = append(numbers, n)
+		}
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil {
+		return err
+	}
+	for _, n := range numbers {
+		if err := RmBlockBalances(db, n); err != nil {
+			return err
+		}
+	}
+	if dbGetBalanceHistoryBookmark(db) > head+1 {
+		return dbSetBalanceHistoryBookmark(db, head+1)
+	}
+	return nil
+}
+
+// GetBalanceHistory returns the balances of an account between the given
+// blocks, in chain order. The series opens with the balance held at the start
+// block, recorded by the last change at or before it, and lists every change
+// up to the end block, 0 meaning unbounded.
+func GetBalanceHistory(db ngindb.Database, address common.Address, blockStartN, blockEndN uint64) ([]*BalanceRecord, error) {
+	if blockEndN == 0 || blockEndN == math.MaxUint64 {
+		blockEndN = math.MaxUint64 - 1
+	}
+	if blockEndN < blockStartN {
+		return nil, fmt.Errorf("start must be prior to (smaller than) or equal to end, got start=%d end=%d", blockStartN, blockEndN)
+	}
+	var records []*BalanceRecord
+	decode := func(key, value []byte) *BalanceRecord {
+		return &BalanceRecord{
+			BlockNumber: binary.BigEndian.Uint64(key[4+common.AddressLength:]),
+			Balance:     new(big.Int).SetBytes(value),
+		}
+	}
+	// The opening balance, as of the last change at or before the start block
+	it := db.NewReverseIteratorRange(formatBalanceIndex(address, 0), formatBalanceIndex(address, blockStartN+1))
+	if it.Next() && len(it.Key()) == balanceKeyLength {
+		records = append(records, decode(it.Key(), it.Value()))
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil {
+		return nil, err
+	}
+	it = db.NewIteratorRange(formatBalanceIndex(address, blockStartN+1), formatBalanceIndex(address, blockEndN+1))
+	defer it.Release()
+	for it.Next() {
+		if len(it.Key()) != balanceKeyLength {
+			continue
+		}
+		records = append(records, decode(it.Key(), it.Value()))
+	}
+	return records, it.Error()
+}
+
+// SetBalanceIndex sets the db of the balance history index, nil disabling
+// the indexing.
+func (bc *BlockChain) SetBalanceIndex(b *BalanceIndexT) {
+	bc.balanceIndex = b
+}
+
+// GetBalanceIndex returns the balance history index, nil if not in use.
+func (bc *BlockChain) GetBalanceIndex() *BalanceIndexT {
+	return bc.balanceIndex
+}
+
+// BlockBalanceChanges returns the balances of the accounts changed by the
+// block, as of after it. Those of the genesis block are its allocations.
+// Unless recently processed, the block is re-executed, see reprocessBlock.
+func (bc *BlockChain) BlockBalanceChanges(block *types.Block) (map[common.Address]*big.Int, error) {
+	if cached, ok := bc.balanceCache.Get(block.Hash()); ok {
+		return cached.(map[common.Address]*big.Int), nil
+	}
+	balances := make(map[common.Address]*big.Int)
+	if block.NumberU64() == 0 {
+		statedb, err := bc.StateAt(block.Root())
+		if err != nil {
+			return nil, err
+		}
+		err = statedb.ForEachBalance(func(addr common.Address, balance *big.Int) bool {
+			if balance.Sign() > 0 {
+				balances[addr] = balance
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		statedb, err := bc.reprocessBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		balances = statedb.BalanceChanges()
+	}
+	bc.balanceCache.Add(block.Hash(), balances)
+	return balances, nil
+}
+
+// BuildBalanceHistory backfills the balance history index between the given
+// canonical blocks by re-executing them on top of the available, or
+// regenerable, historical states. A start of math.MaxUint64 resumes where the
+// last session left off, a stop of 0 or math.MaxUint64 runs up to the head
+// block. Progress is bookmarked every step blocks.
+func BuildBalanceHistory(bc *BlockChain, indexDB ngindb.Database, startIndex, stopIndex, step uint64) error {
+	if startIndex == math.MaxUint64 {
+		startIndex = dbGetBalanceHistoryBookmark(indexDB)
+	}
+	if step == 0 || step == math.MaxUint64 {
+		step = 10000
+	}
+	if stopIndex == 0 || stopIndex == math.MaxUint64 {
+		stopIndex = bc.CurrentBlock().NumberU64()
+	}
+	if stopIndex < startIndex {
+		return fmt.Errorf("start must be prior to (smaller than) or equal to stop, got start=%d stop=%d", startIndex, stopIndex)
+	}
+
+	// sigc is a single-val channel for listening to program interrupt
+	var sigc = make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	startTime := time.Now()
+	stepStartTime := startTime
+	changes := 0
+	glog.D(logger.Error).Infoln("Balance history indexing start:", startIndex, "stop:", stopIndex, "step:", step)
+	for i := startIndex; i <= stopIndex; i++ {
+		block := bc.GetBlockByNumber(i)
+		if block == nil {
+			return fmt.Errorf("block %d is nil", i)
+		}
+		balances, err := bc.BlockBalanceChanges(block)
+		if err != nil {
+			return fmt.Errorf("failed to process block %d: %v", i, err)
+		}
+		if err := WriteBlockBalances(indexDB, i, balances); err != nil {
+			return err
+		}
+		changes += len(balances)
+
+		if (i+1-startIndex)%step == 0 || i == stopIndex {
+			if err := dbSetBalanceHistoryBookmark(indexDB, i+1); err != nil {
+				return err
+			}
+			glog.D(logger.Error).Infof("balance-history-build: block %d / %d changes: %d took: %v", i, stopIndex, changes, time.Since(stepStartTime).Round(time.Millisecond))
+			stepStartTime = time.Now()
+		}
+		// Listen for interrupts, nonblocking
+		select {
+		case s := <-sigc:
+			glog.D(logger.Info).Warnln("balance history build", "got interrupt:", s, "quitting")
+			return dbSetBalanceHistoryBookmark(indexDB, i+1)
+		default:
+		}
+	}
+	took := time.Since(startTime)
+	glog.D(logger.Error).Infof("Finished balance-history-build in %v: %d blocks (~ %.2f blocks/sec), %d balance changes",
+		took.Round(time.Second),
+		stopIndex-startIndex+1,
+		float64(stopIndex-startIndex+1)/took.Seconds(),
+		changes,
+	)
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+// balanceSeries lists the balance records as <block>:<balance>.
+func balanceSeries(t *testing.T, db ngindb.Database, address common.Address, start, end uint64) []string {
+	records, err := GetBalanceHistory(db, address, start, end)
+	if err != nil {
+		t.Fatalf("failed to get balance history of %x: %v", address, err)
+	}
+	series := []string{}
+	for _, r := range records {
+		series = append(series, fmt.Sprintf("%d:%v", r.BlockNumber, r.Balance))
+	}
+	return series
+}
+
+// newBalanceHistoryTestDB returns an index holding the balances of X changed
+// in blocks 0, 2 and 5, to zero in the last one, and of Y in block 2.
+func newBalanceHistoryTestDB(t *testing.T) *ngindb.MemDatabase {
+	db, _ := ngindb.NewMemDatabase()
+
+	blocks := []struct {
+		number   uint64
+		balances map[common.Address]*big.Int
+	}{
+		{0, map[common.Address]*big.Int{testAddrX: big.NewInt(100)}},
+		{2, map[common.Address]*big.Int{testAddrX: big.NewInt(70), testAddrY: big.NewInt(30)}},
+		{5, map[common.Address]*big.Int{testAddrX: new(big.Int)}},
+	}
+	for _, b := range blocks {
+		if err := WriteBlockBalances(db, b.number, b.balances); err != nil {
+			t.Fatalf("failed to index block #%d: %v", b.number, err)
+		}
+	}
+	return db
+}
+
+// Tests that balance histories open with the balance held at the start block
+// and list the changes up to the end block.
+func TestBalanceHistoryRanges(t *testing.T) {
+	db := newBalanceHistoryTestDB(t)
+
+	tests := []struct {
+		address    common.Address
+		start, end uint64
+		want       []string
+	}{
+		{testAddrX, 0, 0, []string{"0:100", "2:70", "5:0"}},
+		{testAddrX, 1, 4, []string{"0:100", "2:70"}},
+		{testAddrX, 2, 2, []string{"2:70"}},
+		{testAddrX, 3, 0, []string{"2:70", "5:0"}},
+		{testAddrX, 6, 10, []string{"5:0"}},
+		{testAddrY, 0, 1, []string{}},
+		{testAddrY, 1, 0, []string{"2:30"}},
+		{testAddrZ, 0, 0, []string{}},
+	}
+	for i, tt := range tests {
+		if have := balanceSeries(t, db, tt.address, tt.start, tt.end); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: history mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+	if _, err := GetBalanceHistory(db, testAddrX, 3, 2); err == nil {
+		t.Errorf("range ending before its start accepted")
+	}
+}
+
+// Tests that the balances of a block replace those of a former block of the
+// same number, and are removed along with it.
+func TestBalanceHistoryReorg(t *testing.T) {
+	db := newBalanceHistoryTestDB(t)
+
+	// A side block #2 changing only the balance of Y
+	if err := WriteBlockBalances(db, 2, map[common.Address]*big.Int{testAddrY: big.NewInt(40)}); err != nil {
+		t.Fatalf("failed to reindex block #2: %v", err)
+	}
+	if have, want := balanceSeries(t, db, testAddrX, 0, 0), []string{"0:100", "5:0"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("history of X mismatch: have %v, want %v", have, want)
+	}
+	if have, want := balanceSeries(t, db, testAddrY, 0, 0), []string{"2:40"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("history of Y mismatch: have %v, want %v", have, want)
+	}
+	if err := RmBlockBalances(db, 2); err != nil {
+		t.Fatalf("failed to remove block #2: %v", err)
+	}
+	if have := balanceSeries(t, db, testAddrY, 0, 0); len(have) != 0 {
+		t.Errorf("history of Y left after removal: %v", have)
+	}
+}
+
+// Tests that rewinding the chain drops the balances above the new head and
+// moves the backfill bookmark back.
+func TestBalanceHistoryRewind(t *testing.T) {
+	db := newBalanceHistoryTestDB(t)
+	if err := dbSetBalanceHistoryBookmark(db, 6); err != nil {
+		t.Fatalf("failed to set bookmark: %v", err)
+	}
+	if err := rmBalancesAbove(db, 2); err != nil {
+		t.Fatalf("failed to rewind: %v", err)
+	}
+	if have, want := balanceSeries(t, db, testAddrX, 0, 0), []string{"0:100", "2:70"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("history mismatch after rewind: have %v, want %v", have, want)
+	}
+	if n := dbGetBalanceHistoryBookmark(db); n != 3 {
+		t.Errorf("bookmark mismatch: have %d, want 3", n)
+	}
+	if err := rmBalancesAbove(db, 0); err != nil {
+		t.Fatalf("failed to rewind: %v", err)
+	}
+	if addrs, _ := getBlockBalanceAddrs(db, 2); addrs != nil {
+		t.Errorf("addresses of block #2 left after rewind: %x", addrs)
+	}
+	if have, want := balanceSeries(t, db, testAddrX, 0, 0), []string{"0:100"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("history mismatch after rewind to genesis: have %v, want %v", have, want)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+var (
+	blockTimePrefix  = []byte("time-")              // blockTimePrefix + time (uint64 big endian) -> canonical block number (uint64 big endian)
+	blockTimeHeadKey = []byte("BlockTimeIndexHead") // number of the last block up to which the time index is complete
+)
+
+// blockTimeBatch is the number of blocks indexed at once while catching up
+// with the canonical chain.
+const blockTimeBatch = 10000
+
+// blockTimeKey returns the time index key of a block timestamp. Timestamps
+// strictly increase along the canonical chain, so each maps to a single block
+// and the keys iterate in chain order.
+func blockTimeKey(time uint64) []byte {
+	key := make([]byte, len(blockTimePrefix)+8)
+	copy(key, blockTimePrefix)
+	binary.BigEndian.PutUint64(key[len(blockTimePrefix):], time)
+	return key
+}
+
+func encodeBlockNumber(number uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, number)
+	return enc
+}
+
+// WriteBlockTime stores the time index entry of a canonical block.
+func WriteBlockTime(db ngindb.Database, time, number uint64) error {
+	return db.Put(blockTimeKey(time), encodeBlockNumber(number))
+}
+
+// DeleteBlockTime removes the time index entry of a block timestamp.
+func DeleteBlockTime(db ngindb.Database, time uint64) {
+	db.Delete(blockTimeKey(time))
+}
+
+// GetBlockTimeIndexHead returns the number of the last block up to which
+// every canonical block is indexed by time, false if none is.
+func GetBlockTimeIndexHead(db ngindb.Database) (uint64, bool) {
+	data, _ := db.Get(blockTimeHeadKey)
+	if len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
+
+// WriteBlockTimeIndexHead stores the number of the last block up to which
+// every canonical block is indexed by time.
+func WriteBlockTimeIndexHead(db ngindb.Database, number uint64) error {
+	return db.Put(blockTimeHeadKey, encodeBlockNumber(number))
+}
+
+// GetBlockNumberByTime returns the number of the last canonical block mined
+// at or before the given unix time or, if after is set, of the first one mined
+// at or after it. False is returned if there is no such block. The time index
+// is used once it caught up with the head block, the canonical headers are
+// searched until then.
+func GetBlockNumberByTime(db ngindb.Database, ts uint64, after bool) (uint64, bool) {
+	head := GetHeader(db, GetHeadBlockHash(db))
+	if head == nil {
+		return 0, false
+	}
+	headNumber := head.Number.Uint64()
+
+	if indexed, ok := GetBlockTimeIndexHead(db); ok && indexed >= headNumber {
+		var it ngindb.Iterator
+		if after {
+			it = db.NewIteratorRange(blockTimeKey(ts), blockTimeKey(math.MaxUint64))
+		} else if ts < math.MaxUint64 {
+			it = db.NewReverseIteratorRange(blockTimeKey(0), blockTimeKey(ts+1))
+		} else {
+			it = db.NewReverseIteratorRange(blockTimeKey(0), blockTimeKey(math.MaxUint64))
+		}
+		defer it.Release()
+		for it.Next() {
+			if len(it.Value()) != 8 {
+				continue
+			}
+			if number := binary.BigEndian.Uint64(it.Value()); number <= headNumber {
+				return number, true
+			}
+		}
+		return 0, false
+	}
+	// Index incomplete, binary search the first block mined after the time
+	headerAt := func(n uint64) *types.Header {
+		return GetHeader(db, GetCanonicalHash(db, n))
+	}
+	first := sort.Search(int(headNumber)+1, func(i int) bool {
+		header := headerAt(uint64(i))
+		if after {
+			return header == nil || header.Time.Uint64() >= ts
+		}
+		return header == nil || header.Time.Uint64() > ts
+	})
+	if after {
+		if uint64(first) > headNumber {
+			return 0, false
+		}
+		return uint64(first), true
+	}
+	if first == 0 {
+		return 0, false
+	}
+	return uint64(first - 1), true
+}
+
+// GetBlockNumberByTime returns the number of the last canonical block mined at
+// or before the given unix time or, if after is set, of the first one mined at
+// or after it, see GetBlockNumberByTime.
+func (bc *BlockChain) GetBlockNumberByTime(ts uint64, after bool) (uint64, bool) {
+	return GetBlockNumberByTime(bc.chainDb, ts, after)
+}
+
+// writeBlockTime indexes a new canonical block by time, extending the
+// complete part of the index when the block follows it.
+//
+// Note, this function assumes that the `mu` mutex is held!
+func (bc *BlockChain) writeBlockTime(header *types.Header) {
+	number := header.Number.Uint64()
+	if err := WriteBlockTime(bc.chainDb, header.Time.Uint64(), number); err != nil {
+		glog.Fatalf("failed to store block time index: %v", err)
+	}
+	if indexed, ok := GetBlockTimeIndexHead(bc.chainDb); ok && indexed+1 == number {
+		if err := WriteBlockTimeIndexHead(bc.chainDb, number); err != nil {
+			glog.Fatalf("failed to store block time index head: %v", err)
+		}
+	}
+}
+
+// rewindBlockTimes removes the time index entries of the blocks above head.
+//
+// Note, this function assumes that the `mu` mutex is held!
+func (bc *BlockChain) rewindBlockTimes(head *types.Header) error {
+	var removals [][]byte
+	it := bc.chainDb.NewIteratorRange(blockTimeKey(head.Time.Uint64()+1), blockTimeKey(math.MaxUint64))
+	for it.Next() {
+		removals = append(removals, common.CopyBytes(it.Key()))
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil {
+		return err
+	}
+	for _, key := range removals {
+		bc.chainDb.Delete(key)
+	}
+	if indexed, ok := GetBlockTimeIndexHead(bc.chainDb); ok && indexed > head.Number.Uint64() {
+		return WriteBlockTimeIndexHead(bc.chainDb, head.Number.Uint64())
+	}
+	return nil
+}
+
+// indexBlockTimes indexes the canonical blocks by time up to the head block,
+// from where the index was left off, then leaves the index to be maintained
+// along with the head changes.
+func (bc *BlockChain) indexBlockTimes() {
+	if !atomic.CompareAndSwapInt32(&bc.timeIndexing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&bc.timeIndexing, 0)
+
+	var (
+		start   = time.Now()
+		indexed uint64
+	)
+	for {
+		select {
+		case <-bc.quit:
+			return
+		default:
+		}
+		bc.mu.Lock()
+		next := uint64(0)
+		if n, ok := GetBlockTimeIndexHead(bc.chainDb); ok {
+			next = n + 1
+		}
+		head := bc.currentBlock.NumberU64()
+		if next > head {
+			bc.mu.Unlock()
+			break
+		}
+		last := next + blockTimeBatch - 1
+		if last > head {
+			last = head
+		}
+		batch := bc.chainDb.NewBatch()
+		for n := next; n <= last; n++ {
+			header := bc.GetHeaderByNumber(n)
+			if header == nil {
+				bc.mu.Unlock()
+				glog.V(logger.Warn).Warnf("Failed to index block times: missing header #%d", n)
+				return
+			}
+			batch.Put(blockTimeKey(header.Time.Uint64()), encodeBlockNumber(n))
+		}
+		batch.Put(blockTimeHeadKey, encodeBlockNumber(last))
+		err := batch.Write()
+		bc.mu.Unlock()
+		if err != nil {
+			glog.V(logger.Warn).Warnf("Failed to index block times: %v", err)
+			return
+		}
+		indexed += last - next + 1
+		glog.V(logger.Debug).Infof("Indexed block times up to #%d / %d", last, head)
+	}
+	if indexed > 0 {
+		glog.V(logger.Info).Infof("Indexed %d block times in %v", indexed, time.Since(start))
+	}
+}
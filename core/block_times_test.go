@@ -0,0 +1,210 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+// newBlockTimesTestChain returns a chain of n blocks mined 10 seconds apart,
+// once the time index caught up with it.
+func newBlockTimesTestChain(t *testing.T, n int) (*BlockChain, *ngindb.MemDatabase, []*types.Block) {
+	db, _ := ngindb.NewMemDatabase()
+	genesis := WriteGenesisBlockForTesting(db, GenesisAccount{Address: testAtxiAddr, Balance: big.NewInt(1000000)})
+	blocks, _ := GenerateChain(DefaultConfigMainnet.ChainConfig, genesis, db, n, nil)
+
+	bc, err := NewBlockChain(db, DefaultConfigMainnet.ChainConfig, FakePow{}, new(event.TypeMux))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if res := bc.InsertChain(blocks); res.Error != nil {
+		t.Fatalf("failed to insert chain: %v", res.Error)
+	}
+	waitBlockTimeIndex(t, db, uint64(n))
+	return bc, db, append([]*types.Block{genesis}, blocks...)
+}
+
+// waitBlockTimeIndex waits for the time index to be complete up to block head.
+func waitBlockTimeIndex(t *testing.T, db ngindb.Database, head uint64) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if indexed, ok := GetBlockTimeIndexHead(db); ok && indexed >= head {
+			return
+		}
+	}
+	t.Fatalf("block times not indexed up to #%d", head)
+}
+
+// blockTimeEntries returns the indexed block numbers by time.
+func blockTimeEntries(t *testing.T, db *ngindb.MemDatabase) map[uint64]uint64 {
+	entries := make(map[uint64]uint64)
+	it := db.NewIteratorWithPrefix(blockTimePrefix)
+	defer it.Release()
+	for it.Next() {
+		if category := DatabaseKeyCategory(it.Key()); category != KeyCategoryBlockTimes {
+			t.Errorf("key %x: category mismatch: have %q, want %q", it.Key(), category, KeyCategoryBlockTimes)
+		}
+		entries[binary.BigEndian.Uint64(it.Key()[len(blockTimePrefix):])] = binary.BigEndian.Uint64(it.Value())
+	}
+	return entries
+}
+
+// canonicalBlockTimes returns the block numbers of the canonical blocks by
+// time.
+func canonicalBlockTimes(blocks []*types.Block) map[uint64]uint64 {
+	entries := make(map[uint64]uint64)
+	for _, block := range blocks {
+		entries[block.Time().Uint64()] = block.NumberU64()
+	}
+	return entries
+}
+
+// checkBlockNumberByTime checks the lookups around the times of the canonical
+// blocks against a scan of the blocks.
+func checkBlockNumberByTime(t *testing.T, db ngindb.Database, blocks []*types.Block, mode string) {
+	t.Helper()
+	times := []uint64{0, math.MaxUint64}
+	for _, block := range blocks {
+		ts := block.Time().Uint64()
+		times = append(times, ts, ts+1, ts+5)
+		if ts > 0 {
+			times = append(times, ts-1)
+		}
+	}
+	for _, ts := range times {
+		for _, after := range []bool{false, true} {
+			var (
+				want  uint64
+				found bool
+			)
+			for _, block := range blocks {
+				bt := block.Time().Uint64()
+				if !after && bt <= ts {
+					want, found = block.NumberU64(), true
+				}
+				if after && bt >= ts && !found {
+					want, found = block.NumberU64(), true
+				}
+			}
+			have, ok := GetBlockNumberByTime(db, ts, after)
+			if have != want || ok != found {
+				t.Errorf("%s: time %d (after %v): have #%d (%v), want #%d (%v)", mode, ts, after, have, ok, want, found)
+			}
+		}
+	}
+}
+
+// Tests that blocks are looked up by time through the index once complete,
+// and through the canonical headers while the index is behind the head.
+func TestGetBlockNumberByTime(t *testing.T) {
+	bc, db, blocks := newBlockTimesTestChain(t, 8)
+	defer bc.Stop()
+
+	if entries := blockTimeEntries(t, db); !reflect.DeepEqual(entries, canonicalBlockTimes(blocks)) {
+		t.Fatalf("index mismatch: have %v, want %v", entries, canonicalBlockTimes(blocks))
+	}
+	checkBlockNumberByTime(t, db, blocks, "indexed")
+
+	// Index behind the head, with the entries past it gone, so that any use
+	// of the index would miss the last blocks
+	for _, block := range blocks[4:] {
+		DeleteBlockTime(db, block.Time().Uint64())
+	}
+	if err := WriteBlockTimeIndexHead(db, 3); err != nil {
+		t.Fatal(err)
+	}
+	checkBlockNumberByTime(t, db, blocks, "index behind")
+
+	db.Delete(blockTimeHeadKey)
+	checkBlockNumberByTime(t, db, blocks, "not indexed")
+
+	// Entries beyond the head, left by a crash before a rewind, are ignored
+	if err := WriteBlockTimeIndexHead(db, 8); err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks[4:] {
+		WriteBlockTime(db, block.Time().Uint64(), block.NumberU64())
+	}
+	WriteBlockTime(db, blocks[8].Time().Uint64()+10, 9)
+	checkBlockNumberByTime(t, db, blocks, "entries beyond head")
+}
+
+// Tests that rewinding the chain drops the time index entries above the new
+// head, and that the index carries on as the chain grows again.
+func TestBlockTimesRewind(t *testing.T) {
+	bc, db, blocks := newBlockTimesTestChain(t, 8)
+	defer bc.Stop()
+
+	bc.SetHead(5)
+	if entries := blockTimeEntries(t, db); !reflect.DeepEqual(entries, canonicalBlockTimes(blocks[:6])) {
+		t.Errorf("index mismatch after rewind: have %v, want %v", entries, canonicalBlockTimes(blocks[:6]))
+	}
+	if indexed, ok := GetBlockTimeIndexHead(db); !ok || indexed != 5 {
+		t.Errorf("index head mismatch after rewind: have #%d (%v), want #5", indexed, ok)
+	}
+	checkBlockNumberByTime(t, db, blocks[:6], "rewound")
+
+	if res := bc.InsertChain(blocks[6:]); res.Error != nil {
+		t.Fatalf("failed to reinsert blocks: %v", res.Error)
+	}
+	if entries := blockTimeEntries(t, db); !reflect.DeepEqual(entries, canonicalBlockTimes(blocks)) {
+		t.Errorf("index mismatch after reinsert: have %v, want %v", entries, canonicalBlockTimes(blocks))
+	}
+	if indexed, ok := GetBlockTimeIndexHead(db); !ok || indexed != 8 {
+		t.Errorf("index head mismatch after reinsert: have #%d (%v), want #8", indexed, ok)
+	}
+	checkBlockNumberByTime(t, db, blocks, "reinserted")
+}
+
+// Tests that a reorg replaces the time index entries of the old chain with
+// those of the new one, mined at other times.
+func TestBlockTimesReorg(t *testing.T) {
+	bc, db, blocks := newBlockTimesTestChain(t, 6)
+	defer bc.Stop()
+
+	// Fork off block #2 with blocks mined 7 seconds apart, heavier as the
+	// difficulty rises with shorter block times
+	config := DefaultConfigMainnet.ChainConfig
+	fork, _ := GenerateChain(config, blocks[2], db, 5, func(i int, b *BlockGen) {
+		parent := b.parent.Header()
+		b.header.Time = new(big.Int).Add(parent.Time, big.NewInt(7))
+		b.header.Difficulty = CalcDifficulty(config, b.header.Time.Uint64(), parent.Time.Uint64(), parent.Number, parent.Difficulty)
+	})
+	if res := bc.InsertChain(fork); res.Error != nil {
+		t.Fatalf("failed to insert fork: %v", res.Error)
+	}
+	if head := bc.CurrentBlock(); head.Hash() != fork[4].Hash() {
+		t.Fatalf("fork not canonical: head #%d [%x…]", head.NumberU64(), head.Hash().Bytes()[:4])
+	}
+	canonical := append(append([]*types.Block{}, blocks[:3]...), fork...)
+	if entries := blockTimeEntries(t, db); !reflect.DeepEqual(entries, canonicalBlockTimes(canonical)) {
+		t.Errorf("index mismatch after reorg: have %v, want %v", entries, canonicalBlockTimes(canonical))
+	}
+	if indexed, ok := GetBlockTimeIndexHead(db); !ok || indexed != 7 {
+		t.Errorf("index head mismatch after reorg: have #%d (%v), want #7", indexed, ok)
+	}
+	checkBlockNumberByTime(t, db, canonical, "reorged")
+}
@@ -32,10 +32,9 @@ import (
 	"reflect"
 	"strconv"
 
-	"encoding/binary"
-
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/core/state"
+	"github.com/NginProject/ngind/core/state/snapshot"
 	"github.com/NginProject/ngind/core/types"
 	"github.com/NginProject/ngind/core/vm"
 	"github.com/NginProject/ngind/crypto"
@@ -65,8 +64,51 @@ const (
 	// must be bumped when consensus algorithm is changed, this forces the upgradedb
 	// command to be run (forces the blocks to be imported again using the new algorithm)
 	BlockChainVersion = 3
+
+	// TriesInMemory is the number of recent block states a pruning node keeps
+	// in memory, bounding the depth of reorgs it can process.
+	TriesInMemory = 128
+
+	// snapshotLayers is the number of recent block states the state snapshot
+	// keeps as diff layers above its disk layer. It stays well within
+	// TriesInMemory, the disk layer's trie must be available to the snapshot
+	// generator.
+	snapshotLayers = 64
 )
 
+// CacheConfig contains the configuration values for the trie caching and
+// state pruning of the block chain.
+type CacheConfig struct {
+	Disabled         bool          // Whether to disable pruning and write every state to disk (archive mode)
+	TrieNodeLimit    int           // Memory limit (MB) at which to flush cached trie nodes to disk
+	FlushInterval    uint64        // Number of blocks after which to flush a state to disk regardless of memory use
+	AncientThreshold uint64        // Number of recent blocks kept out of the ancient store, 0 disables freezing
+	RegenLimit       uint64        // Maximum number of blocks re-executed to regenerate a pruned state, 0 disables regeneration
+	RegenTimeout     time.Duration // Maximum time spent regenerating a pruned state per request, 0 means no limit
+	Snapshot         bool          // Whether to maintain a flat snapshot of the state for faster reads
+}
+
+// DefaultCacheConfig is the state pruning configuration used by full nodes.
+var DefaultCacheConfig = &CacheConfig{
+	TrieNodeLimit:    256,
+	FlushInterval:    8192,
+	AncientThreshold: FreezerThreshold,
+	RegenLimit:       DefaultRegenLimit,
+	RegenTimeout:     DefaultRegenTimeout,
+}
+
+// ArchiveCacheConfig writes every state to disk, keeping the full history.
+var ArchiveCacheConfig = &CacheConfig{
+	Disabled:         true,
+	AncientThreshold: FreezerThreshold,
+}
+
+// trieRoot is a state root held in the trie node cache.
+type trieRoot struct {
+	number uint64
+	root   common.Hash
+}
+
 // BlockChain represents the canonical chain given a database with a genesis
 // block. The Blockchain manages chain imports, reverts, chain reorganisations.
 //
@@ -96,6 +138,20 @@ type BlockChain struct {
 	currentBlock     *types.Block // Current head of the block chain
 	currentFastBlock *types.Block // Current head of the fast-sync chain (may be above the block chain!)
 
+	cacheConfig   *CacheConfig    // State pruning configuration
+	nodeCache     *trie.NodeCache // Trie node cache of the recent states, nil in archive mode
+	stateDatabase state.Database  // State database shared by every state opened on the chain
+	triegc        []trieRoot      // State roots referenced in the node cache
+	lastFlushed   uint64          // Number of the last block whose state was flushed to disk
+	regenCache    *lru.Cache      // Recently regenerated historical states
+	internalTxs   *lru.Cache      // Internal transactions of the recently processed blocks, for the atx-index
+	balanceCache  *lru.Cache      // Balance changes of the recently processed blocks, for the balance history
+	snaps         *snapshot.Tree  // Flat snapshot of the recent states, nil if disabled
+	timeIndexing  int32           // Whether the block time index is catching up with the chain (atomic)
+
+	regenmu    sync.Mutex                 // Lock protecting the regenerations in progress
+	regenCalls map[common.Hash]*regenCall // State regenerations in progress, by block hash
+
 	stateCache   *state.StateDB // State database to reuse between imports (contains state cache)
 	bodyCache    *lru.Cache     // Cache for the most recent block bodies
 	bodyRLPCache *lru.Cache     // Cache for the most recent block bodies in RLP encoded format
@@ -112,7 +168,8 @@ type BlockChain struct {
 	processor Processor // block processor interface
 	validator Validator // block and state validator interface
 
-	atxi *AtxiT
+	atxi         *AtxiT
+	balanceIndex *BalanceIndexT
 }
 
 type ChainInsertResult struct {
@@ -143,24 +200,46 @@ func (bc *BlockChain) GetBlockByHash(h common.Hash) *types.Block {
 
 // NewBlockChain returns a fully initialised block chain using information
 // available in the database. It initialises the default Ethereum Validator and
-// Processor.
+// Processor. Every state is written to disk.
 func NewBlockChain(chainDb ngindb.Database, config *ChainConfig, pow pow.PoW, mux *event.TypeMux) (*BlockChain, error) {
+	return NewBlockChainWithCache(chainDb, config, pow, mux, ArchiveCacheConfig)
+}
+
+// NewBlockChainWithCache works like NewBlockChain, pruning the state according
+// to the given cache configuration.
+func NewBlockChainWithCache(chainDb ngindb.Database, config *ChainConfig, pow pow.PoW, mux *event.TypeMux, cacheConfig *CacheConfig) (*BlockChain, error) {
 	bodyCache, _ := lru.New(bodyCacheLimit)
 	bodyRLPCache, _ := lru.New(bodyCacheLimit)
 	blockCache, _ := lru.New(blockCacheLimit)
 	futureBlocks, _ := lru.New(maxFutureBlocks)
+	internalTxs, _ := lru.New(blockCacheLimit)
+	balanceCache, _ := lru.New(blockCacheLimit)
 
 	bc := &BlockChain{
 		config:       config,
 		chainDb:      chainDb,
 		eventMux:     mux,
 		quit:         make(chan struct{}),
+		cacheConfig:  cacheConfig,
 		bodyCache:    bodyCache,
 		bodyRLPCache: bodyRLPCache,
 		blockCache:   blockCache,
 		futureBlocks: futureBlocks,
+		regenCalls:   make(map[common.Hash]*regenCall),
+		internalTxs:  internalTxs,
+		balanceCache: balanceCache,
 		pow:          pow,
 	}
+	// Regenerated states hold their base state in the node cache until evicted
+	bc.regenCache, _ = lru.NewWithEvict(regenCacheLimit, func(key, value interface{}) {
+		bc.releaseRegenState(value.(*regenState))
+	})
+	if cacheConfig.Disabled {
+		bc.stateDatabase = state.NewDatabase(chainDb)
+	} else {
+		bc.nodeCache = trie.NewNodeCache(chainDb)
+		bc.stateDatabase = state.NewDatabaseWithCache(bc.nodeCache)
+	}
 	bc.SetValidator(NewBlockValidator(config, bc, pow))
 	bc.SetProcessor(NewStateProcessor(config, bc))
 
@@ -179,6 +258,20 @@ func NewBlockChain(chainDb ngindb.Database, config *ChainConfig, pow pow.PoW, mu
 	if err := bc.LoadLastState(false); err != nil {
 		return nil, err
 	}
+	// The ancient store may outlive a wiped or rewound key-value store
+	if err := bc.truncateAncients(bc.hc.CurrentHeader().Number.Uint64()); err != nil {
+		return nil, err
+	}
+	if cacheConfig.Snapshot {
+		var triedb trie.Database = chainDb
+		if bc.nodeCache != nil {
+			triedb = bc.nodeCache
+		}
+		bc.snaps = snapshot.New(chainDb, triedb, bc.currentBlock.Root())
+		if bc.stateCache, err = bc.State(); err != nil {
+			return nil, err
+		}
+	}
 	// Check the current state of the block hashes and make sure that we do not have any of the bad blocks in our chain
 	for i := range config.BadHashes {
 		if header := bc.GetHeader(config.BadHashes[i].Hash); header != nil && header.Number.Cmp(config.BadHashes[i].Block) == 0 {
@@ -189,6 +282,11 @@ func NewBlockChain(chainDb ngindb.Database, config *ChainConfig, pow pow.PoW, mu
 	}
 	// Take ownership of this particular state
 	go bc.update()
+	go bc.indexBlockTimes()
+	if store, ok := chainDb.(ngindb.AncientStore); ok && cacheConfig.AncientThreshold > 0 {
+		bc.wg.Add(1)
+		go bc.freezeLoop(store)
+	}
 	return bc, nil
 }
 
@@ -197,17 +295,26 @@ func NewBlockChainDryrun(chainDb ngindb.Database, config *ChainConfig, pow pow.P
 	bodyRLPCache, _ := lru.New(bodyCacheLimit)
 	blockCache, _ := lru.New(blockCacheLimit)
 	futureBlocks, _ := lru.New(maxFutureBlocks)
+	regenCache, _ := lru.New(regenCacheLimit)
+	internalTxs, _ := lru.New(blockCacheLimit)
+	balanceCache, _ := lru.New(blockCacheLimit)
 
 	bc := &BlockChain{
-		config:       config,
-		chainDb:      chainDb,
-		eventMux:     mux,
-		quit:         make(chan struct{}),
-		bodyCache:    bodyCache,
-		bodyRLPCache: bodyRLPCache,
-		blockCache:   blockCache,
-		futureBlocks: futureBlocks,
-		pow:          pow,
+		config:        config,
+		chainDb:       chainDb,
+		eventMux:      mux,
+		quit:          make(chan struct{}),
+		cacheConfig:   ArchiveCacheConfig,
+		stateDatabase: state.NewDatabase(chainDb),
+		bodyCache:     bodyCache,
+		bodyRLPCache:  bodyRLPCache,
+		blockCache:    blockCache,
+		futureBlocks:  futureBlocks,
+		regenCache:    regenCache,
+		regenCalls:    make(map[common.Hash]*regenCall),
+		internalTxs:   internalTxs,
+		balanceCache:  balanceCache,
+		pow:           pow,
 	}
 	bc.SetValidator(NewBlockValidator(config, bc, pow))
 	bc.SetProcessor(NewStateProcessor(config, bc))
@@ -441,6 +548,12 @@ func (bc *BlockChain) blockIsInvalid(b *types.Block) error {
 		return e
 	}
 
+	// A pruning node only keeps the state of some blocks, whether state is
+	// present tells nothing about a block's health.
+	if bc.nodeCache != nil {
+		return nil
+	}
+
 	// Separate checks for fast/full blocks.
 	//
 	// Assume state is not missing.
@@ -724,8 +837,21 @@ func (bc *BlockChain) LoadLastState(dryrun bool) error {
 		glog.V(logger.Error).Errorf("Found unaccompanied headerchain (headers > 0 && current|fast ==0), attempting reset with recovery...")
 	}
 
+	// A pruning node that didn't shut down cleanly may miss the head state,
+	// rewind to the newest block having one. The blocks above are processed
+	// again when synced.
+	if _, err := state.New(bc.currentBlock.Root(), bc.stateDatabase); err != nil && bc.nodeCache != nil {
+		glog.V(logger.Warn).Errorf("Head state missing for block #%d [%x…], repairing chain", bc.currentBlock.Number(), bc.currentBlock.Hash().Bytes()[:4])
+		if err := bc.repair(&bc.currentBlock); err != nil {
+			return err
+		}
+		if err := WriteHeadBlockHash(bc.chainDb, bc.currentBlock.Hash()); err != nil {
+			return err
+		}
+	}
+
 	// Initialize a statedb cache to ensure singleton account bloom filter generation
-	statedb, err := state.New(bc.currentBlock.Root(), state.NewDatabase(bc.chainDb))
+	statedb, err := bc.StateAt(bc.currentBlock.Root())
 	if err != nil {
 		return err
 	}
@@ -755,6 +881,21 @@ func (bc *BlockChain) LoadLastState(dryrun bool) error {
 	return nil
 }
 
+// repair rewinds head to its newest ancestor whose state is available.
+func (bc *BlockChain) repair(head **types.Block) error {
+	for {
+		if _, err := state.New((*head).Root(), bc.stateDatabase); err == nil {
+			glog.V(logger.Warn).Infof("Rewound blockchain to past state: #%d [%x…]", (*head).Number(), (*head).Hash().Bytes()[:4])
+			return nil
+		}
+		block := bc.GetBlock((*head).ParentHash())
+		if block == nil {
+			return fmt.Errorf("missing block #%d [%x…]", (*head).NumberU64()-1, (*head).ParentHash().Bytes()[:4])
+		}
+		*head = block
+	}
+}
+
 // PurgeAbove works like SetHead, but instead of rm'ing head <-> bc.currentBlock,
 // it removes all stored blockchain data n -> *anyexistingblockdata*
 // TODO: possibly replace with kv database iterator
@@ -782,6 +923,9 @@ func (bc *BlockChain) SetHead(head uint64) error {
 	}
 	bc.hc.SetHead(head, delFn)
 	currentHeader := bc.hc.CurrentHeader()
+	if err := bc.truncateAncients(currentHeader.Number.Uint64()); err != nil {
+		glog.V(logger.Error).Errorf("Failed to truncate ancient store: %v", err)
+	}
 
 	// Clear out any stale content from the caches
 	bc.bodyCache.Purge()
@@ -794,9 +938,16 @@ func (bc *BlockChain) SetHead(head uint64) error {
 		bc.currentBlock = bc.GetBlock(currentHeader.Hash())
 	}
 	if bc.currentBlock != nil {
-		if _, err := state.New(bc.currentBlock.Root(), state.NewDatabase(bc.chainDb)); err != nil {
-			// Rewound state missing, rolled back to before pivot, reset to genesis
-			bc.currentBlock = nil
+		if _, err := state.New(bc.currentBlock.Root(), bc.stateDatabase); err != nil {
+			if bc.nodeCache != nil {
+				// Pruned state, rewind further to the newest block having one
+				if err := bc.repair(&bc.currentBlock); err != nil {
+					bc.currentBlock = nil
+				}
+			} else {
+				// Rewound state missing, rolled back to before pivot, reset to genesis
+				bc.currentBlock = nil
+			}
 		}
 	}
 	// Rewind the fast block in a simpleton way to the target head
@@ -817,31 +968,30 @@ func (bc *BlockChain) SetHead(head uint64) error {
 	if err := WriteHeadFastBlockHash(bc.chainDb, bc.currentFastBlock.Hash()); err != nil {
 		glog.Fatalf("failed to reset head fast block hash: %v", err)
 	}
+	if err := bc.rewindBlockTimes(bc.currentBlock.Header()); err != nil {
+		glog.V(logger.Error).Errorf("Failed to rewind block time index: %v", err)
+	}
 
 	if bc.atxi != nil && bc.atxi.AutoMode {
-		ldb, ok := bc.atxi.Db.(*ngindb.LDBDatabase)
-		if !ok {
-			glog.Fatal("could not cast indexes db to level db")
-		}
-
 		var removals [][]byte
 		deleteRemovalsFn := func(rs [][]byte) {
 			for _, r := range rs {
-				if e := ldb.Delete(r); e != nil {
+				if e := bc.atxi.Db.Delete(r); e != nil {
 					glog.Fatal(e)
 				}
 			}
 		}
 
-		pre := ngindb.NewBytesPrefix(txAddressIndexPrefix)
-		it := ldb.NewIteratorRange(pre)
+		it := bc.atxi.Db.NewIteratorWithPrefix(txAddressIndexPrefix)
 
 		for it.Next() {
 			key := it.Key()
-			_, bn, _, _, _ := resolveAddrTxBytes(key)
-			n := binary.LittleEndian.Uint64(bn)
+			if len(key) != addrTxKeyLength {
+				continue
+			}
+			_, n, _, _, _, _ := resolveAddrTxBytes(key)
 			if n > head {
-				removals = append(removals, key)
+				removals = append(removals, common.CopyBytes(key))
 				// Prevent removals from getting too massive in case it's a big rollback
 				// 100000 is a guess at a big but not-too-big memory allowance
 				if len(removals) > 100000 {
@@ -855,6 +1005,17 @@ func (bc *BlockChain) SetHead(head uint64) error {
 			return e
 		}
 		deleteRemovalsFn(removals)
+		removals = nil
+
+		if _, err := rmAddrTxBlocksAbove(bc.atxi.Db, head); err != nil {
+			return err
+		}
+
+		if bc.atxi.TokenTransfers {
+			if err := rmTokenTransfersAbove(bc.atxi.Db, head); err != nil {
+				return err
+			}
+		}
 
 		// update atxi bookmark to lower head in the case that its progress was higher than the new head
 		if bc.atxi != nil && bc.atxi.AutoMode {
@@ -865,6 +1026,11 @@ func (bc *BlockChain) SetHead(head uint64) error {
 			}
 		}
 	}
+	if bc.balanceIndex != nil {
+		if err := rmBalancesAbove(bc.balanceIndex.Db, head); err != nil {
+			return err
+		}
+	}
 
 	bc.mu.Unlock()
 	return bc.LoadLastState(false)
@@ -886,6 +1052,9 @@ func (bc *BlockChain) FastSyncCommitHead(hash common.Hash) error {
 	bc.currentBlock = block
 	bc.mu.Unlock()
 
+	// Blocks synced up to the new head were not indexed by time
+	go bc.indexBlockTimes()
+
 	glog.V(logger.Info).Infof("committed block #%d [%x…] as new head", block.Number(), hash[:4])
 	return nil
 }
@@ -970,7 +1139,13 @@ func (bc *BlockChain) State() (*state.StateDB, error) {
 
 // StateAt returns a new mutable state based on a particular point in time.
 func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
-	return state.New(root, state.NewDatabase(bc.chainDb))
+	return state.NewWithSnapshot(root, bc.stateDatabase, bc.snaps)
+}
+
+// StateDatabase returns the state database backing the chain's states. When
+// pruning, recent states are only found in it and not in the chain database.
+func (bc *BlockChain) StateDatabase() state.Database {
+	return bc.stateDatabase
 }
 
 // Reset purges the entire blockchain, restoring it to its genesis state.
@@ -1055,6 +1230,7 @@ func (bc *BlockChain) insert(block *types.Block) {
 	if err := WriteHeadBlockHash(bc.chainDb, block.Hash()); err != nil {
 		glog.Fatalf("failed to insert head block hash: %v", err)
 	}
+	bc.writeBlockTime(block.Header())
 	bc.currentBlock = block
 
 	// If the block is better than our head or is on a different chain, force update heads
@@ -1121,7 +1297,7 @@ func (bc *BlockChain) HasBlockAndState(hash common.Hash) bool {
 		return false
 	}
 	// Ensure the associated state is also present
-	_, err := state.New(block.Root(), state.NewDatabase(bc.chainDb))
+	_, err := state.New(block.Root(), bc.stateDatabase)
 	return err == nil
 }
 
@@ -1186,9 +1362,100 @@ func (bc *BlockChain) Stop() {
 
 	bc.wg.Wait()
 
+	// Persist the head state, the recent ones only live in memory
+	if bc.nodeCache != nil {
+		bc.chainmu.Lock()
+		if block := bc.CurrentBlock(); block.NumberU64() > bc.lastFlushed {
+			glog.V(logger.Info).Infof("Writing cached state of block #%d [%x…] to disk", block.Number(), block.Hash().Bytes()[:4])
+			if err := bc.nodeCache.Commit(block.Root()); err != nil {
+				glog.V(logger.Error).Errorf("Failed to commit recent state trie: %v", err)
+			}
+		}
+		bc.chainmu.Unlock()
+	}
+	// Merge the snapshot diffs into its disk layer, they aren't persisted
+	// otherwise. A snapshot not matching the head is rebuilt on restart.
+	if bc.snaps != nil {
+		bc.chainmu.Lock()
+		if err := bc.snaps.Cap(bc.CurrentBlock().Root(), 0); err != nil {
+			glog.V(logger.Error).Errorf("Failed to write state snapshot: %v", err)
+		}
+		bc.snaps.Stop()
+		bc.chainmu.Unlock()
+	}
 	glog.V(logger.Info).Infoln("Chain manager stopped")
 }
 
+// WriteBlockState writes the state of a block processed outside of the chain,
+// such as a freshly mined one, honouring the chain's pruning configuration.
+func (bc *BlockChain) WriteBlockState(block *types.Block, statedb *state.StateDB) error {
+	bc.chainmu.Lock()
+	defer bc.chainmu.Unlock()
+
+	return bc.commitState(block, statedb)
+}
+
+// commitState writes the state of a processed block. In archive mode it goes
+// straight to disk. Otherwise it's kept in the trie node cache for the next
+// TriesInMemory blocks and garbage collected after; only the state of every
+// FlushInterval-th block, or of the oldest retained one whenever the cache
+// outgrows its limit, is flushed to disk.
+func (bc *BlockChain) commitState(block *types.Block, statedb *state.StateDB) error {
+	if bc.nodeCache == nil {
+		_, err := statedb.CommitTo(bc.chainDb, false)
+		return err
+	}
+	root, err := statedb.CommitTo(bc.nodeCache, false)
+	if err != nil {
+		return err
+	}
+	bc.nodeCache.Reference(root, common.Hash{})
+	bc.triegc = append(bc.triegc, trieRoot{block.NumberU64(), root})
+
+	current := block.NumberU64()
+	if current <= TriesInMemory {
+		return nil
+	}
+	chosen := current - TriesInMemory
+
+	limit := common.StorageSize(bc.cacheConfig.TrieNodeLimit * 1024 * 1024)
+	if bc.nodeCache.Size() > limit || chosen >= bc.lastFlushed+bc.cacheConfig.FlushInterval {
+		if header := bc.GetHeaderByNumber(chosen); header != nil {
+			if err := bc.nodeCache.Commit(header.Root); err != nil {
+				return err
+			}
+			bc.lastFlushed = chosen
+		}
+	}
+	// Release the states which fell out of the retained window
+	retained := bc.triegc[:0]
+	for _, tr := range bc.triegc {
+		if tr.number > chosen {
+			retained = append(retained, tr)
+			continue
+		}
+		bc.nodeCache.Dereference(tr.root)
+	}
+	bc.triegc = retained
+
+	return nil
+}
+
+// updateSnapshot moves the state snapshot along with the new head block,
+// merging the diff layers falling out of the reorg window into the disk layer.
+// The snapshot is rebuilt if it doesn't have the head state, which happens
+// after a sync, a rewind or a reorg deeper than its diff layers.
+func (bc *BlockChain) updateSnapshot(block *types.Block) {
+	if bc.snaps.Snapshot(block.Root()) == nil {
+		glog.V(logger.Info).Infof("State snapshot missing for block #%d [%x…], rebuilding", block.NumberU64(), block.Hash().Bytes()[:4])
+		bc.snaps.Rebuild(block.Root())
+		return
+	}
+	if err := bc.snaps.Cap(block.Root(), snapshotLayers); err != nil {
+		glog.V(logger.Error).Errorf("Failed to update state snapshot: %v", err)
+	}
+}
+
 type WriteStatus byte
 
 const (
@@ -1328,9 +1595,21 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 			}
 			// Store the addr-tx indexes if enabled
 			if bc.atxi != nil {
-				if err := WriteBlockAddTxIndexes(bc.atxi.Db, block); err != nil {
+				// Blocks aren't executed in fast sync, their internal transactions are
+				// left to the offline builder
+				if err := WriteBlockAddTxIndexes(bc.atxi.Db, block, nil); err != nil {
 					glog.Fatalf("failed to write block add-tx indexes", err)
 				}
+				if bc.atxi.InternalTxs && len(block.Transactions()) > 0 {
+					if err := dbMarkATXIIncomplete(bc.atxi.Db, block.NumberU64()); err != nil {
+						glog.Fatalf("failed to mark add-tx indexes incomplete: %v", err)
+					}
+				}
+				if bc.atxi.TokenTransfers {
+					if err := WriteBlockTokenTransfers(bc.atxi.Db, block, receipts); err != nil {
+						glog.Fatalf("failed to write block token transfer indexes: %v", err)
+					}
+				}
 				// if buildATXI has been in use (via RPC) and is NOT finished, current < stop
 				// if buildATXI has been in use (via RPC) and IS finished, current == stop
 				// else if builtATXI has not been in use (via RPC), then current == stop == 0
@@ -1417,10 +1696,21 @@ func (bc *BlockChain) WriteBlockAddrTxIndexesBatch(indexDb ngindb.Database, star
 	}
 
 	for block != nil && blockProcessedHead() <= stopBlockN {
-		txP, err := putBlockAddrTxsToBatch(batch, block)
+		var internals [][]*state.InternalTx
+		if bc.atxi.InternalTxs {
+			if internals, err = bc.BlockInternalTxs(block); err != nil {
+				return txsCount, err
+			}
+		}
+		txP, err := putBlockAddrTxsToBatch(indexDb, batch, block, internals)
 		if err != nil {
 			return txsCount, err
 		}
+		if bc.atxi.TokenTransfers {
+			if _, err := putBlockTokenTransfersToBatch(batch, block, GetBlockReceipts(bc.chainDb, block.Hash())); err != nil {
+				return txsCount, err
+			}
+		}
 		txsCount += txP
 		blockProcessedCount++
 
@@ -1525,6 +1815,9 @@ func (bc *BlockChain) WriteBlock(block *types.Block) (status WriteStatus, err er
 	if err := WriteBlock(bc.chainDb, block); err != nil {
 		glog.Fatalf("failed to write block contents: %v", err)
 	}
+	if status == CanonStatTy && bc.snaps != nil {
+		bc.updateSnapshot(block)
+	}
 
 	bc.futureBlocks.Remove(block.Hash())
 
@@ -1648,6 +1941,18 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (res *ChainInsertResult) {
 			res.Error = err
 			return
 		}
+		// Keep the internal transactions around for indexing, also those of side
+		// blocks which may become canonical in a reorg
+		var internals [][]*state.InternalTx
+		if bc.atxi != nil && bc.atxi.InternalTxs {
+			internals = collectInternalTxs(block, bc.stateCache)
+			bc.internalTxs.Add(block.Hash(), internals)
+		}
+		var balances map[common.Address]*big.Int
+		if bc.balanceIndex != nil {
+			balances = bc.stateCache.BalanceChanges()
+			bc.balanceCache.Add(block.Hash(), balances)
+		}
 		// Validate the state using the default validator
 		err = bc.Validator().ValidateState(block, bc.GetBlock(block.ParentHash()), bc.stateCache, receipts, usedGas)
 		if err != nil {
@@ -1655,7 +1960,7 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (res *ChainInsertResult) {
 			return
 		}
 		// Write state changes to database
-		_, err = bc.stateCache.CommitTo(bc.chainDb, false)
+		err = bc.commitState(block, bc.stateCache)
 		if err != nil {
 			res.Error = err
 			return
@@ -1701,10 +2006,16 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (res *ChainInsertResult) {
 			}
 			// Store the addr-tx indexes if enabled
 			if bc.atxi != nil {
-				if err := WriteBlockAddTxIndexes(bc.atxi.Db, block); err != nil {
+				if err := WriteBlockAddTxIndexes(bc.atxi.Db, block, internals); err != nil {
 					res.Error = fmt.Errorf("failed to write block add-tx indexes: %v", err)
 					return
 				}
+				if bc.atxi.TokenTransfers {
+					if err := WriteBlockTokenTransfers(bc.atxi.Db, block, receipts); err != nil {
+						res.Error = fmt.Errorf("failed to write block token transfer indexes: %v", err)
+						return
+					}
+				}
 				// if buildATXI has been in use (via RPC) and is NOT finished, current < stop
 				// if buildATXI has been in use (via RPC) and IS finished, current == stop
 				// else if builtATXI has not been in use (via RPC), then current == stop == 0
@@ -1715,6 +2026,13 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (res *ChainInsertResult) {
 					}
 				}
 			}
+			// Store the balance history if enabled
+			if bc.balanceIndex != nil {
+				if err := WriteBlockBalances(bc.balanceIndex.Db, block.NumberU64(), balances); err != nil {
+					res.Error = fmt.Errorf("failed to write block balance history: %v", err)
+					return
+				}
+			}
 		case SideStatTy:
 			if glog.V(logger.Detail) {
 				glog.Infof("inserted forked block #%d (TD=%v) (%d TXs %d UNCs) [%s]. Took %v\n", block.Number(), block.Difficulty(), len(block.Transactions()), len(block.Uncles()), block.Hash().Hex(), time.Since(bstart))
@@ -1856,15 +2174,35 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 
 	// Remove all atxis from old chain; indexes should only reflect canonical
 	// Doesn't matter whether automode or not, they should be removed.
+	// Blocks indexed with their hash are cleaned through their record, the
+	// old chain isn't re-executed for internal transactions no longer cached.
 	if bc.atxi != nil {
 		for _, block := range oldChain {
-			for _, tx := range block.Transactions() {
-				if err := RmAddrTx(bc.atxi.Db, tx); err != nil {
+			var internals [][]*state.InternalTx
+			if cached, ok := bc.internalTxs.Get(block.Hash()); ok {
+				internals = cached.([][]*state.InternalTx)
+			}
+			if err := RmBlockAddrTxs(bc.atxi.Db, block, internals); err != nil {
+				return err
+			}
+			if bc.atxi.TokenTransfers {
+				if err := RmBlockTokenTransfers(bc.atxi.Db, block, GetBlockReceipts(bc.chainDb, block.Hash())); err != nil {
 					return err
 				}
 			}
 		}
 	}
+	if bc.balanceIndex != nil {
+		for _, block := range oldChain {
+			if err := RmBlockBalances(bc.balanceIndex.Db, block.NumberU64()); err != nil {
+				return err
+			}
+		}
+	}
+	// Unindex the old chain by time, the new one is indexed as inserted
+	for _, block := range oldChain {
+		DeleteBlockTime(bc.chainDb, block.Time().Uint64())
+	}
 
 	var addedTxs types.Transactions
 	// insert blocks. Order does not matter. Last block will be written in ImportChain itbc which creates the new head properly
@@ -1877,9 +2215,18 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 		}
 		// Store the addr-tx indexes if enabled
 		if bc.atxi != nil {
-			if err := WriteBlockAddTxIndexes(bc.atxi.Db, block); err != nil {
+			internals, err := bc.indexedInternalTxs(bc.atxi.Db, block)
+			if err != nil {
+				return err
+			}
+			if err := WriteBlockAddTxIndexes(bc.atxi.Db, block, internals); err != nil {
 				return err
 			}
+			if bc.atxi.TokenTransfers {
+				if err := WriteBlockTokenTransfers(bc.atxi.Db, block, GetBlockReceipts(bc.chainDb, block.Hash())); err != nil {
+					return err
+				}
+			}
 			// if buildATXI has been in use (via RPC) and is NOT finished, current < stop
 			// if buildATXI has been in use (via RPC) and IS finished, current == stop
 			// else if builtATXI has not been in use (via RPC), then current == stop == 0
@@ -1889,6 +2236,14 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 				}
 			}
 		}
+		// Store the balance history if enabled
+		if bc.balanceIndex != nil {
+			if balances, err := bc.BlockBalanceChanges(block); err != nil {
+				glog.V(logger.Warn).Warnf("Failed to trace balance changes of block #%d [%x…], its balance history is missing: %v", block.NumberU64(), block.Hash().Bytes()[:4], err)
+			} else if err := WriteBlockBalances(bc.balanceIndex.Db, block.NumberU64(), balances); err != nil {
+				return err
+			}
+		}
 		receipts := GetBlockReceipts(bc.chainDb, block.Hash())
 		// write receipts
 		if err := WriteReceipts(bc.chainDb, receipts); err != nil {
@@ -1900,6 +2255,16 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 		}
 		addedTxs = append(addedTxs, block.Transactions()...)
 	}
+	// The time index stays complete through the new chain if it was up to the fork
+	if indexed, ok := GetBlockTimeIndexHead(bc.chainDb); ok && indexed >= commonBlock.NumberU64() {
+		head := commonBlock.NumberU64()
+		if len(newChain) > 0 {
+			head = newChain[0].NumberU64()
+		}
+		if err := WriteBlockTimeIndexHead(bc.chainDb, head); err != nil {
+			return err
+		}
+	}
 
 	// calculate the difference between deleted and added transactions
 	diff := types.TxDifference(deletedTxs, addedTxs)
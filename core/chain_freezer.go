@@ -0,0 +1,175 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+const (
+	// FreezerThreshold is the default number of recent blocks kept in the
+	// key-value store, older canonical blocks are moved to the ancient store.
+	// It must stay well above the depth of any possible reorg.
+	FreezerThreshold = 90000
+
+	freezerRecheckInterval = time.Minute // Time between checks for blocks to freeze
+	freezerBatchLimit      = 30000       // Maximum number of blocks frozen in one go
+)
+
+// emptyReceiptsRLP is stored for frozen blocks whose receipts are missing.
+var emptyReceiptsRLP = []byte{0xc0}
+
+// freezeLoop periodically moves the canonical blocks older than the ancient
+// threshold out of the key-value store into the ancient store.
+func (bc *BlockChain) freezeLoop(store ngindb.AncientStore) {
+	defer bc.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-bc.quit:
+			return
+		}
+		for {
+			frozen, err := bc.freeze(store)
+			if err != nil {
+				glog.V(logger.Error).Errorf("Failed to freeze ancient blocks: %v", err)
+				break
+			}
+			if frozen < freezerBatchLimit {
+				break
+			}
+			select {
+			case <-bc.quit:
+				return
+			default:
+			}
+		}
+		timer.Reset(freezerRecheckInterval)
+	}
+}
+
+// freeze moves the next batch of old canonical blocks to the ancient store,
+// returning how many were moved.
+//
+// Blocks are appended and synced to the ancient store before being deleted
+// from the key-value store. A crash in between leaves them in both, which is
+// harmless as reads try the key-value store first. The genesis block is kept
+// in the key-value store as well.
+func (bc *BlockChain) freeze(store ngindb.AncientStore) (int, error) {
+	head := bc.CurrentBlock().NumberU64()
+	if head < bc.cacheConfig.AncientThreshold {
+		return 0, nil
+	}
+	first, last := store.Ancients(), head-bc.cacheConfig.AncientThreshold
+	if last >= first+freezerBatchLimit {
+		last = first + freezerBatchLimit - 1
+	}
+	if first > last {
+		return 0, nil
+	}
+	start := time.Now()
+
+	// Blocks this deep are never reorged, so the canonical chain can be read
+	// without holding the chain lock.
+	var hashes []common.Hash
+	for number := first; number <= last; number++ {
+		hash := GetCanonicalHash(bc.chainDb, number)
+		if hash == (common.Hash{}) {
+			return len(hashes), fmt.Errorf("canonical hash of block #%d missing", number)
+		}
+		header := GetHeaderRLP(bc.chainDb, hash)
+		if len(header) == 0 {
+			return len(hashes), fmt.Errorf("header of block #%d [%x…] missing", number, hash[:4])
+		}
+		body := GetBodyRLP(bc.chainDb, hash)
+		if len(body) == 0 {
+			return len(hashes), fmt.Errorf("body of block #%d [%x…] missing", number, hash[:4])
+		}
+		td, _ := bc.chainDb.Get(append(append(blockPrefix, hash[:]...), tdSuffix...))
+		if len(td) == 0 {
+			return len(hashes), fmt.Errorf("total difficulty of block #%d [%x…] missing", number, hash[:4])
+		}
+		receipts, _ := bc.chainDb.Get(append(blockReceiptsPrefix, hash[:]...))
+		if len(receipts) == 0 {
+			receipts = emptyReceiptsRLP
+		}
+		if err := store.AppendAncient(number, hash[:], header, body, receipts, td); err != nil {
+			return len(hashes), err
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := store.Sync(); err != nil {
+		return 0, err
+	}
+
+	// Record where the frozen blocks went and drop them from the key-value store
+	batch := bc.chainDb.NewBatch()
+	for i, hash := range hashes {
+		number := first + uint64(i)
+
+		enc := make([]byte, 8)
+		binary.BigEndian.PutUint64(enc, number)
+		if err := batch.Put(append(ancientNumberPrefix, hash[:]...), enc); err != nil {
+			return 0, err
+		}
+		if number > 0 {
+			for _, key := range [][]byte{
+				append(append(blockPrefix, hash[:]...), headerSuffix...),
+				append(append(blockPrefix, hash[:]...), bodySuffix...),
+				append(append(blockPrefix, hash[:]...), tdSuffix...),
+				append(blockReceiptsPrefix, hash[:]...),
+			} {
+				if err := batch.Delete(key); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if batch.ValueSize() >= ngindb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return 0, err
+			}
+			batch = bc.chainDb.NewBatch()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	glog.V(logger.Info).Infof("Moved blocks #%d-#%d to the ancient store in %v", first, last, time.Since(start))
+	return len(hashes), nil
+}
+
+// truncateAncients discards the frozen blocks above the given head, after the
+// chain was rewound below the ancient store.
+func (bc *BlockChain) truncateAncients(head uint64) error {
+	store, ok := bc.chainDb.(ngindb.AncientStore)
+	if !ok || store.Ancients() <= head+1 {
+		return nil
+	}
+	glog.V(logger.Warn).Infof("Truncating ancient store from %d to %d blocks", store.Ancients(), head+1)
+	return store.TruncateAncients(head + 1)
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
+)
+
+// Tests that headers, bodies, receipts and total difficulties of the blocks
+// moved to the ancient store are read from there, and no longer once the
+// ancient store drops them.
+func TestFreezerFallthrough(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freezer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	memdb, _ := ngindb.NewMemDatabase()
+	db, err := ngindb.NewDatabaseWithFreezer(memdb, dir, true)
+	if err != nil {
+		t.Fatalf("failed to open ancient store: %v", err)
+	}
+	defer db.Close()
+
+	genesis := WriteGenesisBlockForTesting(db, GenesisAccount{Address: testAtxiAddr, Balance: big.NewInt(1000000)})
+	config := DefaultConfigMainnet.ChainConfig
+	blocks, _ := GenerateChain(config, genesis, db, 6, func(i int, b *BlockGen) {
+		tx, err := types.NewTransaction(b.TxNonce(testAtxiAddr), testAddrY, big.NewInt(1), big.NewInt(21000), new(big.Int), nil).SignECDSA(testAtxiKey)
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	// Freezing is disabled on creation to move the blocks by hand
+	bc, err := NewBlockChainWithCache(db, config, FakePow{}, new(event.TypeMux), &CacheConfig{Disabled: true})
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer bc.Stop()
+	if res := bc.InsertChain(blocks); res.Error != nil {
+		t.Fatalf("failed to insert chain: %v", res.Error)
+	}
+
+	type blockData struct {
+		header, body, receipts, td []byte
+	}
+	read := func(n uint64) blockData {
+		hash := GetCanonicalHash(db, n)
+		header, _ := rlp.EncodeToBytes(GetHeader(db, hash))
+		body, _ := rlp.EncodeToBytes(GetBody(db, hash))
+		receipts, _ := rlp.EncodeToBytes(GetBlockReceipts(db, hash))
+		td, _ := rlp.EncodeToBytes(GetTd(db, hash))
+		return blockData{header, body, receipts, td}
+	}
+	var want []blockData
+	for n := uint64(0); n <= 6; n++ {
+		want = append(want, read(n))
+	}
+
+	bc.cacheConfig.AncientThreshold = 2
+	frozen, err := bc.freeze(db)
+	if err != nil {
+		t.Fatalf("failed to freeze blocks: %v", err)
+	}
+	if frozen != 5 || db.Ancients() != 5 {
+		t.Fatalf("frozen block count mismatch: have %d (%d stored), want 5", frozen, db.Ancients())
+	}
+	for n := uint64(0); n <= 6; n++ {
+		hash := GetCanonicalHash(db, n)
+		if stored, _ := memdb.Get(append(append(blockPrefix, hash[:]...), bodySuffix...)); (len(stored) == 0) != (n > 0 && n < 5) {
+			t.Errorf("block #%d: body kept in the key-value store: %v", n, len(stored) > 0)
+		}
+		if have := read(n); !reflect.DeepEqual(have, want[n]) {
+			t.Errorf("block #%d: data mismatch after freezing: have %x, want %x", n, have, want[n])
+		}
+	}
+
+	// Blocks dropped from the ancient store are gone, even if refilled
+	if err := db.TruncateAncients(3); err != nil {
+		t.Fatalf("failed to truncate ancient store: %v", err)
+	}
+	if err := db.AppendAncient(3, make([]byte, 32), want[3].header, want[3].body, want[3].receipts, want[3].td); err != nil {
+		t.Fatalf("failed to refill ancient store: %v", err)
+	}
+	for _, n := range []uint64{3, 4} {
+		hash := GetCanonicalHash(db, n)
+		if GetHeader(db, hash) != nil || GetBody(db, hash) != nil || GetBlockReceipts(db, hash) != nil || GetTd(db, hash) != nil {
+			t.Errorf("block #%d: data read from the truncated ancient store", n)
+		}
+	}
+	if have := read(2); !reflect.DeepEqual(have, want[2]) {
+		t.Errorf("block #2: data mismatch after truncation: have %x, want %x", have, want[2])
+	}
+}
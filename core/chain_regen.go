@@ -0,0 +1,252 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/state"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/trie"
+)
+
+const (
+	// DefaultRegenLimit is the default maximum number of blocks re-executed
+	// to regenerate a pruned state. It matches the flush interval of the
+	// pruned states, so that any historical state can be rebuilt.
+	DefaultRegenLimit = 8192
+
+	// DefaultRegenTimeout is the default maximum time spent regenerating the
+	// state of a single request.
+	DefaultRegenTimeout = time.Minute
+
+	regenCacheLimit = 8 // Number of regenerated states kept in memory
+)
+
+// regenState is a regenerated state, held in a private trie node cache on top
+// of the chain database. The state it was regenerated from may only live in
+// the node cache of the chain, its root is referenced there until the state
+// is released.
+type regenState struct {
+	root     common.Hash
+	base     common.Hash
+	database state.Database
+	cache    *trie.NodeCache
+}
+
+// regenCall is a regeneration in progress, which concurrent requests for the
+// same block wait for.
+type regenCall struct {
+	done  chan struct{}
+	regen *regenState
+	err   error
+}
+
+// nodeCacheReader reads through the node cache of the chain, so that states
+// not flushed to disk yet can be regenerated from. It is never written to.
+type nodeCacheReader struct {
+	ngindb.Database
+	cache *trie.NodeCache
+}
+
+func (r nodeCacheReader) Get(key []byte) ([]byte, error) { return r.cache.Get(key) }
+func (r nodeCacheReader) Has(key []byte) (bool, error)   { return r.cache.Has(key) }
+
+// newRegenCache returns a private trie node cache for a regeneration, on top
+// of the node cache of the chain if states are pruned.
+func (bc *BlockChain) newRegenCache() *trie.NodeCache {
+	if bc.nodeCache == nil {
+		return trie.NewNodeCache(bc.chainDb)
+	}
+	return trie.NewNodeCache(nodeCacheReader{Database: bc.chainDb, cache: bc.nodeCache})
+}
+
+// pinRegenBase references root in the node cache of the chain, keeping it
+// from being garbage collected while a regenerated state builds on it.
+// Roots flushed to disk or not cached are left alone.
+func (bc *BlockChain) pinRegenBase(root common.Hash) {
+	if bc.nodeCache != nil {
+		bc.nodeCache.Reference(root, common.Hash{})
+	}
+}
+
+// releaseRegenState drops the reference held by a regenerated state, called
+// as it's evicted from the cache or discarded.
+func (bc *BlockChain) releaseRegenState(regen *regenState) {
+	if bc.nodeCache != nil {
+		bc.nodeCache.Dereference(regen.base)
+	}
+}
+
+// StateAtBlock returns a new mutable state as of after the given block. If the
+// state was pruned, it is regenerated by re-executing the blocks following the
+// nearest older available state, as long as there are no more than the
+// configured RegenLimit of them and it takes less than the RegenTimeout.
+func (bc *BlockChain) StateAtBlock(block *types.Block) (*state.StateDB, error) {
+	statedb, err := bc.StateAt(block.Root())
+	if err == nil {
+		return statedb, nil
+	}
+	if bc.cacheConfig.RegenLimit == 0 {
+		return nil, err
+	}
+	regen, err := bc.regenerate(block)
+	if err != nil {
+		return nil, err
+	}
+	return state.New(regen.root, regen.database)
+}
+
+// regenerate returns the regenerated state of block, from the cache or else
+// regenerating it. Concurrent requests for the same block share a single
+// regeneration, those for different blocks run in parallel.
+func (bc *BlockChain) regenerate(block *types.Block) (*regenState, error) {
+	hash := block.Hash()
+
+	bc.regenmu.Lock()
+	if regen, ok := bc.regenCache.Get(hash); ok {
+		bc.regenmu.Unlock()
+		return regen.(*regenState), nil
+	}
+	if call := bc.regenCalls[hash]; call != nil {
+		bc.regenmu.Unlock()
+		<-call.done
+		return call.regen, call.err
+	}
+	call := &regenCall{done: make(chan struct{})}
+	bc.regenCalls[hash] = call
+	bc.regenmu.Unlock()
+
+	call.regen, call.err = bc.regenerateState(block)
+
+	bc.regenmu.Lock()
+	if call.err == nil {
+		bc.regenCache.Add(hash, call.regen)
+	}
+	delete(bc.regenCalls, hash)
+	bc.regenmu.Unlock()
+
+	close(call.done)
+	return call.regen, call.err
+}
+
+// regenerateState rebuilds the state of block from the nearest older state
+// held on disk, in the node cache of the chain or among the recently
+// regenerated ones.
+func (bc *BlockChain) regenerateState(block *types.Block) (*regenState, error) {
+	var (
+		start   = time.Now()
+		timeout = bc.cacheConfig.RegenTimeout
+		regen   *regenState
+		current = block
+		blocks  []*types.Block
+	)
+	for regen == nil {
+		if uint64(len(blocks)) >= bc.cacheConfig.RegenLimit {
+			return nil, fmt.Errorf("state of block #%d unavailable within %d blocks, regeneration limit reached", block.NumberU64(), bc.cacheConfig.RegenLimit)
+		}
+		blocks = append(blocks, current)
+		if current.NumberU64() == 0 {
+			return nil, fmt.Errorf("genesis state unavailable")
+		}
+		parent := bc.GetBlock(current.ParentHash())
+		if parent == nil {
+			return nil, fmt.Errorf("block #%d [%x…] not found", current.NumberU64()-1, current.ParentHash().Bytes()[:4])
+		}
+		if cached, ok := bc.regenCache.Get(parent.Hash()); ok {
+			// Work on a copy, the cached state may still be in use
+			base := cached.(*regenState)
+			bc.pinRegenBase(base.base)
+			regen = &regenState{root: base.root, base: base.base, cache: base.cache.Copy()}
+		} else {
+			// Pin before opening, the state may be garbage collected meanwhile
+			bc.pinRegenBase(parent.Root())
+			cache := bc.newRegenCache()
+			if _, err := trie.NewSecure(parent.Root(), cache, 0); err == nil {
+				regen = &regenState{root: parent.Root(), base: parent.Root(), cache: cache}
+			} else {
+				bc.releaseRegenState(&regenState{base: parent.Root()})
+			}
+		}
+		current = parent
+	}
+	regen.database = state.NewDatabaseWithCache(regen.cache)
+	glog.V(logger.Info).Infof("Regenerating state of block #%d from block #%d (%d blocks)", block.NumberU64(), current.NumberU64(), len(blocks))
+
+	// Re-execute the blocks on top of the base state, releasing the
+	// intermediate states as soon as their child is processed.
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if timeout > 0 && time.Since(start) > timeout {
+			bc.releaseRegenState(regen)
+			return nil, fmt.Errorf("regeneration of the state of block #%d timed out after %v, %d of %d blocks re-executed", block.NumberU64(), timeout, len(blocks)-1-i, len(blocks))
+		}
+		b := blocks[i]
+		root, err := bc.regenerateBlock(regen, b)
+		if err != nil {
+			bc.releaseRegenState(regen)
+			return nil, err
+		}
+		regen.cache.Reference(root, common.Hash{})
+		regen.cache.Dereference(regen.root)
+		regen.root = root
+	}
+	glog.V(logger.Info).Infof("Regenerated state of block #%d in %v, %v held in memory", block.NumberU64(), time.Since(start), regen.cache.Size())
+	return regen, nil
+}
+
+// regenerateBlock re-executes block on top of the regenerated state of its
+// parent, committing the result to the private cache.
+func (bc *BlockChain) regenerateBlock(regen *regenState, b *types.Block) (common.Hash, error) {
+	statedb, err := state.New(regen.root, regen.database)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if _, _, _, err := bc.processor.Process(b, statedb); err != nil {
+		return common.Hash{}, fmt.Errorf("regeneration failed processing block #%d: %v", b.NumberU64(), err)
+	}
+	root, err := statedb.CommitTo(regen.cache, false)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if root != b.Root() {
+		return common.Hash{}, fmt.Errorf("regeneration failed at block #%d: state root mismatch: have %x, want %x", b.NumberU64(), root, b.Root())
+	}
+	return root, nil
+}
+
+// reprocessBlock re-executes the block on top of its parent state, which must
+// be available or regenerable, and returns the resulting state along with the
+// changes journaled while processing it.
+func (bc *BlockChain) reprocessBlock(block *types.Block) (*state.StateDB, error) {
+	parent := bc.GetBlock(block.ParentHash())
+	if parent == nil {
+		return nil, fmt.Errorf("block #%d [%x…] not found", block.NumberU64()-1, block.ParentHash().Bytes()[:4])
+	}
+	statedb, err := bc.StateAtBlock(parent)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err := bc.processor.Process(block, statedb); err != nil {
+		return nil, err
+	}
+	return statedb, nil
+}
@@ -23,6 +23,7 @@ import (
 	"math/big"
 
 	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/state/snapshot"
 	"github.com/NginProject/ngind/core/types"
 	"github.com/NginProject/ngind/ngindb"
 	"github.com/NginProject/ngind/logger"
@@ -53,6 +54,8 @@ var (
 
 	preimagePrefix = "secure-key-" // preimagePrefix + hash -> preimage
 	lookupPrefix   = []byte("l")   // lookupPrefix + hash -> transaction/receipt lookup metadata
+
+	ancientNumberPrefix = []byte("ancient-num-") // ancientNumberPrefix + hash -> number of a block moved to the ancient store
 )
 
 // TxLookupEntry is a positional metadata to help looking up the data content of
@@ -110,6 +113,9 @@ func GetHeadFastBlockHash(db ngindb.Database) common.Hash {
 // if the header's not found.
 func GetHeaderRLP(db ngindb.Database, hash common.Hash) rlp.RawValue {
 	data, _ := db.Get(append(append(blockPrefix, hash[:]...), headerSuffix...))
+	if len(data) == 0 {
+		data = getAncient(db, ngindb.FreezerHeaderTable, hash)
+	}
 	return data
 }
 
@@ -131,6 +137,9 @@ func GetHeader(db ngindb.Database, hash common.Hash) *types.Header {
 // GetBodyRLP retrieves the block body (transactions and uncles) in RLP encoding.
 func GetBodyRLP(db ngindb.Database, hash common.Hash) rlp.RawValue {
 	data, _ := db.Get(append(append(blockPrefix, hash[:]...), bodySuffix...))
+	if len(data) == 0 {
+		data = getAncient(db, ngindb.FreezerBodiesTable, hash)
+	}
 	return data
 }
 
@@ -153,6 +162,9 @@ func GetBody(db ngindb.Database, hash common.Hash) *types.Body {
 // none found.
 func GetTd(db ngindb.Database, hash common.Hash) *big.Int {
 	data, _ := db.Get(append(append(blockPrefix, hash.Bytes()...), tdSuffix...))
+	if len(data) == 0 {
+		data = getAncient(db, ngindb.FreezerDifficultyTable, hash)
+	}
 	if len(data) == 0 {
 		return nil
 	}
@@ -188,6 +200,9 @@ func GetBlock(db ngindb.Database, hash common.Hash) *types.Block {
 // in a block given by its hash.
 func GetBlockReceipts(db ngindb.Database, hash common.Hash) types.Receipts {
 	data, _ := db.Get(append(blockReceiptsPrefix, hash[:]...))
+	if len(data) == 0 {
+		data = getAncient(db, ngindb.FreezerReceiptTable, hash)
+	}
 	if len(data) == 0 {
 		return nil
 	}
@@ -203,6 +218,28 @@ func GetBlockReceipts(db ngindb.Database, hash common.Hash) types.Receipts {
 	return receipts
 }
 
+// getAncient retrieves an item of a block moved to the ancient store, nil if
+// the database has no ancient store or the block isn't in it.
+func getAncient(db ngindb.Database, kind string, hash common.Hash) []byte {
+	store, ok := db.(ngindb.AncientStore)
+	if !ok {
+		return nil
+	}
+	enc, _ := db.Get(append(ancientNumberPrefix, hash[:]...))
+	if len(enc) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(enc)
+
+	// The ancient store may have been truncated and refilled with another
+	// chain since the number was recorded.
+	if frozen, _ := store.Ancient(ngindb.FreezerHashTable, number); !bytes.Equal(frozen, hash[:]) {
+		return nil
+	}
+	data, _ := store.Ancient(kind, number)
+	return data
+}
+
 // GetTransaction retrieves a specific transaction from the database, along with
 // its added positional metadata.
 func GetTransaction(db ngindb.Database, hash common.Hash) (*types.Transaction, common.Hash, uint64, uint64) {
@@ -231,6 +268,24 @@ func GetTransaction(db ngindb.Database, hash common.Hash) (*types.Transaction, c
 	return &tx, meta.BlockHash, meta.BlockIndex, meta.Index
 }
 
+// GetTxLookupEntry retrieves the positional metadata of a transaction without
+// the transaction itself, from the metadata stored along with the transaction
+// or else from its lookup entry.
+func GetTxLookupEntry(db ngindb.Database, hash common.Hash) (common.Hash, uint64, uint64) {
+	data, _ := db.Get(append(hash.Bytes(), txMetaSuffix...))
+	if len(data) == 0 {
+		data, _ = db.Get(append(lookupPrefix, hash.Bytes()...))
+		if len(data) == 0 {
+			return common.Hash{}, 0, 0
+		}
+	}
+	var entry TxLookupEntry
+	if err := rlp.DecodeBytes(data, &entry); err != nil {
+		return common.Hash{}, 0, 0
+	}
+	return entry.BlockHash, entry.BlockIndex, entry.Index
+}
+
 // GetReceipt returns a receipt by hash
 func GetReceipt(db ngindb.Database, txHash common.Hash) *types.Receipt {
 	data, _ := db.Get(append(receiptsPrefix, txHash[:]...))
@@ -591,3 +646,97 @@ func WriteBlockChainVersion(db ngindb.Database, vsn int) {
 	enc, _ := rlp.EncodeToBytes(uint(vsn))
 	db.Put([]byte("BlockchainVersion"), enc)
 }
+
+// The categories of data in the chain and index databases, as reported by
+// DatabaseKeyCategory.
+const (
+	KeyCategoryHeaders      = "Headers"
+	KeyCategoryBodies       = "Bodies"
+	KeyCategoryDifficulties = "Difficulties"
+	KeyCategoryCanonical    = "Canonical hashes"
+	KeyCategoryReceipts     = "Receipts"
+	KeyCategoryTxReceipts   = "Transaction receipts"
+	KeyCategoryTxLookups    = "Transaction lookups"
+	KeyCategoryTrieNodes    = "Trie nodes, code and transactions"
+	KeyCategoryPreimages    = "Preimages"
+	KeyCategoryMipmaps      = "Log bloom mipmaps"
+	KeyCategoryAncientNums  = "Ancient block numbers"
+	KeyCategoryBlockTimes   = "Block time index"
+	KeyCategoryAtxi         = "Address transaction index"
+	KeyCategoryTokenTxs     = "Token transfer index"
+	KeyCategoryBalances     = "Balance history"
+	KeyCategorySnapshot     = "State snapshot"
+	KeyCategoryLegacyBlocks = "Legacy blocks"
+	KeyCategoryMetadata     = "Metadata"
+	KeyCategoryUnaccounted  = "Unaccounted"
+)
+
+// KeyCategories lists every category returned by DatabaseKeyCategory.
+var KeyCategories = []string{
+	KeyCategoryHeaders, KeyCategoryBodies, KeyCategoryDifficulties, KeyCategoryCanonical,
+	KeyCategoryReceipts, KeyCategoryTxReceipts, KeyCategoryTxLookups, KeyCategoryTrieNodes,
+	KeyCategoryPreimages, KeyCategoryMipmaps, KeyCategoryAncientNums, KeyCategoryBlockTimes,
+	KeyCategoryAtxi, KeyCategoryTokenTxs, KeyCategoryBalances, KeyCategorySnapshot,
+	KeyCategoryLegacyBlocks, KeyCategoryMetadata, KeyCategoryUnaccounted,
+}
+
+// metadataKeys are the single keys holding the chain markers and settings.
+var metadataKeys = [][]byte{
+	headHeaderKey, headBlockKey, headFastKey, txAddressBookmarkKey, txAddressIndexVersionKey,
+	txAddressIncompleteKey, balanceBookmarkKey, blockTimeHeadKey,
+	[]byte("BlockchainVersion"), []byte("setting-mipmap-version"),
+}
+
+// DatabaseKeyCategory classifies a database key by the schema above. Trie
+// nodes, contract code and transactions are all keyed by their bare hash and
+// share a category.
+func DatabaseKeyCategory(key []byte) string {
+	hashKey := func(prefix, suffix []byte) bool {
+		return len(key) == len(prefix)+common.HashLength+len(suffix) &&
+			bytes.HasPrefix(key, prefix) && bytes.HasSuffix(key, suffix)
+	}
+	switch {
+	case hashKey(blockPrefix, headerSuffix):
+		return KeyCategoryHeaders
+	case hashKey(blockPrefix, bodySuffix):
+		return KeyCategoryBodies
+	case hashKey(blockPrefix, tdSuffix):
+		return KeyCategoryDifficulties
+	case bytes.HasPrefix(key, blockNumPrefix):
+		return KeyCategoryCanonical
+	case bytes.HasPrefix(key, blockHashPrefix):
+		return KeyCategoryLegacyBlocks
+	case hashKey(blockReceiptsPrefix, nil):
+		return KeyCategoryReceipts
+	case hashKey(receiptsPrefix, nil):
+		return KeyCategoryTxReceipts
+	case hashKey(nil, txMetaSuffix), hashKey(lookupPrefix, nil):
+		return KeyCategoryTxLookups
+	case bytes.HasPrefix(key, balanceIndexPrefix), bytes.HasPrefix(key, balanceBlockIndexPrefix):
+		// Balance index keys are as long as a hash, tell them apart first
+		return KeyCategoryBalances
+	case len(key) == common.HashLength:
+		return KeyCategoryTrieNodes
+	case hashKey([]byte(preimagePrefix), nil):
+		return KeyCategoryPreimages
+	case bytes.HasPrefix(key, mipmapPre):
+		return KeyCategoryMipmaps
+	case hashKey(ancientNumberPrefix, nil):
+		return KeyCategoryAncientNums
+	case len(key) == len(blockTimePrefix)+8 && bytes.HasPrefix(key, blockTimePrefix):
+		return KeyCategoryBlockTimes
+	case bytes.HasPrefix(key, txAddressIndexPrefix), bytes.HasPrefix(key, txAddressBlockPrefix),
+		bytes.HasPrefix(key, txAddressIndexV1Prefix):
+		return KeyCategoryAtxi
+	case bytes.HasPrefix(key, tokenTransferIndexPrefix), bytes.HasPrefix(key, tokenTransferTokenPrefix):
+		return KeyCategoryTokenTxs
+	case snapshot.IsKey(key):
+		return KeyCategorySnapshot
+	}
+	for _, meta := range metadataKeys {
+		if bytes.Equal(key, meta) {
+			return KeyCategoryMetadata
+		}
+	}
+	return KeyCategoryUnaccounted
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+)
+
+// Tests that the keys of the chain and index databases are classified by the
+// data they hold, every category being reachable.
+func TestDatabaseKeyCategory(t *testing.T) {
+	hash := common.HexToHash("0x0102030405060708091011121314151617181920212223242526272829303132")
+	join := func(parts ...[]byte) []byte {
+		var key []byte
+		for _, part := range parts {
+			key = append(key, part...)
+		}
+		return key
+	}
+	tests := []struct {
+		key  []byte
+		want string
+	}{
+		{join(blockPrefix, hash[:], headerSuffix), KeyCategoryHeaders},
+		{join(blockPrefix, hash[:], bodySuffix), KeyCategoryBodies},
+		{join(blockPrefix, hash[:], tdSuffix), KeyCategoryDifficulties},
+		{join(blockNumPrefix, []byte{0x12, 0x34}), KeyCategoryCanonical},
+		{join(blockReceiptsPrefix, hash[:]), KeyCategoryReceipts},
+		{join(receiptsPrefix, hash[:]), KeyCategoryTxReceipts},
+		{join(hash[:], txMetaSuffix), KeyCategoryTxLookups},
+		{join(lookupPrefix, hash[:]), KeyCategoryTxLookups},
+		{hash[:], KeyCategoryTrieNodes},
+		{join([]byte(preimagePrefix), hash[:]), KeyCategoryPreimages},
+		{join(mipmapPre, []byte{0, 0, 0, 0, 0, 0, 0x03, 0xe8}), KeyCategoryMipmaps},
+		{join(ancientNumberPrefix, hash[:]), KeyCategoryAncientNums},
+		{blockTimeKey(1500000000), KeyCategoryBlockTimes},
+		{formatAddrTxBytesIndex(testAddrX[:], 12, 3, []byte("f"), []byte("s"), hash[:]), KeyCategoryAtxi},
+		{formatAddrTxBlockKey(12), KeyCategoryAtxi},
+		{join(txAddressIndexV1Prefix, testAddrX[:], []byte{12}), KeyCategoryAtxi},
+		{formatTokenTransferIndex(testAddrX, nil, 12, 3, 't'), KeyCategoryTokenTxs},
+		{formatTokenTransferIndex(testAddrX, &testAddrY, 12, 3, 'f'), KeyCategoryTokenTxs},
+		{formatBalanceIndex(testAddrX, 12), KeyCategoryBalances},
+		{formatBalanceBlockIndex(12), KeyCategoryBalances},
+		{join([]byte("sa"), hash[:]), KeyCategorySnapshot},
+		{join([]byte("ss"), hash[:], hash[:]), KeyCategorySnapshot},
+		{[]byte("SnapshotRoot"), KeyCategorySnapshot},
+		{[]byte("SnapshotGenerator"), KeyCategorySnapshot},
+		{join(blockHashPrefix, hash[:]), KeyCategoryLegacyBlocks},
+		{headBlockKey, KeyCategoryMetadata},
+		{txAddressIncompleteKey, KeyCategoryMetadata},
+		{balanceBookmarkKey, KeyCategoryMetadata},
+		{blockTimeHeadKey, KeyCategoryMetadata},
+		{[]byte("BlockchainVersion"), KeyCategoryMetadata},
+		{join([]byte("sa"), hash[:4]), KeyCategoryUnaccounted},
+		{join(hash[:], []byte{0x02}), KeyCategoryUnaccounted},
+		{[]byte("unknown"), KeyCategoryUnaccounted},
+	}
+	seen := make(map[string]bool)
+	for i, tt := range tests {
+		if have := DatabaseKeyCategory(tt.key); have != tt.want {
+			t.Errorf("test %d: key %x category mismatch: have %q, want %q", i, tt.key, have, tt.want)
+		}
+		seen[tt.want] = true
+	}
+	for _, category := range KeyCategories {
+		if !seen[category] {
+			t.Errorf("category %q not covered", category)
+		}
+	}
+	if len(seen) != len(KeyCategories) {
+		t.Errorf("category count mismatch: have %d listed, want %d", len(KeyCategories), len(seen))
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+// Package era implements the archive format used to export and import the
+// chain history in fixed-size epochs.
+//
+// An era file is a sequence of records, each made of an 8 byte header holding
+// the record type (2 bytes, little endian), the data length (4 bytes, little
+// endian) and two zero bytes, followed by the data itself:
+//
+//	Version | block(0) | block(1) | ... | block(n-1) | Accumulator | BlockIndex
+//	block   = Header | Body | Receipts | TotalDifficulty
+//
+// Headers, bodies and receipts are snappy compressed RLP, receipts in their
+// consensus encoding. The total difficulty is a 32 byte big endian integer.
+// The accumulator is the merkle root of the (hash, total difficulty) pairs of
+// the blocks of the epoch, see ComputeAccumulator. The block index closing the
+// file lets readers seek to any block:
+//
+//	BlockIndex = start number | offset(0) | ... | offset(n-1) | count
+//
+// with all fields 8 byte little endian integers, and the offsets relative to
+// the beginning of the block index record.
+package era
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/rlp"
+	"github.com/golang/snappy"
+)
+
+// EpochSize is the number of blocks held by an era file. Every file but the
+// last one of an export holds exactly as many, starting at a multiple of it.
+const EpochSize = 8192
+
+// Record types of an era file.
+const (
+	TypeVersion         uint16 = 0x3265
+	TypeHeader          uint16 = 0x03
+	TypeBody            uint16 = 0x04
+	TypeReceipts        uint16 = 0x05
+	TypeTotalDifficulty uint16 = 0x06
+	TypeAccumulator     uint16 = 0x07
+	TypeBlockIndex      uint16 = 0x3266
+
+	recordHeaderSize = 8
+	maxRecordSize    = 1 << 30
+)
+
+var (
+	ErrNotFound    = errors.New("block not in era file")
+	errBadVersion  = errors.New("missing era version record")
+	errBadIndex    = errors.New("corrupt era block index")
+	errRecordLimit = errors.New("era record too large")
+)
+
+// Filename returns the name of the era file of the given epoch. The file name
+// includes a short prefix of its accumulator to tell apart the exports of
+// different chains.
+func Filename(network string, epoch uint64, root common.Hash) string {
+	return fmt.Sprintf("%s-%05d-%x.era", network, epoch, root[:4])
+}
+
+// ReadDir returns the paths of the era files of the network found in dir,
+// ordered by epoch. It fails if an epoch is missing or present twice.
+func ReadDir(dir, network string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type entry struct {
+		epoch uint64
+		path  string
+	}
+	var files []entry
+	for _, fi := range entries {
+		name := fi.Name()
+		if fi.IsDir() || filepath.Ext(name) != ".era" || !strings.HasPrefix(name, network+"-") {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(name, ".era"), "-")
+		if len(parts) < 3 {
+			continue
+		}
+		epoch, err := strconv.ParseUint(parts[len(parts)-2], 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, entry{epoch, filepath.Join(dir, name)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].epoch < files[j].epoch })
+
+	paths := make([]string, len(files))
+	for i, f := range files {
+		if i > 0 && f.epoch != files[i-1].epoch+1 {
+			return nil, fmt.Errorf("era files of epochs %d and %d are not contiguous", files[i-1].epoch, f.epoch)
+		}
+		paths[i] = f.path
+	}
+	return paths, nil
+}
+
+// ComputeAccumulator returns the root of the binary merkle tree whose leaves
+// are keccak256(hash || td) of the blocks of an epoch, td being a 32 byte big
+// endian integer. Leaves past the last block are zero, so that the tree always
+// has EpochSize leaves.
+func ComputeAccumulator(hashes []common.Hash, tds []*big.Int) (common.Hash, error) {
+	if len(hashes) != len(tds) {
+		return common.Hash{}, fmt.Errorf("accumulator of %d hashes and %d total difficulties", len(hashes), len(tds))
+	}
+	if len(hashes) > EpochSize {
+		return common.Hash{}, fmt.Errorf("accumulator of %d blocks exceeds the epoch size", len(hashes))
+	}
+	level := make([]common.Hash, EpochSize)
+	for i := range hashes {
+		level[i] = crypto.Keccak256Hash(hashes[i][:], common.BigToHash(tds[i]).Bytes())
+	}
+	for len(level) > 1 {
+		for i := 0; i < len(level)/2; i++ {
+			level[i] = crypto.Keccak256Hash(level[2*i][:], level[2*i+1][:])
+		}
+		level = level[:len(level)/2]
+	}
+	return level[0], nil
+}
+
+// Era is a read-only handle to an era file.
+type Era struct {
+	f     *os.File
+	size  int64
+	start uint64 // Number of the first block in the file
+	count uint64 // Number of blocks in the file
+	index int64  // Offset of the block index record
+}
+
+// Open opens the era file at path and loads its block index.
+func Open(path string) (*Era, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEra(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return e, nil
+}
+
+func newEra(f *os.File) (*Era, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	e := &Era{f: f, size: fi.Size()}
+
+	typ, _, err := e.readRecord(0)
+	if err != nil {
+		return nil, err
+	}
+	if typ != TypeVersion {
+		return nil, errBadVersion
+	}
+	if e.size < recordHeaderSize+3*8 {
+		return nil, errBadIndex
+	}
+	if e.count, err = e.readUint64(e.size - 8); err != nil {
+		return nil, err
+	}
+	if e.count == 0 || e.count > EpochSize {
+		return nil, errBadIndex
+	}
+	e.index = e.size - int64(e.count)*8 - 2*8 - recordHeaderSize
+	if e.index < recordHeaderSize {
+		return nil, errBadIndex
+	}
+	typ, length, err := e.readRecordHeader(e.index)
+	if err != nil {
+		return nil, err
+	}
+	if typ != TypeBlockIndex || int64(length) != e.size-e.index-recordHeaderSize {
+		return nil, errBadIndex
+	}
+	if e.start, err = e.readUint64(e.index + recordHeaderSize); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Close closes the underlying file.
+func (e *Era) Close() error {
+	return e.f.Close()
+}
+
+// Start returns the number of the first block in the file.
+func (e *Era) Start() uint64 { return e.start }
+
+// Count returns the number of blocks in the file.
+func (e *Era) Count() uint64 { return e.count }
+
+// Epoch returns the epoch of the file.
+func (e *Era) Epoch() uint64 { return e.start / EpochSize }
+
+// Accumulator returns the accumulator root recorded in the file.
+func (e *Era) Accumulator() (common.Hash, error) {
+	// The accumulator is the record right before the block index
+	off := e.index - recordHeaderSize - common.HashLength
+	typ, data, err := e.readRecord(off)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if typ != TypeAccumulator || len(data) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("missing accumulator record")
+	}
+	return common.BytesToHash(data), nil
+}
+
+// GetBlockByNumber returns the block, receipts and total difficulty stored for
+// the given block number.
+func (e *Era) GetBlockByNumber(number uint64) (*types.Block, types.Receipts, *big.Int, error) {
+	if number < e.start || number >= e.start+e.count {
+		return nil, nil, nil, ErrNotFound
+	}
+	rel, err := e.readUint64(e.index + recordHeaderSize + 8 + int64(number-e.start)*8)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	off := e.index + int64(rel)
+
+	var (
+		header   types.Header
+		body     types.Body
+		receipts types.Receipts
+	)
+	for _, item := range []struct {
+		typ uint16
+		val interface{}
+	}{
+		{TypeHeader, &header},
+		{TypeBody, &body},
+		{TypeReceipts, &receipts},
+	} {
+		typ, data, err := e.readRecord(off)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if typ != item.typ {
+			return nil, nil, nil, fmt.Errorf("block #%d: record of type %#x, want %#x", number, typ, item.typ)
+		}
+		off += recordHeaderSize + int64(len(data))
+
+		if data, err = snappy.Decode(nil, data); err != nil {
+			return nil, nil, nil, fmt.Errorf("block #%d: %v", number, err)
+		}
+		if err := rlp.DecodeBytes(data, item.val); err != nil {
+			return nil, nil, nil, fmt.Errorf("block #%d: %v", number, err)
+		}
+	}
+	typ, data, err := e.readRecord(off)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if typ != TypeTotalDifficulty || len(data) != common.HashLength {
+		return nil, nil, nil, fmt.Errorf("block #%d: missing total difficulty", number)
+	}
+	if header.Number == nil || header.Number.Uint64() != number {
+		return nil, nil, nil, fmt.Errorf("block #%d: header of block #%v", number, header.Number)
+	}
+	block := types.NewBlockWithHeader(&header).WithBody(body.Transactions, body.Uncles)
+	return block, receipts, new(big.Int).SetBytes(data), nil
+}
+
+// readRecordHeader reads the type and length of the record at offset off.
+func (e *Era) readRecordHeader(off int64) (uint16, uint32, error) {
+	var head [recordHeaderSize]byte
+	if _, err := e.f.ReadAt(head[:], off); err != nil {
+		return 0, 0, err
+	}
+	length := binary.LittleEndian.Uint32(head[2:6])
+	if int64(length) > e.size-off-recordHeaderSize {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return binary.LittleEndian.Uint16(head[:2]), length, nil
+}
+
+// readRecord reads the record at offset off.
+func (e *Era) readRecord(off int64) (uint16, []byte, error) {
+	typ, length, err := e.readRecordHeader(off)
+	if err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, length)
+	if _, err := e.f.ReadAt(data, off+recordHeaderSize); err != nil {
+		return 0, nil, err
+	}
+	return typ, data, nil
+}
+
+func (e *Era) readUint64(off int64) (uint64, error) {
+	var buf [8]byte
+	if _, err := e.f.ReadAt(buf[:], off); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// Builder writes an era file block by block.
+type Builder struct {
+	w       io.Writer
+	written int64
+
+	start   uint64
+	offsets []int64
+	hashes  []common.Hash
+	tds     []*big.Int
+}
+
+// NewBuilder creates a builder writing an era file to w.
+func NewBuilder(w io.Writer) *Builder {
+	return &Builder{w: w}
+}
+
+// Add appends a block along with its receipts and total difficulty. Blocks
+// must be added in order and belong to the same epoch.
+func (b *Builder) Add(block *types.Block, receipts types.Receipts, td *big.Int) error {
+	header, err := rlp.EncodeToBytes(block.Header())
+	if err != nil {
+		return err
+	}
+	body, err := rlp.EncodeToBytes(block.Body())
+	if err != nil {
+		return err
+	}
+	rcpts, err := rlp.EncodeToBytes(receipts)
+	if err != nil {
+		return err
+	}
+	return b.AddRLP(block.NumberU64(), block.Hash(), header, body, rcpts, td)
+}
+
+// AddRLP appends a block given its RLP encoded header, body and receipts.
+func (b *Builder) AddRLP(number uint64, hash common.Hash, header, body, receipts []byte, td *big.Int) error {
+	if len(b.offsets) == 0 {
+		if err := b.writeRecord(TypeVersion, nil); err != nil {
+			return err
+		}
+		b.start = number
+	}
+	switch {
+	case number != b.start+uint64(len(b.offsets)):
+		return fmt.Errorf("block #%d added out of order, want #%d", number, b.start+uint64(len(b.offsets)))
+	case number/EpochSize != b.start/EpochSize:
+		return fmt.Errorf("block #%d is past the epoch of block #%d", number, b.start)
+	}
+	b.offsets = append(b.offsets, b.written)
+	b.hashes = append(b.hashes, hash)
+	b.tds = append(b.tds, new(big.Int).Set(td))
+
+	for _, item := range []struct {
+		typ  uint16
+		data []byte
+	}{
+		{TypeHeader, header},
+		{TypeBody, body},
+		{TypeReceipts, receipts},
+	} {
+		if err := b.writeRecord(item.typ, snappy.Encode(nil, item.data)); err != nil {
+			return err
+		}
+	}
+	return b.writeRecord(TypeTotalDifficulty, common.BigToHash(td).Bytes())
+}
+
+// Finalize writes the accumulator and block index closing the file, returning
+// the accumulator root.
+func (b *Builder) Finalize() (common.Hash, error) {
+	if len(b.offsets) == 0 {
+		return common.Hash{}, errors.New("no blocks added to era file")
+	}
+	root, err := ComputeAccumulator(b.hashes, b.tds)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := b.writeRecord(TypeAccumulator, root[:]); err != nil {
+		return common.Hash{}, err
+	}
+	index := make([]byte, 8*(len(b.offsets)+2))
+	binary.LittleEndian.PutUint64(index, b.start)
+	for i, off := range b.offsets {
+		binary.LittleEndian.PutUint64(index[8*(i+1):], uint64(off-b.written))
+	}
+	binary.LittleEndian.PutUint64(index[len(index)-8:], uint64(len(b.offsets)))
+	if err := b.writeRecord(TypeBlockIndex, index); err != nil {
+		return common.Hash{}, err
+	}
+	return root, nil
+}
+
+func (b *Builder) writeRecord(typ uint16, data []byte) error {
+	if len(data) > maxRecordSize {
+		return errRecordLimit
+	}
+	var head [recordHeaderSize]byte
+	binary.LittleEndian.PutUint16(head[:2], typ)
+	binary.LittleEndian.PutUint32(head[2:6], uint32(len(data)))
+
+	n, err := b.w.Write(append(head[:], data...))
+	b.written += int64(n)
+	return err
+}
+
+// ReadChecksums parses a list of trusted accumulator roots, one "epoch root"
+// pair per line, as written next to the era files by an export.
+func ReadChecksums(path string) (map[uint64]common.Hash, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := make(map[uint64]common.Hash)
+	for i, line := range bytes.Split(blob, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<epoch> <root>\"", path, i+1)
+		}
+		epoch, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid epoch: %v", path, i+1, err)
+		}
+		root := common.FromHex(fields[1])
+		if len(root) != common.HashLength {
+			return nil, fmt.Errorf("%s:%d: invalid accumulator root %q", path, i+1, fields[1])
+		}
+		roots[epoch] = common.BytesToHash(root)
+	}
+	return roots, nil
+}
@@ -0,0 +1,345 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package era
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/rlp"
+)
+
+// testEra is an era file built from a run of blocks.
+type testEra struct {
+	blocks   []*types.Block
+	receipts []types.Receipts
+	tds      []*big.Int
+	root     common.Hash
+	data     []byte
+}
+
+// newTestBlocks returns n blocks from block number start, each holding a
+// transaction, without building their era file.
+func newTestBlocks(start, n uint64) *testEra {
+	e := new(testEra)
+	parent := common.Hash{}
+	td := big.NewInt(int64(start) * 131072)
+	for i := uint64(0); i < n; i++ {
+		number := start + i
+		header := &types.Header{
+			ParentHash: parent,
+			Number:     new(big.Int).SetUint64(number),
+			Difficulty: big.NewInt(131072),
+			GasLimit:   big.NewInt(4712388),
+			GasUsed:    big.NewInt(21000),
+			Time:       new(big.Int).SetUint64(1500000000 + number*15),
+		}
+		tx := types.NewTransaction(number, common.HexToAddress("0x1111"), big.NewInt(int64(number)), big.NewInt(21000), big.NewInt(1), nil)
+		receipts := types.Receipts{types.NewReceipt(common.Hash{byte(number)}.Bytes(), big.NewInt(21000))}
+		block := types.NewBlock(header, []*types.Transaction{tx}, nil, receipts)
+
+		td = new(big.Int).Add(td, header.Difficulty)
+		e.blocks = append(e.blocks, block)
+		e.receipts = append(e.receipts, receipts)
+		e.tds = append(e.tds, td)
+		parent = block.Hash()
+	}
+	return e
+}
+
+// newTestEra builds an era file of n blocks from block number start.
+func newTestEra(t *testing.T, start, n uint64) *testEra {
+	e := newTestBlocks(start, n)
+
+	buf := new(bytes.Buffer)
+	b := NewBuilder(buf)
+	for i, block := range e.blocks {
+		if err := b.Add(block, e.receipts[i], e.tds[i]); err != nil {
+			t.Fatalf("failed to add block #%d: %v", block.NumberU64(), err)
+		}
+	}
+	root, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("failed to finalize era file: %v", err)
+	}
+	e.root, e.data = root, buf.Bytes()
+	return e
+}
+
+// writeTestFile writes data to a file in a temporary directory, removed once
+// the test is done.
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	dir, err := ioutil.TempDir("", "era-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Tests that blocks, receipts and total difficulties added to an era file are
+// read back by number.
+func TestEraRoundTrip(t *testing.T) {
+	start := uint64(EpochSize + 10)
+	want := newTestEra(t, start, 5)
+
+	e, err := Open(writeTestFile(t, "test.era", want.data))
+	if err != nil {
+		t.Fatalf("failed to open era file: %v", err)
+	}
+	defer e.Close()
+
+	if e.Start() != start || e.Count() != 5 || e.Epoch() != 1 {
+		t.Errorf("range mismatch: have start %d, count %d, epoch %d, want %d, 5, 1", e.Start(), e.Count(), e.Epoch(), start)
+	}
+	if root, err := e.Accumulator(); err != nil || root != want.root {
+		t.Errorf("accumulator mismatch: have %x (%v), want %x", root, err, want.root)
+	}
+	for i, wantBlock := range want.blocks {
+		number := wantBlock.NumberU64()
+		block, receipts, td, err := e.GetBlockByNumber(number)
+		if err != nil {
+			t.Fatalf("block #%d: failed to read: %v", number, err)
+		}
+		if block.Hash() != wantBlock.Hash() {
+			t.Errorf("block #%d: hash mismatch: have %x, want %x", number, block.Hash(), wantBlock.Hash())
+		}
+		if types.DeriveSha(block.Transactions()) != wantBlock.TxHash() {
+			t.Errorf("block #%d: transactions mismatch", number)
+		}
+		have, _ := rlp.EncodeToBytes(receipts)
+		wantReceipts, _ := rlp.EncodeToBytes(want.receipts[i])
+		if !bytes.Equal(have, wantReceipts) {
+			t.Errorf("block #%d: receipts mismatch: have %x, want %x", number, have, wantReceipts)
+		}
+		if td.Cmp(want.tds[i]) != 0 {
+			t.Errorf("block #%d: total difficulty mismatch: have %v, want %v", number, td, want.tds[i])
+		}
+	}
+	for _, number := range []uint64{0, start - 1, start + 5} {
+		if _, _, _, err := e.GetBlockByNumber(number); err != ErrNotFound {
+			t.Errorf("block #%d: have error %v, want %v", number, err, ErrNotFound)
+		}
+	}
+}
+
+// Tests that blocks are only added in order and within one epoch.
+func TestBuilderOrder(t *testing.T) {
+	blocks := newTestBlocks(EpochSize-2, 3)
+
+	b := NewBuilder(ioutil.Discard)
+	if _, err := b.Finalize(); err == nil {
+		t.Errorf("empty era file finalized")
+	}
+	if err := b.Add(blocks.blocks[0], blocks.receipts[0], blocks.tds[0]); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := b.Add(blocks.blocks[0], blocks.receipts[0], blocks.tds[0]); err == nil {
+		t.Errorf("block added twice")
+	}
+	if err := b.Add(blocks.blocks[2], blocks.receipts[2], blocks.tds[2]); err == nil {
+		t.Errorf("block added out of order")
+	}
+	if err := b.Add(blocks.blocks[1], blocks.receipts[1], blocks.tds[1]); err != nil {
+		t.Fatalf("failed to add block: %v", err)
+	}
+	if err := b.Add(blocks.blocks[2], blocks.receipts[2], blocks.tds[2]); err == nil {
+		t.Errorf("block of the next epoch added")
+	}
+}
+
+// merkleRoot computes the root of a tree of size leaves, those past the given
+// ones being zero.
+func merkleRoot(leaves []common.Hash, size int) common.Hash {
+	if size == 1 {
+		if len(leaves) == 0 {
+			return common.Hash{}
+		}
+		return leaves[0]
+	}
+	half := size / 2
+	split := half
+	if len(leaves) < split {
+		split = len(leaves)
+	}
+	return crypto.Keccak256Hash(merkleRoot(leaves[:split], half).Bytes(), merkleRoot(leaves[split:], half).Bytes())
+}
+
+// Tests that the accumulator is the root of the tree of the block hashes and
+// total difficulties, padded to the epoch size.
+func TestComputeAccumulator(t *testing.T) {
+	e := newTestEra(t, 0, 5)
+
+	var hashes []common.Hash
+	var leaves []common.Hash
+	for i, block := range e.blocks {
+		hashes = append(hashes, block.Hash())
+		leaves = append(leaves, crypto.Keccak256Hash(block.Hash().Bytes(), common.BigToHash(e.tds[i]).Bytes()))
+	}
+	root, err := ComputeAccumulator(hashes, e.tds)
+	if err != nil {
+		t.Fatalf("failed to compute accumulator: %v", err)
+	}
+	if want := merkleRoot(leaves, EpochSize); root != want || root != e.root {
+		t.Errorf("accumulator mismatch: have %x, want %x, built %x", root, want, e.root)
+	}
+	// Every block and total difficulty is committed to
+	tds := append([]*big.Int{}, e.tds...)
+	tds[4] = new(big.Int).Add(tds[4], common.Big1)
+	if other, _ := ComputeAccumulator(hashes, tds); other == root {
+		t.Errorf("accumulator ignores the total difficulty")
+	}
+	if other, _ := ComputeAccumulator(hashes[:4], e.tds[:4]); other == root {
+		t.Errorf("accumulator ignores the last block")
+	}
+	if _, err := ComputeAccumulator(hashes, e.tds[:4]); err == nil {
+		t.Errorf("accumulator of mismatched hashes and total difficulties computed")
+	}
+	if _, err := ComputeAccumulator(make([]common.Hash, EpochSize+1), make([]*big.Int, EpochSize+1)); err == nil {
+		t.Errorf("accumulator past the epoch size computed")
+	}
+}
+
+// Tests that era files are listed by epoch, gaps and duplicates being
+// reported.
+func TestReadDir(t *testing.T) {
+	tests := []struct {
+		files []string
+		want  []string
+		fail  bool
+	}{
+		{
+			files: []string{"mainnet-00001-bbbbbbbb.era", "mainnet-00000-aaaaaaaa.era", "mainnet-00002-cccccccc.era"},
+			want:  []string{"mainnet-00000-aaaaaaaa.era", "mainnet-00001-bbbbbbbb.era", "mainnet-00002-cccccccc.era"},
+		},
+		{
+			files: []string{"mainnet-00000-aaaaaaaa.era", "testnet-00001-bbbbbbbb.era", "mainnet-00001-bbbbbbbb.txt", "mainnet-x-bbbbbbbb.era", "checksums.txt"},
+			want:  []string{"mainnet-00000-aaaaaaaa.era"},
+		},
+		{
+			files: []string{"mainnet-00005-aaaaaaaa.era", "mainnet-00006-bbbbbbbb.era"},
+			want:  []string{"mainnet-00005-aaaaaaaa.era", "mainnet-00006-bbbbbbbb.era"},
+		},
+		{
+			files: []string{"mainnet-00000-aaaaaaaa.era", "mainnet-00002-cccccccc.era"},
+			fail:  true,
+		},
+		{
+			files: []string{"mainnet-00000-aaaaaaaa.era", "mainnet-00001-bbbbbbbb.era", "mainnet-00001-dddddddd.era"},
+			fail:  true,
+		},
+		{
+			files: nil,
+			want:  []string{},
+		},
+	}
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", "era-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for _, name := range tt.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		paths, err := ReadDir(dir, "mainnet")
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: gap or duplicate not reported: %v", i, paths)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to read directory: %v", i, err)
+			continue
+		}
+		names := []string{}
+		for _, path := range paths {
+			names = append(names, filepath.Base(path))
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("test %d: files mismatch: have %v, want %v", i, names, tt.want)
+		}
+	}
+}
+
+// Tests that era files whose block index is truncated or corrupt are rejected.
+func TestEraCorruptIndex(t *testing.T) {
+	e := newTestEra(t, 0, 3)
+	size := len(e.data)
+	index := size - 5*8 - recordHeaderSize
+
+	corrupt := func(off int, value uint64) []byte {
+		data := common.CopyBytes(e.data)
+		binary.LittleEndian.PutUint64(data[off:], value)
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated count", e.data[:size-1]},
+		{"truncated index", e.data[:index+recordHeaderSize+8]},
+		{"missing index", e.data[:index]},
+		{"only version", e.data[:recordHeaderSize]},
+		{"zero count", corrupt(size-8, 0)},
+		{"count too large", corrupt(size-8, 4)},
+		{"count past epoch", corrupt(size-8, EpochSize+1)},
+		{"index type", corrupt(index, uint64(TypeAccumulator)|uint64(5*8)<<16)},
+		{"index length", corrupt(index, uint64(TypeBlockIndex)|uint64(4*8)<<16)},
+		{"version", corrupt(0, uint64(TypeHeader))},
+	}
+	for _, tt := range tests {
+		era, err := Open(writeTestFile(t, "test.era", tt.data))
+		if err == nil {
+			era.Close()
+			t.Errorf("%s: corrupt era file opened", tt.name)
+		}
+	}
+	// Offsets pointing elsewhere than a block, here the accumulator, are
+	// caught on read
+	accumulator := int64(-recordHeaderSize - common.HashLength)
+	data := corrupt(index+recordHeaderSize+8, uint64(accumulator))
+	era, err := Open(writeTestFile(t, "test.era", data))
+	if err != nil {
+		t.Fatalf("failed to open era file: %v", err)
+	}
+	defer era.Close()
+	if _, _, _, err := era.GetBlockByNumber(0); err == nil || !strings.Contains(err.Error(), "type") {
+		t.Errorf("block read from a corrupt offset: %v", err)
+	}
+	if _, _, _, err := era.GetBlockByNumber(1); err != nil {
+		t.Errorf("block #1 unreadable: %v", err)
+	}
+}
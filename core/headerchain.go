@@ -574,6 +574,12 @@ type headerValidator struct {
 	Pow    pow.PoW      // Proof of work used for validating
 }
 
+// NewHeaderValidator returns a HeaderValidator checking headers against the
+// given header chain, for chains without a BlockValidator (light clients).
+func NewHeaderValidator(config *ChainConfig, hc *HeaderChain, pow pow.PoW) HeaderValidator {
+	return &headerValidator{config: config, hc: hc, Pow: pow}
+}
+
 // ValidateHeader validates the given header and, depending on the pow arg,
 // checks the proof of work of the given header. Returns an error if the
 // validation failed.
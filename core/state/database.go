@@ -22,6 +22,7 @@ import (
 
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
 	"github.com/NginProject/ngind/trie"
 	lru "github.com/hashicorp/golang-lru"
 )
@@ -29,6 +30,9 @@ import (
 // Trie cache generation limit after which to evict trie nodes from memory.
 var MaxTrieCacheGen = uint16(120)
 
+// emptyRoot is the known root hash of an empty trie.
+var emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
 //const (
 //	// Number of past tries to keep. This value is chosen such that
 //	// reasonable chain reorg depths will hit an existing trie.
@@ -70,13 +74,31 @@ func NewDatabase(db ngindb.Database) Database {
 	return &cachingDB{db: db, codeSizeCache: csc}
 }
 
+// NewDatabaseWithCache creates a backing store for state reading and writing
+// through the given trie node cache. States committed to the cache stay in
+// memory until flushed to disk by the cache owner.
+func NewDatabaseWithCache(cache *trie.NodeCache) Database {
+	csc, _ := lru.New(codeSizeCacheSize)
+	return &cachingDB{db: cache, cache: cache, codeSizeCache: csc}
+}
+
 type cachingDB struct {
-	db            ngindb.Database
+	db            trie.Database
+	cache         *trie.NodeCache // nil if the state isn't pruned
 	mu            sync.Mutex
 	pastTries     []*trie.SecureTrie
 	codeSizeCache *lru.Cache
 }
 
+// NodeCache returns the trie node cache of db, or nil if it writes straight
+// to disk.
+func NodeCache(db Database) *trie.NodeCache {
+	if db, ok := db.(*cachingDB); ok {
+		return db.cache
+	}
+	return nil
+}
+
 func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -146,7 +168,22 @@ type cachedTrie struct {
 }
 
 func (m cachedTrie) CommitTo(dbw trie.DatabaseWriter) (common.Hash, error) {
-	root, err := m.SecureTrie.CommitTo(dbw)
+	// Storage tries hang off the account leaves, reference them so they live
+	// exactly as long as the accounts using them.
+	var onleaf trie.LeafCallback
+	if cache, ok := dbw.(*trie.NodeCache); ok {
+		onleaf = func(leaf []byte, parent common.Hash) error {
+			var account Account
+			if err := rlp.DecodeBytes(leaf, &account); err != nil {
+				return nil
+			}
+			if account.Root != emptyRoot {
+				cache.Reference(account.Root, parent)
+			}
+			return nil
+		}
+	}
+	root, err := m.SecureTrie.CommitToCache(dbw, onleaf)
 	if err == nil {
 		m.db.pushTrie(m.SecureTrie)
 	}
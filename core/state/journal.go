@@ -34,7 +34,8 @@ type (
 		account *common.Address
 	}
 	resetObjectChange struct {
-		prev *StateObject
+		prev         *StateObject
+		prevdestruct bool // whether the previous object was already destructed in the snapshot changes
 	}
 	suicideChange struct {
 		account     *common.Address
@@ -67,6 +68,9 @@ type (
 	addLogChange struct {
 		txhash common.Hash
 	}
+	addInternalTxChange struct {
+		txhash common.Hash
+	}
 	addPreimageChange struct {
 		hash common.Hash
 	}
@@ -84,6 +88,9 @@ func (ch createObjectChange) undo(s *StateDB) {
 
 func (ch resetObjectChange) undo(s *StateDB) {
 	s.setStateObject(ch.prev)
+	if !ch.prevdestruct && s.snap != nil {
+		delete(s.snapDestructs, ch.prev.addrHash)
+	}
 }
 
 func (ch suicideChange) undo(s *StateDB) {
@@ -135,6 +142,15 @@ func (ch addLogChange) undo(s *StateDB) {
 	s.logSize--
 }
 
+func (ch addInternalTxChange) undo(s *StateDB) {
+	txs := s.internalTxs[ch.txhash]
+	if len(txs) == 1 {
+		delete(s.internalTxs, ch.txhash)
+	} else {
+		s.internalTxs[ch.txhash] = txs[:len(txs)-1]
+	}
+}
+
 func (ch addPreimageChange) undo(s *StateDB) {
 	delete(s.preimages, ch.hash)
 }
@@ -0,0 +1,90 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package pruner
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/NginProject/ngind/common"
+)
+
+// bloomHashes is the number of bit positions set per key. Keys are hashes
+// already, so each position is taken from an 8 byte slice of the key itself.
+const bloomHashes = 4
+
+var errBloomCorrupt = errors.New("state bloom file corrupt")
+
+// stateBloom is a bloom filter over trie node and contract code hashes. False
+// positives only mean some garbage survives the prune, there are no false
+// negatives so a marked node is never deleted.
+type stateBloom struct {
+	bits []byte
+}
+
+// newStateBloom creates an empty bloom filter of the given size in bytes.
+func newStateBloom(size uint64) *stateBloom {
+	return &stateBloom{bits: make([]byte, size)}
+}
+
+// add marks the given hash as present.
+func (b *stateBloom) add(hash common.Hash) {
+	m := uint64(len(b.bits)) * 8
+	for i := 0; i < bloomHashes; i++ {
+		bit := binary.BigEndian.Uint64(hash[i*8:]) % m
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// contains reports whether the hash may have been added.
+func (b *stateBloom) contains(hash common.Hash) bool {
+	m := uint64(len(b.bits)) * 8
+	for i := 0; i < bloomHashes; i++ {
+		bit := binary.BigEndian.Uint64(hash[i*8:]) % m
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// commit writes the filter to path, prefixed by the block hash the marked
+// states were collected at. The file is written aside and renamed so a crash
+// never leaves a partial filter behind.
+func (b *stateBloom) commit(path string, head common.Hash) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(head.Bytes(), b.bits...), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadStateBloom reads a filter previously written by commit, returning it
+// along with the block hash it was marked at.
+func loadStateBloom(path string) (*stateBloom, common.Hash, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	if len(blob) <= common.HashLength {
+		return nil, common.Hash{}, errBloomCorrupt
+	}
+	head := common.BytesToHash(blob[:common.HashLength])
+	return &stateBloom{bits: blob[common.HashLength:]}, head, nil
+}
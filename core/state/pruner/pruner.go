@@ -0,0 +1,231 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+// Package pruner implements offline pruning of the state trie nodes which are
+// no longer reachable from the recent canonical states.
+package pruner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/state"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+// bloomFileName is the file within the data directory the bloom filter of
+// the marked states is persisted to while pruning.
+const bloomFileName = "statebloom.bf"
+
+// logInterval is the time between progress reports.
+const logInterval = 8 * time.Second
+
+// txMetaSuffix is appended to a transaction hash to store its lookup metadata.
+// Transactions share the 32 byte hash key space with the trie nodes.
+var txMetaSuffix = []byte{0x01}
+
+// Pruner deletes every trie node and contract code which isn't reachable from
+// the state of the chain head, the states of the retained recent blocks or
+// the genesis state.
+//
+// Pruning runs in two phases. The retained states are first walked and their
+// nodes marked in a bloom filter, which is persisted to the data directory.
+// The database is then swept, deleting the unmarked nodes. An interrupted
+// prune is continued by running it again: the persisted filter is reused and
+// the sweep simply starts over, since only garbage is ever deleted.
+type Pruner struct {
+	db        ngindb.Database
+	bloomPath string
+	bloomSize uint64 // bloom filter size in bytes
+	retain    uint64 // number of recent states to keep besides the head
+}
+
+// NewPruner creates a pruner for the chain database, keeping its progress in
+// datadir. The bloom filter size is given in megabytes, larger filters leave
+// less garbage behind.
+func NewPruner(db ngindb.Database, datadir string, bloomSize, retain uint64) *Pruner {
+	if bloomSize < 1 {
+		bloomSize = 1
+	}
+	return &Pruner{
+		db:        db,
+		bloomPath: filepath.Join(datadir, bloomFileName),
+		bloomSize: bloomSize * 1024 * 1024,
+		retain:    retain,
+	}
+}
+
+// Prune marks the retained states, sweeps the unreachable nodes and compacts
+// the database.
+func (p *Pruner) Prune() error {
+	headHash := core.GetHeadBlockHash(p.db)
+	head := core.GetHeader(p.db, headHash)
+	if head == nil {
+		return fmt.Errorf("head block %x not found", headHash)
+	}
+	if ok, _ := p.db.Has(head.Root[:]); !ok {
+		return fmt.Errorf("state of head block #%d [%x…] missing, restart the node once to recover it", head.Number, headHash[:4])
+	}
+
+	bloom, marked, err := loadStateBloom(p.bloomPath)
+	switch {
+	case err == nil && marked == headHash:
+		glog.V(logger.Info).Infof("Resuming state prune at block #%d [%x…]", head.Number, headHash[:4])
+	case err == nil:
+		// The node ran since the filter was written, the new states must be
+		// marked on top of the old ones as the sweep may already be underway.
+		glog.V(logger.Info).Infof("Resuming state prune, chain head moved to #%d [%x…]", head.Number, headHash[:4])
+		if err := p.mark(bloom, head.Number.Uint64()); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		bloom = newStateBloom(p.bloomSize)
+		if err := p.mark(bloom, head.Number.Uint64()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("failed to load state bloom %s: %v", p.bloomPath, err)
+	}
+	if err := bloom.commit(p.bloomPath, headHash); err != nil {
+		return err
+	}
+
+	if err := p.sweep(bloom); err != nil {
+		return err
+	}
+	if err := p.compact(); err != nil {
+		return err
+	}
+
+	return os.Remove(p.bloomPath)
+}
+
+// mark adds every node of the retained canonical states up to block number
+// head, and of the genesis state, to the bloom filter.
+func (p *Pruner) mark(bloom *stateBloom, head uint64) error {
+	var (
+		start  = time.Now()
+		logged = time.Now()
+		nodes  int
+		states int
+	)
+	numbers := []uint64{0}
+	for n := head; n > 0 && head-n <= p.retain; n-- {
+		numbers = append(numbers, n)
+	}
+	for _, n := range numbers {
+		header := core.GetHeader(p.db, core.GetCanonicalHash(p.db, n))
+		if header == nil {
+			return fmt.Errorf("canonical block #%d not found", n)
+		}
+		if ok, _ := p.db.Has(header.Root[:]); !ok {
+			glog.V(logger.Debug).Infof("State of block #%d [%x…] missing, skipping", n, header.Root[:4])
+			continue
+		}
+		statedb, err := state.New(header.Root, state.NewDatabase(p.db))
+		if err != nil {
+			return err
+		}
+		it := state.NewNodeIterator(statedb)
+		for it.Next() {
+			if it.Hash != (common.Hash{}) {
+				bloom.add(it.Hash)
+				nodes++
+			}
+			if time.Since(logged) > logInterval {
+				glog.V(logger.Info).Infof("Marking state of block #%d: %d nodes marked in %d states, elapsed %v", n, nodes, states, time.Since(start))
+				logged = time.Now()
+			}
+		}
+		if it.Error != nil {
+			return fmt.Errorf("failed to iterate state of block #%d: %v", n, it.Error)
+		}
+		states++
+	}
+	glog.V(logger.Info).Infof("Marked %d nodes in %d states in %v", nodes, states, time.Since(start))
+	return nil
+}
+
+// compact reclaims the space of the deleted nodes.
+func (p *Pruner) compact() error {
+	start := time.Now()
+	glog.V(logger.Info).Infoln("Compacting database")
+	if err := p.db.Compact(nil, nil); err == ngindb.ErrCompactUnsupported {
+		glog.V(logger.Warn).Warnf("Database not compacted (%v), the space of the deleted nodes is left to later writes", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	glog.V(logger.Info).Infof("Database compacted in %v", time.Since(start))
+	return nil
+}
+
+// sweep deletes the trie nodes and codes not present in the bloom filter.
+// Entries of other kinds, including transactions which are also keyed by
+// their bare hash, are left alone.
+func (p *Pruner) sweep(bloom *stateBloom) error {
+	var (
+		start   = time.Now()
+		logged  = time.Now()
+		batch   = p.db.NewBatch()
+		checked int
+		deleted int
+		size    common.StorageSize
+	)
+	it := p.db.NewIterator()
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		checked++
+		if len(key) != common.HashLength || bloom.contains(common.BytesToHash(key)) {
+			continue
+		}
+		if ok, _ := p.db.Has(append(common.CopyBytes(key), txMetaSuffix...)); ok {
+			continue
+		}
+		if err := batch.Delete(common.CopyBytes(key)); err != nil {
+			return err
+		}
+		deleted++
+		size += common.StorageSize(len(key) + len(it.Value()))
+
+		if batch.ValueSize() >= ngindb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch = p.db.NewBatch()
+		}
+		if time.Since(logged) > logInterval {
+			glog.V(logger.Info).Infof("Sweeping state: %d entries checked, %d nodes (%v) deleted, elapsed %v", checked, deleted, size, time.Since(start))
+			logged = time.Now()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	glog.V(logger.Info).Infof("Swept state: %d entries checked, %d nodes (%v) deleted in %v", checked, deleted, size, time.Since(start))
+	return nil
+}
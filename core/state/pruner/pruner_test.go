@@ -0,0 +1,214 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package pruner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/state"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+var (
+	testBankKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	testBankAddr   = crypto.PubkeyToAddress(testBankKey.PublicKey)
+	testContract   = crypto.CreateAddress(testBankAddr, 0)
+
+	// testContractInit stores 42 at slot 1 and deploys the code 0x34600055,
+	// storing the value of every call at slot 0.
+	testContractInit = common.FromHex("602a600155633460005560005260046" + "01cf3")
+	testContractCode = common.FromHex("34600055")
+)
+
+// newPrunerTestChain returns an archive chain of n blocks, the first creating
+// the test contract and the others calling it with their number as value, so
+// that every block changes the account and storage tries.
+func newPrunerTestChain(t *testing.T, n int) (*core.BlockChain, ngindb.Database) {
+	db, _ := ngindb.NewMemDatabase()
+	genesis := core.WriteGenesisBlockForTesting(db, core.GenesisAccount{Address: testBankAddr, Balance: big.NewInt(1000000000)})
+	bc, err := core.NewBlockChain(db, core.DefaultConfigMainnet.ChainConfig, core.FakePow{}, new(event.TypeMux))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	extendPrunerTestChain(t, bc, db, genesis, n)
+	return bc, db
+}
+
+// extendPrunerTestChain adds n blocks on top of parent.
+func extendPrunerTestChain(t *testing.T, bc *core.BlockChain, db ngindb.Database, parent *types.Block, n int) {
+	blocks, _ := core.GenerateChain(core.DefaultConfigMainnet.ChainConfig, parent, db, n, func(i int, b *core.BlockGen) {
+		var tx *types.Transaction
+		if nonce := b.TxNonce(testBankAddr); nonce == 0 {
+			tx = types.NewContractCreation(nonce, new(big.Int), big.NewInt(200000), new(big.Int), testContractInit)
+		} else {
+			tx = types.NewTransaction(nonce, testContract, b.Number(), big.NewInt(100000), new(big.Int), nil)
+		}
+		tx, err := tx.SignECDSA(testBankKey)
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	if res := bc.InsertChain(blocks); res.Error != nil {
+		t.Fatalf("failed to insert chain: %v", res.Error)
+	}
+}
+
+// checkPrunerTestState checks that the state of block n is complete and holds
+// the contract with its code and storage.
+func checkPrunerTestState(t *testing.T, db ngindb.Database, n uint64) {
+	t.Helper()
+	header := core.GetHeader(db, core.GetCanonicalHash(db, n))
+	statedb, err := state.New(header.Root, state.NewDatabase(db))
+	if err != nil {
+		t.Fatalf("block #%d: state missing: %v", n, err)
+	}
+	it := state.NewNodeIterator(statedb)
+	for it.Next() {
+	}
+	if it.Error != nil {
+		t.Fatalf("block #%d: state incomplete: %v", n, it.Error)
+	}
+	if n == 0 {
+		return
+	}
+	if code := statedb.GetCode(testContract); !bytes.Equal(code, testContractCode) {
+		t.Errorf("block #%d: code mismatch: have %x, want %x", n, code, testContractCode)
+	}
+	if value := statedb.GetState(testContract, common.BigToHash(common.Big1)); value != common.BigToHash(big.NewInt(42)) {
+		t.Errorf("block #%d: slot 1 mismatch: have %x, want 42", n, value)
+	}
+	if n > 1 {
+		if value := statedb.GetState(testContract, common.Hash{}); value != common.BigToHash(new(big.Int).SetUint64(n)) {
+			t.Errorf("block #%d: slot 0 mismatch: have %x, want %d", n, value, n)
+		}
+	}
+}
+
+// checkPrunerTestTransactions checks that the transactions of blocks 1 to head
+// are retrievable.
+func checkPrunerTestTransactions(t *testing.T, db ngindb.Database, head uint64) {
+	t.Helper()
+	for n := uint64(1); n <= head; n++ {
+		block := core.GetBlock(db, core.GetCanonicalHash(db, n))
+		for _, tx := range block.Transactions() {
+			if have, hash, _, _ := core.GetTransaction(db, tx.Hash()); have == nil || hash != block.Hash() {
+				t.Errorf("block #%d: transaction %x lost", n, tx.Hash())
+			}
+		}
+	}
+}
+
+// Tests that pruning keeps the retained and genesis states, with their code
+// and storage, and the transactions keyed by their bare hash, dropping the
+// other states.
+func TestPrune(t *testing.T) {
+	bc, db := newPrunerTestChain(t, 10)
+	defer bc.Stop()
+
+	dir, err := ioutil.TempDir("", "pruner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	before := len(db.(*ngindb.MemDatabase).Keys())
+	if err := NewPruner(db, dir, 1, 2).Prune(); err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	if after := len(db.(*ngindb.MemDatabase).Keys()); after >= before {
+		t.Errorf("nothing pruned: %d entries before, %d after", before, after)
+	}
+	for _, n := range []uint64{0, 8, 9, 10} {
+		checkPrunerTestState(t, db, n)
+	}
+	for n := uint64(1); n < 8; n++ {
+		root := core.GetHeader(db, core.GetCanonicalHash(db, n)).Root
+		if ok, _ := db.Has(root[:]); ok {
+			t.Errorf("block #%d: state root kept", n)
+		}
+	}
+	checkPrunerTestTransactions(t, db, 10)
+
+	if _, err := os.Stat(filepath.Join(dir, bloomFileName)); !os.IsNotExist(err) {
+		t.Errorf("state bloom left behind: %v", err)
+	}
+}
+
+// Tests that pruning again after an interrupted sweep completes, also when
+// the chain moved on in between.
+func TestPruneResume(t *testing.T) {
+	bc, db := newPrunerTestChain(t, 10)
+	defer bc.Stop()
+
+	dir, err := ioutil.TempDir("", "pruner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Mark and sweep, crashing before the bloom is removed
+	p := NewPruner(db, dir, 1, 2)
+	bloom := newStateBloom(p.bloomSize)
+	if err := p.mark(bloom, 10); err != nil {
+		t.Fatalf("failed to mark: %v", err)
+	}
+	if err := bloom.commit(p.bloomPath, core.GetHeadBlockHash(db)); err != nil {
+		t.Fatalf("failed to persist bloom: %v", err)
+	}
+	if err := p.sweep(bloom); err != nil {
+		t.Fatalf("failed to sweep: %v", err)
+	}
+	checkPrunerTestState(t, db, 10)
+
+	// The node runs for a few blocks before pruning is run again
+	extendPrunerTestChain(t, bc, db, bc.CurrentBlock(), 3)
+	if err := NewPruner(db, dir, 1, 2).Prune(); err != nil {
+		t.Fatalf("failed to resume prune: %v", err)
+	}
+	for _, n := range []uint64{0, 10, 11, 12, 13} {
+		checkPrunerTestState(t, db, n)
+	}
+	checkPrunerTestTransactions(t, db, 13)
+
+	// And a prune on an unchanged chain after an interrupted one
+	if err := p.mark(bloom, 13); err != nil {
+		t.Fatalf("failed to mark: %v", err)
+	}
+	if err := bloom.commit(p.bloomPath, core.GetHeadBlockHash(db)); err != nil {
+		t.Fatalf("failed to persist bloom: %v", err)
+	}
+	if err := p.sweep(bloom); err != nil {
+		t.Fatalf("failed to sweep: %v", err)
+	}
+	if err := NewPruner(db, dir, 1, 2).Prune(); err != nil {
+		t.Fatalf("failed to resume prune: %v", err)
+	}
+	for _, n := range []uint64{0, 11, 12, 13} {
+		checkPrunerTestState(t, db, n)
+	}
+}
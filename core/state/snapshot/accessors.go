@@ -0,0 +1,103 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
+)
+
+var (
+	accountPrefix = []byte("sa") // accountPrefix + account hash -> account RLP
+	storagePrefix = []byte("ss") // storagePrefix + account hash + slot hash -> slot value RLP
+
+	rootKey      = []byte("SnapshotRoot")      // State root of the disk layer
+	generatorKey = []byte("SnapshotGenerator") // Progress of the disk layer generation
+)
+
+// generatorStatus is the persisted progress of the disk layer generation.
+type generatorStatus struct {
+	Done   bool
+	Marker []byte // Last account generated
+}
+
+func accountKey(hash common.Hash) []byte {
+	return append(append([]byte{}, accountPrefix...), hash[:]...)
+}
+
+func storageKey(accountHash, storageHash common.Hash) []byte {
+	key := append(append([]byte{}, storagePrefix...), accountHash[:]...)
+	return append(key, storageHash[:]...)
+}
+
+// IsKey reports whether the database key belongs to the state snapshot.
+func IsKey(key []byte) bool {
+	switch {
+	case len(key) == len(accountPrefix)+common.HashLength && bytes.HasPrefix(key, accountPrefix):
+		return true
+	case len(key) == len(storagePrefix)+2*common.HashLength && bytes.HasPrefix(key, storagePrefix):
+		return true
+	}
+	return bytes.Equal(key, rootKey) || bytes.Equal(key, generatorKey)
+}
+
+func readRoot(db ngindb.Database) common.Hash {
+	data, _ := db.Get(rootKey)
+	return common.BytesToHash(data)
+}
+
+func writeRoot(db ngindb.Putter, root common.Hash) error {
+	return db.Put(rootKey, root[:])
+}
+
+func readGenerator(db ngindb.Database) (*generatorStatus, error) {
+	data, err := db.Get(generatorKey)
+	if err != nil {
+		return nil, err
+	}
+	status := new(generatorStatus)
+	if err := rlp.DecodeBytes(data, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// writeGenerator persists the generation progress, a nil marker meaning it's
+// done.
+func writeGenerator(db ngindb.Putter, marker []byte) error {
+	enc, err := rlp.EncodeToBytes(&generatorStatus{Done: marker == nil, Marker: marker})
+	if err != nil {
+		return err
+	}
+	return db.Put(generatorKey, enc)
+}
+
+// wipeStorage adds the deletion of every storage slot of the account to batch.
+func wipeStorage(db ngindb.Database, batch ngindb.Batch, accountHash common.Hash) error {
+	it := db.NewIteratorWithPrefix(append(append([]byte{}, storagePrefix...), accountHash[:]...))
+	defer it.Release()
+
+	for it.Next() {
+		if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
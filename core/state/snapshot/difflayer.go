@@ -0,0 +1,95 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"sync"
+
+	"github.com/NginProject/ngind/common"
+)
+
+// diffLayer is an in-memory layer holding the entries changed by one block
+// on top of its parent layer.
+type diffLayer struct {
+	parent Snapshot // Layer below, either a diff or the disk layer
+	root   common.Hash
+
+	destructs map[common.Hash]struct{}               // Accounts deleted or recreated, their storage below is void
+	accounts  map[common.Hash][]byte                 // Accounts changed, by account hash
+	storage   map[common.Hash]map[common.Hash][]byte // Slots changed, by account and slot hash, nil if deleted
+
+	stale bool // Whether the layer was merged into the disk layer or dropped
+	lock  sync.RWMutex
+}
+
+// Root returns the state root of the layer.
+func (dl *diffLayer) Root() common.Hash {
+	return dl.root
+}
+
+// AccountRLP returns the RLP encoded account, looking it up in the layers
+// below if the block didn't change it.
+func (dl *diffLayer) AccountRLP(hash common.Hash) ([]byte, error) {
+	dl.lock.RLock()
+	if dl.stale {
+		dl.lock.RUnlock()
+		return nil, ErrSnapshotStale
+	}
+	if blob, ok := dl.accounts[hash]; ok {
+		dl.lock.RUnlock()
+		return blob, nil
+	}
+	if _, ok := dl.destructs[hash]; ok {
+		dl.lock.RUnlock()
+		return nil, nil
+	}
+	parent := dl.parent
+	dl.lock.RUnlock()
+
+	return parent.AccountRLP(hash)
+}
+
+// Storage returns the RLP encoded value of a storage slot, looking it up in
+// the layers below if the block didn't change it.
+func (dl *diffLayer) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	dl.lock.RLock()
+	if dl.stale {
+		dl.lock.RUnlock()
+		return nil, ErrSnapshotStale
+	}
+	if slots, ok := dl.storage[accountHash]; ok {
+		if value, ok := slots[storageHash]; ok {
+			dl.lock.RUnlock()
+			return value, nil
+		}
+	}
+	if _, ok := dl.destructs[accountHash]; ok {
+		dl.lock.RUnlock()
+		return nil, nil
+	}
+	parent := dl.parent
+	dl.lock.RUnlock()
+
+	return parent.Storage(accountHash, storageHash)
+}
+
+// markStale flags the layer as no longer part of the tree.
+func (dl *diffLayer) markStale() {
+	dl.lock.Lock()
+	dl.stale = true
+	dl.lock.Unlock()
+}
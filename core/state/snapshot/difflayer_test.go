@@ -0,0 +1,250 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+var (
+	testAccA  = common.HexToHash("0x0a")
+	testAccB  = common.HexToHash("0x0b")
+	testAccC  = common.HexToHash("0x0c")
+	testSlot1 = common.HexToHash("0x01")
+	testSlot2 = common.HexToHash("0x02")
+
+	testRoot0 = common.HexToHash("0xf0")
+	testRoot1 = common.HexToHash("0xf1")
+	testRoot2 = common.HexToHash("0xf2")
+	testRoot3 = common.HexToHash("0xf3")
+	testSide2 = common.HexToHash("0xe2")
+)
+
+// newTestTree returns a tree of a generated disk layer at testRoot0 holding
+// the accounts A and B with a slot each, and the diff layers:
+//
+//	root1: A changed, slot A/1 deleted, slot A/2 set
+//	root2: B destructed, C created
+//	root3: C changed
+//	side2: on top of root1, B changed
+func newTestTree(t *testing.T) (*Tree, *ngindb.MemDatabase) {
+	db, _ := ngindb.NewMemDatabase()
+	db.Put(accountKey(testAccA), []byte("a0"))
+	db.Put(accountKey(testAccB), []byte("b0"))
+	db.Put(storageKey(testAccA, testSlot1), []byte("a0/1"))
+	db.Put(storageKey(testAccB, testSlot1), []byte("b0/1"))
+	writeRoot(db, testRoot0)
+	writeGenerator(db, nil)
+
+	tree := New(db, nil, testRoot0)
+
+	updates := []struct {
+		root, parent common.Hash
+		destructs    map[common.Hash]struct{}
+		accounts     map[common.Hash][]byte
+		storage      map[common.Hash]map[common.Hash][]byte
+	}{
+		{testRoot1, testRoot0, nil,
+			map[common.Hash][]byte{testAccA: []byte("a1")},
+			map[common.Hash]map[common.Hash][]byte{testAccA: {testSlot1: nil, testSlot2: []byte("a1/2")}}},
+		{testRoot2, testRoot1, map[common.Hash]struct{}{testAccB: {}},
+			map[common.Hash][]byte{testAccC: []byte("c2")},
+			map[common.Hash]map[common.Hash][]byte{testAccC: {testSlot1: []byte("c2/1")}}},
+		{testRoot3, testRoot2, nil,
+			map[common.Hash][]byte{testAccC: []byte("c3")}, nil},
+		{testSide2, testRoot1, nil,
+			map[common.Hash][]byte{testAccB: []byte("b2'")}, nil},
+	}
+	for _, u := range updates {
+		if err := tree.Update(u.root, u.parent, u.destructs, u.accounts, u.storage); err != nil {
+			t.Fatalf("failed to add layer %x: %v", u.root[:1], err)
+		}
+	}
+	return tree, db
+}
+
+// checkAccount fails if the account read from the snapshot isn't want, nil
+// meaning missing.
+func checkAccount(t *testing.T, snap Snapshot, hash common.Hash, want []byte) {
+	t.Helper()
+	blob, err := snap.AccountRLP(hash)
+	if err != nil {
+		t.Fatalf("layer %x: failed to read account %x: %v", snap.Root().Bytes()[31:], hash.Bytes()[31:], err)
+	}
+	if string(blob) != string(want) {
+		t.Errorf("layer %x: account %x mismatch: have %q, want %q", snap.Root().Bytes()[31:], hash.Bytes()[31:], blob, want)
+	}
+}
+
+// checkStorage fails if the slot read from the snapshot isn't want, nil
+// meaning missing.
+func checkStorage(t *testing.T, snap Snapshot, account, slot common.Hash, want []byte) {
+	t.Helper()
+	value, err := snap.Storage(account, slot)
+	if err != nil {
+		t.Fatalf("layer %x: failed to read slot %x/%x: %v", snap.Root().Bytes()[31:], account.Bytes()[31:], slot.Bytes()[31:], err)
+	}
+	if string(value) != string(want) {
+		t.Errorf("layer %x: slot %x/%x mismatch: have %q, want %q", snap.Root().Bytes()[31:], account.Bytes()[31:], slot.Bytes()[31:], value, want)
+	}
+}
+
+// checkTestLayers checks the reads of the layers of the test tree above the
+// disk layer.
+func checkTestLayers(t *testing.T, tree *Tree, roots ...common.Hash) {
+	t.Helper()
+	for _, root := range roots {
+		snap := tree.Snapshot(root)
+		if snap == nil {
+			t.Fatalf("layer %x missing", root[31:])
+		}
+		switch root {
+		case testRoot1:
+			checkAccount(t, snap, testAccA, []byte("a1"))
+			checkAccount(t, snap, testAccB, []byte("b0"))
+			checkAccount(t, snap, testAccC, nil)
+			checkStorage(t, snap, testAccA, testSlot1, nil)
+			checkStorage(t, snap, testAccA, testSlot2, []byte("a1/2"))
+			checkStorage(t, snap, testAccB, testSlot1, []byte("b0/1"))
+		case testRoot2, testRoot3:
+			checkAccount(t, snap, testAccA, []byte("a1"))
+			checkAccount(t, snap, testAccB, nil)
+			checkStorage(t, snap, testAccA, testSlot1, nil)
+			checkStorage(t, snap, testAccA, testSlot2, []byte("a1/2"))
+			checkStorage(t, snap, testAccB, testSlot1, nil)
+			checkStorage(t, snap, testAccC, testSlot1, []byte("c2/1"))
+			if root == testRoot2 {
+				checkAccount(t, snap, testAccC, []byte("c2"))
+			} else {
+				checkAccount(t, snap, testAccC, []byte("c3"))
+			}
+		case testSide2:
+			checkAccount(t, snap, testAccB, []byte("b2'"))
+			checkAccount(t, snap, testAccC, nil)
+			checkStorage(t, snap, testAccB, testSlot1, []byte("b0/1"))
+		}
+	}
+}
+
+// Tests that diff layers serve the entries they changed, deleted slots and
+// destructed accounts included, and fall through to the layers below for the
+// others.
+func TestDiffLayerReads(t *testing.T) {
+	tree, _ := newTestTree(t)
+	defer tree.Stop()
+
+	checkTestLayers(t, tree, testRoot1, testRoot2, testRoot3, testSide2)
+
+	disk := tree.Snapshot(testRoot0)
+	checkAccount(t, disk, testAccA, []byte("a0"))
+	checkStorage(t, disk, testAccA, testSlot1, []byte("a0/1"))
+
+	// Layers need their parent, and are added once
+	if err := tree.Update(common.HexToHash("0xff"), common.HexToHash("0xee"), nil, nil, nil); err == nil {
+		t.Errorf("layer without parent added")
+	}
+	if err := tree.Update(testRoot1, testRoot0, nil, map[common.Hash][]byte{testAccA: []byte("other")}, nil); err != nil {
+		t.Fatalf("failed to re-add layer: %v", err)
+	}
+	checkAccount(t, tree.Snapshot(testRoot1), testAccA, []byte("a1"))
+}
+
+// Tests that capping the tree merges the layers below the kept ones into the
+// disk layer, persisting their changes, and drops the side chains forking off
+// below the new disk layer.
+func TestDiffLayerCap(t *testing.T) {
+	tree, db := newTestTree(t)
+	defer tree.Stop()
+
+	oldDisk, oldRoot1 := tree.Snapshot(testRoot0), tree.Snapshot(testRoot1)
+
+	// More layers kept than there are is a no-op
+	if err := tree.Cap(testRoot3, 3); err != nil {
+		t.Fatalf("failed to cap: %v", err)
+	}
+	checkTestLayers(t, tree, testRoot1, testRoot2, testRoot3, testSide2)
+
+	if err := tree.Cap(testRoot3, 1); err != nil {
+		t.Fatalf("failed to cap: %v", err)
+	}
+	if readRoot(db) != testRoot2 {
+		t.Fatalf("disk layer root mismatch: have %x, want %x", readRoot(db), testRoot2)
+	}
+	disk := tree.Snapshot(testRoot2)
+	if _, ok := disk.(*diskLayer); !ok {
+		t.Fatalf("layer %x not merged into the disk layer: %T", testRoot2[31:], disk)
+	}
+	checkTestLayers(t, tree, testRoot2, testRoot3)
+
+	// The merged entries are persisted, the destructed storage wiped
+	for key, want := range map[string]string{
+		string(accountKey(testAccA)):            "a1",
+		string(accountKey(testAccB)):            "",
+		string(accountKey(testAccC)):            "c2",
+		string(storageKey(testAccA, testSlot1)): "",
+		string(storageKey(testAccA, testSlot2)): "a1/2",
+		string(storageKey(testAccB, testSlot1)): "",
+		string(storageKey(testAccC, testSlot1)): "c2/1",
+	} {
+		if have, _ := db.Get([]byte(key)); string(have) != want {
+			t.Errorf("entry %x mismatch: have %q, want %q", key, have, want)
+		}
+	}
+	// The merged layers, the former disk layer and the side chain are gone
+	for _, root := range []common.Hash{testRoot0, testRoot1, testSide2} {
+		if tree.Snapshot(root) != nil {
+			t.Errorf("layer %x left in tree", root[31:])
+		}
+	}
+	for _, snap := range []Snapshot{oldDisk, oldRoot1} {
+		if _, err := snap.AccountRLP(testAccA); err != ErrSnapshotStale {
+			t.Errorf("layer %x not stale: %v", snap.Root().Bytes()[31:], err)
+		}
+	}
+	// Capping at a disk layer is a no-op
+	if err := tree.Cap(testRoot2, 0); err != nil {
+		t.Fatalf("failed to cap disk layer: %v", err)
+	}
+	if err := tree.Cap(testRoot3, 0); err != nil {
+		t.Fatalf("failed to cap: %v", err)
+	}
+	if _, ok := tree.Snapshot(testRoot3).(*diskLayer); !ok {
+		t.Fatalf("layer %x not merged into the disk layer", testRoot3[31:])
+	}
+	checkAccount(t, tree.Snapshot(testRoot3), testAccC, []byte("c3"))
+}
+
+// Tests that the disk layer refuses reads of accounts the generation hasn't
+// reached yet.
+func TestDiskLayerCoverage(t *testing.T) {
+	db, _ := ngindb.NewMemDatabase()
+	db.Put(accountKey(testAccA), []byte("a0"))
+	db.Put(accountKey(testAccC), []byte("c0"))
+
+	dl := &diskLayer{db: db, root: testRoot0, genMarker: testAccB[:]}
+	checkAccount(t, dl, testAccA, []byte("a0"))
+	checkAccount(t, dl, testAccB, nil)
+	if _, err := dl.AccountRLP(testAccC); err != ErrNotCovered {
+		t.Errorf("account beyond the marker served: %v", err)
+	}
+	if _, err := dl.Storage(testAccC, testSlot1); err != ErrNotCovered {
+		t.Errorf("slot beyond the marker served: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/trie"
+)
+
+// diskLayer is the bottom layer of the snapshot, persisted in the database.
+type diskLayer struct {
+	db     ngindb.Database
+	triedb trie.Database
+	root   common.Hash
+
+	genMarker []byte             // Last account generated, nil once the generation is done
+	genAbort  chan chan struct{} // Channel stopping the generator, nil if none runs
+
+	stale bool // Whether the layer was superseded by a newer disk layer
+	lock  sync.RWMutex
+}
+
+// Root returns the state root of the layer.
+func (dl *diskLayer) Root() common.Hash {
+	return dl.root
+}
+
+// AccountRLP returns the RLP encoded account from the database.
+func (dl *diskLayer) AccountRLP(hash common.Hash) ([]byte, error) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.stale {
+		return nil, ErrSnapshotStale
+	}
+	if !covered(dl.genMarker, hash) {
+		return nil, ErrNotCovered
+	}
+	blob, _ := dl.db.Get(accountKey(hash))
+	return blob, nil
+}
+
+// Storage returns the RLP encoded value of a storage slot from the database.
+func (dl *diskLayer) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.stale {
+		return nil, ErrSnapshotStale
+	}
+	if !covered(dl.genMarker, accountHash) {
+		return nil, ErrNotCovered
+	}
+	blob, _ := dl.db.Get(storageKey(accountHash, storageHash))
+	return blob, nil
+}
+
+// covered reports whether the generation up to marker produced the entries of
+// the account. Accounts are generated in hash order along with their storage.
+func covered(marker []byte, hash common.Hash) bool {
+	return marker == nil || bytes.Compare(hash[:], marker) <= 0
+}
+
+// startGeneration runs the generator of the layer's missing entries.
+func (dl *diskLayer) startGeneration() {
+	dl.genAbort = make(chan chan struct{})
+	go dl.generate()
+}
+
+// stopGeneration interrupts the generator, if any, and waits until it has
+// persisted its progress.
+func (dl *diskLayer) stopGeneration() {
+	if dl.genAbort == nil {
+		return
+	}
+	abort := make(chan struct{})
+	dl.genAbort <- abort
+	<-abort
+	dl.genAbort = nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/rlp"
+	"github.com/NginProject/ngind/trie"
+)
+
+// generateLogInterval is the interval between generation progress logs.
+const generateLogInterval = 8 * time.Second
+
+// generate fills the disk layer with the accounts and storage of its state
+// trie, resuming after the generation marker. It runs until stopped through
+// genAbort, also once done or stalled; a generation stalls when the state trie
+// is unavailable, such as pruned, and resumes when the next disk layer is
+// created.
+func (dl *diskLayer) generate() {
+	var (
+		start    = time.Now()
+		logged   = time.Now()
+		marker   = dl.genMarker
+		batch    = dl.db.NewBatch()
+		accounts int
+		slots    int
+	)
+	// Only the generator updates the marker, it's safe to read unlocked.
+	// Starting from scratch, remove the leftovers of the previous snapshot.
+	if len(marker) == 0 {
+		if abort := dl.wipe(); abort != nil {
+			close(abort)
+			return
+		}
+	}
+	stall := func(err error) {
+		glog.V(logger.Warn).Warnf("State snapshot generation stalled at root %x…: %v", dl.root[:4], err)
+		dl.flush(batch, marker)
+		abort := <-dl.genAbort
+		close(abort)
+	}
+	accTrie, err := trie.NewSecure(dl.root, dl.triedb, 0)
+	if err != nil {
+		stall(err)
+		return
+	}
+	// The account at the marker is done, start right after it. Its storage may
+	// also have been partially written by an interrupted pass, clear it first.
+	var origin []byte
+	if len(marker) > 0 {
+		if origin = nextKey(marker); origin == nil {
+			dl.flush(batch, nil)
+			abort := <-dl.genAbort
+			close(abort)
+			return
+		}
+	}
+	it := trie.NewIterator(accTrie.NodeIterator(origin))
+	for it.Next() {
+		select {
+		case abort := <-dl.genAbort:
+			dl.flush(batch, marker)
+			close(abort)
+			return
+		default:
+		}
+		hash := common.BytesToHash(it.Key)
+		if origin != nil {
+			if err := wipeStorage(dl.db, batch, hash); err != nil {
+				stall(err)
+				return
+			}
+			origin = nil
+		}
+		if err := batch.Put(accountKey(hash), common.CopyBytes(it.Value)); err != nil {
+			stall(err)
+			return
+		}
+		var account Account
+		if err := rlp.DecodeBytes(it.Value, &account); err != nil {
+			stall(err)
+			return
+		}
+		if account.Root != emptyRoot {
+			stTrie, err := trie.NewSecure(account.Root, dl.triedb, 0)
+			if err != nil {
+				stall(err)
+				return
+			}
+			stIt := trie.NewIterator(stTrie.NodeIterator(nil))
+			for stIt.Next() {
+				if err := batch.Put(storageKey(hash, common.BytesToHash(stIt.Key)), common.CopyBytes(stIt.Value)); err != nil {
+					stall(err)
+					return
+				}
+				slots++
+
+				// Large storage may be written out ahead of the marker, it is
+				// not served until the account is complete.
+				if batch.ValueSize() > ngindb.IdealBatchSize {
+					if err := batch.Write(); err != nil {
+						stall(err)
+						return
+					}
+					batch = dl.db.NewBatch()
+				}
+			}
+			if stIt.Err != nil {
+				stall(stIt.Err)
+				return
+			}
+		}
+		accounts++
+		marker = hash[:]
+
+		if batch.ValueSize() > ngindb.IdealBatchSize {
+			dl.flush(batch, marker)
+			batch = dl.db.NewBatch()
+		}
+		if time.Since(logged) > generateLogInterval {
+			glog.V(logger.Info).Infof("Generating state snapshot: %d accounts, %d slots, at %x…, elapsed %v", accounts, slots, marker[:4], time.Since(start))
+			logged = time.Now()
+		}
+	}
+	if it.Err != nil {
+		stall(it.Err)
+		return
+	}
+	dl.flush(batch, nil)
+	glog.V(logger.Info).Infof("Generated state snapshot at root %x…: %d accounts, %d slots, elapsed %v", dl.root[:4], accounts, slots, time.Since(start))
+
+	abort := <-dl.genAbort
+	close(abort)
+}
+
+// flush writes the generated entries along with the progress marker and
+// exposes them to readers.
+func (dl *diskLayer) flush(batch ngindb.Batch, marker []byte) {
+	if err := writeGenerator(batch, marker); err != nil {
+		glog.V(logger.Error).Errorf("Failed to write state snapshot progress: %v", err)
+		return
+	}
+	if err := batch.Write(); err != nil {
+		glog.V(logger.Error).Errorf("Failed to write state snapshot: %v", err)
+		return
+	}
+	dl.lock.Lock()
+	dl.genMarker = marker
+	dl.lock.Unlock()
+}
+
+// wipe deletes every entry of the snapshot. It returns the abort request if
+// interrupted.
+func (dl *diskLayer) wipe() chan struct{} {
+	for _, prefix := range [][]byte{accountPrefix, storagePrefix} {
+		it := dl.db.NewIteratorWithPrefix(prefix)
+		batch := dl.db.NewBatch()
+		for it.Next() {
+			batch.Delete(common.CopyBytes(it.Key()))
+			if batch.ValueSize() < ngindb.IdealBatchSize {
+				continue
+			}
+			if err := batch.Write(); err != nil {
+				glog.V(logger.Error).Errorf("Failed to wipe state snapshot: %v", err)
+			}
+			batch = dl.db.NewBatch()
+
+			select {
+			case abort := <-dl.genAbort:
+				it.Release()
+				return abort
+			default:
+			}
+		}
+		it.Release()
+		if err := batch.Write(); err != nil {
+			glog.V(logger.Error).Errorf("Failed to wipe state snapshot: %v", err)
+		}
+	}
+	return nil
+}
+
+// nextKey returns the key following key in byte order among the keys of the
+// same length, nil if there is none.
+func nextKey(key []byte) []byte {
+	next := common.CopyBytes(key)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+// Package snapshot implements a flat key-value snapshot of the state, serving
+// account and storage reads without walking the state trie.
+//
+// The snapshot is a tree of layers. At its bottom, the disk layer holds the
+// accounts and storage slots of one state in the database, keyed by account
+// hash and slot hash. Each block committed on top adds an in-memory diff layer
+// holding the entries it changed. Diff layers are merged into the disk layer
+// once they are deep enough in the chain that no reorg reaches them anymore.
+//
+// When the disk layer is missing, or doesn't match the chain head, it is
+// rebuilt from the state trie in the background. Until the generation is done,
+// reads of the entries it has not reached yet fail with ErrNotCovered and must
+// be served from the trie.
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/trie"
+)
+
+var (
+	// ErrNotCovered is returned when reading an entry the background
+	// generation of the disk layer has not reached yet.
+	ErrNotCovered = errors.New("snapshot not yet generated")
+
+	// ErrSnapshotStale is returned when reading a layer which was merged into
+	// a newer disk layer or dropped from the tree.
+	ErrSnapshotStale = errors.New("snapshot stale")
+)
+
+// emptyRoot is the known root hash of an empty trie.
+var emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+// Account is the consensus representation of accounts, as stored in the
+// account trie and the snapshot.
+type Account struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// Snapshot is the state of the accounts and storage at a given state root.
+// Entries are returned in the encoding of the state trie leaves, nil if they
+// don't exist.
+type Snapshot interface {
+	// Root returns the state root the snapshot represents.
+	Root() common.Hash
+
+	// AccountRLP returns the RLP encoded account of the given account hash.
+	AccountRLP(hash common.Hash) ([]byte, error)
+
+	// Storage returns the RLP encoded value of a storage slot, given the
+	// hashes of the account and the slot key.
+	Storage(accountHash, storageHash common.Hash) ([]byte, error)
+}
+
+// Tree is the set of snapshot layers built on top of the disk layer, one for
+// every recent state. It is safe for concurrent use.
+type Tree struct {
+	db     ngindb.Database // Database holding the disk layer
+	triedb trie.Database   // Database of the state tries, used to generate the disk layer
+	layers map[common.Hash]Snapshot
+	lock   sync.RWMutex
+}
+
+// New opens the snapshot persisted in db. If it is missing or doesn't match
+// the state of the given root, it is rebuilt from the state trie in the
+// background; an interrupted generation is resumed.
+func New(db ngindb.Database, triedb trie.Database, root common.Hash) *Tree {
+	t := &Tree{
+		db:     db,
+		triedb: triedb,
+		layers: make(map[common.Hash]Snapshot),
+	}
+	status, err := readGenerator(db)
+	if err != nil || readRoot(db) != root {
+		glog.V(logger.Info).Infof("State snapshot missing or outdated, rebuilding at root %x…", root[:4])
+		t.rebuild(root)
+		return t
+	}
+	dl := &diskLayer{db: db, triedb: triedb, root: root}
+	if !status.Done {
+		dl.genMarker = append([]byte{}, status.Marker...)
+		glog.V(logger.Info).Infof("Resuming state snapshot generation at root %x…", root[:4])
+		dl.startGeneration()
+	}
+	t.layers[root] = dl
+	return t
+}
+
+// Snapshot returns the snapshot of the given state root, or nil if the tree
+// doesn't have it.
+func (t *Tree) Snapshot(root common.Hash) Snapshot {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.layers[root]
+}
+
+// Update adds a diff layer for the state root built on top of the parent
+// state, holding the accounts and storage slots changed between them. The
+// destructed accounts have their storage wiped before the changes apply,
+// nil storage values are deleted slots. The tree takes ownership of the maps.
+func (t *Tree) Update(root, parent common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+	if root == parent {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	base := t.layers[parent]
+	if base == nil {
+		return fmt.Errorf("parent snapshot %x… missing", parent[:4])
+	}
+	if _, ok := t.layers[root]; ok {
+		return nil
+	}
+	t.layers[root] = &diffLayer{
+		parent:    base,
+		root:      root,
+		destructs: destructs,
+		accounts:  accounts,
+		storage:   storage,
+	}
+	return nil
+}
+
+// Cap keeps at most the given number of diff layers below the state root,
+// merging the older ones into the disk layer. Layers which are not built on
+// top of the new disk layer, such as the side chains forking off below it,
+// are dropped.
+func (t *Tree) Cap(root common.Hash, layers int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	snap := t.layers[root]
+	if snap == nil {
+		return fmt.Errorf("snapshot %x… missing", root[:4])
+	}
+	diff, ok := snap.(*diffLayer)
+	if !ok {
+		return nil
+	}
+	for i := 0; i < layers; i++ {
+		parent, ok := diff.parent.(*diffLayer)
+		if !ok {
+			return nil
+		}
+		diff = parent
+	}
+	base, err := t.flatten(diff)
+	if err != nil {
+		return err
+	}
+	// Attach the children of the merged layer to the new disk layer and drop
+	// whatever no longer descends from it.
+	for _, snap := range t.layers {
+		if child, ok := snap.(*diffLayer); ok {
+			child.lock.Lock()
+			if child.parent == Snapshot(diff) {
+				child.parent = base
+			}
+			child.lock.Unlock()
+		}
+	}
+	retained := map[common.Hash]Snapshot{base.root: base}
+	for root, snap := range t.layers {
+		if child, ok := snap.(*diffLayer); ok {
+			if descends(child, base) {
+				retained[root] = child
+			} else {
+				child.markStale()
+			}
+		}
+	}
+	t.layers = retained
+	return nil
+}
+
+// descends reports whether the diff layer is built on top of the disk layer.
+func descends(dl *diffLayer, base *diskLayer) bool {
+	for {
+		dl.lock.RLock()
+		parent, stale := dl.parent, dl.stale
+		dl.lock.RUnlock()
+
+		if stale {
+			return false
+		}
+		switch parent := parent.(type) {
+		case *diskLayer:
+			return parent == base
+		case *diffLayer:
+			dl = parent
+		default:
+			return false
+		}
+	}
+}
+
+// flatten merges the diff layer and all those below it into the disk layer,
+// returning the disk layer of the diff layer's root. The merged layers and the
+// previous disk layer become stale.
+func (t *Tree) flatten(top *diffLayer) (*diskLayer, error) {
+	var (
+		diffs []*diffLayer
+		disk  *diskLayer
+	)
+	for snap := Snapshot(top); disk == nil; {
+		switch dl := snap.(type) {
+		case *diffLayer:
+			diffs = append(diffs, dl)
+			snap = dl.parent
+		case *diskLayer:
+			disk = dl
+		}
+	}
+	// Combine the changes, oldest first
+	var (
+		destructs = make(map[common.Hash]struct{})
+		accounts  = make(map[common.Hash][]byte)
+		storage   = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	for i := len(diffs) - 1; i >= 0; i-- {
+		dl := diffs[i]
+		dl.markStale()
+
+		for hash := range dl.destructs {
+			destructs[hash] = struct{}{}
+			delete(accounts, hash)
+			delete(storage, hash)
+		}
+		for hash, blob := range dl.accounts {
+			accounts[hash] = blob
+		}
+		for hash, slots := range dl.storage {
+			merged := storage[hash]
+			if merged == nil {
+				merged = make(map[common.Hash][]byte)
+				storage[hash] = merged
+			}
+			for slot, value := range slots {
+				merged[slot] = value
+			}
+		}
+	}
+	// Stop the generator and invalidate the disk layer before touching the
+	// entries it serves.
+	disk.stopGeneration()
+	disk.lock.Lock()
+	disk.stale = true
+	marker := disk.genMarker
+	disk.lock.Unlock()
+
+	// Write the changes in a single batch, the disk layer stays consistent if
+	// the node goes down meanwhile. Entries beyond the generation marker are
+	// left to the generator.
+	batch := t.db.NewBatch()
+	for hash := range destructs {
+		if err := batch.Delete(accountKey(hash)); err != nil {
+			return nil, err
+		}
+		if err := wipeStorage(t.db, batch, hash); err != nil {
+			return nil, err
+		}
+	}
+	for hash, blob := range accounts {
+		if !covered(marker, hash) {
+			continue
+		}
+		if err := batch.Put(accountKey(hash), blob); err != nil {
+			return nil, err
+		}
+	}
+	for hash, slots := range storage {
+		if !covered(marker, hash) {
+			continue
+		}
+		for slot, value := range slots {
+			var err error
+			if value == nil {
+				err = batch.Delete(storageKey(hash, slot))
+			} else {
+				err = batch.Put(storageKey(hash, slot), value)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := writeRoot(batch, top.root); err != nil {
+		return nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	base := &diskLayer{db: t.db, triedb: t.triedb, root: top.root, genMarker: marker}
+	if marker != nil {
+		base.startGeneration()
+	}
+	return base, nil
+}
+
+// Rebuild drops every layer and regenerates the disk layer from the state
+// trie of the given root in the background.
+func (t *Tree) Rebuild(root common.Hash) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.rebuild(root)
+}
+
+func (t *Tree) rebuild(root common.Hash) {
+	for _, snap := range t.layers {
+		switch dl := snap.(type) {
+		case *diskLayer:
+			dl.stopGeneration()
+			dl.lock.Lock()
+			dl.stale = true
+			dl.lock.Unlock()
+		case *diffLayer:
+			dl.markStale()
+		}
+	}
+	// An empty marker makes the generator wipe the previous snapshot first.
+	// Persist it right away so that a restart won't trust the old entries.
+	batch := t.db.NewBatch()
+	if err := writeRoot(batch, root); err != nil {
+		glog.V(logger.Error).Errorf("Failed to reset state snapshot: %v", err)
+	}
+	if err := writeGenerator(batch, []byte{}); err != nil {
+		glog.V(logger.Error).Errorf("Failed to reset state snapshot: %v", err)
+	}
+	if err := batch.Write(); err != nil {
+		glog.V(logger.Error).Errorf("Failed to reset state snapshot: %v", err)
+	}
+	dl := &diskLayer{db: t.db, triedb: t.triedb, root: root, genMarker: []byte{}}
+	dl.startGeneration()
+	t.layers = map[common.Hash]Snapshot{root: dl}
+}
+
+// Stop interrupts the background generation, persisting its progress. The
+// diff layers are not persisted, merge them into the disk layer beforehand
+// with Cap to keep them.
+func (t *Tree) Stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, snap := range t.layers {
+		if dl, ok := snap.(*diskLayer); ok {
+			dl.stopGeneration()
+		}
+	}
+}
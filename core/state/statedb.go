@@ -24,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/state/snapshot"
 	"github.com/NginProject/ngind/core/vm"
 	"github.com/NginProject/ngind/crypto"
 	"github.com/NginProject/ngind/logger"
@@ -32,6 +33,16 @@ import (
 	"github.com/NginProject/ngind/trie"
 )
 
+// InternalTx is a value transfer or contract creation made by a contract
+// during the execution of a transaction, as opposed to by the transaction
+// itself.
+type InternalTx struct {
+	From   common.Address
+	To     common.Address // Recipient, or address of the created contract
+	Value  *big.Int
+	Create bool
+}
+
 // The starting nonce determines the default nonce when new accounts are being
 // created.
 var StartingNonce uint64
@@ -66,6 +77,14 @@ type StateDB struct {
 	trie      Trie
 	pastTries []*trie.SecureTrie
 
+	// Flat state snapshot, read before the trie when available. The accounts
+	// and storage changed are collected to update it on commit.
+	snaps         *snapshot.Tree
+	snap          snapshot.Snapshot
+	snapDestructs map[common.Hash]struct{}
+	snapAccounts  map[common.Hash][]byte
+	snapStorage   map[common.Hash]map[common.Hash][]byte
+
 	// DB error.
 	// State objects are used by the consensus core and VM which are
 	// unable to deal with database-level errors. Any error that occurs
@@ -84,6 +103,11 @@ type StateDB struct {
 	txIndex      int
 	logs         map[common.Hash]vm.Logs
 	logSize      uint
+	internalTxs  map[common.Hash][]*InternalTx
+
+	// Balances of the accounts before their first change since the state was
+	// opened or reset, collected along with the journal.
+	balanceOrigins map[common.Address]*big.Int
 
 	// Journal of state modifications. This is the backbone of
 	// Snapshot and RevertToSnapshot.
@@ -113,6 +137,32 @@ func New(root common.Hash, db Database) (*StateDB, error) {
 	}, nil
 }
 
+// NewWithSnapshot creates a new state from a given trie, reading it from the
+// snapshot tree when it holds the state.
+func NewWithSnapshot(root common.Hash, db Database, snaps *snapshot.Tree) (*StateDB, error) {
+	statedb, err := New(root, db)
+	if err != nil {
+		return nil, err
+	}
+	if snaps != nil {
+		statedb.snaps = snaps
+		statedb.openSnapshot(root)
+	}
+	return statedb, nil
+}
+
+// openSnapshot looks up the snapshot of the state root, resetting the
+// collected changes.
+func (self *StateDB) openSnapshot(root common.Hash) {
+	self.snap = self.snaps.Snapshot(root)
+	self.snapDestructs, self.snapAccounts, self.snapStorage = nil, nil, nil
+	if self.snap != nil {
+		self.snapDestructs = make(map[common.Hash]struct{})
+		self.snapAccounts = make(map[common.Hash][]byte)
+		self.snapStorage = make(map[common.Hash]map[common.Hash][]byte)
+	}
+}
+
 // setError remembers the first non-nil error it is called with.
 func (self *StateDB) setError(err error) {
 	if self.dbErr == nil {
@@ -120,6 +170,23 @@ func (self *StateDB) setError(err error) {
 	}
 }
 
+// Error returns the first database error encountered while reading the state
+// or the storage and code of a live state object, if any.
+func (self *StateDB) Error() error {
+	if self.dbErr != nil {
+		return self.dbErr
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, obj := range self.stateObjects {
+		if obj.dbErr != nil {
+			return obj.dbErr
+		}
+	}
+	return nil
+}
+
 // Preimages returns a list of SHA3 preimages that have been submitted.
 func (self *StateDB) Preimages() map[common.Hash][]byte {
 	return self.preimages
@@ -140,7 +207,12 @@ func (self *StateDB) Reset(root common.Hash) error {
 	self.txIndex = 0
 	self.logs = make(map[common.Hash]vm.Logs)
 	self.logSize = 0
+	self.internalTxs = nil
+	self.balanceOrigins = nil
 	self.preimages = make(map[common.Hash][]byte)
+	if self.snaps != nil {
+		self.openSnapshot(root)
+	}
 	self.clearJournalAndRefund()
 	return nil
 }
@@ -186,6 +258,72 @@ func (self *StateDB) Logs() vm.Logs {
 	return logs
 }
 
+// AddInternalTx records a value transfer or contract creation made by a
+// contract while executing the current transaction.
+func (self *StateDB) AddInternalTx(from, to common.Address, value *big.Int, create bool) {
+	self.journal = append(self.journal, addInternalTxChange{txhash: self.thash})
+
+	if self.internalTxs == nil {
+		self.internalTxs = make(map[common.Hash][]*InternalTx)
+	}
+	self.internalTxs[self.thash] = append(self.internalTxs[self.thash], &InternalTx{
+		From:   from,
+		To:     to,
+		Value:  new(big.Int).Set(value),
+		Create: create,
+	})
+}
+
+// GetInternalTxs returns the internal transactions recorded for the given
+// transaction.
+func (self *StateDB) GetInternalTxs(hash common.Hash) []*InternalTx {
+	return self.internalTxs[hash]
+}
+
+// noteBalanceOrigin remembers the balance of the account before its first
+// change.
+func (self *StateDB) noteBalanceOrigin(addr common.Address, prev *big.Int) {
+	if self.balanceOrigins == nil {
+		self.balanceOrigins = make(map[common.Address]*big.Int)
+	}
+	if _, ok := self.balanceOrigins[addr]; !ok {
+		self.balanceOrigins[addr] = new(big.Int).Set(prev)
+	}
+}
+
+// BalanceChanges returns the accounts whose balance differs from the one they
+// had when the state was opened or reset, along with their current balance.
+func (self *StateDB) BalanceChanges() map[common.Address]*big.Int {
+	changes := make(map[common.Address]*big.Int)
+	for addr, origin := range self.balanceOrigins {
+		if balance := self.GetBalance(addr); balance.Cmp(origin) != 0 {
+			changes[addr] = new(big.Int).Set(balance)
+		}
+	}
+	return changes
+}
+
+// ForEachBalance calls fn with the address and balance of the accounts of the
+// committed state, as long as it returns true. Accounts whose address is not
+// known to the database are skipped.
+func (self *StateDB) ForEachBalance(fn func(addr common.Address, balance *big.Int) bool) error {
+	it := trie.NewIterator(self.trie.NodeIterator(nil))
+	for it.Next() {
+		addr := self.trie.GetKey(it.Key)
+		if addr == nil {
+			continue
+		}
+		var data Account
+		if err := rlp.DecodeBytes(it.Value, &data); err != nil {
+			return err
+		}
+		if !fn(common.BytesToAddress(addr), data.Balance) {
+			return nil
+		}
+	}
+	return it.Err
+}
+
 func (self *StateDB) AddRefund(gas *big.Int) {
 	self.journal = append(self.journal, refundChange{prev: new(big.Int).Set(self.refund)})
 	self.refund.Add(self.refund, gas)
@@ -320,6 +458,7 @@ func (self *StateDB) Suicide(addr common.Address) bool {
 		prev:        stateObject.suicided,
 		prevbalance: new(big.Int).Set(stateObject.Balance()),
 	})
+	self.noteBalanceOrigin(addr, stateObject.Balance())
 	stateObject.markSuicided()
 	stateObject.data.Balance = new(big.Int)
 	return true
@@ -337,6 +476,10 @@ func (self *StateDB) updateStateObject(stateObject *StateObject) {
 		panic(fmt.Errorf("can't encode object at %x: %v", addr[:], err))
 	}
 	self.setError(self.trie.TryUpdate(addr[:], data))
+
+	if self.snap != nil {
+		self.snapAccounts[stateObject.addrHash] = data
+	}
 }
 
 // deleteStateObject removes the given object from the state trie.
@@ -344,6 +487,12 @@ func (self *StateDB) deleteStateObject(stateObject *StateObject) {
 	stateObject.deleted = true
 	addr := stateObject.Address()
 	self.setError(self.trie.TryDelete(addr[:]))
+
+	if self.snap != nil {
+		self.snapDestructs[stateObject.addrHash] = struct{}{}
+		delete(self.snapAccounts, stateObject.addrHash)
+		delete(self.snapStorage, stateObject.addrHash)
+	}
 }
 
 // Retrieve a state object given my the address. Returns nil if not found.
@@ -359,8 +508,17 @@ func (self *StateDB) getStateObject(addr common.Address) (stateObject *StateObje
 		return obj
 	}
 
-	// Load the object from the database.
-	enc, err := self.trie.TryGet(addr[:])
+	// Load the object from the snapshot, or the trie if it doesn't cover it.
+	var (
+		enc []byte
+		err error
+	)
+	if self.snap != nil {
+		enc, err = self.snap.AccountRLP(crypto.Keccak256Hash(addr[:]))
+	}
+	if self.snap == nil || err != nil {
+		enc, err = self.trie.TryGet(addr[:])
+	}
 	if len(enc) == 0 {
 		self.setError(err)
 		return nil
@@ -421,7 +579,16 @@ func (self *StateDB) createObject(addr common.Address) (newobj, prev *StateObjec
 				prev.address.Hex(),
 			).Send(mlogState)
 		}
-		self.journal = append(self.journal, resetObjectChange{prev: prev})
+		// The storage of the previous object is gone, don't read it from
+		// the snapshot anymore.
+		var prevdestruct bool
+		if self.snap != nil {
+			_, prevdestruct = self.snapDestructs[prev.addrHash]
+			if !prevdestruct {
+				self.snapDestructs[prev.addrHash] = struct{}{}
+			}
+		}
+		self.journal = append(self.journal, resetObjectChange{prev: prev, prevdestruct: prevdestruct})
 	}
 	self.setStateObject(newobj)
 	return newobj, prev
@@ -461,6 +628,8 @@ func (self *StateDB) Copy() *StateDB {
 		logs:              make(map[common.Hash]vm.Logs, len(self.logs)),
 		logSize:           self.logSize,
 		preimages:         make(map[common.Hash][]byte),
+		snaps:             self.snaps,
+		snap:              self.snap,
 	}
 	// Copy the dirty states, logs, and preimages
 	for addr := range self.stateObjectsDirty {
@@ -471,9 +640,41 @@ func (self *StateDB) Copy() *StateDB {
 		state.logs[hash] = make(vm.Logs, len(logs))
 		copy(state.logs[hash], logs)
 	}
+	if self.balanceOrigins != nil {
+		state.balanceOrigins = make(map[common.Address]*big.Int, len(self.balanceOrigins))
+		for addr, balance := range self.balanceOrigins {
+			state.balanceOrigins[addr] = balance
+		}
+	}
+	if self.internalTxs != nil {
+		state.internalTxs = make(map[common.Hash][]*InternalTx, len(self.internalTxs))
+		for hash, txs := range self.internalTxs {
+			state.internalTxs[hash] = make([]*InternalTx, len(txs))
+			copy(state.internalTxs[hash], txs)
+		}
+	}
 	for hash, preimage := range self.preimages {
 		state.preimages[hash] = preimage
 	}
+	// Copy the changes collected for the snapshot
+	if self.snap != nil {
+		state.snapDestructs = make(map[common.Hash]struct{}, len(self.snapDestructs))
+		for hash := range self.snapDestructs {
+			state.snapDestructs[hash] = struct{}{}
+		}
+		state.snapAccounts = make(map[common.Hash][]byte, len(self.snapAccounts))
+		for hash, blob := range self.snapAccounts {
+			state.snapAccounts[hash] = blob
+		}
+		state.snapStorage = make(map[common.Hash]map[common.Hash][]byte, len(self.snapStorage))
+		for hash, slots := range self.snapStorage {
+			cpy := make(map[common.Hash][]byte, len(slots))
+			for slot, value := range slots {
+				cpy[slot] = value
+			}
+			state.snapStorage[hash] = cpy
+		}
+	}
 	return state
 }
 
@@ -596,6 +797,17 @@ func (s *StateDB) CommitTo(dbw trie.DatabaseWriter, deleteEmptyObjects bool) (ro
 	// Write trie changes.
 	root, err = s.trie.CommitTo(dbw)
 	glog.V(logger.Debug).Infoln("Trie cache stats after commit", "misses", trie.CacheMisses(), "unloads", trie.CacheUnloads())
+
+	// Add the changes on top of the snapshot. The state now differs from the
+	// snapshot, stop reading it.
+	if err == nil && s.snap != nil {
+		if parent := s.snap.Root(); parent != root {
+			if err := s.snaps.Update(root, parent, s.snapDestructs, s.snapAccounts, s.snapStorage); err != nil {
+				glog.V(logger.Warn).Warnf("Failed to update state snapshot %x…: %v", root[:4], err)
+			}
+		}
+		s.snap, s.snapDestructs, s.snapAccounts, s.snapStorage = nil, nil, nil, nil
+	}
 	return root, err
 }
 
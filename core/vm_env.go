@@ -40,6 +40,20 @@ func GetHashFn(ref common.Hash, chain *BlockChain) func(n uint64) common.Hash {
 	}
 }
 
+// GetHeaderHashFn is like GetHashFn, but walks a header chain, so it can be
+// used without block bodies.
+func GetHeaderHashFn(ref common.Hash, hc *HeaderChain) func(n uint64) common.Hash {
+	return func(n uint64) common.Hash {
+		for header := hc.GetHeader(ref); header != nil; header = hc.GetHeader(header.ParentHash) {
+			if header.Number.Uint64() == n {
+				return header.Hash()
+			}
+		}
+
+		return common.Hash{}
+	}
+}
+
 type VMEnv struct {
 	chainConfig *ChainConfig   // Chain configuration
 	state       *state.StateDB // State to use for executing
@@ -66,6 +80,21 @@ func NewEnv(state *state.StateDB, chainConfig *ChainConfig, chain *BlockChain, m
 	return env
 }
 
+// NewHeaderEnv creates a VM environment whose block hashes are looked up in a
+// header chain, for light clients which have no full blocks.
+func NewHeaderEnv(state *state.StateDB, chainConfig *ChainConfig, hc *HeaderChain, msg Message, header *types.Header) *VMEnv {
+	env := &VMEnv{
+		chainConfig: chainConfig,
+		state:       state,
+		header:      header,
+		msg:         msg,
+		getHashFn:   GetHeaderHashFn(header.ParentHash, hc),
+	}
+
+	env.evm = vm.New(env)
+	return env
+}
+
 func (self *VMEnv) RuleSet() vm.RuleSet      { return self.chainConfig }
 func (self *VMEnv) Vm() vm.Vm                { return self.evm }
 func (self *VMEnv) Origin() common.Address   { f, _ := self.msg.From(); return f }
@@ -101,8 +130,15 @@ func (self *VMEnv) Transfer(from, to vm.Account, amount *big.Int) {
 	Transfer(from, to, amount)
 }
 
+// Call executes the contract at addr. Value transfers made by a running
+// contract, rather than by the transaction itself, are recorded in the state
+// as internal transactions.
 func (self *VMEnv) Call(me vm.ContractRef, addr common.Address, data []byte, gas, price, value *big.Int) ([]byte, error) {
-	return Call(self, me, addr, data, gas, price, value)
+	ret, err := Call(self, me, addr, data, gas, price, value)
+	if err == nil && self.depth > 0 && value.Sign() > 0 {
+		self.state.AddInternalTx(me.Address(), addr, value, false)
+	}
+	return ret, err
 }
 func (self *VMEnv) CallCode(me vm.ContractRef, addr common.Address, data []byte, gas, price, value *big.Int) ([]byte, error) {
 	return CallCode(self, me, addr, data, gas, price, value)
@@ -112,6 +148,12 @@ func (self *VMEnv) DelegateCall(me vm.ContractRef, addr common.Address, data []b
 	return DelegateCall(self, me, addr, data, gas, price)
 }
 
+// Create creates a new contract. Contracts created by a running contract are
+// recorded in the state as internal transactions.
 func (self *VMEnv) Create(me vm.ContractRef, data []byte, gas, price, value *big.Int) ([]byte, common.Address, error) {
-	return Create(self, me, data, gas, price, value)
+	ret, addr, err := Create(self, me, data, gas, price, value)
+	if err == nil && self.depth > 0 {
+		self.state.AddInternalTx(me.Address(), addr, value, true)
+	}
+	return ret, addr, err
 }
@@ -5,6 +5,7 @@ require (
 	github.com/boltdb/bolt v1.3.1
 	github.com/davecgh/go-spew v1.1.0
 	github.com/denisbrodbeck/machineid v1.0.0
+	github.com/dgraph-io/badger v1.6.2
 	github.com/ethereumproject/benchmark v0.0.0-20180113190147-8eff34efba25
 	github.com/fatih/color v1.7.0
 	github.com/fsnotify/fsnotify v1.4.7 // indirect
@@ -39,7 +40,7 @@ require (
 	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d
 	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
 	golang.org/x/sys v0.0.0-20180906133057-8cf3aee42992 // indirect
-	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/text v0.3.0
 	golang.org/x/tools v0.0.0-20180904205237-0aa4b8830f48
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/fatih/set.v0 v0.1.0
@@ -41,6 +41,32 @@ web3._extend({
 			call: 'admin_addPeer',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'removePeer',
+			call: 'admin_removePeer',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'addTrustedPeer',
+			call: 'admin_addTrustedPeer',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'removeTrustedPeer',
+			call: 'admin_removeTrustedPeer',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'addBan',
+			call: 'admin_addBan',
+			params: 3,
+			inputFormatter: [null, null, null]
+		}),
+		new web3._extend.Method({
+			name: 'removeBan',
+			call: 'admin_removeBan',
+			params: 1
+		}),
 		new web3._extend.Method({
 			name: 'exportChain',
 			call: 'admin_exportChain',
@@ -146,6 +172,10 @@ web3._extend({
 		new web3._extend.Property({
 			name: 'datadir',
 			getter: 'admin_datadir'
+		}),
+		new web3._extend.Property({
+			name: 'bans',
+			getter: 'admin_bans'
 		})
 	]
 });
@@ -168,6 +198,41 @@ web3._extend({
 			params: 8,
 			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, web3._extend.formatters.inputDefaultBlockNumberFormatter, null, null, null, null, null]
 		}),
+		new web3._extend.Method({
+			name: 'getAddressTransactionsPage',
+			call: 'ngin_getAddressTransactionsPage',
+			params: 8,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, web3._extend.formatters.inputDefaultBlockNumberFormatter, null, null, null, null, null]
+		}),
+		new web3._extend.Method({
+			name: 'getAddressTransactionsPageByTime',
+			call: 'ngin_getAddressTransactionsPageByTime',
+			params: 8,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, null, null, null, null, null, null]
+		}),
+		new web3._extend.Method({
+			name: 'getBlockNumberByTimestamp',
+			call: 'ngin_getBlockNumberByTimestamp',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'getTokenTransfers',
+			call: 'ngin_getTokenTransfers',
+			params: 8,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, null, web3._extend.formatters.inputDefaultBlockNumberFormatter, null, null, null, null]
+		}),
+		new web3._extend.Method({
+			name: 'getBalanceHistory',
+			call: 'ngin_getBalanceHistory',
+			params: 3,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, web3._extend.formatters.inputDefaultBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getBalanceHistoryByTime',
+			call: 'ngin_getBalanceHistoryByTime',
+			params: 3,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, null, null]
+		}),
 		new web3._extend.Method({
 			name: 'buildATXI',
 			call: 'ngin_buildATXI',
@@ -379,6 +444,48 @@ web3._extend({
 			call: 'personal_ecRecover',
 			params: 2,
 			inputFormatter: [null, null]
+		}),
+		new web3._extend.Method({
+			name: 'signTypedData',
+			call: 'personal_signTypedData',
+			params: 3,
+			inputFormatter: [null, web3._extend.formatters.inputAddressFormatter, null]
+		}),
+		new web3._extend.Method({
+			name: 'ecRecoverTypedData',
+			call: 'personal_ecRecoverTypedData',
+			params: 2,
+			inputFormatter: [null, null]
+		}),
+		new web3._extend.Method({
+			name: 'newHDWallet',
+			call: 'personal_newHDWallet',
+			params: 3,
+			inputFormatter: [null, null, null]
+		}),
+		new web3._extend.Method({
+			name: 'importHDWallet',
+			call: 'personal_importHDWallet',
+			params: 4,
+			inputFormatter: [null, null, null, null]
+		}),
+		new web3._extend.Method({
+			name: 'deriveAccount',
+			call: 'personal_deriveAccount',
+			params: 3,
+			inputFormatter: [null, null, null]
+		}),
+		new web3._extend.Method({
+			name: 'discoverAccounts',
+			call: 'personal_discoverAccounts',
+			params: 2
+		})
+	],
+	properties:
+	[
+		new web3._extend.Property({
+			name: 'listHDWallets',
+			getter: 'personal_listHDWallets'
 		})
 	]
 });
@@ -0,0 +1,299 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/state"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngin"
+	"github.com/NginProject/ngind/rlp"
+	"github.com/NginProject/ngind/rpc"
+)
+
+// PublicLightAPI provides the subset of the ngin RPC API a light client can
+// answer, retrieving state and block bodies on demand.
+type PublicLightAPI struct {
+	l *LightNgin
+}
+
+// NewPublicLightAPI creates a new light client RPC service.
+func NewPublicLightAPI(l *LightNgin) *PublicLightAPI {
+	return &PublicLightAPI{l: l}
+}
+
+// headerByNumber returns the requested canonical header. Light clients have no
+// pending block, the chain head is used instead.
+func (s *PublicLightAPI) headerByNumber(blockNr rpc.BlockNumber) (*types.Header, error) {
+	if blockNr == rpc.LatestBlockNumber || blockNr == rpc.PendingBlockNumber {
+		return s.l.chain.CurrentHeader(), nil
+	}
+	if header := s.l.chain.GetHeaderByNumber(uint64(blockNr)); header != nil {
+		return header, nil
+	}
+	return nil, fmt.Errorf("block #%d not found", blockNr)
+}
+
+// stateByNumber returns the on-demand state of the requested block.
+func (s *PublicLightAPI) stateByNumber(ctx context.Context, blockNr rpc.BlockNumber) (*state.StateDB, *types.Header, error) {
+	header, err := s.headerByNumber(blockNr)
+	if err != nil {
+		return nil, nil, err
+	}
+	statedb, err := newOdrState(ctx, header, s.l.retriever)
+	return statedb, header, err
+}
+
+// BlockNumber returns the block number of the header chain head.
+func (s *PublicLightAPI) BlockNumber() *big.Int {
+	return s.l.chain.CurrentHeader().Number
+}
+
+// GetBalance returns the amount of wei for the given address in the state of
+// the given block number.
+func (s *PublicLightAPI) GetBalance(ctx context.Context, address common.Address, blockNr rpc.BlockNumber) (*big.Int, error) {
+	statedb, _, err := s.stateByNumber(ctx, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	balance := statedb.GetBalance(address)
+	return balance, statedb.Error()
+}
+
+// GetTransactionCount returns the number of transactions the given address has
+// sent as of the given block number.
+func (s *PublicLightAPI) GetTransactionCount(ctx context.Context, address common.Address, blockNr rpc.BlockNumber) (*rpc.HexNumber, error) {
+	statedb, _, err := s.stateByNumber(ctx, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	nonce := statedb.GetNonce(address)
+	return rpc.NewHexNumber(nonce), statedb.Error()
+}
+
+// GetCode returns the code stored at the given address in the state for the
+// given block number.
+func (s *PublicLightAPI) GetCode(ctx context.Context, address common.Address, blockNr rpc.BlockNumber) (string, error) {
+	statedb, _, err := s.stateByNumber(ctx, blockNr)
+	if err != nil {
+		return "", err
+	}
+	res := statedb.GetCode(address)
+	if err := statedb.Error(); err != nil {
+		return "", err
+	}
+	if len(res) == 0 { // backwards compatibility
+		return "0x", nil
+	}
+	return common.ToHex(res), nil
+}
+
+// GetStorageAt returns the storage from the state at the given address, key
+// and block number.
+func (s *PublicLightAPI) GetStorageAt(ctx context.Context, address common.Address, key string, blockNr rpc.BlockNumber) (string, error) {
+	statedb, _, err := s.stateByNumber(ctx, blockNr)
+	if err != nil {
+		return "0x", err
+	}
+	value := statedb.GetState(address, common.HexToHash(key))
+	if err := statedb.Error(); err != nil {
+		return "0x", err
+	}
+	return value.Hex(), nil
+}
+
+// callmsg is the message type used for call transactions.
+type callmsg struct {
+	from          *state.StateObject
+	to            *common.Address
+	gas, gasPrice *big.Int
+	value         *big.Int
+	data          []byte
+}
+
+// accessor boilerplate to implement core.Message
+func (m callmsg) From() (common.Address, error)         { return m.from.Address(), nil }
+func (m callmsg) FromFrontier() (common.Address, error) { return m.from.Address(), nil }
+func (m callmsg) Nonce() uint64                         { return m.from.Nonce() }
+func (m callmsg) To() *common.Address                   { return m.to }
+func (m callmsg) GasPrice() *big.Int                    { return m.gasPrice }
+func (m callmsg) Gas() *big.Int                         { return m.gas }
+func (m callmsg) Value() *big.Int                       { return m.value }
+func (m callmsg) Data() []byte                          { return m.data }
+
+func (s *PublicLightAPI) doCall(ctx context.Context, args ngin.CallArgs, blockNr rpc.BlockNumber) (string, *big.Int, error) {
+	statedb, header, err := s.stateByNumber(ctx, blockNr)
+	if err != nil {
+		return "0x", nil, err
+	}
+	var from *state.StateObject
+	if args.From == (common.Address{}) {
+		accounts := s.l.accountManager.Accounts()
+		if len(accounts) == 0 {
+			from = statedb.GetOrNewStateObject(common.Address{})
+		} else {
+			from = statedb.GetOrNewStateObject(accounts[0].Address)
+		}
+	} else {
+		from = statedb.GetOrNewStateObject(args.From)
+	}
+	from.SetBalance(common.MaxBig)
+
+	msg := callmsg{
+		from:     from,
+		to:       args.To,
+		gas:      args.Gas.BigInt(),
+		gasPrice: args.GasPrice.BigInt(),
+		value:    args.Value.BigInt(),
+		data:     common.FromHex(args.Data),
+	}
+	if msg.gas == nil {
+		msg.gas = big.NewInt(50000000)
+	}
+	if msg.gasPrice == nil {
+		msg.gasPrice = s.l.config.GasPrice
+	}
+
+	vmenv := core.NewHeaderEnv(statedb, s.l.chainConfig, s.l.chain.hc, msg, header)
+	gp := new(core.GasPool).AddGas(common.MaxBig)
+
+	res, requiredGas, _, err := core.NewStateTransition(vmenv, msg, gp).TransitionDb()
+	// A failed retrieval surfaces as missing state inside the EVM, report it
+	// rather than the misleading execution result.
+	if dbErr := statedb.Error(); dbErr != nil {
+		return "0x", nil, dbErr
+	}
+	if len(res) == 0 { // backwards compatibility
+		return "0x", requiredGas, err
+	}
+	return common.ToHex(res), requiredGas, err
+}
+
+// Call executes the given transaction on the state for the given block number.
+func (s *PublicLightAPI) Call(ctx context.Context, args ngin.CallArgs, blockNr rpc.BlockNumber) (string, error) {
+	result, _, err := s.doCall(ctx, args, blockNr)
+	return result, err
+}
+
+// EstimateGas returns an estimate of the amount of gas needed to execute the
+// given transaction on top of the chain head.
+func (s *PublicLightAPI) EstimateGas(ctx context.Context, args ngin.CallArgs) (*rpc.HexNumber, error) {
+	_, gas, err := s.doCall(ctx, args, rpc.LatestBlockNumber)
+	return rpc.NewHexNumber(gas), err
+}
+
+// GetBlockByNumber returns the requested block, retrieving its body if needed.
+func (s *PublicLightAPI) GetBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber, fullTx bool) (map[string]interface{}, error) {
+	header, err := s.headerByNumber(blockNr)
+	if err != nil {
+		return nil, nil
+	}
+	return s.rpcOutputBlock(ctx, header, fullTx)
+}
+
+// GetBlockByHash returns the requested block, retrieving its body if needed.
+func (s *PublicLightAPI) GetBlockByHash(ctx context.Context, blockHash common.Hash, fullTx bool) (map[string]interface{}, error) {
+	if header := s.l.chain.GetHeader(blockHash); header != nil {
+		return s.rpcOutputBlock(ctx, header, fullTx)
+	}
+	return nil, nil
+}
+
+// SendRawTransaction relays the signed transaction to the connected light
+// servers. The sender is responsible for signing the transaction and using the
+// correct nonce.
+func (s *PublicLightAPI) SendRawTransaction(encodedTx string) (string, error) {
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(common.FromHex(encodedTx), tx); err != nil {
+		return "", err
+	}
+	var sent int
+	for _, p := range s.l.peers.AllPeers() {
+		if err := p.send(SendTxMsg, types.Transactions{tx}); err != nil {
+			glog.V(logger.Debug).Infof("%v: failed to relay tx %x: %v", p, tx.Hash(), err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return "", errNoPeers
+	}
+	glog.V(logger.Info).Infof("Tx(%x) relayed to %d light servers", tx.Hash(), sent)
+	return tx.Hash().Hex(), nil
+}
+
+// rpcOutputBlock converts the given header, and its body if any, to the RPC
+// block representation.
+func (s *PublicLightAPI) rpcOutputBlock(ctx context.Context, header *types.Header, fullTx bool) (map[string]interface{}, error) {
+	block := types.NewBlockWithHeader(header)
+	if header.TxHash != types.EmptyRootHash || header.UncleHash != types.EmptyUncleHash {
+		req := &bodyRequest{header: header}
+		if err := s.l.retriever.retrieve(ctx, req); err != nil {
+			return nil, err
+		}
+		block = block.WithBody(req.body.Transactions, req.body.Uncles)
+	}
+	fields := map[string]interface{}{
+		"number":           rpc.NewHexNumber(block.Number()),
+		"hash":             block.Hash(),
+		"parentHash":       block.ParentHash(),
+		"nonce":            header.Nonce,
+		"sha3Uncles":       block.UncleHash(),
+		"logsBloom":        block.Bloom(),
+		"stateRoot":        block.Root(),
+		"miner":            block.Coinbase(),
+		"difficulty":       rpc.NewHexNumber(block.Difficulty()),
+		"totalDifficulty":  rpc.NewHexNumber(s.l.chain.GetTd(block.Hash())),
+		"extraData":        fmt.Sprintf("0x%x", block.Extra()),
+		"size":             rpc.NewHexNumber(block.Size().Int64()),
+		"gasLimit":         rpc.NewHexNumber(block.GasLimit()),
+		"gasUsed":          rpc.NewHexNumber(block.GasUsed()),
+		"timestamp":        rpc.NewHexNumber(block.Time()),
+		"transactionsRoot": block.TxHash(),
+		"receiptsRoot":     block.ReceiptHash(),
+	}
+	txs := block.Transactions()
+	transactions := make([]interface{}, len(txs))
+	for i, tx := range txs {
+		if !fullTx {
+			transactions[i] = tx.Hash()
+			continue
+		}
+		rpcTx, err := ngin.NewRPCTransactionFromBlockIndex(block, i)
+		if err != nil {
+			return nil, err
+		}
+		transactions[i] = rpcTx
+	}
+	fields["transactions"] = transactions
+
+	uncles := block.Uncles()
+	uncleHashes := make([]common.Hash, len(uncles))
+	for i, uncle := range uncles {
+		uncleHashes[i] = uncle.Hash()
+	}
+	fields["uncles"] = uncleHashes
+
+	return fields, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/NginProject/ngind/M00N"
+	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngin"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/node"
+	"github.com/NginProject/ngind/p2p"
+	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/pow"
+	"github.com/NginProject/ngind/rpc"
+)
+
+// LightNgin is the light client backend. It keeps only the header chain and
+// retrieves state, code and block bodies on demand from light servers,
+// verifying them against the headers. It implements node.Service.
+type LightNgin struct {
+	config      *ngin.Config
+	chainConfig *core.ChainConfig
+
+	chainDb        ngindb.Database
+	chain          *lightChain
+	eventMux       *event.TypeMux
+	accountManager *accounts.Manager
+
+	peers        *peerSet
+	retriever    *retriever
+	SubProtocols []p2p.Protocol
+
+	netVersionId  int
+	netRPCService *ngin.PublicNetAPI
+
+	syncCh chan struct{} // signals that a peer may have a better chain
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates a light client backend using the same configuration as the
+// full ngin service.
+func New(ctx *node.ServiceContext, config *ngin.Config) (*LightNgin, error) {
+	if config.ChainConfig == nil {
+		return nil, errors.New("missing chain config")
+	}
+	chainDb, err := ctx.OpenDatabase("lightchaindata", config.DatabaseCache, config.DatabaseHandles)
+	if err != nil {
+		return nil, err
+	}
+	if config.Genesis != nil {
+		if _, err := core.WriteGenesisBlock(chainDb, config.Genesis); err != nil {
+			return nil, err
+		}
+	}
+
+	var engine pow.PoW
+	switch {
+	case config.PowTest:
+		glog.V(logger.Info).Infof("Consensus: M00N used in test mode")
+		if engine, err = M00N.NewForTesting(); err != nil {
+			return nil, err
+		}
+	case config.PowShared:
+		glog.V(logger.Info).Infof("Consensus: M00N used in shared mode")
+		engine = M00N.NewShared()
+	default:
+		engine = M00N.New()
+	}
+
+	l := &LightNgin{
+		config:         config,
+		chainConfig:    config.ChainConfig,
+		chainDb:        chainDb,
+		eventMux:       ctx.EventMux,
+		accountManager: config.AccountManager,
+		peers:          newPeerSet(),
+		netVersionId:   config.NetworkId,
+		syncCh:         make(chan struct{}, 1),
+		quit:           make(chan struct{}),
+	}
+	l.retriever = newRetriever(l.peers)
+	if l.chain, err = newLightChain(chainDb, config.ChainConfig, engine, l.eventMux); err != nil {
+		return nil, err
+	}
+	head := l.chain.CurrentHeader()
+	glog.V(logger.Info).Infof("Light client: protocol versions %v, network id %d, head #%d [%x…]", ProtocolVersions, config.NetworkId, head.Number, head.Hash().Bytes()[:4])
+
+	for i, version := range ProtocolVersions {
+		version := version // Closure for the run
+		l.SubProtocols = append(l.SubProtocols, p2p.Protocol{
+			Name:    ProtocolName,
+			Version: version,
+			Length:  ProtocolLengths[i],
+			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+				l.wg.Add(1)
+				defer l.wg.Done()
+				return l.handle(newPeer(int(version), p, rw))
+			},
+			PeerInfo: func(id discover.NodeID) interface{} {
+				if p := l.peers.Peer(fmt.Sprintf("%x", id[:8])); p != nil {
+					return p.Info()
+				}
+				return nil
+			},
+		})
+	}
+	return l, nil
+}
+
+// APIs returns the collection of RPC services the light client offers.
+func (l *LightNgin) APIs() []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "ngin",
+			Version:   "1.0",
+			Service:   NewPublicLightAPI(l),
+			Public:    true,
+		}, {
+			Namespace: "ngin",
+			Version:   "1.0",
+			Service:   ngin.NewPublicAccountAPI(l.accountManager),
+			Public:    true,
+		}, {
+			Namespace: "net",
+			Version:   "1.0",
+			Service:   l.netRPCService,
+			Public:    true,
+		},
+	}
+}
+
+func (l *LightNgin) ChainDb() ngindb.Database       { return l.chainDb }
+func (l *LightNgin) EventMux() *event.TypeMux       { return l.eventMux }
+func (l *LightNgin) NetVersion() int                { return l.netVersionId }
+func (l *LightNgin) ChainConfig() *core.ChainConfig { return l.chainConfig }
+
+// Protocols implements node.Service, returning the les protocol.
+func (l *LightNgin) Protocols() []p2p.Protocol {
+	return l.SubProtocols
+}
+
+// Start implements node.Service, starting the header synchronisation.
+func (l *LightNgin) Start(srvr *p2p.Server) error {
+	l.netRPCService = ngin.NewPublicNetAPI(srvr, l.NetVersion())
+	l.wg.Add(1)
+	go l.syncLoop()
+	return nil
+}
+
+// Stop implements node.Service, terminating all internal goroutines.
+func (l *LightNgin) Stop() error {
+	close(l.quit)
+	l.chain.Stop()
+	l.peers.Close()
+	l.wg.Wait()
+	l.eventMux.Stop()
+	l.chainDb.Close()
+	return nil
+}
+
+// handle is the callback invoked to manage the life cycle of a light server.
+// When this function terminates, the peer is disconnected.
+func (l *LightNgin) handle(p *peer) error {
+	td, head, headNum, genesis := l.chain.Status()
+	if err := p.Handshake(uint64(l.netVersionId), td, head, headNum, genesis, nil); err != nil {
+		glog.V(logger.Debug).Infof("%v: handshake failed: %v", p, err)
+		return err
+	}
+	if !p.serving {
+		return errNotServing
+	}
+	if err := l.peers.Register(p); err != nil {
+		return err
+	}
+	defer l.peers.Unregister(p.id)
+	glog.V(logger.Debug).Infof("%v: light server connected", p)
+
+	l.triggerSync()
+	for {
+		if err := l.handleMsg(p); err != nil {
+			glog.V(logger.Debug).Infof("%v: message handling failed: %v", p, err)
+			return err
+		}
+	}
+}
+
+// handleMsg is invoked whenever an inbound message is received from a remote
+// light server. The remote connection is torn down upon returning any error.
+func (l *LightNgin) handleMsg(p *peer) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Size > ProtocolMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
+	}
+	defer msg.Discard()
+
+	var (
+		resp   responseHeader
+		answer interface{}
+	)
+	switch msg.Code {
+	case StatusMsg:
+		return errResp(ErrExtraStatusMsg, "uncontrolled status message")
+
+	case AnnounceMsg:
+		var announce announceData
+		if err := msg.Decode(&announce); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if announce.TD == nil {
+			return errResp(ErrDecode, "announcement without total difficulty")
+		}
+		p.SetHead(announce.Hash, announce.Number, announce.TD)
+		l.triggerSync()
+		return nil
+
+	case BlockHeadersMsg:
+		var data blockHeadersData
+		if err := msg.Decode(&data); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		resp, answer = responseHeader{data.ReqID, data.BV}, data.Headers
+
+	case BlockBodiesMsg:
+		var data blockBodiesData
+		if err := msg.Decode(&data); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		resp, answer = responseHeader{data.ReqID, data.BV}, data.Bodies
+
+	case ReceiptsMsg:
+		var data receiptsData
+		if err := msg.Decode(&data); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		resp, answer = responseHeader{data.ReqID, data.BV}, data.Receipts
+
+	case ProofsMsg:
+		var data proofsData
+		if err := msg.Decode(&data); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		resp, answer = responseHeader{data.ReqID, data.BV}, data.Proofs
+
+	case CodeMsg:
+		var data codeData
+		if err := msg.Decode(&data); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		resp, answer = responseHeader{data.ReqID, data.BV}, data.Code
+
+	case GetBlockHeadersMsg, GetBlockBodiesMsg, GetReceiptsMsg, GetProofsMsg, GetCodeMsg, SendTxMsg:
+		return errResp(ErrRequestRejected, "light clients don't serve requests")
+
+	default:
+		return errResp(ErrInvalidMsgCode, "%v", msg.Code)
+	}
+	// Answers arriving after their request timed out are harmless, don't
+	// punish the server for being slow.
+	if err := l.retriever.deliver(p, msg.Code, resp.ReqID, resp.BV, answer); err != nil {
+		glog.V(logger.Detail).Infof("%v: %v", p, err)
+	}
+	return nil
+}
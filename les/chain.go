@@ -0,0 +1,135 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/pow"
+)
+
+// lightChain is a header-only chain. It wraps a core.HeaderChain, adding the
+// locking the header chain leaves to its owner.
+type lightChain struct {
+	hc        *core.HeaderChain
+	validator core.HeaderValidator
+
+	mu            sync.RWMutex
+	procInterrupt int32 // interrupt signaler for header insertion
+}
+
+func newLightChain(chainDb ngindb.Database, config *core.ChainConfig, pow pow.PoW, mux *event.TypeMux) (*lightChain, error) {
+	lc := new(lightChain)
+	gv := func() core.HeaderValidator { return lc.validator }
+	interrupted := func() bool { return atomic.LoadInt32(&lc.procInterrupt) == 1 }
+
+	var err error
+	if lc.hc, err = core.NewHeaderChain(chainDb, config, mux, gv, interrupted); err != nil {
+		return nil, err
+	}
+	lc.validator = core.NewHeaderValidator(config, lc.hc, pow)
+
+	// The header chain starts at the head block, which a light client has
+	// none of; resume from the last head header instead.
+	if head := core.GetHeadHeaderHash(chainDb); head != (common.Hash{}) {
+		if header := lc.hc.GetHeader(head); header != nil {
+			lc.hc.SetCurrentHeader(header)
+		}
+	}
+	return lc, nil
+}
+
+// Stop interrupts any running header insertion.
+func (lc *lightChain) Stop() {
+	atomic.StoreInt32(&lc.procInterrupt, 1)
+}
+
+// CurrentHeader retrieves the head of the canonical chain.
+func (lc *lightChain) CurrentHeader() *types.Header {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return lc.hc.CurrentHeader()
+}
+
+// Genesis retrieves the genesis header.
+func (lc *lightChain) Genesis() *types.Header {
+	return lc.GetHeaderByNumber(0)
+}
+
+// Status returns the total difficulty, hash and number of the chain head and
+// the genesis hash.
+func (lc *lightChain) Status() (td *big.Int, head common.Hash, headNum uint64, genesis common.Hash) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	current := lc.hc.CurrentHeader()
+	head = current.Hash()
+	return lc.hc.GetTd(head), head, current.Number.Uint64(), lc.hc.GetHeaderByNumber(0).Hash()
+}
+
+// GetHeader retrieves a header by hash.
+func (lc *lightChain) GetHeader(hash common.Hash) *types.Header {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return lc.hc.GetHeader(hash)
+}
+
+// GetHeaderByNumber retrieves a header of the canonical chain by number.
+func (lc *lightChain) GetHeaderByNumber(number uint64) *types.Header {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return lc.hc.GetHeaderByNumber(number)
+}
+
+// HasHeader checks if a header is present in the database.
+func (lc *lightChain) HasHeader(hash common.Hash) bool {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return lc.hc.HasHeader(hash)
+}
+
+// GetTd retrieves the total difficulty of a header.
+func (lc *lightChain) GetTd(hash common.Hash) *big.Int {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return lc.hc.GetTd(hash)
+}
+
+// InsertHeaderChain verifies and inserts a contiguous batch of headers,
+// verifying the proof of work of every checkFreq-th header.
+func (lc *lightChain) InsertHeaderChain(headers []*types.Header, checkFreq int) *core.HeaderChainInsertResult {
+	whFunc := func(header *types.Header) error {
+		lc.mu.Lock()
+		defer lc.mu.Unlock()
+
+		_, err := lc.hc.WriteHeader(header)
+		return err
+	}
+	return lc.hc.InsertHeaderChain(headers, checkFreq, whFunc)
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"sync"
+	"time"
+)
+
+// Flow control works with an abstract cost unit of roughly one microsecond
+// of server time. Every client gets a buffer of BufLimit units, recharging at
+// MinRecharge units per millisecond. Each request deducts its cost from the
+// buffer, and a client sending a request it can't pay for is disconnected.
+// Responses carry the buffer value after serving, which the client uses to
+// correct its own estimate.
+const (
+	// fullServeRecharge is the recharge rate available to all clients together
+	// when serving light clients 100% of the time: one unit per microsecond.
+	fullServeRecharge = 1000
+
+	// bufLimitRatio is the size of the client buffer in milliseconds of recharge.
+	bufLimitRatio = 6000
+)
+
+// requestCost is the cost of a single request type: BaseCost for the request
+// plus ReqCost for each item asked for.
+type requestCost struct {
+	MsgCode  uint64
+	BaseCost uint64
+	ReqCost  uint64
+}
+
+// defaultCosts is the cost table announced by servers.
+var defaultCosts = []requestCost{
+	{GetBlockHeadersMsg, 150, 30},
+	{GetBlockBodiesMsg, 200, 500},
+	{GetReceiptsMsg, 200, 500},
+	{GetProofsMsg, 200, 1000},
+	{GetCodeMsg, 200, 1000},
+	{SendTxMsg, 200, 1500},
+}
+
+// costTable maps request message codes to their costs.
+type costTable map[uint64]requestCost
+
+func newCostTable(costs []requestCost) costTable {
+	t := make(costTable)
+	for _, c := range costs {
+		t[c.MsgCode] = c
+	}
+	return t
+}
+
+// cost returns the cost of a request with the given code asking for amount
+// items. Request types missing from the table are free.
+func (t costTable) cost(code uint64, amount int) uint64 {
+	c, ok := t[code]
+	if !ok {
+		return 0
+	}
+	return c.BaseCost + uint64(amount)*c.ReqCost
+}
+
+// flowParams are the flow control parameters of a single client.
+type flowParams struct {
+	BufLimit    uint64
+	MinRecharge uint64
+}
+
+// newFlowParams derives the per client flow control parameters from the
+// percentage of time the server is willing to spend serving and the number of
+// clients it accepts.
+func newFlowParams(servePercent, maxClients int) flowParams {
+	if maxClients < 1 {
+		maxClients = 1
+	}
+	recharge := uint64(fullServeRecharge * servePercent / 100 / maxClients)
+	if recharge == 0 {
+		recharge = 1
+	}
+	return flowParams{BufLimit: recharge * bufLimitRatio, MinRecharge: recharge}
+}
+
+// buffer is a recharging flow control buffer. Servers keep one per client to
+// enforce the limits, clients keep one per server to estimate how much they
+// can send without being dropped.
+type buffer struct {
+	params flowParams
+
+	lock   sync.Mutex
+	value  uint64
+	update time.Time
+}
+
+func newBuffer(params flowParams) *buffer {
+	return &buffer{params: params, value: params.BufLimit, update: time.Now()}
+}
+
+// recharge refills the buffer for the time passed since the last update. The
+// lock must be held.
+func (b *buffer) recharge(now time.Time) {
+	if ms := uint64(now.Sub(b.update) / time.Millisecond); ms > 0 {
+		b.value += ms * b.params.MinRecharge
+		if b.value > b.params.BufLimit {
+			b.value = b.params.BufLimit
+		}
+		b.update = b.update.Add(time.Duration(ms) * time.Millisecond)
+	}
+}
+
+// accept deducts the cost of a request from the buffer, reporting false if the
+// buffer doesn't hold enough. The returned value is the buffer after deduction.
+func (b *buffer) accept(cost uint64) (bool, uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.recharge(time.Now())
+	if cost > b.value {
+		return false, b.value
+	}
+	b.value -= cost
+	return true, b.value
+}
+
+// wait returns how long to wait until the buffer holds at least cost units.
+func (b *buffer) wait(cost uint64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.recharge(time.Now())
+	if cost <= b.value {
+		return 0
+	}
+	if cost > b.params.BufLimit || b.params.MinRecharge == 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration((cost-b.value)/b.params.MinRecharge+1) * time.Millisecond
+}
+
+// set overwrites the buffer value with the one reported by the server.
+func (b *buffer) set(value uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.recharge(time.Now())
+	if value < b.value {
+		b.value = value
+	}
+}
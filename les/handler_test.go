@@ -0,0 +1,340 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/p2p"
+	"github.com/NginProject/ngind/p2p/discover"
+)
+
+var (
+	testBankKey, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	testBankAddr    = crypto.PubkeyToAddress(testBankKey.PublicKey)
+	testContract    = crypto.CreateAddress(testBankAddr, 0)
+	testRecipient   = common.HexToAddress("0x2222")
+	testStorageSlot = common.BigToHash(big.NewInt(1))
+
+	// testContractInit stores 42 at slot 1 and deploys the code 0x60016000
+	testContractInit = common.FromHex("602a6001556360016000600052600460" + "1cf3")
+	testContractCode = common.FromHex("60016000")
+)
+
+// newTestServer returns a light server on top of a chain of n blocks, the
+// first one creating the test contract and the others holding a transfer.
+func newTestServer(t *testing.T, n int, flow flowParams) *Server {
+	db, _ := ngindb.NewMemDatabase()
+	genesis := core.WriteGenesisBlockForTesting(db, core.GenesisAccount{Address: testBankAddr, Balance: big.NewInt(1000000000)})
+	config := core.DefaultConfigMainnet.ChainConfig
+	blocks, _ := core.GenerateChain(config, genesis, db, n, func(i int, b *core.BlockGen) {
+		var tx *types.Transaction
+		if i == 0 {
+			tx = types.NewContractCreation(b.TxNonce(testBankAddr), new(big.Int), big.NewInt(200000), new(big.Int), testContractInit)
+		} else {
+			tx = types.NewTransaction(b.TxNonce(testBankAddr), testRecipient, big.NewInt(1), big.NewInt(21000), new(big.Int), nil)
+		}
+		tx, err := tx.SignECDSA(testBankKey)
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	bc, err := core.NewBlockChain(db, config, core.FakePow{}, new(event.TypeMux))
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if res := bc.InsertChain(blocks); res.Error != nil {
+		t.Fatalf("failed to insert chain: %v", res.Error)
+	}
+	return &Server{
+		networkId:  1,
+		maxClients: 1,
+		flow:       flow,
+		costs:      newCostTable(defaultCosts),
+		blockchain: bc,
+		chainDb:    db,
+		triedb:     db,
+		eventMux:   new(event.TypeMux),
+		peers:      newPeerSet(),
+		quit:       make(chan struct{}),
+	}
+}
+
+// newTestPeers returns the two ends of a les connection.
+func newTestPeers() (client, server *peer) {
+	app, net := p2p.MsgPipe()
+	client = newPeer(1, p2p.NewPeer(discover.NodeID{2}, "server", nil), net)
+	server = newPeer(1, p2p.NewPeer(discover.NodeID{1}, "client", nil), app)
+	return client, server
+}
+
+// newTestClient returns a light client handling the messages of a server
+// peer whose handshake is done.
+func newTestClient(t *testing.T, p *peer) *LightNgin {
+	l := &LightNgin{peers: newPeerSet(), syncCh: make(chan struct{}, 1), quit: make(chan struct{})}
+	l.retriever = newRetriever(l.peers)
+	if err := l.peers.Register(p); err != nil {
+		t.Fatalf("failed to register server: %v", err)
+	}
+	go func() {
+		for l.handleMsg(p) == nil {
+		}
+	}()
+	return l
+}
+
+// connectTestClient connects a light client to the server, returning the
+// client and its peer of the server. The server's error ends up on errc.
+func connectTestClient(t *testing.T, s *Server) (*LightNgin, *peer, <-chan error) {
+	client, server := newTestPeers()
+	errc := make(chan error, 1)
+	go func() { errc <- s.handle(server) }()
+
+	td, head, genesis := s.blockchain.Status()
+	if err := client.Handshake(s.networkId, td, head, s.blockchain.CurrentBlock().NumberU64(), genesis, nil); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if !client.serving || client.buffer == nil {
+		t.Fatalf("server not serving after handshake")
+	}
+	return newTestClient(t, client), client, errc
+}
+
+// receiptsRequest retrieves the receipts of a block.
+type receiptsRequest struct {
+	header *types.Header
+
+	receipts types.Receipts
+}
+
+func (req *receiptsRequest) code() (uint64, int)   { return GetReceiptsMsg, 1 }
+func (req *receiptsRequest) canServe(p *peer) bool { return true }
+
+func (req *receiptsRequest) send(p *peer, reqID uint64) error {
+	return p.send(GetReceiptsMsg, &getByHashesData{ReqID: reqID, Hashes: []common.Hash{req.header.Hash()}})
+}
+
+func (req *receiptsRequest) validate(answer interface{}) error {
+	receipts, ok := answer.([]types.Receipts)
+	if !ok || len(receipts) != 1 {
+		return errInvalidAnswer
+	}
+	req.receipts = receipts[0]
+	return nil
+}
+
+// Tests that headers, bodies, receipts, state proofs and code are retrieved
+// from a light server and verified.
+func TestHandlerRetrieval(t *testing.T) {
+	s := newTestServer(t, 4, newFlowParams(100, 1))
+	l, p, _ := connectTestClient(t, s)
+	defer p.rw.(*p2p.MsgPipeRW).Close()
+
+	ctx := context.Background()
+	bc := s.blockchain
+	head := bc.CurrentHeader()
+
+	// Headers, by number and in reverse with skips from a hash
+	headerTests := []struct {
+		query headersQuery
+		want  []uint64
+	}{
+		{headersQuery{Number: 1, Amount: 3}, []uint64{1, 2, 3}},
+		{headersQuery{Number: 3, Amount: 5}, []uint64{3, 4}},
+		{headersQuery{Hash: head.Hash(), Amount: 3, Skip: 1, Reverse: true}, []uint64{4, 2, 0}},
+		{headersQuery{Number: 5, Amount: 1}, nil},
+	}
+	for i, tt := range headerTests {
+		req := &headersRequest{peer: p, query: tt.query}
+		if err := l.retriever.retrieve(ctx, req); err != nil {
+			t.Fatalf("test %d: failed to retrieve headers: %v", i, err)
+		}
+		if len(req.headers) != len(tt.want) {
+			t.Fatalf("test %d: header count mismatch: have %d, want %d", i, len(req.headers), len(tt.want))
+		}
+		for j, header := range req.headers {
+			if header.Hash() != bc.GetHeaderByNumber(tt.want[j]).Hash() {
+				t.Errorf("test %d: header %d mismatch: have #%v", i, j, header.Number)
+			}
+		}
+	}
+	// Bodies and receipts
+	for n := uint64(1); n <= head.Number.Uint64(); n++ {
+		header := bc.GetHeaderByNumber(n)
+		body := &bodyRequest{header: header}
+		if err := l.retriever.retrieve(ctx, body); err != nil {
+			t.Fatalf("block #%d: failed to retrieve body: %v", n, err)
+		}
+		if len(body.body.Transactions) != 1 {
+			t.Errorf("block #%d: transaction count mismatch: have %d, want 1", n, len(body.body.Transactions))
+		}
+		receipts := &receiptsRequest{header: header}
+		if err := l.retriever.retrieve(ctx, receipts); err != nil {
+			t.Fatalf("block #%d: failed to retrieve receipts: %v", n, err)
+		}
+		if hash := types.DeriveSha(receipts.receipts); hash != header.ReceiptHash {
+			t.Errorf("block #%d: receipt root mismatch: have %x, want %x", n, hash, header.ReceiptHash)
+		}
+	}
+	// Accounts, storage and code through proofs
+	full, err := bc.State()
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	odr, err := newOdrState(ctx, head, l.retriever)
+	if err != nil {
+		t.Fatalf("failed to open light state: %v", err)
+	}
+	for _, addr := range []common.Address{testBankAddr, testContract, testRecipient} {
+		if have, want := odr.GetBalance(addr), full.GetBalance(addr); have.Cmp(want) != 0 {
+			t.Errorf("%x: balance mismatch: have %v, want %v", addr, have, want)
+		}
+	}
+	if code := odr.GetCode(testContract); !bytes.Equal(code, testContractCode) {
+		t.Errorf("code mismatch: have %x, want %x", code, testContractCode)
+	}
+	if value := odr.GetState(testContract, testStorageSlot); value != common.BigToHash(big.NewInt(42)) {
+		t.Errorf("storage mismatch: have %x, want 42", value)
+	}
+	if err := odr.Error(); err != nil {
+		t.Errorf("light state failed: %v", err)
+	}
+	// Unknown blocks get empty answers, which don't verify
+	unknown := &types.Header{Number: big.NewInt(1), Root: head.Root}
+	if err := l.retriever.retrieve(ctx, &codeRequest{header: unknown, accKey: crypto.Keccak256(testContract[:]), codeHash: crypto.Keccak256Hash(testContractCode)}); err != errRetrievalFailed {
+		t.Errorf("code of unknown block retrieved: %v", err)
+	}
+}
+
+// Tests that servers report the buffer left after serving a request, and drop
+// clients sending requests their buffer can't pay for.
+func TestHandlerFlowControl(t *testing.T) {
+	flow := flowParams{BufLimit: 1000, MinRecharge: 1}
+	s := newTestServer(t, 1, flow)
+	client, server := newTestPeers()
+	errc := make(chan error, 1)
+	go func() { errc <- s.handle(server) }()
+
+	td, head, genesis := s.blockchain.Status()
+	if err := client.Handshake(s.networkId, td, head, 1, genesis, nil); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if client.buffer.params != flow || client.costs.cost(GetBlockBodiesMsg, 1) != 700 {
+		t.Fatalf("flow control parameters mismatch: %+v, body cost %d", client.buffer.params, client.costs.cost(GetBlockBodiesMsg, 1))
+	}
+	if err := client.send(GetBlockBodiesMsg, &getByHashesData{ReqID: 1, Hashes: []common.Hash{head}}); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	msg, err := client.rw.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read answer: %v", err)
+	}
+	var answer blockBodiesData
+	if msg.Code != BlockBodiesMsg || msg.Decode(&answer) != nil {
+		t.Fatalf("invalid answer: %v", msg)
+	}
+	if answer.ReqID != 1 || answer.BV < 300 || answer.BV > 400 || len(answer.Bodies) != 1 {
+		t.Errorf("answer mismatch: request %d, buffer %d, %d bodies", answer.ReqID, answer.BV, len(answer.Bodies))
+	}
+	// The buffer is left short of the cost of another body
+	if err := client.send(GetBlockBodiesMsg, &getByHashesData{ReqID: 2, Hashes: []common.Hash{head}}); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), errCode(ErrRequestRejected).String()) {
+			t.Errorf("error mismatch: have %v, want request rejection", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("client not dropped")
+	}
+	client.rw.(*p2p.MsgPipeRW).Close()
+}
+
+// Tests that answers are only delivered to the request they answer, of the
+// same type and from the peer asked.
+func TestHandlerAnswerMatching(t *testing.T) {
+	client, server := newTestPeers()
+	defer client.rw.(*p2p.MsgPipeRW).Close()
+
+	flow := newFlowParams(100, 1)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake(1, big.NewInt(1), common.Hash{1}, 1, common.Hash{}, &flow) }()
+	if err := client.Handshake(1, big.NewInt(1), common.Hash{}, 0, common.Hash{}, nil); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+	l := newTestClient(t, client)
+
+	header := &types.Header{Number: big.NewInt(1)}
+	req := &headersRequest{peer: client, query: headersQuery{Number: 1, Amount: 1}}
+	done := make(chan error, 1)
+	go func() { done <- l.retriever.retrieve(context.Background(), req) }()
+
+	msg, err := server.rw.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query getBlockHeadersData
+	if msg.Code != GetBlockHeadersMsg || msg.Decode(&query) != nil {
+		t.Fatalf("invalid request: %v", msg)
+	}
+	// Answers of another type or to another request are dropped
+	server.send(CodeMsg, &codeData{ReqID: query.ReqID, Code: [][]byte{{1}}})
+	server.send(BlockHeadersMsg, &blockHeadersData{ReqID: query.ReqID + 1, Headers: []*types.Header{header}})
+	select {
+	case err := <-done:
+		t.Fatalf("request completed by a mismatched answer: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := l.retriever.deliver(client, CodeMsg, query.ReqID, 0, [][]byte{}); err == nil || !strings.Contains(err.Error(), errCode(ErrUnexpectedResponse).String()) {
+		t.Errorf("answer of another type delivered: %v", err)
+	}
+	other, _ := newTestPeers()
+	if err := l.retriever.deliver(other, BlockHeadersMsg, query.ReqID, 0, []*types.Header{header}); err == nil {
+		t.Errorf("answer of another peer delivered")
+	}
+	server.send(BlockHeadersMsg, &blockHeadersData{ReqID: query.ReqID, BV: 10, Headers: []*types.Header{header}})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request not answered")
+	}
+	if len(req.headers) != 1 || req.headers[0].Hash() != header.Hash() {
+		t.Errorf("answer mismatch: %v", req.headers)
+	}
+	if wait := client.buffer.wait(flow.BufLimit); wait == 0 {
+		t.Errorf("buffer value reported by the server not applied")
+	}
+}
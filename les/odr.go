@@ -0,0 +1,345 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/p2p"
+	"github.com/NginProject/ngind/trie"
+)
+
+const (
+	retrieveTimeout = 5 * time.Second // time to wait for a single answer
+	retrieveTries   = 3               // number of peers to try before giving up
+	maxFlowWait     = 2 * time.Second // longest wait for a server's buffer to recharge
+)
+
+var (
+	errRetrievalFailed = errors.New("on-demand retrieval failed")
+	errInvalidAnswer   = errors.New("invalid on-demand retrieval answer")
+)
+
+// odrRequest is a single on-demand retrieval request. Answers are validated
+// against locally known headers before being accepted.
+type odrRequest interface {
+	// code returns the request message code and the number of items asked for.
+	code() (uint64, int)
+	// canServe reports whether the peer is expected to be able to answer.
+	canServe(p *peer) bool
+	// send sends the request to the peer.
+	send(p *peer, reqID uint64) error
+	// validate checks the decoded answer, storing the result in the request.
+	validate(answer interface{}) error
+}
+
+// responseCodes maps the request message codes to the codes of their answers.
+var responseCodes = map[uint64]uint64{
+	GetBlockHeadersMsg: BlockHeadersMsg,
+	GetBlockBodiesMsg:  BlockBodiesMsg,
+	GetReceiptsMsg:     ReceiptsMsg,
+	GetProofsMsg:       ProofsMsg,
+	GetCodeMsg:         CodeMsg,
+}
+
+// pendingRequest is a request waiting for its answer.
+type pendingRequest struct {
+	peer   *peer
+	code   uint64 // message code of the expected answer
+	answer chan interface{}
+}
+
+// retriever sends on-demand requests to light servers and matches the answers.
+type retriever struct {
+	peers *peerSet
+
+	lock    sync.Mutex
+	reqID   uint64
+	pending map[uint64]*pendingRequest
+}
+
+func newRetriever(peers *peerSet) *retriever {
+	return &retriever{peers: peers, pending: make(map[uint64]*pendingRequest)}
+}
+
+// retrieve sends the request to suitable servers until a valid answer arrives,
+// the retry limit is reached or the context is cancelled.
+func (r *retriever) retrieve(ctx context.Context, req odrRequest) error {
+	tried := make(map[*peer]bool)
+	for i := 0; i < retrieveTries; i++ {
+		p, wait := r.selectPeer(req, tried)
+		if p == nil {
+			if i == 0 {
+				return errNoPeers
+			}
+			break
+		}
+		tried[p] = true
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		code, amount := req.code()
+		p.buffer.accept(p.costs.cost(code, amount))
+
+		id, pending := r.register(p, responseCodes[code])
+		if err := req.send(p, id); err != nil {
+			r.unregister(id)
+			continue
+		}
+		select {
+		case answer := <-pending.answer:
+			if err := req.validate(answer); err != nil {
+				glog.V(logger.Debug).Infof("%v: %v: %v", p, errInvalidAnswer, err)
+				p.Disconnect(p2p.DiscUselessPeer)
+				continue
+			}
+			return nil
+		case <-time.After(retrieveTimeout):
+			r.unregister(id)
+			glog.V(logger.Debug).Infof("%v: on-demand request %d timed out", p, id)
+		case <-ctx.Done():
+			r.unregister(id)
+			return ctx.Err()
+		}
+	}
+	return errRetrievalFailed
+}
+
+// selectPeer picks the untried serving peer able to answer the request whose
+// flow control buffer allows sending it soonest.
+func (r *retriever) selectPeer(req odrRequest, tried map[*peer]bool) (*peer, time.Duration) {
+	var (
+		best     *peer
+		bestWait time.Duration
+	)
+	code, amount := req.code()
+	for _, p := range r.peers.AllPeers() {
+		if !p.serving || tried[p] || !req.canServe(p) {
+			continue
+		}
+		wait := p.buffer.wait(p.costs.cost(code, amount))
+		if wait > maxFlowWait {
+			continue
+		}
+		if best == nil || wait < bestWait {
+			best, bestWait = p, wait
+		}
+	}
+	return best, bestWait
+}
+
+func (r *retriever) register(p *peer, code uint64) (uint64, *pendingRequest) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.reqID++
+	pending := &pendingRequest{peer: p, code: code, answer: make(chan interface{}, 1)}
+	r.pending[r.reqID] = pending
+	return r.reqID, pending
+}
+
+func (r *retriever) unregister(id uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, id)
+}
+
+// deliver hands a decoded answer to the request waiting for it. An error is
+// returned if the peer sent an answer nobody asked it for, or an answer of
+// another type than the one asked for.
+func (r *retriever) deliver(p *peer, code, reqID, bv uint64, answer interface{}) error {
+	r.lock.Lock()
+	pending := r.pending[reqID]
+	if pending == nil || pending.peer != p {
+		r.lock.Unlock()
+		return errResp(ErrUnexpectedResponse, "request ID %d", reqID)
+	}
+	if pending.code != code {
+		r.lock.Unlock()
+		return errResp(ErrUnexpectedResponse, "message code %d for request ID %d, want %d", code, reqID, pending.code)
+	}
+	delete(r.pending, reqID)
+	r.lock.Unlock()
+
+	p.buffer.set(bv)
+	pending.answer <- answer
+	return nil
+}
+
+// headersRequest retrieves headers from a given peer.
+type headersRequest struct {
+	peer  *peer
+	query headersQuery
+
+	headers []*types.Header
+}
+
+func (req *headersRequest) code() (uint64, int)   { return GetBlockHeadersMsg, int(req.query.Amount) }
+func (req *headersRequest) canServe(p *peer) bool { return p == req.peer }
+
+func (req *headersRequest) send(p *peer, reqID uint64) error {
+	return p.send(GetBlockHeadersMsg, &getBlockHeadersData{ReqID: reqID, Query: req.query})
+}
+
+func (req *headersRequest) validate(answer interface{}) error {
+	headers, ok := answer.([]*types.Header)
+	if !ok {
+		return fmt.Errorf("answer of type %T instead of headers", answer)
+	}
+	if len(headers) > int(req.query.Amount) {
+		return fmt.Errorf("%d headers returned, %d requested", len(headers), req.query.Amount)
+	}
+	for i := 1; i < len(headers); i++ {
+		if !req.query.Reverse && req.query.Skip == 0 && headers[i].ParentHash != headers[i-1].Hash() {
+			return fmt.Errorf("header %d not a child of header %d", i, i-1)
+		}
+	}
+	req.headers = headers
+	return nil
+}
+
+// bodyRequest retrieves the body of a known block.
+type bodyRequest struct {
+	header *types.Header
+
+	body *types.Body
+}
+
+func (req *bodyRequest) code() (uint64, int) { return GetBlockBodiesMsg, 1 }
+
+func (req *bodyRequest) canServe(p *peer) bool {
+	_, number, _ := p.Head()
+	return number >= req.header.Number.Uint64()
+}
+
+func (req *bodyRequest) send(p *peer, reqID uint64) error {
+	return p.send(GetBlockBodiesMsg, &getByHashesData{ReqID: reqID, Hashes: []common.Hash{req.header.Hash()}})
+}
+
+func (req *bodyRequest) validate(answer interface{}) error {
+	bodies, ok := answer.([]*types.Body)
+	if !ok {
+		return fmt.Errorf("answer of type %T instead of bodies", answer)
+	}
+	if len(bodies) != 1 {
+		return fmt.Errorf("%d bodies returned, 1 requested", len(bodies))
+	}
+	body := bodies[0]
+	if hash := types.DeriveSha(types.Transactions(body.Transactions)); hash != req.header.TxHash {
+		return fmt.Errorf("transaction root mismatch: have %x, want %x", hash, req.header.TxHash)
+	}
+	if hash := types.CalcUncleHash(body.Uncles); hash != req.header.UncleHash {
+		return fmt.Errorf("uncle hash mismatch: have %x, want %x", hash, req.header.UncleHash)
+	}
+	req.body = body
+	return nil
+}
+
+// proofRequest retrieves the Merkle proof of a key in the account trie, or in
+// a storage trie if accKey is set, storing the proof nodes in db.
+type proofRequest struct {
+	header *types.Header
+	root   common.Hash // root of the trie the key is proven in
+	accKey []byte
+	key    []byte
+	db     ngindb.Database
+}
+
+func (req *proofRequest) code() (uint64, int) { return GetProofsMsg, 1 }
+
+func (req *proofRequest) canServe(p *peer) bool {
+	_, number, _ := p.Head()
+	return number >= req.header.Number.Uint64()
+}
+
+func (req *proofRequest) send(p *peer, reqID uint64) error {
+	r := proofReq{BlockHash: req.header.Hash(), AccKey: req.accKey, Key: req.key}
+	return p.send(GetProofsMsg, &getProofsData{ReqID: reqID, Reqs: []proofReq{r}})
+}
+
+func (req *proofRequest) validate(answer interface{}) error {
+	proofs, ok := answer.([][][]byte)
+	if !ok {
+		return fmt.Errorf("answer of type %T instead of proofs", answer)
+	}
+	if len(proofs) != 1 {
+		return fmt.Errorf("%d proofs returned, 1 requested", len(proofs))
+	}
+	nodes, _ := ngindb.NewMemDatabase()
+	for _, node := range proofs[0] {
+		nodes.Put(crypto.Keccak256(node), node)
+	}
+	if _, err, _ := trie.VerifyProof(req.root, crypto.Keccak256(req.key), nodes); err != nil {
+		return err
+	}
+	for _, key := range nodes.Keys() {
+		value, _ := nodes.Get(key)
+		req.db.Put(key, value)
+	}
+	return nil
+}
+
+// codeRequest retrieves the code of an account.
+type codeRequest struct {
+	header   *types.Header
+	accKey   []byte
+	codeHash common.Hash
+
+	data []byte
+}
+
+func (req *codeRequest) code() (uint64, int) { return GetCodeMsg, 1 }
+
+func (req *codeRequest) canServe(p *peer) bool {
+	_, number, _ := p.Head()
+	return number >= req.header.Number.Uint64()
+}
+
+func (req *codeRequest) send(p *peer, reqID uint64) error {
+	r := codeReq{BlockHash: req.header.Hash(), AccKey: req.accKey}
+	return p.send(GetCodeMsg, &getCodeData{ReqID: reqID, Reqs: []codeReq{r}})
+}
+
+func (req *codeRequest) validate(answer interface{}) error {
+	codes, ok := answer.([][]byte)
+	if !ok {
+		return fmt.Errorf("answer of type %T instead of codes", answer)
+	}
+	if len(codes) != 1 {
+		return fmt.Errorf("%d codes returned, 1 requested", len(codes))
+	}
+	if hash := crypto.Keccak256Hash(codes[0]); hash != req.codeHash {
+		return fmt.Errorf("code hash mismatch: have %x, want %x", hash, req.codeHash)
+	}
+	req.data = codes[0]
+	return nil
+}
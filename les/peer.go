@@ -0,0 +1,289 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/p2p"
+)
+
+// PeerInfo represents a short summary of the les sub-protocol metadata known
+// about a connected peer.
+type PeerInfo struct {
+	Version int      `json:"version"` // les protocol version negotiated
+	Head    string   `json:"head"`    // SHA3 hash of the peer's best owned block
+	HeadNum uint64   `json:"headNumber"`
+	TD      *big.Int `json:"difficulty"` // Total difficulty of the peer's blockchain
+	Serving bool     `json:"serving"`    // Whether the peer answers light requests
+}
+
+type peer struct {
+	*p2p.Peer
+	rw p2p.MsgReadWriter
+
+	id      string
+	version int
+
+	lock    sync.RWMutex
+	head    common.Hash
+	headNum uint64
+	td      *big.Int
+
+	serving bool      // remote answers light requests (client side)
+	costs   costTable // remote's request costs (client side)
+	buffer  *buffer   // client: estimated buffer at the server, server: the client's buffer
+}
+
+func newPeer(version int, p *p2p.Peer, rw p2p.MsgReadWriter) *peer {
+	id := p.ID()
+	return &peer{
+		Peer:    p,
+		rw:      rw,
+		version: version,
+		id:      fmt.Sprintf("%x", id[:8]),
+	}
+}
+
+// Info gathers and returns a collection of metadata known about a peer.
+func (p *peer) Info() *PeerInfo {
+	hash, num, td := p.Head()
+	return &PeerInfo{
+		Version: p.version,
+		Head:    hash.Hex(),
+		HeadNum: num,
+		TD:      td,
+		Serving: p.serving,
+	}
+}
+
+// Head retrieves the latest announced head of the peer.
+func (p *peer) Head() (hash common.Hash, number uint64, td *big.Int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.head, p.headNum, new(big.Int).Set(p.td)
+}
+
+// SetHead updates the head of the peer.
+func (p *peer) SetHead(hash common.Hash, number uint64, td *big.Int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.head, p.headNum, p.td = hash, number, new(big.Int).Set(td)
+}
+
+// send writes a message to the peer.
+func (p *peer) send(code uint64, data interface{}) error {
+	_, err := p2p.Send(p.rw, code, data)
+	return err
+}
+
+// Handshake executes the les protocol handshake, negotiating version number,
+// network IDs, difficulties, head and genesis blocks and, if we serve light
+// clients, announcing our flow control parameters and costs.
+func (p *peer) Handshake(network uint64, td *big.Int, head common.Hash, headNum uint64, genesis common.Hash, serve *flowParams) error {
+	ours := &statusData{
+		ProtocolVersion: uint32(p.version),
+		NetworkId:       uint32(network),
+		TD:              td,
+		Head:            head,
+		HeadNum:         headNum,
+		Genesis:         genesis,
+	}
+	if serve != nil {
+		ours.Serve = true
+		ours.BufLimit, ours.MinRecharge = serve.BufLimit, serve.MinRecharge
+		ours.Costs = defaultCosts
+	}
+	errc := make(chan error, 2)
+	var status statusData // safe to read after two values have been received from errc
+
+	go func() {
+		errc <- p.send(StatusMsg, ours)
+	}()
+	go func() {
+		errc <- p.readStatus(network, &status, genesis)
+	}()
+	timeout := time.NewTimer(handshakeTimeout)
+	defer timeout.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				return err
+			}
+		case <-timeout.C:
+			return p2p.DiscReadTimeout
+		}
+	}
+	p.head, p.headNum, p.td = status.Head, status.HeadNum, status.TD
+	if status.Serve {
+		p.serving = true
+		p.costs = newCostTable(status.Costs)
+		p.buffer = newBuffer(flowParams{BufLimit: status.BufLimit, MinRecharge: status.MinRecharge})
+	}
+	if serve != nil {
+		p.buffer = newBuffer(*serve)
+	}
+	return nil
+}
+
+func (p *peer) readStatus(network uint64, status *statusData, genesis common.Hash) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer msg.Discard()
+
+	if msg.Code != StatusMsg {
+		return errResp(ErrNoStatusMsg, "first msg has code %x (!= %x)", msg.Code, StatusMsg)
+	}
+	if msg.Size > ProtocolMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
+	}
+	if err := msg.Decode(status); err != nil {
+		return errResp(ErrDecode, "msg %v: %v", msg, err)
+	}
+	if status.Genesis != genesis {
+		return errResp(ErrGenesisBlockMismatch, "%x (!= %x)", status.Genesis[:8], genesis[:8])
+	}
+	if uint64(status.NetworkId) != network {
+		return errResp(ErrNetworkIdMismatch, "%d (!= %d)", status.NetworkId, network)
+	}
+	if int(status.ProtocolVersion) != p.version {
+		return errResp(ErrProtocolVersionMismatch, "%d (!= %d)", status.ProtocolVersion, p.version)
+	}
+	if status.TD == nil {
+		return errResp(ErrDecode, "missing total difficulty")
+	}
+	return nil
+}
+
+// String implements fmt.Stringer.
+func (p *peer) String() string {
+	return fmt.Sprintf("Peer %s [%s]", p.id,
+		fmt.Sprintf("les/%2d", p.version),
+	)
+}
+
+// peerSet represents the collection of active peers participating in the les
+// sub-protocol.
+type peerSet struct {
+	peers  map[string]*peer
+	lock   sync.RWMutex
+	closed bool
+}
+
+// newPeerSet creates a new peer set to track the active participants.
+func newPeerSet() *peerSet {
+	return &peerSet{
+		peers: make(map[string]*peer),
+	}
+}
+
+// Register injects a new peer into the working set, or returns an error if the
+// peer is already known.
+func (ps *peerSet) Register(p *peer) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ps.closed {
+		return errClosed
+	}
+	if _, ok := ps.peers[p.id]; ok {
+		return errAlreadyRegistered
+	}
+	ps.peers[p.id] = p
+	return nil
+}
+
+// Unregister removes a remote peer from the active set.
+func (ps *peerSet) Unregister(id string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if _, ok := ps.peers[id]; !ok {
+		return errNotRegistered
+	}
+	delete(ps.peers, id)
+	return nil
+}
+
+// Peer retrieves the registered peer with the given id.
+func (ps *peerSet) Peer(id string) *peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.peers[id]
+}
+
+// Len returns the current number of peers in the set.
+func (ps *peerSet) Len() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.peers)
+}
+
+// AllPeers returns all peers in the set.
+func (ps *peerSet) AllPeers() []*peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	list := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		list = append(list, p)
+	}
+	return list
+}
+
+// BestPeer retrieves the serving peer with the currently highest total difficulty.
+func (ps *peerSet) BestPeer() *peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		bestPeer *peer
+		bestTd   *big.Int
+	)
+	for _, p := range ps.peers {
+		if !p.serving {
+			continue
+		}
+		if _, _, td := p.Head(); bestPeer == nil || td.Cmp(bestTd) > 0 {
+			bestPeer, bestTd = p, td
+		}
+	}
+	return bestPeer
+}
+
+// Close disconnects all peers.
+// No new peers can be registered after Close has returned.
+func (ps *peerSet) Close() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for _, p := range ps.peers {
+		p.Disconnect(p2p.DiscQuitting)
+	}
+	ps.closed = true
+}
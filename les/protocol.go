@@ -0,0 +1,227 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+// Package les implements the light client sub-protocol: a server side which
+// answers on-demand retrieval requests of full nodes' chain data with flow
+// control, and a light client backend which syncs headers only and fetches
+// everything else, verified against them, from light servers.
+package les
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/types"
+)
+
+// Official short name of the protocol used during capability negotiation.
+var ProtocolName = "les"
+
+// Supported versions of the les protocol (first is primary).
+var ProtocolVersions = []uint{1}
+
+// Number of implemented messages corresponding to different protocol versions.
+var ProtocolLengths = []uint64{13}
+
+const (
+	ProtocolMaxMsgSize = 10 * 1024 * 1024 // Maximum cap on the size of a protocol message
+
+	handshakeTimeout = 5 * time.Second
+)
+
+// les protocol message codes
+const (
+	StatusMsg          = 0x00
+	AnnounceMsg        = 0x01
+	GetBlockHeadersMsg = 0x02
+	BlockHeadersMsg    = 0x03
+	GetBlockBodiesMsg  = 0x04
+	BlockBodiesMsg     = 0x05
+	GetReceiptsMsg     = 0x06
+	ReceiptsMsg        = 0x07
+	GetProofsMsg       = 0x08
+	ProofsMsg          = 0x09
+	GetCodeMsg         = 0x0a
+	CodeMsg            = 0x0b
+	SendTxMsg          = 0x0c
+)
+
+// Maximum number of items a client may ask for in a single request.
+const (
+	MaxHeaderFetch  = 192
+	MaxBodyFetch    = 32
+	MaxReceiptFetch = 128
+	MaxProofsFetch  = 64
+	MaxCodeFetch    = 64
+	MaxTxSend       = 64
+)
+
+type errCode int
+
+const (
+	ErrMsgTooLarge = iota
+	ErrDecode
+	ErrInvalidMsgCode
+	ErrProtocolVersionMismatch
+	ErrNetworkIdMismatch
+	ErrGenesisBlockMismatch
+	ErrNoStatusMsg
+	ErrExtraStatusMsg
+	ErrRequestRejected
+	ErrUnexpectedResponse
+	ErrInvalidResponse
+	ErrTooManyClients
+)
+
+func (e errCode) String() string {
+	return errorToString[int(e)]
+}
+
+var errorToString = map[int]string{
+	ErrMsgTooLarge:             "Message too long",
+	ErrDecode:                  "Invalid message",
+	ErrInvalidMsgCode:          "Invalid message code",
+	ErrProtocolVersionMismatch: "Protocol version mismatch",
+	ErrNetworkIdMismatch:       "NetworkId mismatch",
+	ErrGenesisBlockMismatch:    "Genesis block mismatch",
+	ErrNoStatusMsg:             "No status message",
+	ErrExtraStatusMsg:          "Extra status message",
+	ErrRequestRejected:         "Request rejected",
+	ErrUnexpectedResponse:      "Unexpected response",
+	ErrInvalidResponse:         "Invalid response",
+	ErrTooManyClients:          "Too many light clients",
+}
+
+func errResp(code errCode, format string, v ...interface{}) error {
+	return fmt.Errorf("%v - %v", code, fmt.Sprintf(format, v...))
+}
+
+var (
+	errClosed            = errors.New("peer set is closed")
+	errAlreadyRegistered = errors.New("peer is already registered")
+	errNotRegistered     = errors.New("peer is not registered")
+	errNoPeers           = errors.New("no suitable light server available")
+	errNotServing        = errors.New("peer does not serve light clients")
+)
+
+// statusData is the network packet for the status message. Servers announce
+// their flow control parameters, clients leave them empty.
+type statusData struct {
+	ProtocolVersion uint32
+	NetworkId       uint32
+	TD              *big.Int
+	Head            common.Hash
+	HeadNum         uint64
+	Genesis         common.Hash
+
+	Serve       bool          // whether the peer answers light requests
+	BufLimit    uint64        // size of the client's request buffer, in cost units
+	MinRecharge uint64        // guaranteed buffer recharge rate, in cost units per millisecond
+	Costs       []requestCost // cost table of the served requests
+}
+
+// announceData is the network packet for new chain head announcements.
+type announceData struct {
+	Hash   common.Hash
+	Number uint64
+	TD     *big.Int
+}
+
+// headersQuery represents a block header query. Zero Hash selects the origin
+// by Number.
+type headersQuery struct {
+	Hash    common.Hash // Block hash from which to retrieve headers (excludes Number)
+	Number  uint64      // Block number from which to retrieve headers (excludes Hash)
+	Amount  uint64      // Maximum number of headers to retrieve
+	Skip    uint64      // Blocks to skip between consecutive headers
+	Reverse bool        // Query direction (false = rising towards latest, true = falling towards genesis)
+}
+
+// getBlockHeadersData is the network packet of header requests.
+type getBlockHeadersData struct {
+	ReqID uint64
+	Query headersQuery
+}
+
+// getByHashesData is the network packet of body and receipt requests.
+type getByHashesData struct {
+	ReqID  uint64
+	Hashes []common.Hash
+}
+
+// proofReq is a Merkle proof request for a single key of the account trie, or
+// of the storage trie of the account with key hash AccKey if it's non-empty.
+// Key is the unhashed trie key, the server proves its hash.
+type proofReq struct {
+	BlockHash common.Hash
+	AccKey    []byte
+	Key       []byte
+	FromLevel uint
+}
+
+// getProofsData is the network packet of proof requests.
+type getProofsData struct {
+	ReqID uint64
+	Reqs  []proofReq
+}
+
+// codeReq is a request for the code of the account with key hash AccKey in
+// the state of the given block.
+type codeReq struct {
+	BlockHash common.Hash
+	AccKey    []byte
+}
+
+// getCodeData is the network packet of code requests.
+type getCodeData struct {
+	ReqID uint64
+	Reqs  []codeReq
+}
+
+// responseHeader is decoded from the beginning of every response: the request
+// ID it answers and the server's buffer value after serving it.
+type responseHeader struct {
+	ReqID, BV uint64
+}
+
+type blockHeadersData struct {
+	ReqID, BV uint64
+	Headers   []*types.Header
+}
+
+type blockBodiesData struct {
+	ReqID, BV uint64
+	Bodies    []*types.Body
+}
+
+type receiptsData struct {
+	ReqID, BV uint64
+	Receipts  []types.Receipts
+}
+
+// proofsData carries one list of RLP encoded trie nodes per proof request.
+type proofsData struct {
+	ReqID, BV uint64
+	Proofs    [][][]byte
+}
+
+type codeData struct {
+	ReqID, BV uint64
+	Code      [][]byte
+}
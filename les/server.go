@@ -0,0 +1,428 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
+	"github.com/NginProject/ngind/core/state"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/event"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngin"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/p2p"
+	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/rlp"
+	"github.com/NginProject/ngind/rpc"
+	"github.com/NginProject/ngind/trie"
+)
+
+// softResponseLimit is the target maximum size of replies to data retrievals.
+const softResponseLimit = 2 * 1024 * 1024
+
+// Server answers the light client requests of connected peers from the chain
+// of a full node. It implements node.Service.
+type Server struct {
+	networkId  uint64
+	maxClients int
+	flow       flowParams
+	costs      costTable
+
+	blockchain *core.BlockChain
+	chainDb    ngindb.Database
+	triedb     trie.Database // state trie nodes, cached in memory if pruning
+	txPool     *core.TxPool
+	eventMux   *event.TypeMux
+
+	peers        *peerSet
+	SubProtocols []p2p.Protocol
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer creates a light server on top of a full node. servePercent is the
+// share of time the node is willing to spend serving light clients, which is
+// split evenly between at most maxClients clients.
+func NewServer(full *ngin.Ngin, servePercent, maxClients int) (*Server, error) {
+	if servePercent <= 0 || servePercent > 100 {
+		return nil, fmt.Errorf("invalid light serving percentage %d, want 1-100", servePercent)
+	}
+	s := &Server{
+		networkId:  uint64(full.NetVersion()),
+		maxClients: maxClients,
+		flow:       newFlowParams(servePercent, maxClients),
+		costs:      newCostTable(defaultCosts),
+		blockchain: full.BlockChain(),
+		chainDb:    full.ChainDb(),
+		txPool:     full.TxPool(),
+		eventMux:   full.EventMux(),
+		peers:      newPeerSet(),
+		quit:       make(chan struct{}),
+	}
+	s.triedb = s.chainDb
+	if cache := state.NodeCache(s.blockchain.StateDatabase()); cache != nil {
+		s.triedb = cache
+	}
+	for i, version := range ProtocolVersions {
+		version := version // Closure for the run
+		s.SubProtocols = append(s.SubProtocols, p2p.Protocol{
+			Name:    ProtocolName,
+			Version: version,
+			Length:  ProtocolLengths[i],
+			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+				s.wg.Add(1)
+				defer s.wg.Done()
+				return s.handle(newPeer(int(version), p, rw))
+			},
+			PeerInfo: func(id discover.NodeID) interface{} {
+				if p := s.peers.Peer(fmt.Sprintf("%x", id[:8])); p != nil {
+					return p.Info()
+				}
+				return nil
+			},
+		})
+	}
+	glog.V(logger.Info).Infof("Serving light clients: %d%% of time, max %d clients, buffer=%d recharge=%d/ms", servePercent, maxClients, s.flow.BufLimit, s.flow.MinRecharge)
+	return s, nil
+}
+
+// Protocols implements node.Service, returning the les protocol.
+func (s *Server) Protocols() []p2p.Protocol {
+	return s.SubProtocols
+}
+
+// APIs implements node.Service. The light server has no APIs of its own.
+func (s *Server) APIs() []rpc.API {
+	return nil
+}
+
+// Start implements node.Service, starting the head announcement loop.
+func (s *Server) Start(srvr *p2p.Server) error {
+	sub := s.eventMux.Subscribe(core.ChainHeadEvent{})
+	s.wg.Add(1)
+	go s.announceLoop(sub)
+	return nil
+}
+
+// Stop implements node.Service, disconnecting all light clients.
+func (s *Server) Stop() error {
+	close(s.quit)
+	s.peers.Close()
+	s.wg.Wait()
+	return nil
+}
+
+// announceLoop announces every new chain head to the connected clients.
+func (s *Server) announceLoop(sub event.Subscription) {
+	defer s.wg.Done()
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case ev, ok := <-sub.Chan():
+			if !ok {
+				return
+			}
+			head, ok := ev.Data.(core.ChainHeadEvent)
+			if !ok {
+				continue
+			}
+			hash := head.Block.Hash()
+			announce := &announceData{Hash: hash, Number: head.Block.NumberU64(), TD: s.blockchain.GetTd(hash)}
+			if announce.TD == nil {
+				continue
+			}
+			for _, p := range s.peers.AllPeers() {
+				if err := p.send(AnnounceMsg, announce); err != nil {
+					glog.V(logger.Debug).Infof("%v: announce failed: %v", p, err)
+				}
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// handle is the callback invoked to manage the life cycle of a light client.
+// When this function terminates, the peer is disconnected.
+func (s *Server) handle(p *peer) error {
+	if s.peers.Len() >= s.maxClients && !p.Peer.Info().Network.Trusted {
+		return p2p.DiscTooManyPeers
+	}
+	td, head, genesis := s.blockchain.Status()
+	headNum := s.blockchain.CurrentBlock().NumberU64()
+	if err := p.Handshake(s.networkId, td, head, headNum, genesis, &s.flow); err != nil {
+		glog.V(logger.Debug).Infof("%v: handshake failed: %v", p, err)
+		return err
+	}
+	if err := s.peers.Register(p); err != nil {
+		return err
+	}
+	defer s.peers.Unregister(p.id)
+	glog.V(logger.Debug).Infof("%v: light client connected", p)
+
+	for {
+		if err := s.handleMsg(p); err != nil {
+			glog.V(logger.Debug).Infof("%v: message handling failed: %v", p, err)
+			return err
+		}
+	}
+}
+
+// charge deducts the cost of a request from the client's buffer, returning the
+// remaining buffer value to report in the response.
+func (s *Server) charge(p *peer, code uint64, amount int) (uint64, error) {
+	ok, bv := p.buffer.accept(s.costs.cost(code, amount))
+	if !ok {
+		return 0, errResp(ErrRequestRejected, "flow control buffer exceeded (code %d, amount %d)", code, amount)
+	}
+	return bv, nil
+}
+
+// handleMsg is invoked whenever an inbound message is received from a remote
+// light client. The remote connection is torn down upon returning any error.
+func (s *Server) handleMsg(p *peer) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Size > ProtocolMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
+	}
+	defer msg.Discard()
+
+	switch msg.Code {
+	case StatusMsg:
+		return errResp(ErrExtraStatusMsg, "uncontrolled status message")
+
+	case GetBlockHeadersMsg:
+		var req getBlockHeadersData
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if req.Query.Amount > MaxHeaderFetch {
+			req.Query.Amount = MaxHeaderFetch
+		}
+		bv, err := s.charge(p, msg.Code, int(req.Query.Amount))
+		if err != nil {
+			return err
+		}
+		return p.send(BlockHeadersMsg, &blockHeadersData{ReqID: req.ReqID, BV: bv, Headers: s.getHeaders(req.Query)})
+
+	case GetBlockBodiesMsg:
+		var req getByHashesData
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if len(req.Hashes) > MaxBodyFetch {
+			return errResp(ErrRequestRejected, "%d bodies requested, max %d", len(req.Hashes), MaxBodyFetch)
+		}
+		bv, err := s.charge(p, msg.Code, len(req.Hashes))
+		if err != nil {
+			return err
+		}
+		var (
+			bodies []*types.Body
+			bytes  int
+		)
+		for _, hash := range req.Hashes {
+			if bytes >= softResponseLimit {
+				break
+			}
+			body := core.GetBody(s.chainDb, hash)
+			if body == nil {
+				body = new(types.Body)
+			}
+			bodies = append(bodies, body)
+			bytes += len(core.GetBodyRLP(s.chainDb, hash))
+		}
+		return p.send(BlockBodiesMsg, &blockBodiesData{ReqID: req.ReqID, BV: bv, Bodies: bodies})
+
+	case GetReceiptsMsg:
+		var req getByHashesData
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if len(req.Hashes) > MaxReceiptFetch {
+			return errResp(ErrRequestRejected, "%d receipts requested, max %d", len(req.Hashes), MaxReceiptFetch)
+		}
+		bv, err := s.charge(p, msg.Code, len(req.Hashes))
+		if err != nil {
+			return err
+		}
+		receipts := make([]types.Receipts, 0, len(req.Hashes))
+		for _, hash := range req.Hashes {
+			receipts = append(receipts, core.GetBlockReceipts(s.chainDb, hash))
+		}
+		return p.send(ReceiptsMsg, &receiptsData{ReqID: req.ReqID, BV: bv, Receipts: receipts})
+
+	case GetProofsMsg:
+		var req getProofsData
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if len(req.Reqs) > MaxProofsFetch {
+			return errResp(ErrRequestRejected, "%d proofs requested, max %d", len(req.Reqs), MaxProofsFetch)
+		}
+		bv, err := s.charge(p, msg.Code, len(req.Reqs))
+		if err != nil {
+			return err
+		}
+		proofs := make([][][]byte, 0, len(req.Reqs))
+		for _, r := range req.Reqs {
+			proofs = append(proofs, s.getProof(r))
+		}
+		return p.send(ProofsMsg, &proofsData{ReqID: req.ReqID, BV: bv, Proofs: proofs})
+
+	case GetCodeMsg:
+		var req getCodeData
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if len(req.Reqs) > MaxCodeFetch {
+			return errResp(ErrRequestRejected, "%d codes requested, max %d", len(req.Reqs), MaxCodeFetch)
+		}
+		bv, err := s.charge(p, msg.Code, len(req.Reqs))
+		if err != nil {
+			return err
+		}
+		codes := make([][]byte, 0, len(req.Reqs))
+		for _, r := range req.Reqs {
+			var code []byte
+			if acc := s.getAccount(r.BlockHash, r.AccKey); acc != nil {
+				code, _ = s.triedb.Get(acc.CodeHash)
+			}
+			codes = append(codes, code)
+		}
+		return p.send(CodeMsg, &codeData{ReqID: req.ReqID, BV: bv, Code: codes})
+
+	case SendTxMsg:
+		var txs []*types.Transaction
+		if err := msg.Decode(&txs); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if len(txs) > MaxTxSend {
+			return errResp(ErrRequestRejected, "%d transactions sent, max %d", len(txs), MaxTxSend)
+		}
+		if _, err := s.charge(p, msg.Code, len(txs)); err != nil {
+			return err
+		}
+		s.txPool.AddTransactions(txs)
+		return nil
+
+	default:
+		return errResp(ErrInvalidMsgCode, "%v", msg.Code)
+	}
+}
+
+// getHeaders gathers the headers satisfying the query.
+func (s *Server) getHeaders(query headersQuery) []*types.Header {
+	var headers []*types.Header
+	for len(headers) < int(query.Amount) {
+		var origin *types.Header
+		if query.Hash != (common.Hash{}) {
+			origin = s.blockchain.GetHeader(query.Hash)
+		} else {
+			origin = s.blockchain.GetHeaderByNumber(query.Number)
+		}
+		if origin == nil {
+			break
+		}
+		headers = append(headers, origin)
+
+		// Advance to the next header of the query. Hash based queries continue
+		// by number along the canonical chain once the origin is found.
+		number := origin.Number.Uint64()
+		query.Hash = common.Hash{}
+		if query.Reverse {
+			if number < query.Skip+1 {
+				break
+			}
+			query.Number = number - (query.Skip + 1)
+		} else {
+			next := number + query.Skip + 1
+			if next <= number {
+				break
+			}
+			query.Number = next
+		}
+	}
+	return headers
+}
+
+// getAccount retrieves the account with the given key hash from the state of
+// the given block.
+func (s *Server) getAccount(blockHash common.Hash, accKey []byte) *state.Account {
+	header := s.blockchain.GetHeader(blockHash)
+	if header == nil {
+		return nil
+	}
+	tr, err := trie.New(header.Root, s.triedb)
+	if err != nil {
+		return nil
+	}
+	enc, err := tr.TryGet(accKey)
+	if err != nil || len(enc) == 0 {
+		return nil
+	}
+	var acc state.Account
+	if err := rlp.DecodeBytes(enc, &acc); err != nil {
+		return nil
+	}
+	return &acc
+}
+
+// getProof creates the Merkle proof of a single key. An empty proof is returned
+// if the requested block or account is unknown.
+func (s *Server) getProof(req proofReq) [][]byte {
+	header := s.blockchain.GetHeader(req.BlockHash)
+	if header == nil {
+		return nil
+	}
+	root := header.Root
+	if len(req.AccKey) > 0 {
+		acc := s.getAccount(req.BlockHash, req.AccKey)
+		if acc == nil {
+			return nil
+		}
+		root = acc.Root
+	}
+	tr, err := trie.New(root, s.triedb)
+	if err != nil {
+		return nil
+	}
+	var proof proofList
+	if err := tr.Prove(crypto.Keccak256(req.Key), req.FromLevel, &proof); err != nil {
+		return nil
+	}
+	return proof
+}
+
+// proofList collects the nodes of a Merkle proof in order.
+type proofList [][]byte
+
+func (l *proofList) Put(key []byte, value []byte) error {
+	*l = append(*l, common.CopyBytes(value))
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core/state"
+	"github.com/NginProject/ngind/core/types"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/trie"
+)
+
+var emptyCodeHash = crypto.Keccak256Hash(nil)
+
+// odrDatabase is a state.Database retrieving the state of a single block on
+// demand. Trie nodes and code fetched from servers are kept in memory for the
+// lifetime of the database, which is meant to serve a single API call.
+type odrDatabase struct {
+	ctx    context.Context
+	header *types.Header
+	r      *retriever
+	nodes  *ngindb.MemDatabase
+}
+
+func newOdrDatabase(ctx context.Context, header *types.Header, r *retriever) *odrDatabase {
+	nodes, _ := ngindb.NewMemDatabase()
+	return &odrDatabase{ctx: ctx, header: header, r: r, nodes: nodes}
+}
+
+// newOdrState returns the state of the given block, retrieved on demand.
+func newOdrState(ctx context.Context, header *types.Header, r *retriever) (*state.StateDB, error) {
+	return state.New(header.Root, newOdrDatabase(ctx, header, r))
+}
+
+func (db *odrDatabase) OpenTrie(root common.Hash) (state.Trie, error) {
+	return &odrTrie{db: db, root: root}, nil
+}
+
+func (db *odrDatabase) OpenStorageTrie(addrHash, root common.Hash) (state.Trie, error) {
+	return &odrTrie{db: db, root: root, accKey: addrHash[:]}, nil
+}
+
+func (db *odrDatabase) CopyTrie(t state.Trie) state.Trie {
+	switch t := t.(type) {
+	case *odrTrie:
+		cpy := *t
+		if t.trie != nil {
+			cpy.trie = t.trie.Copy()
+		}
+		return &cpy
+	default:
+		panic(fmt.Errorf("unknown trie type %T", t))
+	}
+}
+
+func (db *odrDatabase) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
+	if codeHash == emptyCodeHash {
+		return nil, nil
+	}
+	if code, err := db.nodes.Get(codeHash[:]); err == nil {
+		return code, nil
+	}
+	req := &codeRequest{header: db.header, accKey: addrHash[:], codeHash: codeHash}
+	if err := db.r.retrieve(db.ctx, req); err != nil {
+		return nil, err
+	}
+	db.nodes.Put(codeHash[:], req.data)
+	return req.data, nil
+}
+
+func (db *odrDatabase) ContractCodeSize(addrHash, codeHash common.Hash) (int, error) {
+	code, err := db.ContractCode(addrHash, codeHash)
+	return len(code), err
+}
+
+// odrTrie is a state.Trie whose nodes are retrieved on demand by requesting
+// the Merkle proofs of the accessed keys.
+type odrTrie struct {
+	db     *odrDatabase
+	root   common.Hash
+	accKey []byte // key hash of the account owning the storage trie, nil for the account trie
+	trie   *trie.SecureTrie
+}
+
+func (t *odrTrie) TryGet(key []byte) ([]byte, error) {
+	var value []byte
+	err := t.do(key, func() (err error) {
+		value, err = t.trie.TryGet(key)
+		return err
+	})
+	return value, err
+}
+
+func (t *odrTrie) TryUpdate(key, value []byte) error {
+	return t.do(key, func() error {
+		return t.trie.TryUpdate(key, value)
+	})
+}
+
+func (t *odrTrie) TryDelete(key []byte) error {
+	return t.do(key, func() error {
+		return t.trie.TryDelete(key)
+	})
+}
+
+func (t *odrTrie) CommitTo(db trie.DatabaseWriter) (common.Hash, error) {
+	if t.trie == nil {
+		return t.root, nil
+	}
+	return t.trie.CommitTo(db)
+}
+
+func (t *odrTrie) Hash() common.Hash {
+	if t.trie == nil {
+		return t.root
+	}
+	return t.trie.Hash()
+}
+
+// NodeIterator iterates the nodes retrieved so far, it doesn't fetch any.
+func (t *odrTrie) NodeIterator(startKey []byte) trie.NodeIterator {
+	if t.trie == nil {
+		tr, _ := trie.NewSecure(common.Hash{}, t.db.nodes, 0)
+		return tr.NodeIterator(startKey)
+	}
+	return t.trie.NodeIterator(startKey)
+}
+
+func (t *odrTrie) GetKey(shaKey []byte) []byte {
+	if t.trie == nil {
+		return nil
+	}
+	return t.trie.GetKey(shaKey)
+}
+
+// do runs fn, retrieving the proof of key and retrying whenever it fails on a
+// missing trie node. It gives up if the proof doesn't contain the node.
+func (t *odrTrie) do(key []byte, fn func() error) error {
+	var lastMissing common.Hash
+	for {
+		var err error
+		if t.trie == nil {
+			t.trie, err = trie.NewSecure(t.root, t.db.nodes, 0)
+		}
+		if err == nil {
+			err = fn()
+		}
+		missing, ok := err.(*trie.MissingNodeError)
+		if !ok {
+			return err
+		}
+		if missing.NodeHash == lastMissing {
+			return err
+		}
+		lastMissing = missing.NodeHash
+
+		req := &proofRequest{header: t.db.header, root: t.root, accKey: t.accKey, key: key, db: t.db.nodes}
+		if err := t.db.r.retrieve(t.db.ctx, req); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"time"
+
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/p2p"
+)
+
+const (
+	forceSyncCycle  = 10 * time.Second // Time interval to force syncs, even if few peers are available
+	headerCheckFreq = 100              // Verify the proof of work of every n-th header
+)
+
+// triggerSync schedules a synchronisation round without blocking.
+func (l *LightNgin) triggerSync() {
+	select {
+	case l.syncCh <- struct{}{}:
+	default:
+	}
+}
+
+// syncLoop synchronises the header chain with the best light server whenever
+// one connects or announces a new head, and periodically in between.
+func (l *LightNgin) syncLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(forceSyncCycle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.syncCh:
+			l.synchronise(l.peers.BestPeer())
+		case <-ticker.C:
+			l.synchronise(l.peers.BestPeer())
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+// synchronise downloads the headers of the given peer's chain if its total
+// difficulty is higher than ours. Headers are fetched in ascending batches
+// from our head; if the peer's chain forked off below it, the starting point
+// is moved back until a known ancestor is found.
+func (l *LightNgin) synchronise(p *peer) {
+	if p == nil {
+		return
+	}
+	td, _, _, _ := l.chain.Status()
+	_, peerNum, peerTd := p.Head()
+	if peerTd.Cmp(td) <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-l.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	start := time.Now()
+	from := l.chain.CurrentHeader().Number.Uint64()
+	glog.V(logger.Debug).Infof("%v: synchronising headers from #%d to #%d", p, from, peerNum)
+	for from < peerNum {
+		req := &headersRequest{peer: p, query: headersQuery{Number: from + 1, Amount: MaxHeaderFetch}}
+		if err := l.retriever.retrieve(ctx, req); err != nil {
+			glog.V(logger.Debug).Infof("%v: header retrieval failed: %v", p, err)
+			return
+		}
+		if len(req.headers) == 0 {
+			return
+		}
+		if !l.chain.HasHeader(req.headers[0].ParentHash) {
+			if from == 0 {
+				glog.V(logger.Debug).Infof("%v: no common ancestor, dropping", p)
+				p.Disconnect(p2p.DiscUselessPeer)
+				return
+			}
+			if from > MaxHeaderFetch {
+				from -= MaxHeaderFetch
+			} else {
+				from = 0
+			}
+			continue
+		}
+		if res := l.chain.InsertHeaderChain(req.headers, headerCheckFreq); res.Error != nil {
+			glog.V(logger.Debug).Infof("%v: invalid header #%d: %v", p, req.headers[res.Index].Number, res.Error)
+			p.Disconnect(p2p.DiscUselessPeer)
+			return
+		}
+		from = req.headers[len(req.headers)-1].Number.Uint64()
+	}
+	head := l.chain.CurrentHeader()
+	glog.V(logger.Info).Infof("Light client synchronised to #%d [%x…] in %v", head.Number, head.Hash().Bytes()[:4], time.Since(start))
+}
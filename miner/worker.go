@@ -268,7 +268,10 @@ func (self *worker) wait() {
 				}
 				go self.mux.Post(core.NewMinedBlockEvent{Block: block})
 			} else {
-				work.state.CommitTo(self.chainDb, false)
+				if err := self.chain.WriteBlockState(block, work.state); err != nil {
+					glog.V(logger.Error).Infoln("error writing mined block state", err)
+					continue
+				}
 				parent := self.chain.GetBlock(block.ParentHash())
 				if parent == nil {
 					glog.V(logger.Error).Infoln("Invalid block found during mining")
@@ -33,6 +33,7 @@ import (
 	"time"
 
 	"github.com/NginProject/ngind/accounts"
+	"github.com/NginProject/ngind/accounts/typeddata"
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/common/compiler"
 	"github.com/NginProject/ngind/common/hexutil"
@@ -86,7 +87,7 @@ func stateAndBlockByNumber(m *miner.Miner, bc *core.BlockChain, blockNr rpc.Bloc
 	if block == nil {
 		return nil, nil, nil
 	}
-	stateDb, err := state.New(block.Root(), state.NewDatabase(chainDb))
+	stateDb, err := bc.StateAtBlock(block)
 	return stateDb, block, err
 }
 
@@ -521,6 +522,119 @@ func (s *PrivateAccountAPI) SignAndSendTransaction(args SendTxArgs, passwd strin
 	return s.SendTransaction(args, passwd)
 }
 
+// NewHDWalletResult is the result of NewHDWallet, the mnemonic of the wallet is
+// only ever returned here.
+type NewHDWalletResult struct {
+	Mnemonic string            `json:"mnemonic"`
+	Wallet   accounts.HDWallet `json:"wallet"`
+}
+
+// parseBasePath parses an optional derivation path, the default base path if nil.
+func parseBasePath(path *string) (accounts.DerivationPath, error) {
+	if path == nil || *path == "" {
+		return accounts.DefaultBaseDerivationPath, nil
+	}
+	return accounts.ParseDerivationPath(*path)
+}
+
+// NewHDWallet creates an HD wallet from a new 24 words mnemonic, protected by the
+// optional mnemonic passphrase, and derives its first account under basePath,
+// m/44'/60'/0'/0 by default. The wallet seed is stored encrypted with password.
+// The mnemonic is not stored, it must be written down to restore the wallet.
+func (s *PrivateAccountAPI) NewHDWallet(password string, mnemonicPassword *string, basePath *string) (*NewHDWalletResult, error) {
+	base, err := parseBasePath(basePath)
+	if err != nil {
+		return nil, err
+	}
+	mnemonic, err := accounts.NewMnemonic(accounts.DefaultMnemonicBits)
+	if err != nil {
+		return nil, err
+	}
+	var mnemonicPass string
+	if mnemonicPassword != nil {
+		mnemonicPass = *mnemonicPassword
+	}
+	w, err := s.am.ImportHDWallet(mnemonic, mnemonicPass, password, base)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.am.DeriveHDAccount(w.ID, nil, password); err != nil {
+		return nil, err
+	}
+	if w, err = s.am.HDWallet(w.ID); err != nil {
+		return nil, err
+	}
+	return &NewHDWalletResult{Mnemonic: mnemonic, Wallet: w}, nil
+}
+
+// ImportHDWallet creates an HD wallet from a BIP-39 mnemonic and its mnemonic
+// passphrase, storing its seed encrypted with password. The accounts used on
+// chain under basePath, m/44'/60'/0'/0 by default, are discovered, and the
+// first one derived if none is.
+func (s *PrivateAccountAPI) ImportHDWallet(mnemonic string, mnemonicPassword string, password string, basePath *string) (accounts.HDWallet, error) {
+	base, err := parseBasePath(basePath)
+	if err != nil {
+		return accounts.HDWallet{}, err
+	}
+	w, err := s.am.ImportHDWallet(mnemonic, mnemonicPassword, password, base)
+	if err != nil {
+		return accounts.HDWallet{}, err
+	}
+	found, err := s.DiscoverAccounts(w.ID, password)
+	if err != nil {
+		return accounts.HDWallet{}, err
+	}
+	if len(found) == 0 {
+		if _, err := s.am.DeriveHDAccount(w.ID, nil, password); err != nil {
+			return accounts.HDWallet{}, err
+		}
+	}
+	return s.am.HDWallet(w.ID)
+}
+
+// ListHDWallets returns the HD wallets of the keystore, along with their
+// derived accounts.
+func (s *PrivateAccountAPI) ListHDWallets() []accounts.HDWallet {
+	return s.am.HDWallets()
+}
+
+// DeriveAccount derives the account at path from the HD wallet of the given id,
+// or the account following the last one derived under its base path if path is
+// omitted, and returns its address.
+func (s *PrivateAccountAPI) DeriveAccount(id string, path *string, password string) (common.Address, error) {
+	var derivationPath accounts.DerivationPath
+	if path != nil && *path != "" {
+		var err error
+		if derivationPath, err = accounts.ParseDerivationPath(*path); err != nil {
+			return common.Address{}, err
+		}
+	}
+	acc, err := s.am.DeriveHDAccount(id, derivationPath, password)
+	return acc.Address, err
+}
+
+// DiscoverAccounts derives the accounts of the HD wallet of the given id by
+// increasing index, adding the ones having sent transactions or holding a
+// balance as of the head block, until 20 unused ones in a row. It returns the
+// addresses of the accounts newly added.
+func (s *PrivateAccountAPI) DiscoverAccounts(id string, password string) ([]common.Address, error) {
+	state, err := s.bc.State()
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.am.DiscoverHDAccounts(id, password, func(addr common.Address) (bool, error) {
+		return state.GetNonce(addr) > 0 || state.GetBalance(addr).Sign() > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]common.Address, len(found))
+	for i, acc := range found {
+		addresses[i] = acc.Address
+	}
+	return addresses, nil
+}
+
 // PublicBlockChainAPI provides an API to access the Ngin blockchain.
 // It offers only methods that operate on public data that is freely available to anyone.
 type PublicBlockChainAPI struct {
@@ -575,6 +689,24 @@ func (s *PublicBlockChainAPI) BlockNumber() *big.Int {
 	return s.bc.CurrentHeader().Number
 }
 
+// GetBlockNumberByTimestamp returns the number of the last block mined at or
+// before the given unix time, or with the "after" direction of the first one
+// mined at or after it, null if there is no such block.
+func (s *PublicBlockChainAPI) GetBlockNumberByTimestamp(ts uint64, direction string) (*rpc.HexNumber, error) {
+	var after bool
+	switch direction {
+	case "", "before":
+	case "after":
+		after = true
+	default:
+		return nil, fmt.Errorf("invalid direction %q, want \"before\" or \"after\"", direction)
+	}
+	if number, ok := s.bc.GetBlockNumberByTime(ts, after); ok {
+		return rpc.NewHexNumber(number), nil
+	}
+	return nil, nil
+}
+
 // GetBalance returns the amount of wei for the given address in the state of the
 // given block number. The rpc.LatestBlockNumber and rpc.PendingBlockNumber meta
 // block numbers are also allowed.
@@ -912,8 +1044,8 @@ func newRPCPendingTransaction(tx *types.Transaction) *RPCTransaction {
 	}
 }
 
-// newRPCTransaction returns a transaction that will serialize to the RPC representation.
-func newRPCTransactionFromBlockIndex(b *types.Block, txIndex int) (*RPCTransaction, error) {
+// NewRPCTransactionFromBlockIndex returns the transaction at the given index of a block in its RPC representation.
+func NewRPCTransactionFromBlockIndex(b *types.Block, txIndex int) (*RPCTransaction, error) {
 	if txIndex >= 0 && txIndex < len(b.Transactions()) {
 		tx := b.Transactions()[txIndex]
 		var signer types.Signer = types.BasicSigner{}
@@ -950,7 +1082,7 @@ func newRPCTransactionFromBlockIndex(b *types.Block, txIndex int) (*RPCTransacti
 func newRPCTransaction(b *types.Block, txHash common.Hash) (*RPCTransaction, error) {
 	for idx, tx := range b.Transactions() {
 		if tx.Hash() == txHash {
-			return newRPCTransactionFromBlockIndex(b, idx)
+			return NewRPCTransactionFromBlockIndex(b, idx)
 		}
 	}
 
@@ -1045,7 +1177,7 @@ func (s *PublicTransactionPoolAPI) GetBlockTransactionCountByHash(blockHash comm
 // GetTransactionByBlockNumberAndIndex returns the transaction for the given block number and index.
 func (s *PublicTransactionPoolAPI) GetTransactionByBlockNumberAndIndex(blockNr rpc.BlockNumber, index rpc.HexNumber) (*RPCTransaction, error) {
 	if block := blockByNumber(s.miner, s.bc, blockNr); block != nil {
-		return newRPCTransactionFromBlockIndex(block, index.Int())
+		return NewRPCTransactionFromBlockIndex(block, index.Int())
 	}
 	return nil, nil
 }
@@ -1053,7 +1185,7 @@ func (s *PublicTransactionPoolAPI) GetTransactionByBlockNumberAndIndex(blockNr r
 // GetTransactionByBlockHashAndIndex returns the transaction for the given block hash and index.
 func (s *PublicTransactionPoolAPI) GetTransactionByBlockHashAndIndex(blockHash common.Hash, index rpc.HexNumber) (*RPCTransaction, error) {
 	if block := s.bc.GetBlock(blockHash); block != nil {
-		return newRPCTransactionFromBlockIndex(block, index.Int())
+		return NewRPCTransactionFromBlockIndex(block, index.Int())
 	}
 	return nil, nil
 }
@@ -1171,15 +1303,11 @@ func (s *PublicTransactionPoolAPI) GetTransactionReceipt(txHash common.Hash) (ma
 	return fields, nil
 }
 
-// sign is a helper function that signs a transaction with the private key of the given address.
+// sign is a helper function that signs a transaction with the private key of the given address,
+// or has it signed by the external signer.
 func (s *PublicTransactionPoolAPI) sign(addr common.Address, tx *types.Transaction) (*types.Transaction, error) {
 	signer := s.bc.Config().GetSigner(s.bc.CurrentBlock().Number())
-
-	signature, err := s.am.Sign(addr, signer.Hash(tx).Bytes())
-	if err != nil {
-		return nil, err
-	}
-	return tx.WithSigner(signer).WithSignature(signature)
+	return s.am.SignTx(addr, tx, signer)
 }
 
 // SendTxArgs represents the arguments to sumbit a new transaction into the transaction pool.
@@ -1215,7 +1343,11 @@ func submitTransaction(bc *core.BlockChain, txPool *core.TxPool, tx *types.Trans
 	if err != nil {
 		return common.Hash{}, err
 	}
+	return submitSignedTransaction(txPool, signedTx)
+}
 
+// submitSignedTransaction is a helper function that submits a signed tx to txPool and creates a log entry.
+func submitSignedTransaction(txPool *core.TxPool, signedTx *types.Transaction) (common.Hash, error) {
 	txPool.SetLocal(signedTx)
 	if err := txPool.Add(signedTx); err != nil {
 		return common.Hash{}, err
@@ -1226,7 +1358,7 @@ func submitTransaction(bc *core.BlockChain, txPool *core.TxPool, tx *types.Trans
 		addr := crypto.CreateAddress(from, signedTx.Nonce())
 		glog.V(logger.Info).Infof("Tx(%s) created: %s\n", signedTx.Hash().Hex(), addr.Hex())
 	} else {
-		glog.V(logger.Info).Infof("Tx(%s) to: %s\n", signedTx.Hash().Hex(), tx.To().Hex())
+		glog.V(logger.Info).Infof("Tx(%s) to: %s\n", signedTx.Hash().Hex(), signedTx.To().Hex())
 	}
 
 	return signedTx.Hash(), nil
@@ -1251,15 +1383,12 @@ func (s *PublicTransactionPoolAPI) SendTransaction(args SendTxArgs) (common.Hash
 		tx = types.NewTransaction(args.Nonce.Uint64(), *args.To, args.Value.BigInt(), args.Gas.BigInt(), args.GasPrice.BigInt(), common.FromHex(args.Data))
 	}
 
-	signer := s.bc.Config().GetSigner(s.bc.CurrentBlock().Number())
-	tx.SetSigner(signer)
-
-	signature, err := s.am.Sign(args.From, signer.Hash(tx).Bytes())
+	signedTx, err := s.sign(args.From, tx)
 	if err != nil {
 		return common.Hash{}, err
 	}
 
-	return submitTransaction(s.bc, s.txPool, tx, signature)
+	return submitSignedTransaction(s.txPool, signedTx)
 }
 
 // SendRawTransaction will add the signed transaction to the transaction pool.
@@ -1297,8 +1426,7 @@ func (s *PublicTransactionPoolAPI) SendRawTransaction(encodedTx string) (string,
 //
 // This gives context to the signed message and prevents signing of transactions.
 func signHash(data []byte) []byte {
-	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(data), data)
-	return crypto.Keccak256([]byte(msg))
+	return accounts.TextHash(data)
 }
 
 // EcRecover returns the address for the account that was used to create the signature.
@@ -1329,11 +1457,69 @@ func (s *PrivateAccountAPI) EcRecover(data, sig hexutil.Bytes) (common.Address,
 	return recoveredAddr, nil
 }
 
+// SignTypedData calculates an Ngin ECDSA signature of typed structured data,
+// following EIP-712:
+// keccak256("\x19\x01" ‖ domainSeparator ‖ hashStruct(message))
+//
+// Note, the produced signature conforms to the secp256k1 curve R, S and V values,
+// where the V value will be 27 or 28 for legacy reasons.
+//
+// The key used to calculate the signature is decrypted with the given password,
+// or must be unlocked when no password is given, unless held by the external signer.
+func (s *PrivateAccountAPI) SignTypedData(data typeddata.TypedData, addr common.Address, passwd *string) (hexutil.Bytes, error) {
+	var (
+		signature []byte
+		err       error
+	)
+	if passwd != nil {
+		var hash []byte
+		if hash, err = data.Hash(); err != nil {
+			return nil, err
+		}
+		signature, err = s.am.SignWithPassphrase(addr, *passwd, hash)
+	} else {
+		signature, err = s.am.SignTypedData(addr, &data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signature[64] += 27 // Transform V from 0/1 to 27/28 according to the yellow paper
+	return signature, nil
+}
+
+// EcRecoverTypedData returns the address for the account that was used to create
+// the signature of typed structured data. It is compatible with personal_signTypedData
+// and recovers the address of:
+// hash = keccak256("\x19\x01" ‖ domainSeparator ‖ hashStruct(message))
+// addr = ecrecover(hash, signature)
+//
+// Note, the signature must conform to the secp256k1 curve R, S and V values, where
+// the V value must be be 27 or 28 for legacy reasons.
+func (s *PrivateAccountAPI) EcRecoverTypedData(data typeddata.TypedData, sig hexutil.Bytes) (common.Address, error) {
+	if len(sig) != 65 {
+		return common.Address{}, fmt.Errorf("signature must be 65 bytes long")
+	}
+	if sig[64] != 27 && sig[64] != 28 {
+		return common.Address{}, fmt.Errorf("invalid Ngin signature (V is not 27 or 28)")
+	}
+	sig[64] -= 27 // Transform yellow paper V from 27/28 to 0/1
+
+	hash, err := data.Hash()
+	if err != nil {
+		return common.Address{}, err
+	}
+	rpk, err := crypto.Ecrecover(hash, sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	pubKey := crypto.ToECDSAPub(rpk)
+	return crypto.PubkeyToAddress(*pubKey), nil
+}
+
 // Sign signs the given hash using the key that matches the address. The key must be
-// unlocked in order to sign the hash.
+// unlocked in order to sign the hash, unless held by the external signer.
 func (s *PublicBlockChainAPI) Sign(addr common.Address, data hexutil.Bytes) (hexutil.Bytes, error) {
-	signed := signHash(data)
-	signature, err := s.am.Sign(addr, signed)
+	signature, err := s.am.SignData(addr, data)
 	if err != nil {
 		return nil, err
 	}
@@ -1659,18 +1845,6 @@ func (api *PrivateAdminAPI) ImportChain(file string) (bool, error) {
 	return true, nil
 }
 
-// PublicDebugAPI is the collection of Etheruem APIs exposed over the public
-// debugging endpoint.
-type PublicNginAPI struct {
-	ngin *Ngin
-}
-
-// NewPublicDebugAPI creates a new API definition for the public debug methods
-// of the Ngin service.
-func NewPublicNginAPI(ngin *Ngin) *PublicNginAPI {
-	return &PublicNginAPI{ngin: ngin}
-}
-
 // GetTransactionsByAddress is an alias for GetAddressTransactions which aligns more closely
 // with established ngin_transaction api namespace
 func (api *PublicNginAPI) GetTransactionsByAddress(address common.Address, blockStartN uint64, blockEndN rpc.BlockNumber, toOrFrom string, txKindOf string, pagStart, pagEnd int, reverse bool) (list []string, err error) {
@@ -1679,11 +1853,13 @@ func (api *PublicNginAPI) GetTransactionsByAddress(address common.Address, block
 
 // AddressTransactions gets transactions for a given address.
 // Optional values include start and stop block numbers, and to/from/both value for tx/address relation.
+// Transactions are of kind standard, contract creation, or internal when the address is only involved
+// in a value transfer or contract creation made by a contract.
 // Returns a slice of strings of transactions hashes.
 func (api *PublicNginAPI) GetAddressTransactions(address common.Address, blockStartN uint64, blockEndN rpc.BlockNumber, toOrFrom string, txKindOf string, pagStart, pagEnd int, reverse bool) (list []string, err error) {
 	glog.V(logger.Debug).Infoln("RPC call: debug_getAddressTransactions %s %d %d %s %s", address, blockStartN, blockEndN, toOrFrom, txKindOf)
 
-	atxi := api.ngin.BlockChain().GetAtxi()
+	atxi := api.e.BlockChain().GetAtxi()
 	if atxi == nil {
 		return nil, errors.New("addr-tx indexing not enabled")
 	}
@@ -1693,10 +1869,8 @@ func (api *PublicNginAPI) GetAddressTransactions(address common.Address, blockSt
 	if toOrFrom == "tf" || toOrFrom == "ft" {
 		toOrFrom = "b"
 	}
-	// _s_tandard OR _c_ontract
-	if txKindOf == "sc" || txKindOf == "cs" {
-		txKindOf = "b"
-	}
+	// _s_tandard, _c_ontract OR _i_nternal, combinations such as 'sc' are
+	// handled by the index
 
 	if blockEndN == rpc.LatestBlockNumber || blockEndN == rpc.PendingBlockNumber {
 		blockEndN = 0
@@ -1715,6 +1889,180 @@ func (api *PublicNginAPI) GetAddressTransactions(address common.Address, blockSt
 	return list, nil
 }
 
+// AddressTransactionsPage is a page of the transactions of an address.
+type AddressTransactionsPage struct {
+	Transactions []string `json:"transactions"`
+	Next         string   `json:"next"` // Cursor of the next page, empty on the last one
+}
+
+// GetAddressTransactionsPage gets a page of at most limit transactions for a
+// given address, in the same order and with the same filters as
+// GetAddressTransactions. The page starts after the cursor returned with the
+// previous one, an empty cursor requesting the first page.
+func (api *PublicNginAPI) GetAddressTransactionsPage(address common.Address, blockStartN uint64, blockEndN rpc.BlockNumber, toOrFrom string, txKindOf string, limit int, cursor string, reverse bool) (*AddressTransactionsPage, error) {
+	glog.V(logger.Debug).Infof("RPC call: ngin_getAddressTransactionsPage %s %d %d %s %s %d %s", address, blockStartN, blockEndN, toOrFrom, txKindOf, limit, cursor)
+
+	atxi := api.e.BlockChain().GetAtxi()
+	if atxi == nil {
+		return nil, errors.New("addr-tx indexing not enabled")
+	}
+	if toOrFrom == "tf" || toOrFrom == "ft" {
+		toOrFrom = "b"
+	}
+	if blockEndN == rpc.LatestBlockNumber || blockEndN == rpc.PendingBlockNumber {
+		blockEndN = 0
+	}
+	txs, next, err := core.GetAddrTxsPage(atxi.Db, address, blockStartN, uint64(blockEndN.Int64()), toOrFrom, txKindOf, limit, cursor, reverse)
+	if err != nil {
+		return nil, err
+	}
+	if txs == nil {
+		txs = []string{}
+	}
+	return &AddressTransactionsPage{Transactions: txs, Next: next}, nil
+}
+
+// GetAddressTransactionsPageByTime gets a page of at most limit transactions
+// for a given address like GetAddressTransactionsPage, between the blocks
+// mined in the given range of unix times, a toTime of 0 meaning now.
+func (api *PublicNginAPI) GetAddressTransactionsPageByTime(address common.Address, fromTime, toTime uint64, toOrFrom string, txKindOf string, limit int, cursor string, reverse bool) (*AddressTransactionsPage, error) {
+	glog.V(logger.Debug).Infof("RPC call: ngin_getAddressTransactionsPageByTime %s %d %d %s %s %d %s", address, fromTime, toTime, toOrFrom, txKindOf, limit, cursor)
+
+	bc := api.e.BlockChain()
+	empty := &AddressTransactionsPage{Transactions: []string{}}
+	start, ok := bc.GetBlockNumberByTime(fromTime, true)
+	if !ok {
+		return empty, nil
+	}
+	end := rpc.LatestBlockNumber
+	if toTime != 0 {
+		n, ok := bc.GetBlockNumberByTime(toTime, false)
+		if !ok || n < start {
+			return empty, nil
+		}
+		end = rpc.BlockNumber(n)
+	}
+	return api.GetAddressTransactionsPage(address, start, end, toOrFrom, txKindOf, limit, cursor, reverse)
+}
+
+// RPCTokenTransfer is the RPC representation of an indexed token transfer.
+type RPCTokenTransfer struct {
+	Token           common.Address `json:"token"`
+	From            common.Address `json:"from"`
+	To              common.Address `json:"to"`
+	Value           *rpc.HexNumber `json:"value"` // Amount, or token id of ERC-721 transfers
+	BlockNumber     *rpc.HexNumber `json:"blockNumber"`
+	LogIndex        *rpc.HexNumber `json:"logIndex"`
+	TransactionHash common.Hash    `json:"transactionHash"`
+}
+
+// TokenTransfersPage is a page of the token transfers of an address.
+type TokenTransfersPage struct {
+	Transfers []*RPCTokenTransfer `json:"transfers"`
+	Next      string              `json:"next"` // Cursor of the next page, empty on the last one
+}
+
+// GetTokenTransfers gets a page of at most limit ERC-20 and ERC-721 token
+// transfers to or from a given address, of a single token unless token is
+// null. Filters and pagination work as with GetAddressTransactionsPage.
+func (api *PublicNginAPI) GetTokenTransfers(address common.Address, token *common.Address, blockStartN uint64, blockEndN rpc.BlockNumber, toOrFrom string, limit int, cursor string, reverse bool) (*TokenTransfersPage, error) {
+	glog.V(logger.Debug).Infof("RPC call: ngin_getTokenTransfers %s %v %d %d %s %d %s", address, token, blockStartN, blockEndN, toOrFrom, limit, cursor)
+
+	atxi := api.e.BlockChain().GetAtxi()
+	if atxi == nil || !atxi.TokenTransfers {
+		return nil, errors.New("token transfer indexing not enabled")
+	}
+	if toOrFrom == "tf" || toOrFrom == "ft" {
+		toOrFrom = "b"
+	}
+	if blockEndN == rpc.LatestBlockNumber || blockEndN == rpc.PendingBlockNumber {
+		blockEndN = 0
+	}
+	transfers, next, err := core.GetTokenTransfers(atxi.Db, address, token, blockStartN, uint64(blockEndN.Int64()), toOrFrom, limit, cursor, reverse)
+	if err != nil {
+		return nil, err
+	}
+	page := &TokenTransfersPage{Transfers: []*RPCTokenTransfer{}, Next: next}
+	for _, t := range transfers {
+		page.Transfers = append(page.Transfers, &RPCTokenTransfer{
+			Token:           t.Token,
+			From:            t.From,
+			To:              t.To,
+			Value:           rpc.NewHexNumber(t.Value),
+			BlockNumber:     rpc.NewHexNumber(t.BlockNumber),
+			LogIndex:        rpc.NewHexNumber(t.LogIndex),
+			TransactionHash: t.TxHash,
+		})
+	}
+	return page, nil
+}
+
+// RPCBalanceRecord is the RPC representation of the balance of an account as
+// of after a block.
+type RPCBalanceRecord struct {
+	BlockNumber *rpc.HexNumber `json:"blockNumber"`
+	Timestamp   *rpc.HexNumber `json:"timestamp"`
+	Balance     *rpc.HexNumber `json:"balance"`
+}
+
+// GetBalanceHistory returns the balance series of a given address between the
+// given blocks: the balance held at the start block, followed by every change
+// up to the end block.
+func (api *PublicNginAPI) GetBalanceHistory(address common.Address, blockStartN uint64, blockEndN rpc.BlockNumber) ([]*RPCBalanceRecord, error) {
+	glog.V(logger.Debug).Infof("RPC call: ngin_getBalanceHistory %s %d %d", address, blockStartN, blockEndN)
+
+	if blockEndN == rpc.LatestBlockNumber || blockEndN == rpc.PendingBlockNumber {
+		blockEndN = 0
+	}
+	return api.balanceHistory(address, blockStartN, uint64(blockEndN.Int64()))
+}
+
+// GetBalanceHistoryByTime returns the balance series of a given address between
+// the given unix times, 0 meaning now: the balance held at the start time,
+// followed by every change up to the end time.
+func (api *PublicNginAPI) GetBalanceHistoryByTime(address common.Address, fromTime, toTime uint64) ([]*RPCBalanceRecord, error) {
+	glog.V(logger.Debug).Infof("RPC call: ngin_getBalanceHistoryByTime %s %d %d", address, fromTime, toTime)
+
+	if toTime != 0 && toTime < fromTime {
+		return nil, fmt.Errorf("start time must be prior to or equal to end time, got from=%d to=%d", fromTime, toTime)
+	}
+	bc := api.e.BlockChain()
+	start, _ := bc.GetBlockNumberByTime(fromTime, false)
+	var end uint64
+	if toTime != 0 {
+		var ok bool
+		if end, ok = bc.GetBlockNumberByTime(toTime, false); !ok {
+			return []*RPCBalanceRecord{}, nil
+		}
+	}
+	return api.balanceHistory(address, start, end)
+}
+
+func (api *PublicNginAPI) balanceHistory(address common.Address, blockStartN, blockEndN uint64) ([]*RPCBalanceRecord, error) {
+	bc := api.e.BlockChain()
+	index := bc.GetBalanceIndex()
+	if index == nil {
+		return nil, errors.New("balance history indexing not enabled")
+	}
+	records, err := core.GetBalanceHistory(index.Db, address, blockStartN, blockEndN)
+	if err != nil {
+		return nil, err
+	}
+	series := []*RPCBalanceRecord{}
+	for _, r := range records {
+		header := bc.GetHeaderByNumber(r.BlockNumber)
+		if header == nil {
+			continue
+		}
+		series = append(series, &RPCBalanceRecord{
+			BlockNumber: rpc.NewHexNumber(r.BlockNumber),
+			Timestamp:   rpc.NewHexNumber(header.Time),
+			Balance:     rpc.NewHexNumber(r.Balance),
+		})
+	}
+	return series, nil
+}
+
 func (api *PublicNginAPI) BuildATXI(start, stop, step rpc.BlockNumber) (bool, error) {
 	glog.V(logger.Debug).Infoln("RPC call: ngin_buildATXI %v %v %v", start, stop, step)
 
@@ -1727,7 +2075,7 @@ func (api *PublicNginAPI) BuildATXI(start, stop, step rpc.BlockNumber) (bool, er
 		}
 	}
 
-	atxi := api.ngin.BlockChain().GetAtxi()
+	atxi := api.e.BlockChain().GetAtxi()
 	if atxi == nil {
 		return false, errors.New("addr-tx indexing not enabled")
 	}
@@ -1735,7 +2083,7 @@ func (api *PublicNginAPI) BuildATXI(start, stop, step rpc.BlockNumber) (bool, er
 		return false, errors.New("addr-tx indexing already running via the auto build mode")
 	}
 
-	progress, err := api.ngin.BlockChain().GetATXIBuildProgress()
+	progress, err := api.e.BlockChain().GetATXIBuildProgress()
 	if err != nil {
 		return false, err
 	}
@@ -1743,13 +2091,13 @@ func (api *PublicNginAPI) BuildATXI(start, stop, step rpc.BlockNumber) (bool, er
 		return false, fmt.Errorf("ATXI build process is already running (first block: %d, last block: %d, current block: %d\n)", progress.Start, progress.Stop, progress.Current)
 	}
 
-	go core.BuildAddrTxIndex(api.ngin.BlockChain(), api.ngin.ChainDb(), atxi.Db, convert(start), convert(stop), convert(step))
+	go core.BuildAddrTxIndex(api.e.BlockChain(), api.e.ChainDb(), atxi.Db, convert(start), convert(stop), convert(step))
 
 	return true, nil
 }
 
 func (api *PublicNginAPI) GetATXIBuildStatus() (*core.AtxiProgressT, error) {
-	atxi := api.ngin.BlockChain().GetAtxi()
+	atxi := api.e.BlockChain().GetAtxi()
 	if atxi == nil {
 		return nil, errors.New("addr-tx indexing not enabled")
 	}
@@ -1757,7 +2105,7 @@ func (api *PublicNginAPI) GetATXIBuildStatus() (*core.AtxiProgressT, error) {
 		return nil, errors.New("no progress available for unstarted atxi indexing process")
 	}
 
-	progress, err := api.ngin.BlockChain().GetATXIBuildProgress()
+	progress, err := api.e.BlockChain().GetATXIBuildProgress()
 	if err != nil {
 		return nil, err
 	}
@@ -1786,7 +2134,7 @@ func (api *PublicDebugAPI) DumpBlock(number uint64) (state.Dump, error) {
 	if block == nil {
 		return state.Dump{}, fmt.Errorf("block #%d not found", number)
 	}
-	stateDb, err := api.ngin.BlockChain().StateAt(block.Root())
+	stateDb, err := api.ngin.BlockChain().StateAtBlock(block)
 	if err != nil {
 		return state.Dump{}, err
 	}
@@ -1799,7 +2147,7 @@ func (api *PublicDebugAPI) AccountExist(address common.Address, number uint64) (
 	if block == nil {
 		return false, fmt.Errorf("block #%d not found", number)
 	}
-	stateDb, err := api.ngin.BlockChain().StateAt(block.Root())
+	stateDb, err := api.ngin.BlockChain().StateAtBlock(block)
 	if err != nil {
 		return false, err
 	}
@@ -2032,7 +2380,7 @@ func (s *PublicDebugAPI) computeTxEnv(blockHash common.Hash, txIndex int) (core.
 	if parent == nil {
 		return nil, nil, fmt.Errorf("block parent %x not found", block.ParentHash())
 	}
-	statedb, err := s.ngin.BlockChain().StateAt(parent.Root())
+	statedb, err := s.ngin.BlockChain().StateAtBlock(parent)
 	if err != nil {
 		return nil, nil, err
 	}
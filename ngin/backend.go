@@ -61,6 +61,9 @@ type Config struct {
 	SkipBcVersionCheck bool // e.g. blockchain export
 	DatabaseCache      int
 	DatabaseHandles    int
+	DatabaseAncient    string // Ancient store directory, defaults to "ancient" within the chain database
+	AncientThreshold   uint64 // Number of recent blocks kept out of the ancient store, 0 disables freezing
+	AncientNoCompress  bool   // Whether to store ancient blocks uncompressed
 
 	NatSpec   bool
 	DocRoot   string
@@ -73,7 +76,14 @@ type Config struct {
 	MinerThreads   int
 	SolcPath       string
 
-	UseAddrTxIndex bool
+	UseAddrTxIndex  bool
+	UseTokenIndex   bool          // Whether to index token transfers along with the address-transaction index
+	UseInternalTxs  bool          // Whether to index internal transactions along with the address-transaction index
+	UseBalanceIndex bool          // Whether to index the balances of the accounts by block
+	NoPruning       bool          // Whether to write every state to disk instead of pruning old ones
+	RegenLimit      uint64        // Maximum number of blocks re-executed to regenerate a pruned state
+	RegenTimeout    time.Duration // Maximum time spent regenerating a pruned state per request
+	Snapshot        bool          // Whether to maintain a flat snapshot of the state for faster reads
 
 	GpoMinGasPrice          *big.Int
 	GpoMaxGasPrice          *big.Int
@@ -131,7 +141,7 @@ type Ngin struct {
 
 func New(ctx *node.ServiceContext, config *Config) (*Ngin, error) {
 	// Open the chain database and perform any upgrades needed
-	chainDb, err := ctx.OpenDatabase("chaindata", config.DatabaseCache, config.DatabaseHandles)
+	chainDb, err := ctx.OpenDatabaseWithFreezer("chaindata", config.DatabaseCache, config.DatabaseHandles, config.DatabaseAncient, !config.AncientNoCompress)
 	if err != nil {
 		return nil, err
 	}
@@ -223,7 +233,7 @@ func New(ctx *node.ServiceContext, config *Config) (*Ngin, error) {
 	// Initialize indexes db if enabled
 	// Blockchain will be assigned the db and atx enabled after blockchain is initialized below.
 	var indexesDb ngindb.Database
-	if config.UseAddrTxIndex {
+	if config.UseAddrTxIndex || config.UseBalanceIndex {
 		// TODO: these are arbitrary numbers I just made up. Optimize?
 		// The reason these numbers are different than the atxi-build command is because for "appending" (vs. building)
 		// the atxi database should require far fewer resources since application performance is limited primarily by block import (chaindata db).
@@ -236,6 +246,9 @@ func New(ctx *node.ServiceContext, config *Config) (*Ngin, error) {
 			return nil, err
 		}
 		ngin.indexesDb = indexesDb
+		if err := core.CheckAddrTxIndexVersion(indexesDb); err != nil {
+			return nil, err
+		}
 	}
 
 	// load the genesis block or write a new one if no genesis
@@ -268,7 +281,17 @@ func New(ctx *node.ServiceContext, config *Config) (*Ngin, error) {
 
 	ngin.chainConfig = config.ChainConfig
 
-	ngin.blockchain, err = core.NewBlockChain(chainDb, ngin.chainConfig, ngin.pow, ngin.EventMux())
+	cacheConfig := *core.DefaultCacheConfig
+	if config.NoPruning {
+		cacheConfig = *core.ArchiveCacheConfig
+	}
+	cacheConfig.AncientThreshold = config.AncientThreshold
+	cacheConfig.Snapshot = config.Snapshot
+	if !config.NoPruning {
+		cacheConfig.RegenLimit = config.RegenLimit
+		cacheConfig.RegenTimeout = config.RegenTimeout
+	}
+	ngin.blockchain, err = core.NewBlockChainWithCache(chainDb, ngin.chainConfig, ngin.pow, ngin.EventMux(), &cacheConfig)
 	if err != nil {
 		if err == core.ErrNoGenesis {
 			return nil, fmt.Errorf(`No chain found. Please initialise a new chain using the "init" subcommand.`)
@@ -278,8 +301,16 @@ func New(ctx *node.ServiceContext, config *Config) (*Ngin, error) {
 	// Configure enabled atxi for blockchain
 	if config.UseAddrTxIndex {
 		ngin.blockchain.SetAtxi(&core.AtxiT{
-			Db: ngin.indexesDb,
+			Db:             ngin.indexesDb,
+			TokenTransfers: config.UseTokenIndex,
+			InternalTxs:    config.UseInternalTxs,
 		})
+		if err := core.CheckAddrTxIndex(ngin.blockchain, ngin.indexesDb); err != nil {
+			return nil, err
+		}
+	}
+	if config.UseBalanceIndex {
+		ngin.blockchain.SetBalanceIndex(&core.BalanceIndexT{Db: ngin.indexesDb})
 	}
 
 	ngin.gpo = NewGasPriceOracle(ngin)
@@ -493,45 +524,43 @@ func upgradeChainDatabase(db ngindb.Database) error {
 	// At least some of the database is still the old format, upgrade (skip the head block!)
 	glog.V(logger.Info).Info("Old database detected, upgrading...")
 
-	if db, ok := db.(*ngindb.LDBDatabase); ok {
-		blockPrefix := []byte("block-hash-")
-		for it := db.NewIterator(); it.Next(); {
-			// Skip anything other than a combined block
-			if !bytes.HasPrefix(it.Key(), blockPrefix) {
-				continue
-			}
-			// Skip the head block (merge last to signal upgrade completion)
-			if bytes.HasSuffix(it.Key(), head.Bytes()) {
-				continue
-			}
-			// Load the block, split and serialize (order!)
-			block := core.GetBlockByHashOld(db, common.BytesToHash(bytes.TrimPrefix(it.Key(), blockPrefix)))
-
-			if err := core.WriteTd(db, block.Hash(), block.DeprecatedTd()); err != nil {
-				return err
-			}
-			if err := core.WriteBody(db, block.Hash(), block.Body()); err != nil {
-				return err
-			}
-			if err := core.WriteHeader(db, block.Header()); err != nil {
-				return err
-			}
-			if err := db.Delete(it.Key()); err != nil {
-				return err
-			}
+	blockPrefix := []byte("block-hash-")
+	for it := db.NewIterator(); it.Next(); {
+		// Skip anything other than a combined block
+		if !bytes.HasPrefix(it.Key(), blockPrefix) {
+			continue
+		}
+		// Skip the head block (merge last to signal upgrade completion)
+		if bytes.HasSuffix(it.Key(), head.Bytes()) {
+			continue
 		}
-		// Lastly, upgrade the head block, disabling the upgrade mechanism
-		current := core.GetBlockByHashOld(db, head)
+		// Load the block, split and serialize (order!)
+		block := core.GetBlockByHashOld(db, common.BytesToHash(bytes.TrimPrefix(it.Key(), blockPrefix)))
 
-		if err := core.WriteTd(db, current.Hash(), current.DeprecatedTd()); err != nil {
+		if err := core.WriteTd(db, block.Hash(), block.DeprecatedTd()); err != nil {
 			return err
 		}
-		if err := core.WriteBody(db, current.Hash(), current.Body()); err != nil {
+		if err := core.WriteBody(db, block.Hash(), block.Body()); err != nil {
 			return err
 		}
-		if err := core.WriteHeader(db, current.Header()); err != nil {
+		if err := core.WriteHeader(db, block.Header()); err != nil {
 			return err
 		}
+		if err := db.Delete(it.Key()); err != nil {
+			return err
+		}
+	}
+	// Lastly, upgrade the head block, disabling the upgrade mechanism
+	current := core.GetBlockByHashOld(db, head)
+
+	if err := core.WriteTd(db, current.Hash(), current.DeprecatedTd()); err != nil {
+		return err
+	}
+	if err := core.WriteBody(db, current.Hash(), current.Body()); err != nil {
+		return err
+	}
+	if err := core.WriteHeader(db, current.Header()); err != nil {
+		return err
 	}
 	return nil
 }
@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/core"
 	"github.com/NginProject/ngind/core/types"
 	"github.com/NginProject/ngind/core/vm"
 	"github.com/NginProject/ngind/ngindb"
@@ -292,10 +293,14 @@ func (s *PublicFilterAPI) Logs(ctx context.Context, args NewFilterArgs) (rpc.Sub
 	return subscription, err
 }
 
-// NewFilterArgs represents a request to create a new filter.
+// NewFilterArgs represents a request to create a new filter. The block range
+// can be given by unix times instead, FromTime taking over FromBlock and
+// ToTime taking over ToBlock when set.
 type NewFilterArgs struct {
 	FromBlock rpc.BlockNumber
 	ToBlock   rpc.BlockNumber
+	FromTime  *uint64
+	ToTime    *uint64
 	Addresses []common.Address
 	Topics    [][]common.Hash
 }
@@ -305,6 +310,8 @@ func (args *NewFilterArgs) UnmarshalJSON(data []byte) error {
 	type input struct {
 		From      *rpc.BlockNumber `json:"fromBlock"`
 		ToBlock   *rpc.BlockNumber `json:"toBlock"`
+		FromTime  *rpc.HexNumber   `json:"fromTime"`
+		ToTime    *rpc.HexNumber   `json:"toTime"`
 		Addresses interface{}      `json:"address"`
 		Topics    []interface{}    `json:"topics"`
 	}
@@ -326,6 +333,15 @@ func (args *NewFilterArgs) UnmarshalJSON(data []byte) error {
 		args.ToBlock = *raw.ToBlock
 	}
 
+	if raw.FromTime != nil {
+		t := raw.FromTime.Uint64()
+		args.FromTime = &t
+	}
+	if raw.ToTime != nil {
+		t := raw.ToTime.Uint64()
+		args.ToTime = &t
+	}
+
 	args.Addresses = []common.Address{}
 
 	if raw.Addresses != nil {
@@ -414,12 +430,36 @@ func (args *NewFilterArgs) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// resolveTimeBounds replaces the block bounds of args by the blocks of its
+// time bounds, if any: the first block mined at or after FromTime and the last
+// one mined at or before ToTime.
+func (s *PublicFilterAPI) resolveTimeBounds(args *NewFilterArgs) error {
+	if args.FromTime != nil {
+		number, ok := core.GetBlockNumberByTime(s.chainDb, *args.FromTime, true)
+		if !ok {
+			return fmt.Errorf("no block mined at or after time %d", *args.FromTime)
+		}
+		args.FromBlock = rpc.BlockNumber(number)
+	}
+	if args.ToTime != nil {
+		number, ok := core.GetBlockNumberByTime(s.chainDb, *args.ToTime, false)
+		if !ok {
+			return fmt.Errorf("no block mined at or before time %d", *args.ToTime)
+		}
+		args.ToBlock = rpc.BlockNumber(number)
+	}
+	return nil
+}
+
 // NewFilter creates a new filter and returns the filter id. It can be uses to retrieve logs.
 func (s *PublicFilterAPI) NewFilter(args NewFilterArgs) (string, error) {
 	externalId, err := newFilterId()
 	if err != nil {
 		return "", err
 	}
+	if err := s.resolveTimeBounds(&args); err != nil {
+		return "", err
+	}
 
 	var id int
 	if len(args.Addresses) > 0 {
@@ -439,14 +479,17 @@ func (s *PublicFilterAPI) NewFilter(args NewFilterArgs) (string, error) {
 }
 
 // GetLogs returns the logs matching the given argument.
-func (s *PublicFilterAPI) GetLogs(args NewFilterArgs) []vmlog {
+func (s *PublicFilterAPI) GetLogs(args NewFilterArgs) ([]vmlog, error) {
+	if err := s.resolveTimeBounds(&args); err != nil {
+		return nil, err
+	}
 	filter := New(s.chainDb)
 	filter.SetBeginBlock(args.FromBlock.Int64())
 	filter.SetEndBlock(args.ToBlock.Int64())
 	filter.SetAddresses(args.Addresses)
 	filter.SetTopics(args.Topics)
 
-	return toRPCLogs(filter.Find(), false)
+	return toRPCLogs(filter.Find(), false), nil
 }
 
 // UninstallFilter removes the filter with the given filter id.
@@ -220,6 +220,9 @@ func (pm *ProtocolManager) Start(maxPeers int) {
 	// start sync handlers
 	go pm.syncer()
 	go pm.txsyncLoop()
+
+	// evaluate peer reputations
+	go pm.scoreLoop()
 }
 
 func (pm *ProtocolManager) Stop() {
@@ -461,6 +464,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) (err error) {
 			return
 		}
 		defer mlogWireDelegate(p, "receive", BlockHeadersMsg, intSize, headers, err)
+		p.score.responded(BlockHeadersMsg)
 
 		// Good will assumption. Even if the peer is ahead of the fork check header but returns
 		// empty header response, it might be that the peer is a light client which only keeps
@@ -535,6 +539,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) (err error) {
 			return
 		}
 		mlogWireDelegate(p, "receive", BlockBodiesMsg, intSize, request, err)
+		p.score.responded(BlockBodiesMsg)
 
 		transactions := make([][]*types.Transaction, len(request))
 		uncles := make([][]*types.Header, len(request))
@@ -595,6 +600,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) (err error) {
 			return
 		}
 		mlogWireDelegate(p, "receive", NodeDataMsg, intSize, data, err)
+		p.score.responded(NodeDataMsg)
 		// Deliver all to the downloader
 		if e := pm.downloader.DeliverNodeData(p.id, data); e != nil {
 			glog.V(logger.Core).Warnf("failed to deliver node state data: %v", e)
@@ -648,6 +654,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) (err error) {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
 		mlogWireDelegate(p, "receive", ReceiptsMsg, intSize, receipts, err)
+		p.score.responded(ReceiptsMsg)
 		// Deliver all to the downloader
 		if err := pm.downloader.DeliverReceipts(p.id, receipts); err != nil {
 			glog.V(logger.Core).Warnf("failed to deliver receipts: %v", err)
@@ -693,6 +700,9 @@ func (pm *ProtocolManager) handleMsg(p *peer) (err error) {
 				unknown = append(unknown, block)
 			}
 		}
+		if len(unknown) > 0 {
+			p.score.add(scoreUsefulBlock / 2)
+		}
 		for _, block := range unknown {
 			// TODO Breaking /ngin tests
 			pm.fetcher.Notify(p.id, block.Hash, block.Number, time.Now(), p.RequestOneHeader, p.RequestBodies)
@@ -719,6 +729,9 @@ func (pm *ProtocolManager) handleMsg(p *peer) (err error) {
 		request.Block.ReceivedFrom = p
 
 		// Mark the peer as owning the block and schedule it for import
+		if !pm.blockchain.HasBlock(request.Block.Hash()) {
+			p.score.add(scoreUsefulBlock)
+		}
 		p.MarkBlock(request.Block.Hash())
 		pm.fetcher.Enqueue(p.id, request.Block)
 
@@ -763,13 +776,22 @@ func (pm *ProtocolManager) handleMsg(p *peer) (err error) {
 			return
 		}
 		mlogWireDelegate(p, "receive", TxMsg, intSize, txs, err)
+		var reward float64
 		for i, tx := range txs {
 			// Validate and mark the remote transaction
 			if tx == nil {
 				return errResp(ErrDecode, "transaction %d is nil", i)
 			}
+			if _, e := tx.From(); e != nil {
+				p.score.add(scoreInvalid)
+			} else if p.knownTxs.Has(tx.Hash()) {
+				reward += scoreDuplicateTx
+			} else if reward < scoreUsefulTxCap {
+				reward += scoreUsefulTx
+			}
 			p.MarkTransaction(tx.Hash())
 		}
+		p.score.add(reward)
 		pm.txpool.AddTransactions(txs)
 
 	default:
@@ -67,6 +67,8 @@ type PeerInfo struct {
 	Version    int      `json:"version"`    // Ngin protocol version negotiated
 	Difficulty *big.Int `json:"difficulty"` // Total difficulty of the peer's blockchain
 	Head       string   `json:"head"`       // SHA3 hash of the peer's best owned block
+	Score      float64  `json:"score"`      // Reputation score of the peer
+	Latency    string   `json:"latency"`    // Average response latency of the peer
 }
 
 // propEvent is a block propagation, waiting for its turn in the broadcast queue.
@@ -83,6 +85,8 @@ type peer struct {
 
 	version  int         // Protocol version negotiated
 	forkDrop *time.Timer // Timed connection dropper if forks aren't validated in time
+	created  time.Time   // Time the peer was created, protects new peers from eviction
+	score    *peerScore  // Reputation of the peer, see peerscore.go
 
 	head common.Hash
 	td   *big.Int
@@ -105,6 +109,8 @@ func newPeer(version int, p *p2p.Peer, rw p2p.MsgReadWriter) *peer {
 		rw:          rw,
 		version:     version,
 		id:          fmt.Sprintf("%x", id[:8]),
+		created:     time.Now(),
+		score:       newPeerScore(),
 		knownTxs:    set.New(),
 		knownBlocks: set.New(),
 		queuedTxs:   make(chan []*types.Transaction, maxQueuedTxs),
@@ -157,9 +163,19 @@ func (p *peer) Info() *PeerInfo {
 		Version:    p.version,
 		Difficulty: td,
 		Head:       hash.Hex(),
+		Score:      p.score.Value(),
+		Latency:    p.score.Latency().String(),
 	}
 }
 
+// protected reports whether the peer is trusted or static, such peers are
+// never dropped for their score. It gathers the p2p peer info, so must not be
+// called with the peer set lock held.
+func (p *peer) protected() bool {
+	info := p.Peer.Info()
+	return info.Network.Trusted || info.Network.Static
+}
+
 // Head retrieves a copy of the current head hash and total difficulty of the
 // peer.
 func (p *peer) Head() (hash common.Hash, td *big.Int) {
@@ -313,6 +329,7 @@ func (p *peer) SendReceiptsRLP(receipts []rlp.RawValue) error {
 func (p *peer) RequestOneHeader(hash common.Hash) error {
 	glog.V(logger.Debug).Infof("fetching from: %v req=singleheader hash=%x", p, hash)
 	d := &getBlockHeadersData{Origin: hashOrNumber{Hash: hash}, Amount: uint64(1), Skip: uint64(0), Reverse: false}
+	p.score.requested(BlockHeadersMsg)
 	s, e := p2p.Send(p.rw, GetBlockHeadersMsg, d)
 	mlogWireDelegate(p, "send", GetBlockHeadersMsg, s, d, nil)
 	return e
@@ -323,6 +340,7 @@ func (p *peer) RequestOneHeader(hash common.Hash) error {
 func (p *peer) RequestHeadersByHash(origin common.Hash, amount int, skip int, reverse bool) error {
 	glog.V(logger.Debug).Infof("fetching from: %v req=headersbyhash n=%d origin=%x, skipping=%d reverse=%v", p, amount, origin[:4], skip, reverse)
 	d := &getBlockHeadersData{Origin: hashOrNumber{Hash: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse}
+	p.score.requested(BlockHeadersMsg)
 	s, e := p2p.Send(p.rw, GetBlockHeadersMsg, d)
 	mlogWireDelegate(p, "send", GetBlockHeadersMsg, s, d, nil)
 	return e
@@ -333,6 +351,7 @@ func (p *peer) RequestHeadersByHash(origin common.Hash, amount int, skip int, re
 func (p *peer) RequestHeadersByNumber(origin uint64, amount int, skip int, reverse bool) error {
 	glog.V(logger.Debug).Infof("fetching from: %v %d req=headersbynumber n=%d, skipping=%d reverse=%v", p, amount, origin, skip, reverse)
 	d := &getBlockHeadersData{Origin: hashOrNumber{Number: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse}
+	p.score.requested(BlockHeadersMsg)
 	s, e := p2p.Send(p.rw, GetBlockHeadersMsg, d)
 	mlogWireDelegate(p, "send", GetBlockHeadersMsg, s, d, nil)
 	return e
@@ -342,6 +361,7 @@ func (p *peer) RequestHeadersByNumber(origin uint64, amount int, skip int, rever
 // specified.
 func (p *peer) RequestBodies(hashes []common.Hash) error {
 	glog.V(logger.Debug).Infof("fetching from: %v req=blockbodies n=%d first=%s", p, len(hashes), hashes[0].Hex())
+	p.score.requested(BlockBodiesMsg)
 	s, e := p2p.Send(p.rw, GetBlockBodiesMsg, hashes)
 	mlogWireDelegate(p, "send", GetBlockBodiesMsg, s, hashes, nil)
 	return e
@@ -351,6 +371,7 @@ func (p *peer) RequestBodies(hashes []common.Hash) error {
 // data, corresponding to the specified hashes.
 func (p *peer) RequestNodeData(hashes []common.Hash) error {
 	glog.V(logger.Debug).Infof("fetching from: %v req=statedata n=%d first=%s", p, len(hashes), hashes[0].Hex())
+	p.score.requested(NodeDataMsg)
 	s, e := p2p.Send(p.rw, GetNodeDataMsg, hashes)
 	mlogWireDelegate(p, "send", GetNodeDataMsg, s, hashes, nil)
 	return e
@@ -359,6 +380,7 @@ func (p *peer) RequestNodeData(hashes []common.Hash) error {
 // RequestReceipts fetches a batch of transaction receipts from a remote node.
 func (p *peer) RequestReceipts(hashes []common.Hash) error {
 	glog.V(logger.Debug).Infof("fetching from: %v req=receipts n=%d first=%s", p, len(hashes), hashes[0].Hex())
+	p.score.requested(ReceiptsMsg)
 	s, e := p2p.Send(p.rw, GetReceiptsMsg, hashes)
 	mlogWireDelegate(p, "send", GetReceiptsMsg, s, hashes, nil)
 	return e
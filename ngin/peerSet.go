@@ -3,6 +3,7 @@ package ngin
 import (
 	"math/big"
 	"sync"
+	"time"
 
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/p2p"
@@ -119,6 +120,59 @@ func (ps *peerSet) BestPeer() *peer {
 	return bestPeer
 }
 
+// Evaluate decays the reputation of every peer and expires their unanswered
+// requests. It returns the peers past their grace period whose score dropped
+// to or below peerDropScore, trusted and static peers excepted.
+func (ps *peerSet) Evaluate(now time.Time) []*peer {
+	ps.lock.RLock()
+	var candidates []*peer
+	for _, p := range ps.peers {
+		p.score.evaluate(now)
+		if now.Sub(p.created) >= peerEvictGrace && p.score.Value() <= peerDropScore {
+			candidates = append(candidates, p)
+		}
+	}
+	ps.lock.RUnlock()
+
+	// Check the candidates outside the lock, see WorstPeer.
+	drop := candidates[:0]
+	for _, p := range candidates {
+		if !p.protected() {
+			drop = append(drop, p)
+		}
+	}
+	return drop
+}
+
+// WorstPeer retrieves the peer with the lowest reputation score which may be
+// evicted, i.e. is past its grace period and neither trusted nor static.
+func (ps *peerSet) WorstPeer(now time.Time) *peer {
+	// Snapshot the candidates first, gathering the p2p peer infos calls back
+	// into the peer set via the protocol's PeerInfo.
+	ps.lock.RLock()
+	candidates := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		if now.Sub(p.created) >= peerEvictGrace {
+			candidates = append(candidates, p)
+		}
+	}
+	ps.lock.RUnlock()
+
+	var (
+		worstPeer  *peer
+		worstScore float64
+	)
+	for _, p := range candidates {
+		if p.protected() {
+			continue
+		}
+		if score := p.score.Value(); worstPeer == nil || score < worstScore {
+			worstPeer, worstScore = p, score
+		}
+	}
+	return worstPeer
+}
+
 // Close disconnects all peers.
 // No new peers can be registered after Close has returned.
 func (ps *peerSet) Close() {
@@ -0,0 +1,204 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+)
+
+// Reputation score adjustments. Scores start at zero, are clamped to
+// [scoreMin, scoreMax] and decay towards zero on every evaluation round, so
+// that old behaviour is gradually forgotten.
+const (
+	scoreMax = 100.0
+	scoreMin = -100.0
+
+	scoreUsefulBlock  = 5.0   // propagated block or announcement we didn't have
+	scoreUsefulTx     = 0.05  // transaction the peer hadn't sent us before
+	scoreUsefulTxCap  = 2.0   // maximum reward for a single transaction message
+	scoreDuplicateTx  = -0.02 // transaction the peer already sent us (spam)
+	scoreFastResponse = 1.0   // response arriving within scoreFastLatency
+	scoreSlowResponse = -2.0  // response arriving after scoreSlowLatency
+	scoreUnsolicited  = -1.0  // response nobody asked for
+	scoreInvalid      = -20.0 // invalid transaction signatures and similar bad data
+	scoreTimeout      = -10.0 // request left unanswered for requestTimeout
+
+	scoreFastLatency = time.Second
+	scoreSlowLatency = 5 * time.Second
+	requestTimeout   = 15 * time.Second
+
+	scoreDecay = 0.9 // multiplier applied on every evaluation round
+)
+
+// Eviction policy of misbehaving peers.
+const (
+	peerEvalInterval = time.Minute     // how often scores are decayed and peers evaluated
+	peerEvictGrace   = 2 * time.Minute // newly connected peers are not evicted before this
+	peerDropScore    = -50.0           // peers at or below this are always dropped
+	peerEvictScore   = 0.0             // when full, the worst peer below this is dropped
+)
+
+// peerScore tracks the reputation of a single peer.
+type peerScore struct {
+	lock    sync.Mutex
+	value   float64
+	latency time.Duration        // moving average of the response latency
+	pending map[uint64][]time.Time // response message code -> send times of the unanswered requests, oldest first
+}
+
+func newPeerScore() *peerScore {
+	return &peerScore{pending: make(map[uint64][]time.Time)}
+}
+
+// Value returns the current score.
+func (s *peerScore) Value() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.value
+}
+
+// Latency returns the moving average of the response latency.
+func (s *peerScore) Latency() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.latency
+}
+
+// add adjusts the score by delta.
+func (s *peerScore) add(delta float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.adjust(delta)
+}
+
+// adjust adds delta to the score, clamping the result. The lock must be held.
+func (s *peerScore) adjust(delta float64) {
+	s.value += delta
+	if s.value > scoreMax {
+		s.value = scoreMax
+	} else if s.value < scoreMin {
+		s.value = scoreMin
+	}
+}
+
+// requested records that a request expecting a response with the given
+// message code was sent. Requests may overlap, each is answered separately.
+func (s *peerScore) requested(code uint64) {
+	s.requestedAt(code, time.Now())
+}
+
+func (s *peerScore) requestedAt(code uint64, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pending[code] = append(s.pending[code], now)
+}
+
+// responded records the arrival of a response with the given message code,
+// matching it with the oldest unanswered request of that code and scoring the
+// peer by the time it took to answer. Only responses without any outstanding
+// request are penalized as unsolicited.
+func (s *peerScore) responded(code uint64) {
+	s.respondedAt(code, time.Now())
+}
+
+func (s *peerScore) respondedAt(code uint64, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	queue := s.pending[code]
+	if len(queue) == 0 {
+		s.adjust(scoreUnsolicited)
+		return
+	}
+	sent := queue[0]
+	if len(queue) == 1 {
+		delete(s.pending, code)
+	} else {
+		s.pending[code] = queue[1:]
+	}
+
+	latency := now.Sub(sent)
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency = (3*s.latency + latency) / 4
+	}
+	switch {
+	case latency <= scoreFastLatency:
+		s.adjust(scoreFastResponse)
+	case latency >= scoreSlowLatency:
+		s.adjust(scoreSlowResponse)
+	}
+}
+
+// evaluate decays the score and penalizes requests which timed out.
+func (s *peerScore) evaluate(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.value *= scoreDecay
+	for code, queue := range s.pending {
+		expired := 0
+		for expired < len(queue) && now.Sub(queue[expired]) > requestTimeout {
+			expired++
+		}
+		if expired == 0 {
+			continue
+		}
+		// Requests sent together usually time out together, penalize the
+		// peer once per message code and round rather than per request.
+		s.adjust(scoreTimeout)
+		if expired == len(queue) {
+			delete(s.pending, code)
+		} else {
+			s.pending[code] = queue[expired:]
+		}
+	}
+}
+
+// scoreLoop periodically re-evaluates the peer scores, dropping peers which
+// misbehaved badly and making room for better ones when the peer set is full.
+func (pm *ProtocolManager) scoreLoop() {
+	ticker := time.NewTicker(peerEvalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, p := range pm.peers.Evaluate(now) {
+				glog.V(logger.Debug).Infof("Peer %s: dropping misbehaving peer, score=%.2f", p.id, p.score.Value())
+				pm.removePeer(p.id)
+			}
+			if pm.peers.Len() >= pm.maxPeers {
+				if p := pm.peers.WorstPeer(now); p != nil && p.score.Value() < peerEvictScore {
+					glog.V(logger.Debug).Infof("Peer %s: evicting lowest scoring peer to make room, score=%.2f", p.id, p.score.Value())
+					pm.removePeer(p.id)
+				}
+			}
+		case <-pm.quitSync:
+			return
+		}
+	}
+}
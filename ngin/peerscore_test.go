@@ -0,0 +1,110 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngin
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that overlapping requests of the same kind, as sent by the fetcher for
+// every announced hash, are each matched with their response.
+func TestPeerScoreOverlappingRequests(t *testing.T) {
+	s := newPeerScore()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		s.requestedAt(BlockHeadersMsg, now)
+	}
+	for i := 0; i < 3; i++ {
+		s.respondedAt(BlockHeadersMsg, now.Add(100*time.Millisecond))
+	}
+	if want := 3 * scoreFastResponse; s.Value() != want {
+		t.Fatalf("score after 3 fast responses: have %v, want %v", s.Value(), want)
+	}
+	if len(s.pending) != 0 {
+		t.Fatalf("pending requests left: %v", s.pending)
+	}
+	// Only a response beyond the outstanding requests is unsolicited
+	s.respondedAt(BlockHeadersMsg, now)
+	if want := 3*scoreFastResponse + scoreUnsolicited; s.Value() != want {
+		t.Fatalf("score after unsolicited response: have %v, want %v", s.Value(), want)
+	}
+}
+
+// Tests that responses are matched with the oldest request of their kind and
+// scored by latency.
+func TestPeerScoreLatency(t *testing.T) {
+	s := newPeerScore()
+	now := time.Now()
+	s.requestedAt(BlockBodiesMsg, now)
+	s.requestedAt(BlockBodiesMsg, now.Add(5*time.Second))
+	s.requestedAt(ReceiptsMsg, now)
+
+	s.respondedAt(BlockBodiesMsg, now.Add(6*time.Second)) // oldest body request: slow
+	if want := scoreSlowResponse; s.Value() != want {
+		t.Fatalf("score after slow response: have %v, want %v", s.Value(), want)
+	}
+	s.respondedAt(BlockBodiesMsg, now.Add(6*time.Second)) // second body request: fast
+	if want := scoreSlowResponse + scoreFastResponse; s.Value() != want {
+		t.Fatalf("score after fast response: have %v, want %v", s.Value(), want)
+	}
+	if len(s.pending[ReceiptsMsg]) != 1 {
+		t.Fatalf("receipts request matched by a response of another kind")
+	}
+}
+
+// Tests that unanswered requests are penalized once they time out, once per
+// message code and evaluation round.
+func TestPeerScoreTimeout(t *testing.T) {
+	s := newPeerScore()
+	now := time.Now()
+	s.requestedAt(NodeDataMsg, now)
+	s.requestedAt(NodeDataMsg, now)
+	s.requestedAt(NodeDataMsg, now.Add(requestTimeout))
+
+	s.evaluate(now.Add(requestTimeout / 2))
+	if s.Value() != 0 {
+		t.Fatalf("penalized before timeout: score %v", s.Value())
+	}
+	s.evaluate(now.Add(requestTimeout + time.Second))
+	if want := scoreTimeout; s.Value() != want {
+		t.Fatalf("score after timeout: have %v, want %v", s.Value(), want)
+	}
+	if n := len(s.pending[NodeDataMsg]); n != 1 {
+		t.Fatalf("pending requests after timeout: have %d, want 1", n)
+	}
+	// The late answer to a timed out request is matched with the one left
+	s.respondedAt(NodeDataMsg, now.Add(requestTimeout+2*time.Second))
+	if len(s.pending) != 0 {
+		t.Fatalf("pending requests left: %v", s.pending)
+	}
+}
+
+// Tests that scores are clamped and decay towards zero.
+func TestPeerScoreClampAndDecay(t *testing.T) {
+	s := newPeerScore()
+	for i := 0; i < 10; i++ {
+		s.add(scoreInvalid)
+	}
+	if s.Value() != scoreMin {
+		t.Fatalf("score not clamped: have %v, want %v", s.Value(), scoreMin)
+	}
+	s.evaluate(time.Now())
+	if want := scoreMin * scoreDecay; s.Value() != want {
+		t.Fatalf("score not decayed: have %v, want %v", s.Value(), want)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngindb
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/dgraph-io/badger"
+)
+
+// badgerManifest is the name of the manifest file within a badger database
+// directory. LevelDB's are suffixed with a number.
+const badgerManifest = "MANIFEST"
+
+// badgerGCRatio is the share of a value log file to be garbage for the file to
+// be rewritten on compaction.
+const badgerGCRatio = 0.5
+
+// BadgerDatabase is a database backed by badger, a pure Go LSM tree keeping
+// the values apart from the keys in a value log. It needs no cgo or native
+// libraries.
+type BadgerDatabase struct {
+	file string
+	db   *badger.DB
+}
+
+// NewBadgerDatabase opens, or creates, the badger database in the directory
+// file. The cache allowance is spent on the memtables, badger memory maps its
+// tables and keeps their files open regardless of the handle allowance.
+func NewBadgerDatabase(file string, cache int, handles int) (*BadgerDatabase, error) {
+	cache, _ = allowance(file, cache, handles)
+
+	opts := badger.DefaultOptions(file).
+		WithLogger(badgerLogger{}).
+		WithNumMemtables(2).
+		WithMaxTableSize(int64(cache) / 4 * 1024 * 1024)
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerDatabase{file: file, db: db}, nil
+}
+
+// Path returns the path to the database directory.
+func (db *BadgerDatabase) Path() string {
+	return db.file
+}
+
+func (db *BadgerDatabase) Put(key []byte, value []byte) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(common.CopyBytes(key), common.CopyBytes(value))
+	})
+}
+
+func (db *BadgerDatabase) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, errNotFound
+	}
+	return value, err
+}
+
+func (db *BadgerDatabase) Has(key []byte) (bool, error) {
+	err := db.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		return err
+	})
+	switch err {
+	case nil:
+		return true, nil
+	case badger.ErrKeyNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (db *BadgerDatabase) Delete(key []byte) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(common.CopyBytes(key))
+	})
+}
+
+func (db *BadgerDatabase) Close() {
+	if err := db.db.Close(); err != nil {
+		glog.V(logger.Error).Errorf("Failed to close database %s: %v", db.file, err)
+	}
+}
+
+func (db *BadgerDatabase) NewBatch() Batch {
+	return &badgerBatch{db: db.db}
+}
+
+// NewIterator iterates over a consistent snapshot of the database, taken in a
+// read transaction held until the iterator is released.
+func (db *BadgerDatabase) NewIterator() Iterator {
+	return db.NewIteratorRange(nil, nil)
+}
+
+func (db *BadgerDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.NewIteratorRange(prefix, prefixLimit(prefix))
+}
+
+func (db *BadgerDatabase) NewIteratorRange(start []byte, limit []byte) Iterator {
+	return newBadgerIterator(db.db, start, limit, false)
+}
+
+func (db *BadgerDatabase) NewReverseIteratorRange(start []byte, limit []byte) Iterator {
+	return newBadgerIterator(db.db, start, limit, true)
+}
+
+// Stat reports the sizes of the LSM tree and value log, and the tables per
+// level, regardless of the property asked for.
+func (db *BadgerDatabase) Stat(property string) (string, error) {
+	lsm, vlog := db.db.Size()
+	stats := fmt.Sprintf("LSM tree: %v\nValue log: %v\n", common.StorageSize(lsm), common.StorageSize(vlog))
+
+	levels := make(map[int]int)
+	var maxLevel int
+	for _, table := range db.db.Tables(false) {
+		levels[table.Level]++
+		if table.Level > maxLevel {
+			maxLevel = table.Level
+		}
+	}
+	for level := 0; level <= maxLevel; level++ {
+		stats += fmt.Sprintf("Level %d: %d tables\n", level, levels[level])
+	}
+	return stats, nil
+}
+
+// Compact compacts the LSM tree into a single level and rewrites the value
+// log files holding mostly garbage. Badger can't compact a key range, the
+// whole database is compacted whatever the bounds, which makes compactions
+// after the first of a series cheap.
+func (db *BadgerDatabase) Compact(start []byte, limit []byte) error {
+	if err := db.db.Flatten(runtime.NumCPU()); err != nil {
+		return err
+	}
+	for {
+		switch err := db.db.RunValueLogGC(badgerGCRatio); err {
+		case nil:
+		case badger.ErrNoRewrite:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// badgerBatch collects writes to commit them in a single transaction, or in
+// several for batches beyond the transaction size limit of badger.
+type badgerBatch struct {
+	db     *badger.DB
+	writes []kv
+	size   int
+}
+
+func (b *badgerBatch) Put(key, value []byte) error {
+	b.writes = append(b.writes, kv{k: common.CopyBytes(key), v: common.CopyBytes(value)})
+	b.size += len(value)
+	return nil
+}
+
+func (b *badgerBatch) Delete(key []byte) error {
+	b.writes = append(b.writes, kv{k: common.CopyBytes(key), del: true})
+	b.size++
+	return nil
+}
+
+func (b *badgerBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *badgerBatch) Write() error {
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, kv := range b.writes {
+		var err error
+		if kv.del {
+			err = wb.Delete(kv.k)
+		} else {
+			err = wb.Set(kv.k, kv.v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// badgerIterator iterates over the keys in [start, limit) of a read
+// transaction.
+type badgerIterator struct {
+	txn   *badger.Txn
+	it    *badger.Iterator
+	start []byte
+	limit []byte
+
+	reverse bool
+	started bool
+	key     []byte
+	value   []byte
+	err     error
+}
+
+func newBadgerIterator(db *badger.DB, start, limit []byte, reverse bool) *badgerIterator {
+	txn := db.NewTransaction(false)
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = reverse
+	return &badgerIterator{
+		txn:     txn,
+		it:      txn.NewIterator(opts),
+		start:   common.CopyBytes(start),
+		limit:   common.CopyBytes(limit),
+		reverse: reverse,
+	}
+}
+
+func (it *badgerIterator) Next() bool {
+	if it.it == nil || it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		switch {
+		case !it.reverse && len(it.start) > 0:
+			it.it.Seek(it.start)
+		case it.reverse && len(it.limit) > 0:
+			// Seek lands on the last key at or before the exclusive limit
+			if it.it.Seek(it.limit); it.it.Valid() && bytes.Equal(it.it.Item().Key(), it.limit) {
+				it.it.Next()
+			}
+		default:
+			it.it.Rewind()
+		}
+	} else {
+		it.it.Next()
+	}
+	it.key, it.value = nil, nil
+	if !it.it.Valid() {
+		return false
+	}
+	item := it.it.Item()
+	if it.reverse && len(it.start) > 0 && bytes.Compare(item.Key(), it.start) < 0 {
+		return false
+	}
+	if !it.reverse && len(it.limit) > 0 && bytes.Compare(item.Key(), it.limit) >= 0 {
+		return false
+	}
+	it.key = item.KeyCopy(nil)
+	if it.value, it.err = item.ValueCopy(nil); it.err != nil {
+		it.key, it.value = nil, nil
+		return false
+	}
+	return true
+}
+
+func (it *badgerIterator) Key() []byte {
+	return it.key
+}
+
+func (it *badgerIterator) Value() []byte {
+	return it.value
+}
+
+func (it *badgerIterator) Error() error {
+	return it.err
+}
+
+func (it *badgerIterator) Release() {
+	if it.it != nil {
+		it.it.Close()
+		it.txn.Discard()
+		it.it, it.key, it.value = nil, nil, nil
+	}
+}
+
+// badgerLogger routes the log messages of badger to glog.
+type badgerLogger struct{}
+
+func (badgerLogger) Errorf(format string, args ...interface{}) {
+	glog.V(logger.Error).Errorf("badger: "+format, args...)
+}
+
+func (badgerLogger) Warningf(format string, args ...interface{}) {
+	glog.V(logger.Warn).Warnf("badger: "+format, args...)
+}
+
+func (badgerLogger) Infof(format string, args ...interface{}) {
+	glog.V(logger.Debug).Infof("badger: "+format, args...)
+}
+
+func (badgerLogger) Debugf(format string, args ...interface{}) {
+	glog.V(logger.Detail).Infof("badger: "+format, args...)
+}
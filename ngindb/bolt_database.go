@@ -0,0 +1,310 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngindb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/boltdb/bolt"
+)
+
+// boltFileName is the name of the database file within a bolt database
+// directory.
+const boltFileName = "bolt.db"
+
+// boltIteratorChunk is the number of entries a bolt iterator reads per
+// transaction.
+const boltIteratorChunk = 1024
+
+var (
+	boltBucket = []byte("ngin")
+
+	errNotFound = errors.New("not found")
+
+	// ErrCompactUnsupported is returned by the engines unable to compact.
+	ErrCompactUnsupported = errors.New("compaction not supported by the database engine")
+)
+
+// BoltDatabase is a database backed by a single bolt B+tree file. Being pure
+// Go it needs no cgo or native libraries, at the cost of slower random writes
+// than LevelDB. Writes are best grouped in batches, as every transaction is
+// synced to disk.
+type BoltDatabase struct {
+	file string
+	db   *bolt.DB
+}
+
+// NewBoltDatabase opens, or creates, the bolt database in the directory file.
+// Bolt memory maps its file and manages no cache or file handles of its own,
+// the allowances are accepted for compatibility with the other engines.
+func NewBoltDatabase(file string, cache int, handles int) (*BoltDatabase, error) {
+	allowance(file, cache, handles)
+
+	if err := os.MkdirAll(file, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(file, boltFileName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDatabase{file: file, db: db}, nil
+}
+
+// Path returns the path to the database directory.
+func (db *BoltDatabase) Path() string {
+	return db.file
+}
+
+func (db *BoltDatabase) Put(key []byte, value []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (db *BoltDatabase) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBucket).Get(key); v != nil {
+			value = common.CopyBytes(v)
+			return nil
+		}
+		return errNotFound
+	})
+	return value, err
+}
+
+func (db *BoltDatabase) Has(key []byte) (bool, error) {
+	var found bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(boltBucket).Get(key) != nil
+		return nil
+	})
+	return found, err
+}
+
+func (db *BoltDatabase) Delete(key []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+func (db *BoltDatabase) Close() {
+	db.db.Close()
+}
+
+func (db *BoltDatabase) NewBatch() Batch {
+	return &boltBatch{db: db.db}
+}
+
+// NewIterator iterates over the database in chunks, each read in its own
+// transaction so that writes may go on during the iteration. Unlike LevelDB's,
+// the iteration isn't a consistent snapshot.
+func (db *BoltDatabase) NewIterator() Iterator {
+	return db.NewIteratorRange(nil, nil)
+}
+
+func (db *BoltDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.NewIteratorRange(prefix, prefixLimit(prefix))
+}
+
+func (db *BoltDatabase) NewIteratorRange(start []byte, limit []byte) Iterator {
+	return &boltIterator{db: db.db, start: common.CopyBytes(start), limit: common.CopyBytes(limit), index: -1}
+}
+
+func (db *BoltDatabase) NewReverseIteratorRange(start []byte, limit []byte) Iterator {
+	return &boltIterator{db: db.db, start: common.CopyBytes(start), limit: common.CopyBytes(limit), index: -1, reverse: true}
+}
+
+// Stat reports the bolt page and transaction statistics, regardless of the
+// property asked for.
+func (db *BoltDatabase) Stat(property string) (string, error) {
+	stats := db.db.Stats()
+	return fmt.Sprintf("Free pages: %d (%d pending)\nFree page bytes: %d\nRead transactions: %d (%d open)\nWrite transactions: %d\n",
+		stats.FreePageN, stats.PendingPageN, stats.FreeAlloc, stats.TxN, stats.OpenTxN, stats.TxStats.Write), nil
+}
+
+// Compact returns ErrCompactUnsupported. Bolt reuses the pages freed by
+// deletions for later writes, but never shrinks its file: only copying the
+// database to a new file would.
+func (db *BoltDatabase) Compact(start []byte, limit []byte) error {
+	return ErrCompactUnsupported
+}
+
+type boltBatch struct {
+	db     *bolt.DB
+	writes []kv
+	size   int
+}
+
+func (b *boltBatch) Put(key, value []byte) error {
+	b.writes = append(b.writes, kv{k: common.CopyBytes(key), v: common.CopyBytes(value)})
+	b.size += len(value)
+	return nil
+}
+
+func (b *boltBatch) Delete(key []byte) error {
+	b.writes = append(b.writes, kv{k: common.CopyBytes(key), del: true})
+	b.size++
+	return nil
+}
+
+func (b *boltBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *boltBatch) Write() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, kv := range b.writes {
+			if kv.del {
+				if err := bucket.Delete(kv.k); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := bucket.Put(kv.k, kv.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type boltIterator struct {
+	db    *bolt.DB
+	start []byte // first key to iterate, empty for the first in the database
+	limit []byte // key to stop at, empty to run to the end
+	chunk []kv   // entries read in the last transaction
+	index int    // position within the chunk
+	done  bool   // whether the last chunk was read
+	err   error
+
+	reverse bool // whether to iterate in descending key order
+}
+
+func (it *boltIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.index+1 < len(it.chunk) {
+		it.index++
+		return true
+	}
+	if it.done {
+		it.index = len(it.chunk)
+		return false
+	}
+	// Chunk exhausted, read the next one starting after its last key
+	var last []byte
+	if len(it.chunk) > 0 {
+		last = it.chunk[len(it.chunk)-1].k
+	}
+	it.chunk, it.index = it.chunk[:0], 0
+	it.err = it.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+
+		if it.reverse {
+			return it.readReverse(c, last)
+		}
+		var k, v []byte
+		switch {
+		case last != nil:
+			if k, v = c.Seek(last); k != nil && bytes.Equal(k, last) {
+				k, v = c.Next()
+			}
+		case len(it.start) > 0:
+			k, v = c.Seek(it.start)
+		default:
+			k, v = c.First()
+		}
+		for ; k != nil && len(it.chunk) < boltIteratorChunk; k, v = c.Next() {
+			if len(it.limit) > 0 && bytes.Compare(k, it.limit) >= 0 {
+				k = nil
+				break
+			}
+			it.chunk = append(it.chunk, kv{k: common.CopyBytes(k), v: common.CopyBytes(v)})
+		}
+		it.done = k == nil
+		return nil
+	})
+	return it.err == nil && len(it.chunk) > 0
+}
+
+// readReverse reads the chunk of entries preceding last, or the limit for the
+// first chunk, in descending order.
+func (it *boltIterator) readReverse(c *bolt.Cursor, last []byte) error {
+	bound := last
+	if bound == nil {
+		bound = it.limit
+	}
+	var k, v []byte
+	if len(bound) > 0 {
+		// Seek lands on the first key at or after the exclusive bound
+		if k, _ = c.Seek(bound); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	} else {
+		k, v = c.Last()
+	}
+	for ; k != nil && len(it.chunk) < boltIteratorChunk; k, v = c.Prev() {
+		if len(it.start) > 0 && bytes.Compare(k, it.start) < 0 {
+			k = nil
+			break
+		}
+		it.chunk = append(it.chunk, kv{k: common.CopyBytes(k), v: common.CopyBytes(v)})
+	}
+	it.done = k == nil
+	return nil
+}
+
+func (it *boltIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.chunk) {
+		return nil
+	}
+	return it.chunk[it.index].k
+}
+
+func (it *boltIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.chunk) {
+		return nil
+	}
+	return it.chunk[it.index].v
+}
+
+func (it *boltIterator) Error() error {
+	return it.err
+}
+
+func (it *boltIterator) Release() {
+	it.chunk, it.done = nil, true
+}
@@ -28,8 +28,8 @@ import (
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/filter"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	ldbiter "github.com/syndtr/goleveldb/leveldb/iterator"
 	ldbutil "github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -57,17 +57,9 @@ func SetHandleRatio(db string, ratio float64) {
 	handleRatio[db] = ratio
 }
 
-type LDBDatabase struct {
-	file string
-	db   *leveldb.DB
-
-	quitLock sync.Mutex      // Mutex protecting the quit channel access
-	quitChan chan chan error // Quit channel to stop the metrics collection before closing the database
-}
-
-// NewLDBDatabase returns a LevelDB wrapped object.
-func NewLDBDatabase(file string, cache int, handles int) (*LDBDatabase, error) {
-	// Calculate the cache and file descriptor allowance for this particular database
+// allowance calculates the cache (MB) and file descriptor allowance of the
+// database at file out of the given totals.
+func allowance(file string, cache int, handles int) (int, int) {
 	cache = int(float64(cache) * cacheRatio[filepath.Base(file)])
 	if cache < 16 {
 		cache = 16
@@ -79,6 +71,21 @@ func NewLDBDatabase(file string, cache int, handles int) (*LDBDatabase, error) {
 	glog.V(logger.Info).Infof("Allotted %dMB cache and %d file handles to %s", cache, handles, file)
 	glog.D(logger.Warn).Infof("Allotted %s cache and %s file handles to %s", logger.ColorGreen(strconv.Itoa(cache)+"MB"), logger.ColorGreen(strconv.Itoa(handles)), logger.ColorGreen(file))
 
+	return cache, handles
+}
+
+type LDBDatabase struct {
+	file string
+	db   *leveldb.DB
+
+	quitLock sync.Mutex      // Mutex protecting the quit channel access
+	quitChan chan chan error // Quit channel to stop the metrics collection before closing the database
+}
+
+// NewLDBDatabase returns a LevelDB wrapped object.
+func NewLDBDatabase(file string, cache int, handles int) (*LDBDatabase, error) {
+	cache, handles = allowance(file, cache, handles)
+
 	// Open the db and recover any potential corruptions
 	db, err := leveldb.OpenFile(file, &opt.Options{
 		OpenFilesCacheCapacity: handles,
@@ -129,16 +136,61 @@ func (self *LDBDatabase) Delete(key []byte) error {
 	return self.db.Delete(key, nil)
 }
 
-func (self *LDBDatabase) NewIterator() iterator.Iterator {
+func (self *LDBDatabase) NewIterator() Iterator {
 	return self.db.NewIterator(nil, nil)
 }
 
-func (self *LDBDatabase) NewIteratorRange(slice *ldbutil.Range) iterator.Iterator {
-	return self.db.NewIterator(slice, nil)
+func (self *LDBDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return self.db.NewIterator(ldbutil.BytesPrefix(prefix), nil)
+}
+
+func (self *LDBDatabase) NewIteratorRange(start []byte, limit []byte) Iterator {
+	return self.db.NewIterator(&ldbutil.Range{Start: start, Limit: limit}, nil)
+}
+
+func (self *LDBDatabase) NewReverseIteratorRange(start []byte, limit []byte) Iterator {
+	return &ldbReverseIterator{it: self.db.NewIterator(&ldbutil.Range{Start: start, Limit: limit}, nil)}
+}
+
+// ldbReverseIterator walks a leveldb iterator backwards from its last key.
+type ldbReverseIterator struct {
+	it      ldbiter.Iterator
+	started bool
+}
+
+func (it *ldbReverseIterator) Next() bool {
+	if !it.started {
+		it.started = true
+		return it.it.Last()
+	}
+	return it.it.Prev()
+}
+
+func (it *ldbReverseIterator) Key() []byte {
+	return it.it.Key()
+}
+
+func (it *ldbReverseIterator) Value() []byte {
+	return it.it.Value()
+}
+
+func (it *ldbReverseIterator) Error() error {
+	return it.it.Error()
+}
+
+func (it *ldbReverseIterator) Release() {
+	it.it.Release()
 }
 
-func NewBytesPrefix(prefix []byte) *ldbutil.Range {
-	return ldbutil.BytesPrefix(prefix)
+// Stat returns the value of a LevelDB property, such as "leveldb.stats".
+func (self *LDBDatabase) Stat(property string) (string, error) {
+	return self.db.GetProperty(property)
+}
+
+// Compact flattens the LSM tree in the given key range, dropping deleted and
+// overwritten entries. It blocks until done.
+func (self *LDBDatabase) Compact(start []byte, limit []byte) error {
+	return self.db.CompactRange(ldbutil.Range{Start: start, Limit: limit})
 }
 
 func (self *LDBDatabase) Close() {
@@ -169,6 +221,12 @@ func (b *ldbBatch) Put(key, value []byte) error {
 	return nil
 }
 
+func (b *ldbBatch) Delete(key []byte) error {
+	b.b.Delete(key)
+	b.size++
+	return nil
+}
+
 func (b *ldbBatch) Write() error {
 	return b.db.Write(b.b, nil)
 }
@@ -207,10 +265,80 @@ func (dt *table) Delete(key []byte) error {
 	return dt.db.Delete(append([]byte(dt.prefix), key...))
 }
 
+// NewIterator iterates over the keys of the table, with the prefix stripped.
+func (dt *table) NewIterator() Iterator {
+	return dt.NewIteratorWithPrefix(nil)
+}
+
+func (dt *table) NewIteratorWithPrefix(prefix []byte) Iterator {
+	it := dt.db.NewIteratorWithPrefix(append([]byte(dt.prefix), prefix...))
+	return &tableIterator{it: it, prefix: []byte(dt.prefix)}
+}
+
+func (dt *table) NewIteratorRange(start []byte, limit []byte) Iterator {
+	start, limit = dt.bounds(start, limit)
+	return &tableIterator{it: dt.db.NewIteratorRange(start, limit), prefix: []byte(dt.prefix)}
+}
+
+func (dt *table) NewReverseIteratorRange(start []byte, limit []byte) Iterator {
+	start, limit = dt.bounds(start, limit)
+	return &tableIterator{it: dt.db.NewReverseIteratorRange(start, limit), prefix: []byte(dt.prefix)}
+}
+
+func (dt *table) Stat(property string) (string, error) {
+	return dt.db.Stat(property)
+}
+
+func (dt *table) Compact(start []byte, limit []byte) error {
+	start, limit = dt.bounds(start, limit)
+	return dt.db.Compact(start, limit)
+}
+
+// bounds maps a key range of the table to the underlying database.
+func (dt *table) bounds(start []byte, limit []byte) ([]byte, []byte) {
+	start = append([]byte(dt.prefix), start...)
+	if len(limit) == 0 {
+		limit = prefixLimit([]byte(dt.prefix))
+	} else {
+		limit = append([]byte(dt.prefix), limit...)
+	}
+	return start, limit
+}
+
 func (dt *table) Close() {
 	// Do nothing; don't close the underlying DB.
 }
 
+// tableIterator strips the table prefix off the keys of an underlying
+// iterator confined to the table.
+type tableIterator struct {
+	it     Iterator
+	prefix []byte
+}
+
+func (ti *tableIterator) Next() bool {
+	return ti.it.Next()
+}
+
+func (ti *tableIterator) Key() []byte {
+	if key := ti.it.Key(); len(key) >= len(ti.prefix) {
+		return key[len(ti.prefix):]
+	}
+	return nil
+}
+
+func (ti *tableIterator) Value() []byte {
+	return ti.it.Value()
+}
+
+func (ti *tableIterator) Error() error {
+	return ti.it.Error()
+}
+
+func (ti *tableIterator) Release() {
+	ti.it.Release()
+}
+
 type tableBatch struct {
 	batch  Batch
 	prefix string
@@ -229,6 +357,10 @@ func (tb *tableBatch) Put(key, value []byte) error {
 	return tb.batch.Put(append([]byte(tb.prefix), key...), value)
 }
 
+func (tb *tableBatch) Delete(key []byte) error {
+	return tb.batch.Delete(append([]byte(tb.prefix), key...))
+}
+
 func (tb *tableBatch) Write() error {
 	return tb.batch.Write()
 }
@@ -236,3 +368,17 @@ func (tb *tableBatch) Write() error {
 func (tb *tableBatch) ValueSize() int {
 	return tb.batch.ValueSize()
 }
+
+// prefixLimit returns the smallest key greater than every key starting with
+// prefix, nil if there is none.
+func prefixLimit(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			limit := make([]byte, i+1)
+			copy(limit, prefix)
+			limit[i]++
+			return limit
+		}
+	}
+	return nil
+}
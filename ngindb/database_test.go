@@ -0,0 +1,116 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngindb_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NginProject/ngind/ngindb"
+	"github.com/NginProject/ngind/ngindb/dbtest"
+)
+
+// newTestDatabase opens a database of the given engine in a temporary
+// directory, removed once the test is done.
+func newTestDatabase(t *testing.T, engine string) ngindb.Database {
+	dir, err := ioutil.TempDir("", "ngindb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := ngindb.Open(engine, filepath.Join(dir, "test"), 16, 16)
+	if err != nil {
+		t.Fatalf("failed to open %s database: %v", engine, err)
+	}
+	return db
+}
+
+func TestLDBDatabase(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ngindb.Database {
+		return newTestDatabase(t, ngindb.EngineLevelDB)
+	})
+}
+
+func TestBadgerDatabase(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ngindb.Database {
+		return newTestDatabase(t, ngindb.EngineBadger)
+	})
+}
+
+func TestBoltDatabase(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ngindb.Database {
+		return newTestDatabase(t, ngindb.EngineBolt)
+	})
+}
+
+func TestMemDatabase(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ngindb.Database {
+		db, _ := ngindb.NewMemDatabase()
+		return db
+	})
+}
+
+// Tests the prefixing table wrapper over a database holding keys around its
+// prefix, which must stay out of sight.
+func TestTable(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ngindb.Database {
+		db, _ := ngindb.NewMemDatabase()
+		for _, key := range []string{"ta", "t", "tabl", "tablf", "u", "\xff"} {
+			db.Put([]byte(key), []byte("outside"))
+		}
+		return ngindb.NewTable(db, "table")
+	})
+}
+
+// Tests that existing databases are opened with the engine they were created
+// with, whatever the engine requested.
+func TestOpenDetectsEngine(t *testing.T) {
+	for _, engine := range []string{ngindb.EngineLevelDB, ngindb.EngineBadger, ngindb.EngineBolt} {
+		dir, err := ioutil.TempDir("", "ngindb-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "test")
+
+		db, err := ngindb.Open(engine, file, 16, 16)
+		if err != nil {
+			t.Fatalf("failed to create %s database: %v", engine, err)
+		}
+		if err := db.Put([]byte("key"), []byte(engine)); err != nil {
+			t.Fatalf("%s: put failed: %v", engine, err)
+		}
+		db.Close()
+
+		if have := ngindb.DetectEngine(file); have != engine {
+			t.Errorf("detected engine mismatch: have %q, want %q", have, engine)
+		}
+		for _, other := range ngindb.Engines() {
+			db, err := ngindb.Open(other, file, 16, 16)
+			if err != nil {
+				t.Fatalf("failed to reopen %s database as %s: %v", engine, other, err)
+			}
+			if v, err := db.Get([]byte("key")); err != nil || string(v) != engine {
+				t.Errorf("%s database opened as %s: have %q (%v), want %q", engine, other, v, err, engine)
+			}
+			db.Close()
+		}
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+// Package dbtest is the conformance suite every ngindb.Database and
+// ngindb.Batch implementation must pass. Engines run it from their own tests:
+//
+//	func TestMyDatabase(t *testing.T) {
+//		dbtest.TestDatabaseSuite(t, func() ngindb.Database {
+//			return newMyDatabase(t)
+//		})
+//	}
+package dbtest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/NginProject/ngind/ngindb"
+)
+
+// TestDatabaseSuite runs the conformance tests against fresh, empty databases
+// created by New. The databases are closed by the suite.
+func TestDatabaseSuite(t *testing.T, New func() ngindb.Database) {
+	t.Run("PutGet", func(t *testing.T) { testPutGet(t, New()) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, New()) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, New()) })
+	t.Run("ValueCopy", func(t *testing.T) { testValueCopy(t, New()) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, New()) })
+	t.Run("BatchDelete", func(t *testing.T) { testBatchDelete(t, New()) })
+	t.Run("Iterator", func(t *testing.T) { testIterator(t, New()) })
+	t.Run("IteratorEmpty", func(t *testing.T) { testIteratorEmpty(t, New()) })
+	t.Run("IteratorWithPrefix", func(t *testing.T) { testIteratorWithPrefix(t, New()) })
+	t.Run("IteratorRange", func(t *testing.T) { testIteratorRange(t, New()) })
+	t.Run("ReverseIteratorRange", func(t *testing.T) { testReverseIteratorRange(t, New()) })
+	t.Run("Compact", func(t *testing.T) { testCompact(t, New()) })
+}
+
+var testValues = []string{"a", "1251", "\x00123\x00", "\xff", "ab", "abc", "abcd", "b"}
+
+func testPutGet(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+	}
+	for _, k := range testValues {
+		if ok, err := db.Has([]byte(k)); err != nil || !ok {
+			t.Fatalf("has %q: have %v (%v), want true", k, ok, err)
+		}
+		v, err := db.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("get %q failed: %v", k, err)
+		}
+		if !bytes.Equal(v, []byte("v"+k)) {
+			t.Fatalf("get %q: have %q, want %q", k, v, "v"+k)
+		}
+	}
+	if _, err := db.Get([]byte("missing")); err == nil {
+		t.Fatalf("get of missing key succeeded")
+	}
+	if ok, err := db.Has([]byte("missing")); err != nil || ok {
+		t.Fatalf("has of missing key: have %v (%v), want false", ok, err)
+	}
+}
+
+func testOverwrite(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	key := []byte("key")
+	for i := 0; i < 3; i++ {
+		value := []byte(fmt.Sprintf("value %d", i))
+		if err := db.Put(key, value); err != nil {
+			t.Fatalf("put %d failed: %v", i, err)
+		}
+		if v, err := db.Get(key); err != nil || !bytes.Equal(v, value) {
+			t.Fatalf("get %d: have %q (%v), want %q", i, v, err, value)
+		}
+	}
+}
+
+func testDelete(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+	}
+	for i, k := range testValues {
+		if i%2 == 0 {
+			if err := db.Delete([]byte(k)); err != nil {
+				t.Fatalf("delete %q failed: %v", k, err)
+			}
+		}
+	}
+	for i, k := range testValues {
+		ok, err := db.Has([]byte(k))
+		if err != nil {
+			t.Fatalf("has %q failed: %v", k, err)
+		}
+		if want := i%2 != 0; ok != want {
+			t.Fatalf("has %q after deletes: have %v, want %v", k, ok, want)
+		}
+	}
+	// Deleting a missing key is not an error
+	if err := db.Delete([]byte("missing")); err != nil {
+		t.Fatalf("delete of missing key failed: %v", err)
+	}
+}
+
+func testValueCopy(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	key, value := []byte("key"), []byte("value")
+	if err := db.Put(key, value); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	// Mutating the written slice must not alter the stored value
+	value[0] = 'X'
+	if v, err := db.Get(key); err != nil || !bytes.Equal(v, []byte("value")) {
+		t.Fatalf("get after mutating put value: have %q (%v), want %q", v, err, "value")
+	}
+}
+
+func testBatch(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	batch := db.NewBatch()
+	for _, k := range testValues {
+		if err := batch.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("batch put %q failed: %v", k, err)
+		}
+	}
+	if batch.ValueSize() == 0 {
+		t.Fatalf("batch value size zero after puts")
+	}
+	// Nothing is visible until the batch is written
+	for _, k := range testValues {
+		if ok, _ := db.Has([]byte(k)); ok {
+			t.Fatalf("key %q visible before batch write", k)
+		}
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatalf("batch write failed: %v", err)
+	}
+	for _, k := range testValues {
+		if v, err := db.Get([]byte(k)); err != nil || !bytes.Equal(v, []byte(k)) {
+			t.Fatalf("get %q after batch write: have %q (%v), want %q", k, v, err, k)
+		}
+	}
+}
+
+func testBatchDelete(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+	}
+	batch := db.NewBatch()
+	for _, k := range testValues {
+		if err := batch.Delete([]byte(k)); err != nil {
+			t.Fatalf("batch delete %q failed: %v", k, err)
+		}
+	}
+	// Operations apply in order, a put after a delete wins
+	if err := batch.Put([]byte("a"), []byte("again")); err != nil {
+		t.Fatalf("batch put failed: %v", err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatalf("batch write failed: %v", err)
+	}
+	for _, k := range testValues {
+		ok, err := db.Has([]byte(k))
+		if err != nil {
+			t.Fatalf("has %q failed: %v", k, err)
+		}
+		if want := k == "a"; ok != want {
+			t.Fatalf("has %q after batch delete: have %v, want %v", k, ok, want)
+		}
+	}
+}
+
+func testIterator(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+	}
+	want := append([]string{}, testValues...)
+	sort.Strings(want)
+
+	var have []string
+	it := db.NewIterator()
+	for it.Next() {
+		key := string(it.Key())
+		if value := string(it.Value()); value != "v"+key {
+			t.Errorf("iterated value of %q: have %q, want %q", key, value, "v"+key)
+		}
+		have = append(have, key)
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	it.Release()
+
+	if fmt.Sprintf("%q", have) != fmt.Sprintf("%q", want) {
+		t.Fatalf("iterated keys mismatch:\nhave %q\nwant %q", have, want)
+	}
+	if it.Next() {
+		t.Fatalf("released iterator advanced")
+	}
+}
+
+func testIteratorEmpty(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	it := db.NewIterator()
+	defer it.Release()
+
+	if it.Next() {
+		t.Fatalf("iterator over empty database advanced to %q", it.Key())
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+}
+
+func testIteratorWithPrefix(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"\x00123\x00", "1251", "a", "ab", "abc", "abcd", "b", "\xff"}},
+		{"a", []string{"a", "ab", "abc", "abcd"}},
+		{"abc", []string{"abc", "abcd"}},
+		{"\xff", []string{"\xff"}},
+		{"c", nil},
+	}
+	for _, tt := range tests {
+		have := iterateKeys(t, db.NewIteratorWithPrefix([]byte(tt.prefix)))
+		if fmt.Sprintf("%q", have) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("prefix %q mismatch:\nhave %q\nwant %q", tt.prefix, have, tt.want)
+		}
+	}
+}
+
+func testIteratorRange(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+	}
+	tests := []struct {
+		start, limit []byte
+		want         []string
+	}{
+		{nil, nil, []string{"\x00123\x00", "1251", "a", "ab", "abc", "abcd", "b", "\xff"}},
+		{[]byte("ab"), []byte("b"), []string{"ab", "abc", "abcd"}},
+		{[]byte("aa"), nil, []string{"ab", "abc", "abcd", "b", "\xff"}},
+		{nil, []byte("a"), []string{"\x00123\x00", "1251"}},
+		{[]byte("b"), []byte("b"), nil},
+	}
+	for _, tt := range tests {
+		have := iterateKeys(t, db.NewIteratorRange(tt.start, tt.limit))
+		if fmt.Sprintf("%q", have) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("range [%q, %q) mismatch:\nhave %q\nwant %q", tt.start, tt.limit, have, tt.want)
+		}
+	}
+}
+
+func testReverseIteratorRange(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+	}
+	tests := []struct {
+		start, limit []byte
+		want         []string
+	}{
+		{nil, nil, []string{"\xff", "b", "abcd", "abc", "ab", "a", "1251", "\x00123\x00"}},
+		{[]byte("ab"), []byte("b"), []string{"abcd", "abc", "ab"}},
+		{[]byte("aa"), nil, []string{"\xff", "b", "abcd", "abc", "ab"}},
+		{nil, []byte("a"), []string{"1251", "\x00123\x00"}},
+		{[]byte("b"), []byte("b"), nil},
+	}
+	for _, tt := range tests {
+		have := iterateKeys(t, db.NewReverseIteratorRange(tt.start, tt.limit))
+		if fmt.Sprintf("%q", have) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("reverse range [%q, %q) mismatch:\nhave %q\nwant %q", tt.start, tt.limit, have, tt.want)
+		}
+	}
+}
+
+func testCompact(t *testing.T, db ngindb.Database) {
+	defer db.Close()
+
+	for _, k := range testValues {
+		if err := db.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("put %q failed: %v", k, err)
+		}
+		if err := db.Delete([]byte(k)); err != nil {
+			t.Fatalf("delete %q failed: %v", k, err)
+		}
+	}
+	// Engines unable to compact must say so
+	if err := db.Compact([]byte("a"), []byte("b")); err != nil && err != ngindb.ErrCompactUnsupported {
+		t.Fatalf("range compaction failed: %v", err)
+	}
+	if err := db.Compact(nil, nil); err != nil && err != ngindb.ErrCompactUnsupported {
+		t.Fatalf("full compaction failed: %v", err)
+	}
+	if have := iterateKeys(t, db.NewIterator()); len(have) != 0 {
+		t.Fatalf("keys left after compaction: %q", have)
+	}
+}
+
+// iterateKeys drains and releases the iterator, returning the keys seen.
+func iterateKeys(t *testing.T, it ngindb.Iterator) []string {
+	defer it.Release()
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	return keys
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngindb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+)
+
+// The built in database engines.
+const (
+	EngineLevelDB = "leveldb"
+	EngineBadger  = "badger"
+	EngineBolt    = "bolt"
+
+	DefaultEngine = EngineLevelDB
+)
+
+// Engine opens, or creates, a persistent database of some kind in the
+// directory file, given the total cache (MB) and file handle allowance. The
+// share of the totals given to the database is up to the engine.
+type Engine struct {
+	Open func(file string, cache int, handles int) (Database, error)
+
+	// Detect reports whether the directory holds a database of this engine.
+	Detect func(file string) bool
+}
+
+var (
+	enginesLock sync.RWMutex
+	engines     = map[string]Engine{
+		EngineLevelDB: {
+			Open: func(file string, cache int, handles int) (Database, error) {
+				return NewLDBDatabase(file, cache, handles)
+			},
+			Detect: func(file string) bool {
+				return fileExists(filepath.Join(file, "CURRENT"))
+			},
+		},
+		EngineBadger: {
+			Open: func(file string, cache int, handles int) (Database, error) {
+				return NewBadgerDatabase(file, cache, handles)
+			},
+			Detect: func(file string) bool {
+				return fileExists(filepath.Join(file, badgerManifest))
+			},
+		},
+		EngineBolt: {
+			Open: func(file string, cache int, handles int) (Database, error) {
+				return NewBoltDatabase(file, cache, handles)
+			},
+			Detect: func(file string) bool {
+				return fileExists(filepath.Join(file, boltFileName))
+			},
+		},
+	}
+)
+
+// RegisterEngine makes a database engine available under the given name,
+// replacing any engine previously registered with it.
+func RegisterEngine(name string, engine Engine) {
+	enginesLock.Lock()
+	defer enginesLock.Unlock()
+
+	engines[name] = engine
+}
+
+// Engines returns the names of the registered database engines.
+func Engines() []string {
+	enginesLock.RLock()
+	defer enginesLock.RUnlock()
+
+	return sortedEngines()
+}
+
+// DetectEngine returns the engine of the database in the directory file, or
+// an empty string if there is none.
+func DetectEngine(file string) string {
+	enginesLock.RLock()
+	defer enginesLock.RUnlock()
+
+	for _, name := range sortedEngines() {
+		if engines[name].Detect(file) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Open opens the database in the directory file. An existing database is
+// always opened with the engine it was created with, the given engine is only
+// used to create new ones. An empty engine selects DefaultEngine.
+func Open(engine string, file string, cache int, handles int) (Database, error) {
+	if engine == "" {
+		engine = DefaultEngine
+	}
+	if existing := DetectEngine(file); existing != "" && existing != engine {
+		glog.V(logger.Warn).Infof("Database %s was created by %s, ignoring requested engine %s", file, existing, engine)
+		engine = existing
+	}
+	enginesLock.RLock()
+	e, ok := engines[engine]
+	enginesLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown database engine %q, available: %v", engine, Engines())
+	}
+	return e.Open(file, cache, handles)
+}
+
+// sortedEngines returns the registered engine names in a stable order. The
+// caller must hold enginesLock.
+func sortedEngines() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
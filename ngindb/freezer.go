@@ -0,0 +1,206 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngindb
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+)
+
+// The ancient store tables, one item per block number.
+const (
+	FreezerHashTable       = "hashes"   // canonical block hashes
+	FreezerHeaderTable     = "headers"  // RLP encoded block headers
+	FreezerBodiesTable     = "bodies"   // RLP encoded block bodies
+	FreezerReceiptTable    = "receipts" // RLP encoded block receipts in storage format
+	FreezerDifficultyTable = "diffs"    // RLP encoded total difficulties
+)
+
+// freezerNoSnappy lists the tables which are never compressed, hashes don't
+// compress.
+var freezerNoSnappy = map[string]bool{
+	FreezerHashTable:       true,
+	FreezerHeaderTable:     false,
+	FreezerBodiesTable:     false,
+	FreezerReceiptTable:    false,
+	FreezerDifficultyTable: false,
+}
+
+// Freezer is an append-only store of the old canonical chain, keeping the
+// blocks in flat files indexed by number. Every table holds the same number
+// of items; a block is either fully frozen or not at all.
+type Freezer struct {
+	frozen uint64 // number of blocks frozen, accessed atomically
+	tables map[string]*freezerTable
+}
+
+// NewFreezer opens, or creates, the ancient store in dir. If compress is set
+// new tables are snappy compressed.
+func NewFreezer(dir string, compress bool) (*Freezer, error) {
+	f := &Freezer{tables: make(map[string]*freezerTable)}
+	for name, nosnappy := range freezerNoSnappy {
+		table, err := newFreezerTable(dir, name, compress && !nosnappy)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.tables[name] = table
+	}
+	if err := f.repair(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	glog.V(logger.Info).Infof("Opened ancient store %s with %d blocks", dir, f.Ancients())
+	return f, nil
+}
+
+// repair truncates the tables to the length of the shortest, dropping blocks
+// partially appended before a crash.
+func (f *Freezer) repair() error {
+	min := ^uint64(0)
+	for _, table := range f.tables {
+		if items := table.Items(); items < min {
+			min = items
+		}
+	}
+	for _, table := range f.tables {
+		if err := table.truncate(min); err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint64(&f.frozen, min)
+	return nil
+}
+
+// HasAncient reports whether block number is frozen.
+func (f *Freezer) HasAncient(kind string, number uint64) bool {
+	if table := f.tables[kind]; table != nil {
+		return number < atomic.LoadUint64(&f.frozen)
+	}
+	return false
+}
+
+// Ancient retrieves the item of the given table for block number.
+func (f *Freezer) Ancient(kind string, number uint64) ([]byte, error) {
+	table := f.tables[kind]
+	if table == nil {
+		return nil, fmt.Errorf("unknown ancient table %q", kind)
+	}
+	if number >= atomic.LoadUint64(&f.frozen) {
+		return nil, errOutOfBounds
+	}
+	return table.Retrieve(number)
+}
+
+// Ancients returns the number of frozen blocks.
+func (f *Freezer) Ancients() uint64 {
+	return atomic.LoadUint64(&f.frozen)
+}
+
+// AppendAncient freezes block number, which must directly follow the last
+// frozen one. On failure the tables are rolled back to the previous block.
+func (f *Freezer) AppendAncient(number uint64, hash, header, body, receipts, td []byte) (err error) {
+	if frozen := atomic.LoadUint64(&f.frozen); number != frozen {
+		return fmt.Errorf("%v: appending block #%d, have %d", errOutOrderInsert, number, frozen)
+	}
+	defer func() {
+		if err != nil {
+			if rerr := f.repair(); rerr != nil {
+				glog.V(logger.Error).Errorf("Failed to roll back ancient store: %v", rerr)
+			}
+		}
+	}()
+	items := map[string][]byte{
+		FreezerHashTable:       hash,
+		FreezerHeaderTable:     header,
+		FreezerBodiesTable:     body,
+		FreezerReceiptTable:    receipts,
+		FreezerDifficultyTable: td,
+	}
+	for name, blob := range items {
+		if err := f.tables[name].Append(number, blob); err != nil {
+			return fmt.Errorf("ancient table %s: %v", name, err)
+		}
+	}
+	atomic.AddUint64(&f.frozen, 1)
+	return nil
+}
+
+// TruncateAncients discards every frozen block from number items onwards.
+func (f *Freezer) TruncateAncients(items uint64) error {
+	if atomic.LoadUint64(&f.frozen) <= items {
+		return nil
+	}
+	for _, table := range f.tables {
+		if err := table.truncate(items); err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint64(&f.frozen, items)
+	return nil
+}
+
+// Sync flushes the tables to disk.
+func (f *Freezer) Sync() error {
+	for _, table := range f.tables {
+		if err := table.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the tables.
+func (f *Freezer) Close() error {
+	var errs []error
+	for _, table := range f.tables {
+		if err := table.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// FreezerDatabase is a key-value database backed by an ancient store for the
+// old canonical blocks.
+type FreezerDatabase struct {
+	Database
+	*Freezer
+}
+
+// NewDatabaseWithFreezer attaches the ancient store in dir to the database.
+func NewDatabaseWithFreezer(db Database, dir string, compress bool) (*FreezerDatabase, error) {
+	freezer, err := NewFreezer(dir, compress)
+	if err != nil {
+		return nil, err
+	}
+	return &FreezerDatabase{Database: db, Freezer: freezer}, nil
+}
+
+// Close closes both the ancient store and the key-value database.
+func (db *FreezerDatabase) Close() {
+	if err := db.Freezer.Close(); err != nil {
+		glog.V(logger.Error).Errorf("Failed to close ancient store: %v", err)
+	}
+	db.Database.Close()
+}
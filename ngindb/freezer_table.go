@@ -0,0 +1,277 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngindb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/golang/snappy"
+)
+
+var (
+	errOutOfBounds    = errors.New("ancient item out of bounds")
+	errOutOrderInsert = errors.New("ancient items must be appended in order")
+	errClosed         = errors.New("ancient store closed")
+)
+
+// indexEntrySize is the size of an index entry, the big endian offset of the
+// end of the item in the data file.
+const indexEntrySize = 8
+
+// freezerTable is an append-only table of items numbered from zero. Items are
+// stored back to back in a data file, the index file holding the end offset of
+// each item.
+//
+// Data is always written before its index entry, so after a crash the table is
+// repaired on open by dropping index entries pointing past the end of the data
+// and trailing data no index entry points to.
+type freezerTable struct {
+	items    uint64 // number of items stored, accessed atomically
+	compress bool   // whether items are snappy compressed
+
+	name  string
+	data  *os.File
+	index *os.File
+	size  uint64 // size of the data file
+
+	lock sync.RWMutex
+}
+
+// newFreezerTable opens, or creates, the table name in dir. Compressed and raw
+// tables use distinct file names; an existing table is opened in the format it
+// was created with regardless of compress.
+func newFreezerTable(dir, name string, compress bool) (*freezerTable, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, tableFileName(name, !compress, "idx"))); err == nil {
+		compress = !compress
+	}
+	index, err := os.OpenFile(filepath.Join(dir, tableFileName(name, compress, "idx")), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(filepath.Join(dir, tableFileName(name, compress, "dat")), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	t := &freezerTable{
+		compress: compress,
+		name:     name,
+		data:     data,
+		index:    index,
+	}
+	if err := t.repair(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// tableFileName returns the file name of a table's index or data file.
+func tableFileName(name string, compress bool, ext string) string {
+	if compress {
+		return fmt.Sprintf("%s.c%s", name, ext)
+	}
+	return fmt.Sprintf("%s.r%s", name, ext)
+}
+
+// repair brings the index and data files back in sync after an unclean
+// shutdown.
+func (t *freezerTable) repair() error {
+	stat, err := t.index.Stat()
+	if err != nil {
+		return err
+	}
+	items := uint64(stat.Size()) / indexEntrySize
+
+	if stat, err = t.data.Stat(); err != nil {
+		return err
+	}
+	size := uint64(stat.Size())
+
+	// Drop the index entries whose data didn't make it to disk
+	var end uint64
+	for ; items > 0; items-- {
+		if end, err = t.offset(items); err != nil {
+			return err
+		}
+		if end <= size {
+			break
+		}
+	}
+	if items == 0 {
+		end = 0
+	}
+	if err := t.index.Truncate(int64(items * indexEntrySize)); err != nil {
+		return err
+	}
+	if end < size {
+		glog.V(logger.Warn).Infof("Ancient table %s: truncating %d bytes of dangling data", t.name, size-end)
+	}
+	if err := t.data.Truncate(int64(end)); err != nil {
+		return err
+	}
+	t.size = end
+	atomic.StoreUint64(&t.items, items)
+	return nil
+}
+
+// offset returns the end offset of the n-th item, counting from one. The end
+// of the zeroth item is the start of the file.
+func (t *freezerTable) offset(n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	var buf [indexEntrySize]byte
+	if _, err := t.index.ReadAt(buf[:], int64((n-1)*indexEntrySize)); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// Items returns the number of items in the table.
+func (t *freezerTable) Items() uint64 {
+	return atomic.LoadUint64(&t.items)
+}
+
+// Append adds item number item to the end of the table. Items must be appended
+// in order, without gaps.
+func (t *freezerTable) Append(item uint64, blob []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return errClosed
+	}
+	if item != atomic.LoadUint64(&t.items) {
+		return errOutOrderInsert
+	}
+	if t.compress {
+		blob = snappy.Encode(nil, blob)
+	}
+	if _, err := t.data.WriteAt(blob, int64(t.size)); err != nil {
+		return err
+	}
+	var entry [indexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[:], t.size+uint64(len(blob)))
+	if _, err := t.index.WriteAt(entry[:], int64(item*indexEntrySize)); err != nil {
+		return err
+	}
+	t.size += uint64(len(blob))
+	atomic.AddUint64(&t.items, 1)
+	return nil
+}
+
+// Retrieve returns the item number item.
+func (t *freezerTable) Retrieve(item uint64) ([]byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.index == nil {
+		return nil, errClosed
+	}
+	if item >= atomic.LoadUint64(&t.items) {
+		return nil, errOutOfBounds
+	}
+	start, err := t.offset(item)
+	if err != nil {
+		return nil, err
+	}
+	end, err := t.offset(item + 1)
+	if err != nil {
+		return nil, err
+	}
+	blob := make([]byte, end-start)
+	if _, err := t.data.ReadAt(blob, int64(start)); err != nil {
+		return nil, err
+	}
+	if t.compress {
+		return snappy.Decode(nil, blob)
+	}
+	return blob, nil
+}
+
+// truncate discards every item from number items onwards.
+func (t *freezerTable) truncate(items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return errClosed
+	}
+	if items >= atomic.LoadUint64(&t.items) {
+		return nil
+	}
+	end, err := t.offset(items)
+	if err != nil {
+		return err
+	}
+	if err := t.index.Truncate(int64(items * indexEntrySize)); err != nil {
+		return err
+	}
+	if err := t.data.Truncate(int64(end)); err != nil {
+		return err
+	}
+	t.size = end
+	atomic.StoreUint64(&t.items, items)
+	return nil
+}
+
+// Sync flushes the table files to disk, data first.
+func (t *freezerTable) Sync() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return errClosed
+	}
+	if err := t.data.Sync(); err != nil {
+		return err
+	}
+	return t.index.Sync()
+}
+
+// Close closes the table files.
+func (t *freezerTable) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var errs []error
+	for _, f := range []*os.File{t.data, t.index} {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.data, t.index = nil, nil
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
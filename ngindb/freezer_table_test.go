@@ -0,0 +1,297 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package ngindb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// freezerTestItem returns the content of item number n, of varying length and
+// compressible.
+func freezerTestItem(n uint64) []byte {
+	return bytes.Repeat([]byte{byte(n)}, int(n%7)*10+1)
+}
+
+// newFreezerTestTable opens a table in a temporary directory, removed once the
+// test is done, holding items test items.
+func newFreezerTestTable(t *testing.T, compress bool, items uint64) (*freezerTable, string) {
+	dir, err := ioutil.TempDir("", "freezer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	table, err := newFreezerTable(dir, "test", compress)
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	for n := uint64(0); n < items; n++ {
+		if err := table.Append(n, freezerTestItem(n)); err != nil {
+			t.Fatalf("failed to append item %d: %v", n, err)
+		}
+	}
+	return table, dir
+}
+
+// checkFreezerTable checks that the table holds exactly items test items.
+func checkFreezerTable(t *testing.T, table *freezerTable, items uint64) {
+	t.Helper()
+	if have := table.Items(); have != items {
+		t.Fatalf("item count mismatch: have %d, want %d", have, items)
+	}
+	for n := uint64(0); n < items; n++ {
+		blob, err := table.Retrieve(n)
+		if err != nil {
+			t.Fatalf("failed to retrieve item %d: %v", n, err)
+		}
+		if !bytes.Equal(blob, freezerTestItem(n)) {
+			t.Fatalf("item %d mismatch: have %x, want %x", n, blob, freezerTestItem(n))
+		}
+	}
+	if _, err := table.Retrieve(items); err != errOutOfBounds {
+		t.Fatalf("item %d past the end: have error %v, want %v", items, err, errOutOfBounds)
+	}
+}
+
+// Tests that items are appended in order and read back, from compressed and
+// raw tables, also after reopening.
+func TestFreezerTableAppendRetrieve(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			table, dir := newFreezerTestTable(t, compress, 50)
+			checkFreezerTable(t, table, 50)
+
+			for _, n := range []uint64{49, 51, 0} {
+				if err := table.Append(n, []byte{1}); err != errOutOrderInsert {
+					t.Errorf("append of item %d: have error %v, want %v", n, err, errOutOrderInsert)
+				}
+			}
+			if err := table.Close(); err != nil {
+				t.Fatalf("failed to close table: %v", err)
+			}
+			if _, err := table.Retrieve(0); err != errClosed {
+				t.Errorf("retrieval from closed table: have error %v, want %v", err, errClosed)
+			}
+			// Tables are reopened in the format they were created with
+			table, err := newFreezerTable(dir, "test", !compress)
+			if err != nil {
+				t.Fatalf("failed to reopen table: %v", err)
+			}
+			defer table.Close()
+
+			if table.compress != compress {
+				t.Errorf("compression mismatch: have %v, want %v", table.compress, compress)
+			}
+			checkFreezerTable(t, table, 50)
+
+			stat, err := os.Stat(filepath.Join(dir, tableFileName("test", compress, "dat")))
+			if err != nil {
+				t.Fatalf("data file missing: %v", err)
+			}
+			var raw int64
+			for n := uint64(0); n < 50; n++ {
+				raw += int64(len(freezerTestItem(n)))
+			}
+			if compress && stat.Size() >= raw {
+				t.Errorf("compressed data not smaller: have %d bytes, raw %d", stat.Size(), raw)
+			}
+			if !compress && stat.Size() != raw {
+				t.Errorf("raw data size mismatch: have %d bytes, want %d", stat.Size(), raw)
+			}
+		})
+	}
+}
+
+// Tests that tables are repaired on open after a write torn by a crash, keeping
+// the items fully written.
+func TestFreezerTableRepair(t *testing.T) {
+	tests := []struct {
+		name  string
+		tear  func(index, data *os.File, size int64) error
+		items uint64
+	}{
+		{
+			name: "partial index entry",
+			tear: func(index, data *os.File, size int64) error {
+				_, err := index.WriteAt([]byte{0, 0, 0}, 10*indexEntrySize)
+				return err
+			},
+			items: 10,
+		},
+		{
+			name: "index entry without data",
+			tear: func(index, data *os.File, size int64) error {
+				return data.Truncate(size - 1)
+			},
+			items: 9,
+		},
+		{
+			name: "index entries without data",
+			tear: func(index, data *os.File, size int64) error {
+				return data.Truncate(int64(len(freezerTestItem(0))))
+			},
+			items: 1,
+		},
+		{
+			name: "data without index entry",
+			tear: func(index, data *os.File, size int64) error {
+				_, err := data.WriteAt([]byte{1, 2, 3, 4}, size)
+				return err
+			},
+			items: 10,
+		},
+		{
+			name: "empty data",
+			tear: func(index, data *os.File, size int64) error {
+				return data.Truncate(0)
+			},
+			items: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, dir := newFreezerTestTable(t, false, 10)
+			size := int64(table.size)
+			table.Close()
+
+			index, err := os.OpenFile(filepath.Join(dir, tableFileName("test", false, "idx")), os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.OpenFile(filepath.Join(dir, tableFileName("test", false, "dat")), os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.tear(index, data, size)
+			index.Close()
+			data.Close()
+			if err != nil {
+				t.Fatalf("failed to tear table: %v", err)
+			}
+
+			if table, err = newFreezerTable(dir, "test", false); err != nil {
+				t.Fatalf("failed to reopen table: %v", err)
+			}
+			defer table.Close()
+			checkFreezerTable(t, table, tt.items)
+
+			// The repaired table carries on where the kept items end
+			if err := table.Append(tt.items, freezerTestItem(tt.items)); err != nil {
+				t.Fatalf("failed to append after repair: %v", err)
+			}
+			checkFreezerTable(t, table, tt.items+1)
+		})
+	}
+}
+
+// Tests that truncated tables drop the items from the new length onwards,
+// also on disk, and are appended to from there.
+func TestFreezerTableTruncate(t *testing.T) {
+	table, dir := newFreezerTestTable(t, true, 20)
+
+	if err := table.truncate(25); err != nil {
+		t.Fatalf("failed to truncate past the end: %v", err)
+	}
+	checkFreezerTable(t, table, 20)
+
+	if err := table.truncate(8); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	checkFreezerTable(t, table, 8)
+
+	for n := uint64(8); n < 12; n++ {
+		if err := table.Append(n, freezerTestItem(n)); err != nil {
+			t.Fatalf("failed to append item %d: %v", n, err)
+		}
+	}
+	table.Close()
+
+	table, err := newFreezerTable(dir, "test", true)
+	if err != nil {
+		t.Fatalf("failed to reopen table: %v", err)
+	}
+	defer table.Close()
+	checkFreezerTable(t, table, 12)
+
+	if err := table.truncate(0); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	checkFreezerTable(t, table, 0)
+	if table.size != 0 {
+		t.Errorf("data size mismatch: have %d, want 0", table.size)
+	}
+}
+
+// Tests that the ancient store keeps its tables of equal length, dropping the
+// block partially appended before a crash.
+func TestFreezerRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freezer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := NewFreezer(dir, true)
+	if err != nil {
+		t.Fatalf("failed to open ancient store: %v", err)
+	}
+	for n := uint64(0); n < 5; n++ {
+		item := freezerTestItem(n)
+		if err := f.AppendAncient(n, item, item, item, item, item); err != nil {
+			t.Fatalf("failed to freeze block #%d: %v", n, err)
+		}
+	}
+	if err := f.AppendAncient(6, nil, nil, nil, nil, nil); err == nil {
+		t.Errorf("block #6 frozen after block #4")
+	}
+	// Crash halfway through appending block #5
+	if err := f.tables[FreezerHeaderTable].Append(5, freezerTestItem(5)); err != nil {
+		t.Fatalf("failed to append header: %v", err)
+	}
+	f.Close()
+
+	if f, err = NewFreezer(dir, true); err != nil {
+		t.Fatalf("failed to reopen ancient store: %v", err)
+	}
+	defer f.Close()
+
+	if f.Ancients() != 5 {
+		t.Fatalf("frozen block count mismatch: have %d, want 5", f.Ancients())
+	}
+	for name, table := range f.tables {
+		if table.Items() != 5 {
+			t.Errorf("table %s: item count mismatch: have %d, want 5", name, table.Items())
+		}
+	}
+	if f.HasAncient(FreezerBodiesTable, 5) || !f.HasAncient(FreezerBodiesTable, 4) || f.HasAncient("unknown", 0) {
+		t.Errorf("frozen blocks misreported")
+	}
+	if blob, err := f.Ancient(FreezerReceiptTable, 3); err != nil || !bytes.Equal(blob, freezerTestItem(3)) {
+		t.Errorf("block #3 receipts mismatch: have %x (%v), want %x", blob, err, freezerTestItem(3))
+	}
+	if err := f.TruncateAncients(2); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	if _, err := f.Ancient(FreezerHashTable, 2); err != errOutOfBounds {
+		t.Errorf("truncated block retrieved: %v", err)
+	}
+}
@@ -32,10 +32,55 @@ type Database interface {
 	Delete(key []byte) error
 	Close()
 	NewBatch() Batch
+	NewIterator() Iterator
+
+	// NewIteratorWithPrefix iterates over the keys starting with prefix.
+	NewIteratorWithPrefix(prefix []byte) Iterator
+
+	// NewIteratorRange iterates over the keys in [start, limit). A nil start
+	// begins at the first key, a nil limit runs to the last.
+	NewIteratorRange(start []byte, limit []byte) Iterator
+
+	// NewReverseIteratorRange iterates over the keys in [start, limit) in
+	// descending order, the bounds work as for NewIteratorRange.
+	NewReverseIteratorRange(start []byte, limit []byte) Iterator
+
+	// Stat returns an engine specific statistics report, the properties
+	// understood depend on the engine.
+	Stat(property string) (string, error)
+
+	// Compact reclaims the space of deleted and overwritten entries in
+	// [start, limit), nil bounds extending to the whole key space. Engines
+	// unable to do so return ErrCompactUnsupported.
+	Compact(start []byte, limit []byte) error
+}
+
+// Iterator iterates over the key/value pairs of a database in ascending key
+// order, or descending for reverse iterators. The key and value slices are
+// only valid until the next call to Next.
+// An iterator must be released after use.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
 }
 
 type Batch interface {
 	Putter
+	Delete(key []byte) error
 	ValueSize() int // amount of data in the batch
 	Write() error
 }
+
+// AncientStore is implemented by databases moving the old canonical chain to
+// an append-only store, see Freezer.
+type AncientStore interface {
+	HasAncient(kind string, number uint64) bool
+	Ancient(kind string, number uint64) ([]byte, error)
+	Ancients() uint64
+	AppendAncient(number uint64, hash, header, body, receipts, td []byte) error
+	TruncateAncients(items uint64) error
+	Sync() error
+}
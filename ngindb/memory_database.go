@@ -18,6 +18,8 @@ package ngindb
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/NginProject/ngind/common"
@@ -99,11 +101,106 @@ func (db *MemDatabase) Delete(key []byte) error {
 
 func (db *MemDatabase) Close() {}
 
+// NewIterator iterates over a snapshot of the database taken at creation.
+func (db *MemDatabase) NewIterator() Iterator {
+	return db.NewIteratorRange(nil, nil)
+}
+
+func (db *MemDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.NewIteratorRange(prefix, prefixLimit(prefix))
+}
+
+func (db *MemDatabase) NewIteratorRange(start []byte, limit []byte) Iterator {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	keys := make([]string, 0, len(db.db))
+	for key := range db.db {
+		if key < string(start) || (len(limit) > 0 && key >= string(limit)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = common.CopyBytes(db.db[key])
+	}
+	return &memIterator{keys: keys, values: values, index: -1}
+}
+
+func (db *MemDatabase) NewReverseIteratorRange(start []byte, limit []byte) Iterator {
+	it := db.NewIteratorRange(start, limit).(*memIterator)
+	for i, j := 0, len(it.keys)-1; i < j; i, j = i+1, j-1 {
+		it.keys[i], it.keys[j] = it.keys[j], it.keys[i]
+		it.values[i], it.values[j] = it.values[j], it.values[i]
+	}
+	return it
+}
+
+// Stat reports the number of entries and their total size, regardless of the
+// property asked for.
+func (db *MemDatabase) Stat(property string) (string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var size common.StorageSize
+	for key, value := range db.db {
+		size += common.StorageSize(len(key) + len(value))
+	}
+	return fmt.Sprintf("%d entries, %v", len(db.db), size), nil
+}
+
+// Compact is a no-op, deleted entries don't linger in memory.
+func (db *MemDatabase) Compact(start []byte, limit []byte) error {
+	return nil
+}
+
+type memIterator struct {
+	keys   []string
+	values [][]byte
+	index  int
+}
+
+func (it *memIterator) Next() bool {
+	if it.index >= len(it.keys) {
+		return false
+	}
+	it.index++
+	return it.index < len(it.keys)
+}
+
+func (it *memIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return []byte(it.keys[it.index])
+}
+
+func (it *memIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+func (it *memIterator) Error() error {
+	return nil
+}
+
+func (it *memIterator) Release() {
+	it.keys, it.values = nil, nil
+}
+
 func (db *MemDatabase) NewBatch() Batch {
 	return &memBatch{db: db}
 }
 
-type kv struct{ k, v []byte }
+type kv struct {
+	k, v []byte
+	del  bool
+}
 type memBatch struct {
 	db     *MemDatabase
 	writes []kv
@@ -111,16 +208,26 @@ type memBatch struct {
 }
 
 func (b *memBatch) Put(key, value []byte) error {
-	b.writes = append(b.writes, kv{common.CopyBytes(key), common.CopyBytes(value)})
+	b.writes = append(b.writes, kv{k: common.CopyBytes(key), v: common.CopyBytes(value)})
 	b.size += len(value)
 	return nil
 }
 
+func (b *memBatch) Delete(key []byte) error {
+	b.writes = append(b.writes, kv{k: common.CopyBytes(key), del: true})
+	b.size++
+	return nil
+}
+
 func (b *memBatch) Write() error {
 	b.db.lock.Lock()
 	defer b.db.lock.Unlock()
 
 	for _, kv := range b.writes {
+		if kv.del {
+			delete(b.db.db, string(kv.k))
+			continue
+		}
 		b.db.db[string(kv.k)] = kv.v
 	}
 	return nil
@@ -17,11 +17,15 @@
 package node
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/p2p"
 	"github.com/NginProject/ngind/p2p/discover"
 	"github.com/NginProject/ngind/rpc"
@@ -53,9 +57,146 @@ func (api *PrivateAdminAPI) AddPeer(url string) (bool, error) {
 		return false, fmt.Errorf("invalid enode: %v", err)
 	}
 	server.AddPeer(node)
+	if err := updatePersistentNodes(api.node.fs, api.node.datadir, datadirStaticNodes, node, true); err != nil {
+		return true, fmt.Errorf("peer added, but failed to update %s: %v", datadirStaticNodes, err)
+	}
+	return true, nil
+}
+
+// RemovePeer disconnects from a remote node if the connection exists and stops
+// maintaining it as a static peer.
+func (api *PrivateAdminAPI) RemovePeer(url string) (bool, error) {
+	server := api.node.Server()
+	if server == nil {
+		return false, ErrNodeStopped
+	}
+	node, err := discover.ParseNode(url)
+	if err != nil {
+		return false, fmt.Errorf("invalid enode: %v", err)
+	}
+	server.RemovePeer(node)
+	if err := updatePersistentNodes(api.node.fs, api.node.datadir, datadirStaticNodes, node, false); err != nil {
+		return true, fmt.Errorf("peer removed, but failed to update %s: %v", datadirStaticNodes, err)
+	}
 	return true, nil
 }
 
+// AddTrustedPeer allows a remote node to always connect, even if slots are full.
+func (api *PrivateAdminAPI) AddTrustedPeer(url string) (bool, error) {
+	server := api.node.Server()
+	if server == nil {
+		return false, ErrNodeStopped
+	}
+	node, err := discover.ParseNode(url)
+	if err != nil {
+		return false, fmt.Errorf("invalid enode: %v", err)
+	}
+	server.AddTrustedPeer(node)
+	if err := updatePersistentNodes(api.node.fs, api.node.datadir, datadirTrustedNodes, node, true); err != nil {
+		return true, fmt.Errorf("trusted peer added, but failed to update %s: %v", datadirTrustedNodes, err)
+	}
+	return true, nil
+}
+
+// RemoveTrustedPeer removes a remote node from the trusted peer set. It does
+// not disconnect the node if it is connected.
+func (api *PrivateAdminAPI) RemoveTrustedPeer(url string) (bool, error) {
+	server := api.node.Server()
+	if server == nil {
+		return false, ErrNodeStopped
+	}
+	node, err := discover.ParseNode(url)
+	if err != nil {
+		return false, fmt.Errorf("invalid enode: %v", err)
+	}
+	server.RemoveTrustedPeer(node)
+	if err := updatePersistentNodes(api.node.fs, api.node.datadir, datadirTrustedNodes, node, false); err != nil {
+		return true, fmt.Errorf("trusted peer removed, but failed to update %s: %v", datadirTrustedNodes, err)
+	}
+	return true, nil
+}
+
+// PeerEvents creates an RPC subscription which receives peer events from the
+// node's p2p.Server, i.e. peers being added and dropped as well as, if message
+// events are enabled, messages sent and received.
+func (api *PrivateAdminAPI) PeerEvents(ctx context.Context) (rpc.Subscription, error) {
+	server := api.node.Server()
+	if server == nil {
+		return nil, ErrNodeStopped
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	quit := make(chan struct{})
+	subscription, err := notifier.NewSubscription(func(id string) {
+		close(quit)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// forward the server's peer events to the client until it unsubscribes
+	events := make(chan *p2p.PeerEvent)
+	sub := server.SubscribeEvents(events)
+	go func() {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case event := <-events:
+				if err := subscription.Notify(event); err != nil {
+					glog.V(logger.Debug).Infof("peer event subscription %s: %v", subscription.ID(), err)
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return subscription, nil
+}
+
+// AddBan bans a node ID (given as enode URL or hex ID), an IP address or a CIDR
+// network from connecting, disconnecting matching peers. The optional duration
+// is given in Go duration syntax (e.g. "72h"); bans without it are permanent.
+func (api *PrivateAdminAPI) AddBan(target string, duration *string, reason *string) (*p2p.BanEntry, error) {
+	server := api.node.Server()
+	if server == nil {
+		return nil, ErrNodeStopped
+	}
+	var d time.Duration
+	if duration != nil && *duration != "" {
+		var err error
+		if d, err = time.ParseDuration(*duration); err != nil {
+			return nil, fmt.Errorf("invalid duration: %v", err)
+		}
+	}
+	var r string
+	if reason != nil {
+		r = *reason
+	}
+	return server.Ban(target, r, d)
+}
+
+// RemoveBan lifts a ban added with AddBan. The target must match the banned
+// node ID or network exactly.
+func (api *PrivateAdminAPI) RemoveBan(target string) (bool, error) {
+	server := api.node.Server()
+	if server == nil {
+		return false, ErrNodeStopped
+	}
+	return server.Unban(target)
+}
+
+// Bans lists the active entries of the peer ban list.
+func (api *PrivateAdminAPI) Bans() ([]*p2p.BanEntry, error) {
+	server := api.node.Server()
+	if server == nil {
+		return nil, ErrNodeStopped
+	}
+	return server.Bans(), nil
+}
+
 // StartRPC starts the HTTP RPC API server.
 func (api *PrivateAdminAPI) StartRPC(host *string, port *rpc.HexNumber, cors *string, apis *string) (bool, error) {
 	api.node.lock.Lock()
@@ -25,12 +25,14 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/NginProject/ngind/common"
 	"github.com/NginProject/ngind/crypto"
 	"github.com/NginProject/ngind/logger"
 	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/p2p/distip"
 	"github.com/NginProject/ngind/p2p/nat"
 	"github.com/spf13/afero"
 )
@@ -40,6 +42,7 @@ var (
 	datadirStaticNodes  = "static-nodes.json"  // Path within the datadir to the static node list
 	datadirTrustedNodes = "trusted-nodes.json" // Path within the datadir to the trusted node list
 	datadirNodeDatabase = "nodes"              // Path within the datadir to store the node infos
+	datadirBanList      = "banned-nodes.json"  // Path within the datadir to the peer ban list
 )
 
 // fs wraps afero.FS, used as a type of it's own so that we can take it's address
@@ -59,6 +62,10 @@ type Config struct {
 	// in memory.
 	DataDir string
 
+	// DatabaseEngine is the engine new service databases are created with, see
+	// ngindb.Engines. Existing databases are opened with their own engine.
+	DatabaseEngine string
+
 	// IPCPath is the requested location to place the IPC endpoint. If the path is
 	// a simple file name, it is placed inside the chaindata directory (or on the root
 	// pipe path on Windows), whereas if it's a resolvable path name (absolute or
@@ -102,6 +109,10 @@ type Config struct {
 	// If NoDial is true, the node will not dial any peers.
 	NoDial bool
 
+	// If NetRestrict is set to a non-nil value, only hosts within the listed IP
+	// networks are discovered, dialed and accepted as peers.
+	NetRestrict *distip.Netlist
+
 	// MaxPeers is the maximum number of peers that can be connected. If this is
 	// set to zero, then only the configured static and trusted peers can connect.
 	MaxPeers int
@@ -320,3 +331,47 @@ func (c *Config) parsePersistentNodes(file string) []*discover.Node {
 	}
 	return nodes
 }
+
+// persistentNodesLock serializes updates of the persistent node lists.
+var persistentNodesLock sync.Mutex
+
+// updatePersistentNodes adds the node to, or removes it from, a persistent node
+// list within the data directory on afs. Entries are matched by node ID, so
+// adding a node with a new address replaces the old entry. A no-op if datadir
+// is empty.
+func updatePersistentNodes(afs afero.Fs, datadir, file string, node *discover.Node, add bool) error {
+	if datadir == "" {
+		return nil
+	}
+	persistentNodesLock.Lock()
+	defer persistentNodesLock.Unlock()
+
+	path := filepath.Join(datadir, file)
+	nodelist := []string{}
+	blob, err := afero.ReadFile(afs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(blob) > 0 {
+		if err := json.Unmarshal(blob, &nodelist); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	// Keep every entry not referring to the node, including unparseable ones
+	// which the user may want to fix by hand.
+	updated := make([]string, 0, len(nodelist)+1)
+	for _, url := range nodelist {
+		if n, err := discover.ParseNode(url); err == nil && n.ID == node.ID {
+			continue
+		}
+		updated = append(updated, url)
+	}
+	if add {
+		updated = append(updated, node.String())
+	}
+	blob, err = json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(afs, path, blob, 0644)
+}
@@ -47,6 +47,8 @@ var (
 // be registered.
 type Node struct {
 	datadir  string         // Path to the currently used data directory
+	dbengine string         // Database engine for newly created service databases
+	fs       *fs            // File system holding the data directory
 	eventmux *event.TypeMux // Event multiplexer used between the services of a stack
 
 	serverConfig p2p.Config
@@ -95,12 +97,15 @@ func New(conf *Config) (*Node, error) {
 		}
 	}
 	// Assemble the networking layer and the node itself
-	nodeDbPath := ""
+	nodeDbPath, banListPath := "", ""
 	if conf.DataDir != "" {
 		nodeDbPath = filepath.Join(conf.DataDir, datadirNodeDatabase)
+		banListPath = filepath.Join(conf.DataDir, datadirBanList)
 	}
 	return &Node{
-		datadir: conf.DataDir,
+		datadir:  conf.DataDir,
+		dbengine: conf.DatabaseEngine,
+		fs:       conf.fs,
 		serverConfig: p2p.Config{
 			PrivateKey:      conf.NodeKey(),
 			Name:            conf.Name,
@@ -109,6 +114,8 @@ func New(conf *Config) (*Node, error) {
 			StaticNodes:     conf.StaticNodes(),
 			TrustedNodes:    conf.TrusterNodes(),
 			NodeDatabase:    nodeDbPath,
+			NetRestrict:     conf.NetRestrict,
+			BanListFile:     banListPath,
 			ListenAddr:      conf.ListenAddr,
 			NAT:             conf.NAT,
 			Dialer:          conf.Dialer,
@@ -161,6 +168,7 @@ func (n *Node) Start() error {
 		// Create a new context for the particular service
 		ctx := &ServiceContext{
 			datadir:  n.datadir,
+			engine:   n.dbengine,
 			services: make(map[reflect.Type]Service),
 			EventMux: n.eventmux,
 		}
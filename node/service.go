@@ -31,6 +31,7 @@ import (
 // as well as utility methods to operate on the service environment.
 type ServiceContext struct {
 	datadir  string                   // Data directory for protocol persistence
+	engine   string                   // Database engine for newly created databases
 	services map[reflect.Type]Service // Index of the already constructed services
 	EventMux *event.TypeMux           // Event multiplexer used for decoupled notifications
 }
@@ -42,7 +43,33 @@ func (ctx *ServiceContext) OpenDatabase(name string, cache int, handles int) (ng
 	if ctx.datadir == "" {
 		return ngindb.NewMemDatabase()
 	}
-	return ngindb.NewLDBDatabase(filepath.Join(ctx.datadir, name), cache, handles)
+	return ngindb.Open(ctx.engine, filepath.Join(ctx.datadir, name), cache, handles)
+}
+
+// OpenDatabaseWithFreezer works like OpenDatabase, attaching an ancient store
+// for the old chain segments. A relative ancient path is resolved within the
+// database directory, an empty one defaults to "ancient" in there.
+func (ctx *ServiceContext) OpenDatabaseWithFreezer(name string, cache int, handles int, ancient string, compress bool) (ngindb.Database, error) {
+	if ctx.datadir == "" {
+		return ngindb.NewMemDatabase()
+	}
+	dir := filepath.Join(ctx.datadir, name)
+	db, err := ngindb.Open(ctx.engine, dir, cache, handles)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ancient == "":
+		ancient = filepath.Join(dir, "ancient")
+	case !filepath.IsAbs(ancient):
+		ancient = filepath.Join(dir, ancient)
+	}
+	frdb, err := ngindb.NewDatabaseWithFreezer(db, ancient, compress)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return frdb, nil
 }
 
 // Service retrieves a currently running service registered of a specific type.
@@ -0,0 +1,236 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/p2p/discover"
+)
+
+var (
+	errBanned         = errors.New("banned")
+	errNotWhitelisted = errors.New("not contained in netrestrict whitelist")
+)
+
+// BanEntry is a single entry of the peer ban list. A ban either targets a
+// node ID or an IP network.
+type BanEntry struct {
+	Target  string    `json:"target"`           // hex node ID or IP network in CIDR notation
+	Reason  string    `json:"reason,omitempty"` // free form note given when the ban was added
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires"` // zero for permanent bans
+
+	id    discover.NodeID
+	ipnet *net.IPNet
+}
+
+func (e *BanEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// parseBanTarget canonicalizes a ban target. It accepts enode URLs, hex node
+// IDs, CIDR masks and plain IP addresses (which are treated as single host
+// networks).
+func parseBanTarget(target string) (discover.NodeID, *net.IPNet, error) {
+	target = strings.TrimSpace(target)
+	if strings.HasPrefix(target, "enode://") {
+		n, err := discover.ParseNode(target)
+		if err != nil {
+			return discover.NodeID{}, nil, err
+		}
+		return n.ID, nil, nil
+	}
+	if id, err := discover.HexID(target); err == nil {
+		return id, nil, nil
+	}
+	if _, ipnet, err := net.ParseCIDR(target); err == nil {
+		return discover.NodeID{}, ipnet, nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return discover.NodeID{}, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return discover.NodeID{}, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	return discover.NodeID{}, nil, fmt.Errorf("invalid ban target %q: want enode URL, node ID, IP or CIDR", target)
+}
+
+// banList is the set of banned node IDs and IP networks. If a path is set,
+// the list is persisted as JSON on every modification.
+type banList struct {
+	path    string
+	mu      sync.RWMutex
+	entries map[string]*BanEntry // keyed by canonical target
+}
+
+// newBanList creates a ban list, loading existing entries from path if it
+// is non-empty and the file exists. An unreadable list is ignored, and
+// replaced on the next modification.
+func newBanList(path string) (*banList, error) {
+	b := &banList{path: path, entries: make(map[string]*BanEntry)}
+	if path == "" {
+		return b, nil
+	}
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []*BanEntry
+	if err := json.Unmarshal(blob, &entries); err != nil {
+		glog.V(logger.Warn).Warnf("Ignoring invalid ban list %s: %v", path, err)
+		glog.D(logger.Warn).Warnf("Ignoring invalid ban list %s: %v", path, err)
+		return b, nil
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.expired(now) {
+			continue
+		}
+		if e.id, e.ipnet, err = parseBanTarget(e.Target); err != nil {
+			glog.V(logger.Warn).Warnf("Ignoring ban list entry: %v", err)
+			continue
+		}
+		b.entries[e.Target] = e
+	}
+	return b, nil
+}
+
+// add bans the target for the given duration, or permanently if the duration
+// is zero. Banning an already banned target replaces the existing entry.
+func (b *banList) add(target, reason string, duration time.Duration) (*BanEntry, error) {
+	id, ipnet, err := parseBanTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	e := &BanEntry{Reason: reason, Added: time.Now(), id: id, ipnet: ipnet}
+	if ipnet != nil {
+		e.Target = ipnet.String()
+	} else {
+		e.Target = id.String()
+	}
+	if duration > 0 {
+		e.Expires = e.Added.Add(duration)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[e.Target] = e
+	return e, b.save()
+}
+
+// remove lifts the ban on the target, reporting whether it was banned.
+func (b *banList) remove(target string) (bool, error) {
+	id, ipnet, err := parseBanTarget(target)
+	if err != nil {
+		return false, err
+	}
+	key := id.String()
+	if ipnet != nil {
+		key = ipnet.String()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.entries[key]; !ok {
+		return false, nil
+	}
+	delete(b.entries, key)
+	return true, b.save()
+}
+
+// list returns the active ban entries, sorted by target.
+func (b *banList) list() []*BanEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	list := make([]*BanEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		if !e.expired(now) {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	return list
+}
+
+// bannedID returns the active ban entry for the given node ID, if any.
+func (b *banList) bannedID(id discover.NodeID) *BanEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if e := b.entries[id.String()]; e != nil && !e.expired(time.Now()) {
+		return e
+	}
+	return nil
+}
+
+// bannedIP returns an active ban entry covering the given IP, if any.
+func (b *banList) bannedIP(ip net.IP) *BanEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	for _, e := range b.entries {
+		if e.ipnet != nil && e.ipnet.Contains(ip) && !e.expired(now) {
+			return e
+		}
+	}
+	return nil
+}
+
+// save writes the list to disk, replacing the former file only once written
+// in full. Expired entries are dropped on the way. The caller must hold the
+// write lock.
+func (b *banList) save() error {
+	now := time.Now()
+	list := make([]*BanEntry, 0, len(b.entries))
+	for k, e := range b.entries {
+		if e.expired(now) {
+			delete(b.entries, k)
+			continue
+		}
+		list = append(list, e)
+	}
+	if b.path == "" {
+		return nil
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	blob, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/p2p/distip"
+)
+
+var (
+	testBanID    = discover.MustHexID("0x1dd9d65c4552b5eb43d5ad55a2ee3f56c6cbc1c64a5c8d659f51fcd51bace24351232b8d7821617d2b29b54b81cdefb9b3e9c37d7fd5f63270bcc9e1a6f6a439")
+	testOtherID  = discover.MustHexID("0x2dd9d65c4552b5eb43d5ad55a2ee3f56c6cbc1c64a5c8d659f51fcd51bace24351232b8d7821617d2b29b54b81cdefb9b3e9c37d7fd5f63270bcc9e1a6f6a439")
+	testBanIP    = net.ParseIP("10.1.2.3")
+	testBanCIDR  = "192.168.0.0/16"
+	testOutsider = net.ParseIP("8.8.8.8")
+)
+
+// Tests that bans match their node ID or the IPs of their network, until
+// they expire or are removed.
+func TestBanListMatch(t *testing.T) {
+	b, err := newBanList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"enode://" + testBanID.String() + "@127.0.0.1:30303", testBanIP.String(), testBanCIDR} {
+		if _, err := b.add(target, "test", 0); err != nil {
+			t.Fatalf("failed to ban %s: %v", target, err)
+		}
+	}
+	if _, err := b.add("invalid", "", 0); err == nil {
+		t.Errorf("invalid target banned")
+	}
+	if b.bannedID(testBanID) == nil || b.bannedID(testOtherID) != nil {
+		t.Errorf("node ID ban mismatch")
+	}
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{"10.1.2.3", true},
+		{"10.1.2.4", false},
+		{"192.168.0.1", true},
+		{"192.168.255.255", true},
+		{"192.169.0.1", false},
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if banned := b.bannedIP(net.ParseIP(tt.ip)) != nil; banned != tt.banned {
+			t.Errorf("%s: ban mismatch: have %v, want %v", tt.ip, banned, tt.banned)
+		}
+	}
+	if n := len(b.list()); n != 3 {
+		t.Errorf("list length mismatch: have %d, want 3", n)
+	}
+	// Expired bans no longer apply and are dropped on the next save
+	e, err := b.add(testOtherID.String(), "", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to ban: %v", err)
+	}
+	if b.bannedID(testOtherID) == nil {
+		t.Errorf("temporary ban not applied")
+	}
+	e.Expires = time.Now().Add(-time.Second)
+	if b.bannedID(testOtherID) != nil {
+		t.Errorf("expired ban applied")
+	}
+	if n := len(b.list()); n != 3 {
+		t.Errorf("list length with expired ban mismatch: have %d, want 3", n)
+	}
+	if ok, err := b.remove(testBanCIDR); !ok || err != nil {
+		t.Fatalf("failed to lift ban: %v, %v", ok, err)
+	}
+	if b.bannedIP(net.ParseIP("192.168.0.1")) != nil {
+		t.Errorf("lifted ban applied")
+	}
+	if len(b.entries) != 2 {
+		t.Errorf("entries mismatch after save: have %d, want 2", len(b.entries))
+	}
+	if ok, _ := b.remove(testBanCIDR); ok {
+		t.Errorf("ban lifted twice")
+	}
+}
+
+// Tests that the list is persisted across restarts, and that a list left
+// unreadable is ignored rather than failing the start.
+func TestBanListPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bans.json")
+
+	b, err := newBanList(path)
+	if err != nil {
+		t.Fatalf("failed to create list: %v", err)
+	}
+	if _, err := b.add(testBanID.String(), "", 0); err != nil {
+		t.Fatalf("failed to ban: %v", err)
+	}
+	if _, err := b.add(testBanCIDR, "", time.Hour); err != nil {
+		t.Fatalf("failed to ban: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left: %v", err)
+	}
+	b, err = newBanList(path)
+	if err != nil {
+		t.Fatalf("failed to reload list: %v", err)
+	}
+	if b.bannedID(testBanID) == nil || b.bannedIP(net.ParseIP("192.168.1.1")) == nil {
+		t.Errorf("bans lost on reload: %v", b.list())
+	}
+	// A torn write leaves the list unreadable
+	blob, _ := ioutil.ReadFile(path)
+	if err := ioutil.WriteFile(path, blob[:len(blob)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = newBanList(path); err != nil {
+		t.Fatalf("unreadable list failed the start: %v", err)
+	}
+	if n := len(b.list()); n != 0 {
+		t.Errorf("bans loaded from unreadable list: %d", n)
+	}
+	if _, err := b.add(testBanIP.String(), "", 0); err != nil {
+		t.Fatalf("failed to ban: %v", err)
+	}
+	if b, err = newBanList(path); err != nil || b.bannedIP(testBanIP) == nil {
+		t.Errorf("replaced list not loaded: %v", err)
+	}
+}
+
+// Tests that nodes outside of the netrestrict whitelist or banned are not
+// dialed, incomplete nodes being checked by ID only.
+func TestCheckDial(t *testing.T) {
+	netrestrict, err := distip.ParseNetlist("10.0.0.0/8, 192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newBanList("")
+	b.add(testBanID.String(), "", 0)
+	b.add(testBanIP.String(), "", 0)
+
+	tests := []struct {
+		restrict *distip.Netlist
+		node     *discover.Node
+		err      error
+	}{
+		{nil, discover.NewNode(testOtherID, testOutsider, 30303, 30303), nil},
+		{netrestrict, discover.NewNode(testOtherID, testOutsider, 30303, 30303), errNotWhitelisted},
+		{netrestrict, discover.NewNode(testOtherID, net.ParseIP("192.168.1.1"), 30303, 30303), nil},
+		{netrestrict, discover.NewNode(testOtherID, testBanIP, 30303, 30303), errBanned},
+		{nil, discover.NewNode(testBanID, testOutsider, 30303, 30303), errBanned},
+		{netrestrict, &discover.Node{ID: testOtherID}, nil},
+		{netrestrict, &discover.Node{ID: testBanID}, errBanned},
+	}
+	for i, tt := range tests {
+		s := newDialState(nil, nil, 0, tt.restrict, b)
+		if err := s.checkDial(tt.node); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	srv := &Server{Config: Config{NetRestrict: netrestrict}, banlist: b}
+	for _, tt := range []struct {
+		ip  net.IP
+		err error
+	}{
+		{testOutsider, errNotWhitelisted},
+		{net.ParseIP("10.9.9.9"), nil},
+		{testBanIP, errBanned},
+	} {
+		if err := srv.checkIP(tt.ip); err != tt.err {
+			t.Errorf("%v: error mismatch: have %v, want %v", tt.ip, err, tt.err)
+		}
+	}
+}
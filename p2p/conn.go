@@ -0,0 +1,120 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/rlp"
+)
+
+// Conn is a single RLPx connection established outside of a Server.
+// It is meant for tools (like the bootnode crawler) which need to talk to a
+// remote node directly without running the whole peer management machinery.
+//
+// A Conn speaks exactly one sub-protocol, which is expected to be the first
+// capability advertised by the dialer. Message codes passed to and returned
+// from ReadProtocolMsg and WriteProtocolMsg are relative to that protocol.
+type Conn struct {
+	t *rlpx
+
+	ID   discover.NodeID // remote node identity, verified during the handshakes
+	Name string          // remote client name, as given in the protocol handshake
+	Caps []Cap           // remote capabilities, as given in the protocol handshake
+}
+
+// Dial connects to the given node and runs both the encryption and the
+// protocol handshake, advertising name and caps as the local identity.
+// The timeout covers the TCP dial and both handshakes.
+func Dial(prv *ecdsa.PrivateKey, dest *discover.Node, name string, caps []Cap, timeout time.Duration) (*Conn, error) {
+	fd, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%d", dest.IP, dest.TCP), timeout)
+	if err != nil {
+		return nil, err
+	}
+	fd.SetDeadline(time.Now().Add(timeout))
+	t := &rlpx{fd: fd}
+
+	id, err := t.doEncHandshake(prv, dest)
+	if err != nil {
+		t.close(err)
+		return nil, err
+	}
+	if id != dest.ID {
+		t.close(DiscUnexpectedIdentity)
+		return nil, DiscUnexpectedIdentity
+	}
+	our := &protoHandshake{Version: baseProtocolVersion, Name: name, Caps: caps, ID: discover.PubkeyID(&prv.PublicKey)}
+	their, err := t.doProtoHandshake(our)
+	if err != nil {
+		t.close(err)
+		return nil, err
+	}
+	if their.ID != id {
+		t.close(DiscUnexpectedIdentity)
+		return nil, DiscUnexpectedIdentity
+	}
+	return &Conn{t: t, ID: id, Name: their.Name, Caps: their.Caps}, nil
+}
+
+// ReadProtocolMsg reads the next sub-protocol message, answering pings and
+// skipping other base protocol messages on the way. A disconnect request
+// from the remote side is returned as a DiscReason error.
+func (c *Conn) ReadProtocolMsg() (Msg, error) {
+	for {
+		msg, err := c.t.ReadMsg()
+		if err != nil {
+			return msg, err
+		}
+		switch {
+		case msg.Code == pingMsg:
+			msg.Discard()
+			if err := SendItems(c.t, pongMsg); err != nil {
+				return msg, err
+			}
+		case msg.Code == discMsg:
+			var reason [1]DiscReason
+			rlp.Decode(msg.Payload, &reason)
+			return msg, reason[0]
+		case msg.Code < baseProtocolLength:
+			msg.Discard()
+		default:
+			msg.Code -= baseProtocolLength
+			return msg, nil
+		}
+	}
+}
+
+// WriteProtocolMsg sends a sub-protocol message with the given code.
+func (c *Conn) WriteProtocolMsg(code uint64, data interface{}) error {
+	_, err := Send(c.t, code+baseProtocolLength, data)
+	return err
+}
+
+// SetDeadline sets the read and write deadline of the underlying connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.t.fd.SetDeadline(t)
+}
+
+// Close sends a disconnect message with the given reason (if possible)
+// and closes the connection.
+func (c *Conn) Close(reason DiscReason) {
+	c.t.close(reason)
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/NginProject/ngind/logger"
 	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/p2p/distip"
 )
 
 const (
@@ -48,6 +49,8 @@ const (
 type dialstate struct {
 	maxDynDials int
 	ntab        discoverTable
+	netrestrict *distip.Netlist
+	banlist     *banList
 
 	lookupRunning bool
 	dialing       map[discover.NodeID]connFlag
@@ -100,10 +103,12 @@ type waitExpireTask struct {
 	time.Duration
 }
 
-func newDialState(static []*discover.Node, ntab discoverTable, maxdyn int) *dialstate {
+func newDialState(static []*discover.Node, ntab discoverTable, maxdyn int, netrestrict *distip.Netlist, banlist *banList) *dialstate {
 	s := &dialstate{
 		maxDynDials: maxdyn,
 		ntab:        ntab,
+		netrestrict: netrestrict,
+		banlist:     banlist,
 		static:      make(map[discover.NodeID]*dialTask),
 		dialing:     make(map[discover.NodeID]connFlag),
 		randomNodes: make([]*discover.Node, maxdyn/2),
@@ -136,7 +141,7 @@ func (s *dialstate) newTasks(nRunning int, peers map[discover.NodeID]*Peer, now
 		return found || peers[id] != nil || s.hist.contains(id)
 	}
 	addDial := func(flag connFlag, n *discover.Node) bool {
-		if isDialing(n.ID) {
+		if isDialing(n.ID) || s.checkDial(n) != nil {
 			return false
 		}
 		s.dialing[n.ID] = flag
@@ -162,6 +167,10 @@ func (s *dialstate) newTasks(nRunning int, peers map[discover.NodeID]*Peer, now
 
 	// Create dials for static nodes if they are not connected.
 	for id, t := range s.static {
+		if err := s.checkDial(t.dest); err != nil {
+			glog.V(logger.Detail).Infof("not dialing static node %v: %v", t.dest, err)
+			continue
+		}
 		if !isDialing(id) {
 			s.dialing[id] = t.flags
 			newtasks = append(newtasks, t)
@@ -205,6 +214,25 @@ func (s *dialstate) newTasks(nRunning int, peers map[discover.NodeID]*Peer, now
 	return newtasks
 }
 
+// checkDial reports whether the node may be dialed according to the
+// netrestrict whitelist and the ban list.
+func (s *dialstate) checkDial(n *discover.Node) error {
+	if s.banlist != nil && s.banlist.bannedID(n.ID) != nil {
+		return errBanned
+	}
+	// Incomplete nodes are checked again once resolved, in setupConn.
+	if n.Incomplete() {
+		return nil
+	}
+	if s.netrestrict != nil && !s.netrestrict.Contains(n.IP) {
+		return errNotWhitelisted
+	}
+	if s.banlist != nil && s.banlist.bannedIP(n.IP) != nil {
+		return errBanned
+	}
+	return nil
+}
+
 func (s *dialstate) taskDone(t task, now time.Time) {
 	switch t := t.(type) {
 	case *dialTask:
@@ -0,0 +1,56 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"net"
+	"testing"
+
+	"github.com/NginProject/ngind/p2p/distip"
+)
+
+// Tests that nodes learned from neighbors packets are dropped unless within
+// the netrestrict whitelist.
+func TestNodeFromRPCNetrestrict(t *testing.T) {
+	netrestrict, err := distip.ParseNetlist("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := MustHexID("0x1dd9d65c4552b5eb43d5ad55a2ee3f56c6cbc1c64a5c8d659f51fcd51bace24351232b8d7821617d2b29b54b81cdefb9b3e9c37d7fd5f63270bcc9e1a6f6a439")
+	sender := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 30303}
+
+	tests := []struct {
+		restrict *distip.Netlist
+		ip       string
+		ok       bool
+	}{
+		{nil, "10.0.0.2", true},
+		{nil, "10.200.0.2", true},
+		{netrestrict, "10.200.0.2", true},
+		{netrestrict, "192.168.0.2", false},
+	}
+	for i, tt := range tests {
+		u := &udp{netrestrict: tt.restrict}
+		n, err := u.nodeFromRPC(sender, rpcNode{ID: id, IP: net.ParseIP(tt.ip), UDP: 30303, TCP: 30303})
+		if (err == nil) != tt.ok {
+			t.Errorf("test %d: error mismatch: have %v, want ok %v", i, err, tt.ok)
+		}
+		if err == nil && (n.ID != id || !n.IP.Equal(net.ParseIP(tt.ip))) {
+			t.Errorf("test %d: node mismatch: %v", i, n)
+		}
+	}
+}
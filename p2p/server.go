@@ -23,12 +23,14 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NginProject/ngind/event"
 	"github.com/NginProject/ngind/logger"
 	"github.com/NginProject/ngind/logger/glog"
 	"github.com/NginProject/ngind/p2p/discover"
+	"github.com/NginProject/ngind/p2p/distip"
 	"github.com/NginProject/ngind/p2p/nat"
 )
 
@@ -94,6 +96,15 @@ type Config struct {
 	// live nodes in the network.
 	NodeDatabase string
 
+	// If NetRestrict is set to a non-nil value, only hosts which match one of the
+	// IP networks contained in the list are considered for discovery, dialing and
+	// inbound connections.
+	NetRestrict *distip.Netlist
+
+	// BanListFile is the path of the JSON file persisting the peer ban list.
+	// If empty, bans are kept in memory only and lost on shutdown.
+	BanListFile string
+
 	// Protocols should contain the protocols supported
 	// by the server. Matching protocols are launched for
 	// each peer.
@@ -137,6 +148,7 @@ type Server struct {
 	listener     net.Listener
 	ourHandshake *protoHandshake
 	lastLookup   time.Time
+	banlist      *banList
 
 	// These are for Peers, PeerCount (and nothing else).
 	peerOp     chan peerOpFunc
@@ -145,6 +157,8 @@ type Server struct {
 	quit          chan struct{}
 	addstatic     chan *discover.Node
 	removestatic  chan *discover.Node
+	addtrusted    chan *discover.Node
+	removetrusted chan *discover.Node
 	posthandshake chan *conn
 	addpeer       chan *conn
 	delpeer       chan peerDrop
@@ -161,7 +175,7 @@ type peerDrop struct {
 	//requested bool // true if signaled by the peer
 }
 
-type connFlag int
+type connFlag int32
 
 const (
 	dynDialedConn connFlag = 1 << iota
@@ -175,7 +189,7 @@ const (
 type conn struct {
 	fd net.Conn
 	transport
-	flags connFlag
+	flags connFlag        // accessed atomically, trustedConn changes while connected
 	cont  chan error      // The run loop uses cont to signal errors to setupConn.
 	id    discover.NodeID // valid after the encryption handshake
 	caps  []Cap           // valid after the protocol handshake
@@ -197,7 +211,7 @@ type transport interface {
 }
 
 func (c *conn) String() string {
-	s := c.flags.String()
+	s := connFlag(atomic.LoadInt32((*int32)(&c.flags))).String()
 	if (c.id != discover.NodeID{}) {
 		s += " " + c.id.String()[:9]
 	}
@@ -226,7 +240,24 @@ func (f connFlag) String() string {
 }
 
 func (c *conn) is(f connFlag) bool {
-	return c.flags&f != 0
+	flags := connFlag(atomic.LoadInt32((*int32)(&c.flags)))
+	return flags&f != 0
+}
+
+// set sets or clears the flag f.
+func (c *conn) set(f connFlag, val bool) {
+	for {
+		oldFlags := connFlag(atomic.LoadInt32((*int32)(&c.flags)))
+		flags := oldFlags
+		if val {
+			flags |= f
+		} else {
+			flags &= ^f
+		}
+		if atomic.CompareAndSwapInt32((*int32)(&c.flags), int32(oldFlags), int32(flags)) {
+			return
+		}
+	}
 }
 
 // Peers returns all connected peers.
@@ -276,6 +307,89 @@ func (srv *Server) RemovePeer(node *discover.Node) {
 	}
 }
 
+// AddTrustedPeer adds the given node to the set of trusted nodes, which are
+// always allowed to connect, even above the peer limit. A peer already
+// connected is marked trusted right away.
+func (srv *Server) AddTrustedPeer(node *discover.Node) {
+	select {
+	case srv.addtrusted <- node:
+	case <-srv.quit:
+	}
+}
+
+// RemoveTrustedPeer removes the given node from the set of trusted nodes. A
+// peer already connected stays connected, it's no longer marked trusted.
+func (srv *Server) RemoveTrustedPeer(node *discover.Node) {
+	select {
+	case srv.removetrusted <- node:
+	case <-srv.quit:
+	}
+}
+
+// Ban adds target to the ban list and disconnects any connected peer matching
+// it. The target may be an enode URL, a hex node ID, an IP address or a network
+// in CIDR notation. A zero duration bans the target permanently.
+func (srv *Server) Ban(target, reason string, duration time.Duration) (*BanEntry, error) {
+	srv.lock.Lock()
+	banlist := srv.banlist
+	srv.lock.Unlock()
+	if banlist == nil {
+		return nil, errServerStopped
+	}
+	entry, err := banlist.add(target, reason, duration)
+	if entry == nil {
+		return nil, err
+	}
+	for _, p := range srv.Peers() {
+		if entry.id == p.ID() || (entry.ipnet != nil && entry.ipnet.Contains(peerIP(p))) {
+			glog.V(logger.Debug).Infof("Disconnecting banned peer %v", p)
+			p.Disconnect(DiscRequested)
+		}
+	}
+	return entry, err
+}
+
+// Unban removes target from the ban list, reporting whether it was banned.
+func (srv *Server) Unban(target string) (bool, error) {
+	srv.lock.Lock()
+	banlist := srv.banlist
+	srv.lock.Unlock()
+	if banlist == nil {
+		return false, errServerStopped
+	}
+	return banlist.remove(target)
+}
+
+// Bans returns the active entries of the ban list.
+func (srv *Server) Bans() []*BanEntry {
+	srv.lock.Lock()
+	banlist := srv.banlist
+	srv.lock.Unlock()
+	if banlist == nil {
+		return nil
+	}
+	return banlist.list()
+}
+
+// checkIP reports whether connections to or from ip are allowed by NetRestrict
+// and the ban list.
+func (srv *Server) checkIP(ip net.IP) error {
+	if srv.NetRestrict != nil && !srv.NetRestrict.Contains(ip) {
+		return errNotWhitelisted
+	}
+	if srv.banlist.bannedIP(ip) != nil {
+		return errBanned
+	}
+	return nil
+}
+
+func peerIP(p *Peer) net.IP {
+	if addr, ok := p.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
 // SubscribePeers subscribes the given channel to peer events
 func (srv *Server) SubscribeEvents(ch chan *PeerEvent) event.Subscription {
 	return srv.peerFeed.Subscribe(ch)
@@ -347,17 +461,23 @@ func (srv *Server) Start() (err error) {
 	if srv.Dialer == nil {
 		srv.Dialer = &net.Dialer{Timeout: defaultDialTimeout}
 	}
+	if srv.banlist, err = newBanList(srv.BanListFile); err != nil {
+		return err
+	}
 	srv.quit = make(chan struct{})
 	srv.addpeer = make(chan *conn)
 	srv.delpeer = make(chan peerDrop)
 	srv.posthandshake = make(chan *conn)
 	srv.addstatic = make(chan *discover.Node)
+	srv.removestatic = make(chan *discover.Node)
+	srv.addtrusted = make(chan *discover.Node)
+	srv.removetrusted = make(chan *discover.Node)
 	srv.peerOp = make(chan peerOpFunc)
 	srv.peerOpDone = make(chan struct{})
 
 	// node table
 	if srv.Discovery {
-		ntab, err := discover.ListenUDP(srv.PrivateKey, srv.ListenAddr, srv.NAT, srv.NodeDatabase)
+		ntab, err := discover.ListenUDP(srv.PrivateKey, srv.ListenAddr, srv.NAT, srv.NodeDatabase, srv.NetRestrict)
 		if err != nil {
 			return err
 		}
@@ -368,7 +488,7 @@ func (srv *Server) Start() (err error) {
 	}
 
 	dynPeers := srv.maxDialedConns()
-	dialer := newDialState(srv.StaticNodes, srv.ntab, dynPeers)
+	dialer := newDialState(srv.StaticNodes, srv.ntab, dynPeers, srv.NetRestrict, srv.banlist)
 
 	// handshake
 	srv.ourHandshake = &protoHandshake{Version: baseProtocolVersion, Name: srv.Name, ID: discover.PubkeyID(&srv.PrivateKey.PublicKey)}
@@ -432,8 +552,8 @@ func (srv *Server) run(dialstate dialer) {
 		queuedTasks  []task // tasks that can't run yet
 	)
 	// Put trusted nodes into a map to speed up checks.
-	// Trusted peers are loaded on startup and cannot be
-	// modified while the server is running.
+	// Trusted peers are loaded on startup and can be
+	// modified at runtime via AddTrustedPeer and RemoveTrustedPeer.
 	for _, n := range srv.TrustedNodes {
 		trusted[n.ID] = true
 	}
@@ -492,6 +612,24 @@ running:
 			if p, ok := peers[n.ID]; ok {
 				p.Disconnect(DiscRequested)
 			}
+		case n := <-srv.addtrusted:
+			// This channel is used by AddTrustedPeer to add an enode
+			// to the trusted node set.
+			glog.V(logger.Detail).Infoln("<-addtrusted:", n)
+			trusted[n.ID] = true
+			// Mark any already-connected peer as trusted
+			if p, ok := peers[n.ID]; ok {
+				p.rw.set(trustedConn, true)
+			}
+		case n := <-srv.removetrusted:
+			// This channel is used by RemoveTrustedPeer to remove an enode
+			// from the trusted node set.
+			glog.V(logger.Detail).Infoln("<-removetrusted:", n)
+			delete(trusted, n.ID)
+			// Unmark any already-connected peer as trusted
+			if p, ok := peers[n.ID]; ok {
+				p.rw.set(trustedConn, false)
+			}
 		case op := <-srv.peerOp:
 			// This channel is used by Peers and PeerCount.
 			op(peers)
@@ -508,7 +646,7 @@ running:
 			// the remote identity is known (but hasn't been verified yet).
 			if trusted[c.id] {
 				// Ensure that the trusted flag is set before checking against MaxPeers.
-				c.flags |= trustedConn
+				c.set(trustedConn, true)
 			}
 			glog.V(logger.Detail).Infoln("<-posthandshake:", c)
 			// TODO: track in-progress inbound node IDs (pre-Peer) to avoid dialing them.
@@ -673,6 +811,14 @@ func (srv *Server) setupConn(fd net.Conn, flags connFlag, dialDest *discover.Nod
 		c.close(errServerStopped)
 		return
 	}
+	// Reject restricted and banned addresses before doing any crypto.
+	if addr, ok := fd.RemoteAddr().(*net.TCPAddr); ok {
+		if err := srv.checkIP(addr.IP); err != nil {
+			glog.V(logger.Debug).Infof("%v rejected: %v", c, err)
+			c.close(err)
+			return
+		}
+	}
 	// Run the encryption handshake.
 	var err error
 	if c.id, err = c.doEncHandshake(srv.PrivateKey, dialDest); err != nil {
@@ -680,6 +826,11 @@ func (srv *Server) setupConn(fd net.Conn, flags connFlag, dialDest *discover.Nod
 		c.close(err)
 		return
 	}
+	if srv.banlist.bannedID(c.id) != nil {
+		glog.V(logger.Debug).Infof("%v rejected: %v", c, errBanned)
+		c.close(errBanned)
+		return
+	}
 	// For dialed connections, check that the remote public key matches.
 	if dialDest != nil && c.id != dialDest.ID {
 		c.close(DiscUnexpectedIdentity)
@@ -45,6 +45,7 @@ type hasher struct {
 	cachelimit uint16
 	threaded   bool
 	mu         sync.Mutex
+	onleaf     LeafCallback // called with every stored leaf when committing to a NodeCache
 }
 
 func newHasher(cachegen, cachelimit uint16) *hasher {
@@ -218,6 +219,28 @@ func (h *hasher) store(n node, db DatabaseWriter, force bool) (node, error) {
 		calculator.sha.Write(calculator.buffer.Bytes())
 		hash = hashNode(calculator.sha.Sum(nil))
 	}
+	if cache, ok := db.(*NodeCache); ok {
+		// The cache tracks the references between nodes, which is only
+		// possible with the node itself at hand.
+		cache.insert(common.BytesToHash(hash), calculator.buffer.Bytes(), n)
+		if h.onleaf != nil {
+			switch n := n.(type) {
+			case *shortNode:
+				if leaf, ok := n.Val.(valueNode); ok {
+					if err := h.onleaf(leaf, common.BytesToHash(hash)); err != nil {
+						return hash, err
+					}
+				}
+			case *fullNode:
+				if leaf, ok := n.Children[16].(valueNode); ok && len(leaf) > 0 {
+					if err := h.onleaf(leaf, common.BytesToHash(hash)); err != nil {
+						return hash, err
+					}
+				}
+			}
+		}
+		return hash, nil
+	}
 	if db != nil {
 		// db might be a leveldb batch, which is not safe for concurrent writes
 		h.mu.Lock()
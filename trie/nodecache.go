@@ -0,0 +1,338 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/logger"
+	"github.com/NginProject/ngind/logger/glog"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+// cachedNode is a trie node held in memory together with its reference counts.
+type cachedNode struct {
+	blob     []byte              // RLP encoding of the node
+	parents  int                 // number of live nodes (or roots) referencing this one
+	children map[common.Hash]int // cached children referenced by this node
+}
+
+// NodeCache is an intermediate write layer between the tries and the disk
+// database. Committed trie nodes are kept in memory with reference counts, so
+// that nodes which became unreachable can be dropped without ever touching the
+// disk. Only the states explicitly committed via Commit are flushed.
+//
+// Writes which aren't trie nodes (secure key preimages, contract code) are
+// buffered as they come and flushed on the next Commit.
+//
+// NodeCache implements Database and is safe for concurrent use.
+type NodeCache struct {
+	diskdb ngindb.Database
+
+	lock  sync.RWMutex
+	nodes map[common.Hash]*cachedNode // referenced trie nodes, the zero hash is the meta-root of all states
+	blobs map[string][]byte           // non-node writes waiting to be flushed
+
+	size    common.StorageSize // storage size of the cached nodes and blobs
+	gcnodes int                // nodes garbage collected since the last flush
+	gcsize  common.StorageSize // storage size of the garbage collected nodes
+}
+
+// NewNodeCache creates a trie node cache on top of the given disk database.
+func NewNodeCache(diskdb ngindb.Database) *NodeCache {
+	return &NodeCache{
+		diskdb: diskdb,
+		nodes:  map[common.Hash]*cachedNode{{}: {children: make(map[common.Hash]int)}},
+		blobs:  make(map[string][]byte),
+	}
+}
+
+// Copy returns an independent copy of the cache on top of the same disk
+// database. Node and blob contents are immutable and shared.
+func (c *NodeCache) Copy() *NodeCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	cpy := &NodeCache{
+		diskdb:  c.diskdb,
+		nodes:   make(map[common.Hash]*cachedNode, len(c.nodes)),
+		blobs:   make(map[string][]byte, len(c.blobs)),
+		size:    c.size,
+		gcnodes: c.gcnodes,
+		gcsize:  c.gcsize,
+	}
+	for hash, node := range c.nodes {
+		entry := &cachedNode{blob: node.blob, parents: node.parents}
+		if node.children != nil {
+			entry.children = make(map[common.Hash]int, len(node.children))
+			for child, n := range node.children {
+				entry.children[child] = n
+			}
+		}
+		cpy.nodes[hash] = entry
+	}
+	for key, blob := range c.blobs {
+		cpy.blobs[key] = blob
+	}
+	return cpy
+}
+
+// DiskDB returns the database the cache flushes to.
+func (c *NodeCache) DiskDB() ngindb.Database {
+	return c.diskdb
+}
+
+// Get retrieves a node or blob from memory, falling back to the disk database.
+func (c *NodeCache) Get(key []byte) ([]byte, error) {
+	c.lock.RLock()
+	if len(key) == common.HashLength {
+		if node := c.nodes[common.BytesToHash(key)]; node != nil {
+			c.lock.RUnlock()
+			return node.blob, nil
+		}
+	}
+	if blob, ok := c.blobs[string(key)]; ok {
+		c.lock.RUnlock()
+		return blob, nil
+	}
+	c.lock.RUnlock()
+
+	return c.diskdb.Get(key)
+}
+
+// Has reports whether the key is held in memory or on disk.
+func (c *NodeCache) Has(key []byte) (bool, error) {
+	if _, err := c.Get(key); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Put buffers a non-node write, such as a preimage or contract code, until
+// the next flush. Trie nodes are inserted by the hasher instead.
+func (c *NodeCache) Put(key, value []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.blobs[string(key)]; ok {
+		return nil
+	}
+	c.blobs[string(key)] = common.CopyBytes(value)
+	c.size += common.StorageSize(len(key) + len(value))
+	return nil
+}
+
+// insert adds a freshly committed trie node, referencing the cached children
+// embedded in its collapsed form.
+func (c *NodeCache) insert(hash common.Hash, blob []byte, collapsed node) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.nodes[hash]; ok {
+		return
+	}
+	entry := &cachedNode{blob: common.CopyBytes(blob)}
+	forEachHash(collapsed, func(child common.Hash) {
+		if node := c.nodes[child]; node != nil {
+			node.parents++
+			if entry.children == nil {
+				entry.children = make(map[common.Hash]int)
+			}
+			entry.children[child]++
+		}
+	})
+	c.nodes[hash] = entry
+	c.size += common.StorageSize(common.HashLength + len(blob))
+}
+
+// forEachHash calls fn for the hash of every node referenced by n, descending
+// into embedded nodes.
+func forEachHash(n node, fn func(common.Hash)) {
+	switch n := n.(type) {
+	case *shortNode:
+		forEachHash(n.Val, fn)
+	case *fullNode:
+		for i := 0; i < 16; i++ {
+			forEachHash(n.Children[i], fn)
+		}
+	case hashNode:
+		fn(common.BytesToHash(n))
+	}
+}
+
+// Reference adds a reference from parent to child. Referencing from the zero
+// hash marks child as the root of a live state. References to nodes which are
+// not cached (already on disk) are ignored.
+func (c *NodeCache) Reference(child, parent common.Hash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	node := c.nodes[child]
+	pnode := c.nodes[parent]
+	if node == nil || pnode == nil {
+		return
+	}
+	if pnode.children == nil {
+		pnode.children = make(map[common.Hash]int)
+	} else if pnode.children[child] > 0 && parent != (common.Hash{}) {
+		// Regular nodes reference a child at most once, roots may be
+		// referenced once per state using them.
+		return
+	}
+	node.parents++
+	pnode.children[child]++
+}
+
+// Dereference removes a state root reference, garbage collecting every node
+// no longer reachable from a live root.
+func (c *NodeCache) Dereference(root common.Hash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nodes, size := len(c.nodes), c.size
+	c.dereference(root, common.Hash{})
+
+	c.gcnodes += nodes - len(c.nodes)
+	c.gcsize += size - c.size
+	glog.V(logger.Debug).Infof("Dereferenced trie %x: %d nodes (%v) collected, %d nodes (%v) cached", root[:4], nodes-len(c.nodes), size-c.size, len(c.nodes), c.size)
+}
+
+func (c *NodeCache) dereference(child, parent common.Hash) {
+	if pnode := c.nodes[parent]; pnode != nil && pnode.children[child] > 0 {
+		pnode.children[child]--
+		if pnode.children[child] == 0 {
+			delete(pnode.children, child)
+		}
+	}
+	node := c.nodes[child]
+	if node == nil {
+		return
+	}
+	// A node flushed and later re-inserted may be dereferenced by stale
+	// parents, it's on disk anyway so dropping it early is harmless.
+	if node.parents > 0 {
+		node.parents--
+	}
+	if node.parents == 0 {
+		for hash := range node.children {
+			c.dereference(hash, child)
+		}
+		delete(c.nodes, child)
+		c.size -= common.StorageSize(common.HashLength + len(node.blob))
+	}
+}
+
+// Commit flushes the trie rooted at root, along with all buffered blobs, to
+// the disk database and drops the flushed nodes from memory.
+func (c *NodeCache) Commit(root common.Hash) error {
+	start := time.Now()
+	batch := c.diskdb.NewBatch()
+
+	// Write in batches of bounded size, the nodes stay cached until all are
+	// written. Children go first, an interrupted flush leaves no dangling
+	// references on disk.
+	put := func(key, value []byte) error {
+		if err := batch.Put(key, value); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= ngindb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch = c.diskdb.NewBatch()
+		}
+		return nil
+	}
+	c.lock.RLock()
+	nodes, size := len(c.nodes), c.size
+	flushed := make([]string, 0, len(c.blobs))
+	for key, blob := range c.blobs {
+		if err := put([]byte(key), blob); err != nil {
+			c.lock.RUnlock()
+			return err
+		}
+		flushed = append(flushed, key)
+	}
+	if err := c.commit(root, put); err != nil {
+		c.lock.RUnlock()
+		return err
+	}
+	c.lock.RUnlock()
+
+	if err := batch.Write(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, key := range flushed {
+		c.size -= common.StorageSize(len(key) + len(c.blobs[key]))
+		delete(c.blobs, key)
+	}
+	c.uncache(root)
+
+	glog.V(logger.Debug).Infof("Flushed trie %x: %d nodes (%v) written in %v, %d nodes (%v) garbage collected since last flush", root[:4], nodes-len(c.nodes), size-c.size, time.Since(start), c.gcnodes, c.gcsize)
+	c.gcnodes, c.gcsize = 0, 0
+
+	return nil
+}
+
+func (c *NodeCache) commit(hash common.Hash, put func(key, value []byte) error) error {
+	node := c.nodes[hash]
+	if node == nil {
+		return nil
+	}
+	for child := range node.children {
+		if err := c.commit(child, put); err != nil {
+			return err
+		}
+	}
+	return put(hash[:], node.blob)
+}
+
+// uncache drops a flushed trie from memory. References to it from the parents
+// still cached are kept, they resolve from disk from now on.
+func (c *NodeCache) uncache(hash common.Hash) {
+	node := c.nodes[hash]
+	if node == nil || hash == (common.Hash{}) {
+		return
+	}
+	for child := range node.children {
+		c.uncache(child)
+	}
+	delete(c.nodes, hash)
+	c.size -= common.StorageSize(common.HashLength + len(node.blob))
+}
+
+// Size returns the storage size of the data held in memory.
+func (c *NodeCache) Size() common.StorageSize {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.size
+}
+
+// Nodes returns the number of trie nodes held in memory.
+func (c *NodeCache) Nodes() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.nodes) - 1 // don't count the meta-root
+}
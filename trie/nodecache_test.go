@@ -0,0 +1,242 @@
+// Copyright 2018 Ngin project
+// This file is part of Ngin.
+//
+// Ngin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Ngin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Ngin. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/NginProject/ngind/common"
+	"github.com/NginProject/ngind/crypto"
+	"github.com/NginProject/ngind/ngindb"
+)
+
+// nodeCacheTestValue returns the value of key i in version v, long enough for
+// no node to be embedded in its parent.
+func nodeCacheTestValue(i, v int) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("%d-%d", i, v)))
+}
+
+// commitNodeCacheTestTrie commits to the cache the trie of root with the keys
+// in changed set to their value of version v. The new root is referenced as a
+// live state.
+func commitNodeCacheTestTrie(t *testing.T, cache *NodeCache, root common.Hash, changed []int, v int) common.Hash {
+	trie, err := New(root, cache)
+	if err != nil {
+		t.Fatalf("failed to open trie %x: %v", root, err)
+	}
+	for _, i := range changed {
+		trie.Update([]byte(fmt.Sprintf("key-%d", i)), nodeCacheTestValue(i, v))
+	}
+	if root, err = trie.CommitTo(cache); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	cache.Reference(root, common.Hash{})
+	return root
+}
+
+// nodeCacheTestKeys returns the indexes 0 to n-1.
+func nodeCacheTestKeys(n int) []int {
+	keys := make([]int, n)
+	for i := range keys {
+		keys[i] = i
+	}
+	return keys
+}
+
+// reachableNodes returns the hashes of the trie nodes reachable from root.
+func reachableNodes(t *testing.T, db Database, root common.Hash) map[common.Hash]bool {
+	trie, err := New(root, db)
+	if err != nil {
+		t.Fatalf("failed to open trie %x: %v", root, err)
+	}
+	nodes := make(map[common.Hash]bool)
+	it := trie.NodeIterator(nil)
+	for it.Next(true) {
+		if hash := it.Hash(); hash != (common.Hash{}) {
+			nodes[hash] = true
+		}
+	}
+	if it.Error() != nil {
+		t.Fatalf("failed to iterate trie %x: %v", root, it.Error())
+	}
+	return nodes
+}
+
+// cachedNodes returns the hashes of the trie nodes held by the cache.
+func cachedNodes(cache *NodeCache) map[common.Hash]bool {
+	nodes := make(map[common.Hash]bool)
+	for hash := range cache.nodes {
+		if hash != (common.Hash{}) {
+			nodes[hash] = true
+		}
+	}
+	return nodes
+}
+
+// union returns the nodes in any of the sets.
+func union(sets ...map[common.Hash]bool) map[common.Hash]bool {
+	nodes := make(map[common.Hash]bool)
+	for _, set := range sets {
+		for hash := range set {
+			nodes[hash] = true
+		}
+	}
+	return nodes
+}
+
+// checkNodeSet checks that have and want hold the same nodes.
+func checkNodeSet(t *testing.T, what string, have, want map[common.Hash]bool) {
+	t.Helper()
+	for hash := range want {
+		if !have[hash] {
+			t.Errorf("%s: node %x missing", what, hash[:4])
+		}
+	}
+	for hash := range have {
+		if !want[hash] {
+			t.Errorf("%s: node %x not expected", what, hash[:4])
+		}
+	}
+}
+
+// checkNodeCacheTestTrie checks that the trie of root holds version 0 of keys
+// 0 to n-1, those in changed holding version changedV.
+func checkNodeCacheTestTrie(t *testing.T, db Database, root common.Hash, n int, changed map[int]bool, changedV int) {
+	t.Helper()
+	trie, err := New(root, db)
+	if err != nil {
+		t.Fatalf("failed to open trie %x: %v", root, err)
+	}
+	for i := 0; i < n; i++ {
+		want := nodeCacheTestValue(i, 0)
+		if changed[i] {
+			want = nodeCacheTestValue(i, changedV)
+		}
+		value, err := trie.TryGet([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatalf("trie %x: key %d unresolvable: %v", root[:4], i, err)
+		}
+		if !bytes.Equal(value, want) {
+			t.Fatalf("trie %x: key %d mismatch: have %x, want %x", root[:4], i, value, want)
+		}
+	}
+}
+
+// Tests that dereferencing a state root drops the nodes only it reaches, the
+// subtries shared with other live states surviving.
+func TestNodeCacheDereference(t *testing.T) {
+	diskdb, _ := ngindb.NewMemDatabase()
+	cache := NewNodeCache(diskdb)
+
+	changed := map[int]bool{3: true, 70: true}
+	rootA := commitNodeCacheTestTrie(t, cache, common.Hash{}, nodeCacheTestKeys(100), 0)
+	rootB := commitNodeCacheTestTrie(t, cache, rootA, []int{3, 70}, 1)
+
+	nodesA, nodesB := reachableNodes(t, cache, rootA), reachableNodes(t, cache, rootB)
+	checkNodeSet(t, "both states", cachedNodes(cache), union(nodesA, nodesB))
+
+	shared := 0
+	for hash := range nodesA {
+		if nodesB[hash] {
+			shared++
+		}
+	}
+	if shared == 0 || shared == len(nodesA) {
+		t.Fatalf("shared node count mismatch: have %d of %d", shared, len(nodesA))
+	}
+	// A root referenced by two states survives the first going away
+	cache.Reference(rootA, common.Hash{})
+	cache.Dereference(rootA)
+	checkNodeSet(t, "root referenced twice", cachedNodes(cache), union(nodesA, nodesB))
+
+	cache.Dereference(rootA)
+	checkNodeSet(t, "after dereferencing A", cachedNodes(cache), nodesB)
+	checkNodeCacheTestTrie(t, cache, rootB, 100, changed, 1)
+
+	// Dereferencing unknown or collected roots does nothing
+	cache.Dereference(rootA)
+	cache.Dereference(common.Hash{1})
+	checkNodeSet(t, "after dereferencing unknown roots", cachedNodes(cache), nodesB)
+
+	cache.Dereference(rootB)
+	if cache.Nodes() != 0 || cache.Size() != 0 {
+		t.Errorf("nodes left after dereferencing every state: %d (%v)", cache.Nodes(), cache.Size())
+	}
+	if keys := diskdb.Keys(); len(keys) != 0 {
+		t.Errorf("garbage collected nodes written to disk: %d", len(keys))
+	}
+}
+
+// Tests that a flush writes exactly the nodes referenced by the root along
+// with the buffered blobs, and drops them from memory.
+func TestNodeCacheCommit(t *testing.T) {
+	diskdb, _ := ngindb.NewMemDatabase()
+	cache := NewNodeCache(diskdb)
+
+	changed := map[int]bool{10: true, 11: true, 99: true}
+	rootA := commitNodeCacheTestTrie(t, cache, common.Hash{}, nodeCacheTestKeys(100), 0)
+	rootB := commitNodeCacheTestTrie(t, cache, rootA, []int{10, 11, 99}, 2)
+	nodesA, nodesB := reachableNodes(t, cache, rootA), reachableNodes(t, cache, rootB)
+
+	code := []byte{0x60, 0x01, 0x60, 0x00}
+	codeHash := crypto.Keccak256(code)
+	cache.Put(codeHash, code)
+
+	if err := cache.Commit(rootB); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	written := make(map[common.Hash]bool)
+	for _, key := range diskdb.Keys() {
+		if bytes.Equal(key, codeHash) {
+			continue
+		}
+		written[common.BytesToHash(key)] = true
+
+		value, _ := diskdb.Get(key)
+		if hash := crypto.Keccak256Hash(value); hash != common.BytesToHash(key) {
+			t.Errorf("node %x stored with hash %x", key[:4], hash[:4])
+		}
+	}
+	checkNodeSet(t, "flushed", written, nodesB)
+	if blob, _ := diskdb.Get(codeHash); !bytes.Equal(blob, code) {
+		t.Errorf("code mismatch: have %x, want %x", blob, code)
+	}
+
+	// The nodes of A not shared with B stay in memory only
+	onlyA := make(map[common.Hash]bool)
+	for hash := range nodesA {
+		if !nodesB[hash] {
+			onlyA[hash] = true
+		}
+	}
+	checkNodeSet(t, "cached after flush", cachedNodes(cache), onlyA)
+	checkNodeCacheTestTrie(t, diskdb, rootB, 100, changed, 2)
+	checkNodeCacheTestTrie(t, cache, rootA, 100, nil, 0)
+
+	// Garbage collecting A leaves the flushed state intact
+	cache.Dereference(rootA)
+	cache.Dereference(rootB)
+	if cache.Nodes() != 0 || cache.Size() != 0 {
+		t.Errorf("nodes left after dereferencing every state: %d (%v)", cache.Nodes(), cache.Size())
+	}
+	if len(diskdb.Keys()) != len(nodesB)+1 {
+		t.Errorf("disk entry count mismatch: have %d, want %d", len(diskdb.Keys()), len(nodesB)+1)
+	}
+	checkNodeCacheTestTrie(t, diskdb, rootB, 100, changed, 2)
+}